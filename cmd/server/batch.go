@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/erock530/go-ollama-api/internal/batch"
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// runBatch implements "batch -key <key> [-concurrency n] <input.jsonl> <results.jsonl>".
+// Results are appended to the results file as they arrive. If the batch is
+// interrupted, running the same command again skips the requests that
+// already have a result.
+func runBatch(runner *batch.Runner, args []string) error {
+	flags := flag.NewFlagSet("batch", flag.ExitOnError)
+	key := flags.String("key", "", "API key whose quota the batch runs under")
+	concurrency := flags.Int("concurrency", 1, "Requests sent at once")
+	flags.Parse(args)
+	if *key == "" || flags.NArg() != 2 {
+		return errors.New("usage: batch -key <key> [-concurrency n] <input.jsonl> <results.jsonl>")
+	}
+
+	input, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	requests, err := batch.ReadRequests(input)
+	input.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", flags.Arg(0), err)
+	}
+
+	results, err := batch.OpenResultsFile(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	done := results.Done()
+	skipped := 0
+	for _, req := range requests {
+		if done[req.CustomID] {
+			skipped++
+		}
+	}
+	if skipped > 0 {
+		fmt.Printf("Resuming: %d of %d requests already have a result\n", skipped, len(requests))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	succeeded, failed := 0, 0
+	err = runner.Run(ctx, *key, requests, *concurrency, done, func(index int, result models.BatchResult) error {
+		if result.Status == batch.StatusSucceeded {
+			succeeded++
+		} else {
+			failed++
+		}
+		return results.Save(index, result)
+	})
+	fmt.Printf("%d succeeded, %d failed, %d left\n", succeeded, failed, len(requests)-skipped-succeeded-failed)
+	if errors.Is(err, context.Canceled) {
+		return errors.New("interrupted; run the same command again to resume")
+	}
+	return err
+}
@@ -3,53 +3,418 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/erock530/go-ollama-api/internal/api"
+	"github.com/erock530/go-ollama-api/internal/batch"
+	"github.com/erock530/go-ollama-api/internal/cache"
 	"github.com/erock530/go-ollama-api/internal/cli"
+	"github.com/erock530/go-ollama-api/internal/concurrency"
 	"github.com/erock530/go-ollama-api/internal/config"
 	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/ipfilter"
+	"github.com/erock530/go-ollama-api/internal/jobs"
+	"github.com/erock530/go-ollama-api/internal/jwtauth"
+	"github.com/erock530/go-ollama-api/internal/listener"
+	"github.com/erock530/go-ollama-api/internal/metrics"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+	"github.com/erock530/go-ollama-api/internal/ratelimit"
+	"github.com/erock530/go-ollama-api/internal/retention"
+	"github.com/erock530/go-ollama-api/internal/scheduler"
+	"github.com/erock530/go-ollama-api/internal/tlsconfig"
+	"github.com/erock530/go-ollama-api/internal/webhook"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
 	// Parse command line flags
-	port := flag.Int("port", 8080, "Port to run the server on")
-	ollamaURL := flag.String("ollama-url", "http://127.0.0.1:11434", "URL of the Ollama server")
+	port := flag.Int("port", 8080, "Port to run the server on when no -listen is given")
+	ollamaURL := flag.String("ollama-url", "http://127.0.0.1:11434", "URL of the Ollama server, or a comma-separated list of servers that model management requests go to (generations use the first)")
+	ollamaConnectTimeout := flag.Duration("ollama-connect-timeout", 5*time.Second, "Maximum time to connect to Ollama (0 is unlimited)")
+	ollamaHeaderTimeout := flag.Duration("ollama-header-timeout", 5*time.Minute, "Maximum wait for Ollama to start responding, which for non-streaming requests includes the whole generation (0 is unlimited)")
+	ollamaIdleTimeout := flag.Duration("ollama-idle-timeout", 2*time.Minute, "Maximum wait for the next part of a streamed Ollama response (0 is unlimited)")
+	ollamaTimeout := flag.Duration("ollama-timeout", 30*time.Minute, "Maximum duration of a request to Ollama (0 is unlimited)")
+	ollamaRetries := flag.Int("ollama-retries", 2, "Times a request that could not connect to Ollama is retried")
+	ollamaRetryBackoff := flag.Duration("ollama-retry-backoff", 250*time.Millisecond, "Wait before the first retry, doubled for each retry after it")
+	ollamaCAFile := flag.String("ollama-ca-file", "", "PEM bundle of CAs trusted for https:// Ollama URLs, besides the system CAs")
+	var listen listFlag
+	flag.Var(&listen, "listen", "Listener to serve on, such as tcp://:8080, unix:///run/go-ollama-api/api.sock?mode=0660&routes=admin or systemd://; may be repeated (default: tcp://:<port>)")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate chain to serve HTTPS with (requires -tls-key)")
+	tlsKey := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "Oldest TLS version accepted: 1.2 or 1.3")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM bundle of CAs that sign client certificates, enabling mutual TLS")
+	tlsRequireClientCert := flag.Bool("tls-require-client-cert", false, "Refuse connections without a client certificate signed by -tls-client-ca")
+	tlsReloadInterval := flag.Duration("tls-reload-interval", time.Minute, "How often the TLS files are checked for changes (0 reloads only on SIGHUP)")
+	jwtJWKSURL := flag.String("jwt-jwks-url", "", "URL of the JWKS whose keys sign bearer tokens, enabling JWT authentication")
+	jwtKeyFile := flag.String("jwt-key-file", "", "JWKS or PEM public keys that sign bearer tokens, for use without -jwt-jwks-url")
+	jwtIssuer := flag.String("jwt-issuer", "", "Required iss claim of bearer tokens")
+	jwtAudience := flag.String("jwt-audience", "", "Required aud claim of bearer tokens")
+	jwtSubjectClaim := flag.String("jwt-subject-claim", "sub", "Claim identifying the caller of a bearer token")
+	jwtScopesClaim := flag.String("jwt-scopes-claim", "scope", "Claim holding the scopes of a bearer token")
+	jwtPlanClaim := flag.String("jwt-plan-claim", "plan", "Claim holding the plan of a bearer token")
+	jwtOrgClaim := flag.String("jwt-org-claim", "org", "Claim holding the organization of a bearer token")
+	jwtDefaultPlan := flag.String("jwt-default-plan", "", "Plan of bearer tokens without a plan claim (empty rejects them)")
+	jwtAllowPresets := flag.Bool("jwt-allow-presets", false, "Let the scopes claim of bearer tokens name scope presets such as inference")
+	jwtAllowAdmin := flag.Bool("jwt-allow-admin", false, "Let the scopes claim of bearer tokens grant the admin scope, directly or through a preset")
+	jwtLeeway := flag.Duration("jwt-leeway", time.Minute, "Clock skew allowed when checking the expiry of bearer tokens")
+	jwtRefresh := flag.Duration("jwt-jwks-refresh", 15*time.Minute, "How often the JWKS is fetched again")
+	breakerThreshold := flag.Int("breaker-threshold", 5, "Failures in a row that open the Ollama circuit breaker (0 disables it)")
+	breakerCooldown := flag.Duration("breaker-cooldown", 30*time.Second, "How long the circuit breaker stays open before letting a probe through")
+	usageRetention := flag.Duration("usage-retention", 7*24*time.Hour, "How long raw usage events are kept before being rolled up (0 keeps them forever)")
+	usageHourlyRetention := flag.Duration("usage-hourly-retention", 90*24*time.Hour, "How long hourly usage rollups are kept (0 keeps them forever)")
+	usageCompactInterval := flag.Duration("usage-compact-interval", time.Hour, "How often usage compaction runs")
+	dbDSN := flag.String("db", "./apiKeys.db", "SQLite database path or postgres:// DSN")
+	dbMaxOpenConns := flag.Int("db-max-open-conns", 0, "Maximum open database connections (0 is unlimited)")
+	dbMaxIdleConns := flag.Int("db-max-idle-conns", 0, "Maximum idle database connections (0 uses the driver default)")
+	dbConnMaxLifetime := flag.Duration("db-conn-max-lifetime", 0, "Maximum lifetime of a database connection (0 is unlimited)")
+	rateLimitStore := flag.String("rate-limit-store", "memory", "Where rate limit counters are kept: memory, sql or redis")
+	rateLimitAlgorithm := flag.String("rate-limit-algorithm", string(ratelimit.DefaultAlgorithm), "Default rate limit algorithm: token_bucket, sliding_window, gcra or fixed_window")
+	redisURL := flag.String("redis-url", "redis://127.0.0.1:6379", "Redis URL used by -rate-limit-store=redis")
+	maxConcurrent := flag.Int("max-concurrent", 0, "Maximum generations in flight across all API keys (0 is unlimited)")
+	concurrencyWait := flag.Duration("concurrency-wait", 0, "How long a request waits for a free generation slot before a 429 (0 rejects immediately)")
+	queueParallel := flag.Int("queue-parallel", 0, "Generations sent to Ollama at once, the rest are queued (0 disables queuing)")
+	queueMaxDepth := flag.Int("queue-max-depth", 100, "Maximum requests waiting in the queue (0 is unlimited)")
+	queueTimeout := flag.Duration("queue-timeout", 30*time.Second, "Maximum time a request waits in the queue (0 is unlimited)")
+	jobWorkers := flag.Int("job-workers", 2, "Number of asynchronous jobs run at once")
+	jobMaxAttempts := flag.Int("job-max-attempts", 3, "Times a job interrupted by a restart is started before it fails")
+	callbackAllowCIDRs := flag.String("callback-allow-cidrs", "", "Comma-separated CIDRs of loopback, private or link-local addresses job callbacks may be sent to")
+	batchWorkers := flag.Int("batch-workers", 1, "Number of uploaded batches run at once")
+	batchMaxConcurrency := flag.Int("batch-max-concurrency", 4, "Maximum requests one batch sends at once")
+	cacheEnabled := flag.Bool("cache", false, "Cache responses to deterministic requests (temperature 0 or a fixed seed)")
+	cacheOptIn := flag.Bool("cache-opt-in", false, "Only cache responses for keys that opted in with setcache")
+	cacheTTL := flag.Duration("cache-ttl", time.Hour, "How long a response is served from the cache")
+	cacheMemoryBytes := flag.Int64("cache-memory-bytes", 64<<20, "Maximum size of the responses cached in memory")
+	cacheDBEntries := flag.Int("cache-db-entries", 10000, "Maximum responses cached in the database (0 is unlimited, -1 caches in memory only)")
+	maxBodyBytes := flag.Int64("max-body-bytes", 32<<20, "Maximum size of a JSON request body (0 is unlimited)")
+	maxPromptChars := flag.Int("max-prompt-chars", 0, "Maximum characters of prompt text in a generation request (0 is unlimited)")
+	maxPromptTokens := flag.Int("max-prompt-tokens", 0, "Maximum estimated tokens of prompt text in a generation request (0 is unlimited)")
+	maxImages := flag.Int("max-images", 0, "Maximum images in a generation request (0 is unlimited)")
+	maxImageBytes := flag.Int64("max-image-bytes", 0, "Maximum decoded size of an image (0 is unlimited)")
+	imageFormats := flag.String("image-formats", "", "Comma-separated accepted image formats, e.g. png,jpeg,webp (empty accepts any)")
+	schemaMaxRetries := flag.Int("schema-max-retries", 2, "Maximum times a response that does not match its format schema is repaired")
+	coalesceRoutes := flag.String("coalesce", "", "Comma-separated routes where identical concurrent requests share one upstream call, e.g. /generate")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated CIDRs of proxies whose Forwarded and X-Forwarded-For headers give the client address")
+	denyCIDRs := flag.String("deny-cidrs", "", "Comma-separated CIDRs of client addresses refused on every route but the probes")
+	ipRejectionWebhooks := flag.Bool("ip-rejection-webhooks", false, "Send an ip_rejected event to the webhooks when a request is refused for its address")
+	autoMigrate := flag.Bool("auto-migrate", true, "Apply pending database migrations at startup")
+	vacuumInterval := flag.Duration("vacuum-interval", 24*time.Hour, "How often the database is incrementally vacuumed (0 disables)")
 	flag.Parse()
 
 	// Initialize configuration
 	cfg := &config.Config{
 		Port:      *port,
-		OllamaURL: *ollamaURL,
+		OllamaURL: strings.TrimSpace(strings.SplitN(*ollamaURL, ",", 2)[0]),
+		Upstream: ollama.Config{
+			ConnectTimeout:   *ollamaConnectTimeout,
+			HeaderTimeout:    *ollamaHeaderTimeout,
+			IdleTimeout:      *ollamaIdleTimeout,
+			Timeout:          *ollamaTimeout,
+			Retries:          *ollamaRetries,
+			RetryBackoff:     *ollamaRetryBackoff,
+			BreakerThreshold: *breakerThreshold,
+			BreakerCooldown:  *breakerCooldown,
+		},
+		TLS: tlsconfig.Config{
+			CertFile:          *tlsCert,
+			KeyFile:           *tlsKey,
+			MinVersion:        *tlsMinVersion,
+			ClientCAFile:      *tlsClientCA,
+			RequireClientCert: *tlsRequireClientCert,
+		},
+		TLSReloadInterval: *tlsReloadInterval,
+		JWT: jwtauth.Config{
+			JWKSURL:         *jwtJWKSURL,
+			KeyFile:         *jwtKeyFile,
+			Issuer:          *jwtIssuer,
+			Audience:        *jwtAudience,
+			SubjectClaim:    *jwtSubjectClaim,
+			ScopesClaim:     *jwtScopesClaim,
+			PlanClaim:       *jwtPlanClaim,
+			OrgClaim:        *jwtOrgClaim,
+			DefaultPlan:     *jwtDefaultPlan,
+			AllowPresets:    *jwtAllowPresets,
+			AllowAdmin:      *jwtAllowAdmin,
+			Leeway:          *jwtLeeway,
+			RefreshInterval: *jwtRefresh,
+		},
+		DatabaseDSN: *dbDSN,
+		DBPool: db.PoolConfig{
+			MaxOpenConns:    *dbMaxOpenConns,
+			MaxIdleConns:    *dbMaxIdleConns,
+			ConnMaxLifetime: *dbConnMaxLifetime,
+		},
+		RateLimitStore:       *rateLimitStore,
+		RedisURL:             *redisURL,
+		RateLimitAlgorithm:   *rateLimitAlgorithm,
+		MaxConcurrent:        *maxConcurrent,
+		ConcurrencyWait:      *concurrencyWait,
+		QueueParallel:        *queueParallel,
+		QueueMaxDepth:        *queueMaxDepth,
+		QueueTimeout:         *queueTimeout,
+		JobWorkers:           *jobWorkers,
+		JobMaxAttempts:       *jobMaxAttempts,
+		BatchWorkers:         *batchWorkers,
+		BatchMaxConcurrency:  *batchMaxConcurrency,
+		CacheEnabled:         *cacheEnabled,
+		CacheOptIn:           *cacheOptIn,
+		CacheTTL:             *cacheTTL,
+		CacheMemoryBytes:     *cacheMemoryBytes,
+		CacheDBEntries:       *cacheDBEntries,
+		MaxBodyBytes:         *maxBodyBytes,
+		MaxPromptChars:       *maxPromptChars,
+		MaxPromptTokens:      *maxPromptTokens,
+		MaxImages:            *maxImages,
+		MaxImageBytes:        *maxImageBytes,
+		ImageFormats:         imageFormatList(*imageFormats),
+		SchemaMaxRetries:     *schemaMaxRetries,
+		CoalesceRoutes:       splitList(*coalesceRoutes),
+		OllamaBackends:       splitList(*ollamaURL),
+		CallbackAllowCIDRs:   splitList(*callbackAllowCIDRs),
+		TrustedProxies:       splitList(*trustedProxies),
+		DenyCIDRs:            splitList(*denyCIDRs),
+		IPRejectionWebhooks:  *ipRejectionWebhooks,
+		UsageRetention:       *usageRetention,
+		UsageHourlyRetention: *usageHourlyRetention,
+		UsageCompactInterval: *usageCompactInterval,
+		VacuumInterval:       *vacuumInterval,
+	}
+
+	for _, route := range cfg.CoalesceRoutes {
+		if !slices.Contains(api.CoalescableRoutes, route) {
+			log.Fatalf("Route %q cannot be coalesced, expected one of %s", route, strings.Join(api.CoalescableRoutes, ", "))
+		}
+	}
+	if _, err := ipfilter.ParseList(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	if _, err := ipfilter.ParseList(cfg.DenyCIDRs); err != nil {
+		log.Fatalf("Invalid -deny-cidrs: %v", err)
+	}
+	callbackAllowlist, err := ipfilter.ParseList(cfg.CallbackAllowCIDRs)
+	if err != nil {
+		log.Fatalf("Invalid -callback-allow-cidrs: %v", err)
+	}
+	specs, err := listenerSpecs(listen, cfg.Port)
+	if err != nil {
+		log.Fatalf("Invalid -listen: %v", err)
+	}
+	cfg.Listeners = specs
+	if *ollamaCAFile != "" {
+		upstreamTLS, err := tlsconfig.ClientConfig(*ollamaCAFile)
+		if err != nil {
+			log.Fatalf("Invalid -ollama-ca-file: %v", err)
+		}
+		cfg.Upstream.TLS = upstreamTLS
+	}
+	var tokens *jwtauth.Authenticator
+	if cfg.JWT.Enabled() || cfg.JWT.Issuer != "" || cfg.JWT.Audience != "" {
+		var err error
+		if tokens, err = jwtauth.New(cfg.JWT); err != nil {
+			log.Fatalf("Invalid JWT authentication settings: %v", err)
+		}
+	}
+
+	// Run one-off database commands such as "db migrate status" without starting the server
+	if flag.NArg() > 0 && flag.Arg(0) != "batch" {
+		if flag.Arg(0) != "db" {
+			log.Fatalf("Unknown command %q", flag.Arg(0))
+		}
+		database, err := db.Connect(cfg.DatabaseDSN, cfg.DBPool)
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		defer database.Close()
+		cli.NewCLI(database).HandleCommand(strings.Join(flag.Args(), " "))
+		return
 	}
 
 	// Initialize database
-	database, err := db.InitDB()
+	database, err := db.Connect(cfg.DatabaseDSN, cfg.DBPool)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer database.Close()
 
+	if *autoMigrate {
+		applied, err := database.Migrate()
+		if err != nil {
+			log.Fatalf("Failed to migrate database: %v", err)
+		}
+		if applied > 0 {
+			log.Printf("Applied %d database migrations", applied)
+		}
+	} else if version, err := database.SchemaVersion(); err != nil {
+		log.Fatalf("Failed to read database schema version: %v", err)
+	} else if version < database.LatestVersion() {
+		log.Fatalf("Database schema is at version %d, expected %d. Run 'db migrate up' first", version, database.LatestVersion())
+	}
+
+	// Initialize the rate limiter
+	limiter, closeLimiter, err := newLimiter(cfg, database)
+	if err != nil {
+		log.Fatalf("Failed to initialize rate limiter: %v", err)
+	}
+	defer closeLimiter()
+
+	// The generation queue is shared by the API, the job workers and batches,
+	// and the generation slots by the API and the job workers
+	registry := metrics.NewRegistry()
+	inFlight := concurrency.NewLimiter(cfg.MaxConcurrent)
+	queue := scheduler.New(scheduler.Config{
+		Parallel: cfg.QueueParallel,
+		MaxDepth: cfg.QueueMaxDepth,
+		Timeout:  cfg.QueueTimeout,
+	}, registry)
+	ollamaClient := ollama.NewClient(cfg.OllamaURL, cfg.Upstream, registry)
+
+	// Batches are held to the same input limits as single requests
+	batchConfig := batch.Config{RateLimitAlgorithm: cfg.RateLimitAlgorithm, CheckInput: api.InputCheck(cfg)}
+
+	// Run a batch file from the command line instead of serving
+	if flag.Arg(0) == "batch" {
+		runner := batch.NewRunner(database, ollamaClient, limiter, inFlight, queue, batchConfig)
+		if err := runBatch(runner, flag.Args()[1:]); err != nil {
+			log.Fatalf("Batch failed: %v", err)
+		}
+		return
+	}
+
+	// Start background usage compaction
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	compactor := retention.NewCompactor(database, retention.Config{
+		RawRetention:    cfg.UsageRetention,
+		HourlyRetention: cfg.UsageHourlyRetention,
+		Interval:        cfg.UsageCompactInterval,
+		VacuumInterval:  cfg.VacuumInterval,
+	})
+	go compactor.Run(bgCtx)
+
 	// Create router
 	router := mux.NewRouter()
 
+	// Set up the response cache, backed by the database unless disabled
+	var responseCache *cache.Cache
+	if cfg.CacheEnabled {
+		var store cache.Store
+		if cfg.CacheDBEntries >= 0 {
+			store = database
+		}
+		responseCache = cache.New(store, cache.Config{
+			TTL:          cfg.CacheTTL,
+			MemoryBytes:  cfg.CacheMemoryBytes,
+			StoreEntries: cfg.CacheDBEntries,
+		}, registry)
+		go responseCache.Run(bgCtx)
+	}
+
+	// Start the asynchronous job workers
+	pool := jobs.NewPool(database, ollamaClient, inFlight, queue, jobs.Config{
+		Workers:           cfg.JobWorkers,
+		MaxAttempts:       cfg.JobMaxAttempts,
+		CallbackAllowlist: callbackAllowlist,
+	})
+	poolDone := make(chan struct{})
+	go func() {
+		pool.Run(bgCtx)
+		close(poolDone)
+	}()
+
+	// Start the batch workers
+	batches := batch.NewManager(database,
+		batch.NewRunner(database, ollamaClient, limiter, inFlight, queue, batchConfig),
+		batch.ManagerConfig{
+			Workers:        cfg.BatchWorkers,
+			MaxConcurrency: cfg.BatchMaxConcurrency,
+		})
+	batchesDone := make(chan struct{})
+	go func() {
+		batches.Run(bgCtx)
+		close(batchesDone)
+	}()
+
+	// Send events such as rejected addresses to the registered webhooks
+	notifier := webhook.NewNotifier(database, webhook.Config{})
+	go notifier.Run(bgCtx)
+
+	// Accept bearer tokens alongside API keys. An identity provider that
+	// cannot be reached now is tried again on the first token.
+	if tokens != nil {
+		if err := tokens.Refresh(); err != nil {
+			log.Printf("Error fetching JWKS: %v", err)
+		}
+	}
+
 	// Initialize API handlers
-	api.SetupRoutes(router, database, cfg)
+	api.SetupRoutes(router, database, cfg,
+		api.WithLimiter(limiter),
+		api.WithConcurrencyLimiter(inFlight),
+		api.WithMetrics(registry),
+		api.WithScheduler(queue),
+		api.WithOllama(ollamaClient),
+		api.WithJobs(pool),
+		api.WithBatches(batches),
+		api.WithCache(responseCache),
+		api.WithOrgs(database),
+		api.WithWebhooks(notifier),
+		api.WithJWT(tokens),
+		api.WithBuildInfo(models.BuildInfo{Version: Version, CommitHash: CommitHash, BuildTime: BuildTime}),
+	)
 
-	// Create server with graceful shutdown
-	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.Port),
-		Handler: router,
+	// Serve HTTPS when a certificate is configured, reloading it when the
+	// files change or on SIGHUP
+	var tlsConfig *tls.Config
+	if cfg.TLS.CertFile != "" || cfg.TLS.KeyFile != "" || cfg.TLS.ClientCAFile != "" {
+		certs, err := tlsconfig.NewServer(cfg.TLS)
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+		tlsConfig = certs.TLSConfig()
+		if cfg.TLSReloadInterval > 0 {
+			go certs.Watch(bgCtx, cfg.TLSReloadInterval)
+		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := certs.Reload(); err != nil {
+					log.Printf("Error reloading TLS certificate: %v", err)
+					continue
+				}
+				log.Println("Reloaded TLS certificate")
+			}
+		}()
+	}
+
+	// Create a server with graceful shutdown for each listener, serving its
+	// own set of routes
+	listeners, err := listener.Open(cfg.Listeners)
+	if err != nil {
+		log.Fatalf("Failed to open listeners: %v", err)
+	}
+	servers := make([]*http.Server, len(listeners))
+	for i, l := range listeners {
+		handler, err := api.LimitRoutes(router, l.Spec.Routes)
+		if err != nil {
+			log.Fatalf("Invalid listener %s: %v", l.Spec, err)
+		}
+		servers[i] = &http.Server{Handler: handler}
+		if l.Spec.TLS {
+			servers[i].TLSConfig = tlsConfig
+		}
 	}
 
 	// Initialize CLI
@@ -60,13 +425,10 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
-	// Start server in a goroutine
-	go func() {
-		log.Printf("Server starting on %s", srv.Addr)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
-		}
-	}()
+	// Start the servers in goroutines
+	for i, srv := range servers {
+		go serve(srv, listeners[i])
+	}
 
 	// Start CLI in a goroutine
 	go func() {
@@ -94,15 +456,120 @@ func main() {
 	// Wait for shutdown signal
 	<-quit
 	log.Println("Server is shutting down...")
+	stopBackground()
 
 	// Gracefully shutdown server
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Fatalf("Server forced to shutdown: %v", err)
+		}
+	}
+
+	// Running jobs and batches are put back in the queue before the database closes
+	for _, workers := range []chan struct{}{poolDone, batchesDone} {
+		select {
+		case <-workers:
+		case <-ctx.Done():
+			log.Println("Timed out waiting for background workers")
+		}
 	}
 
 	close(done)
 	log.Println("Server stopped")
 }
+
+// serve runs srv on l until it is shut down
+func serve(srv *http.Server, l listener.Listener) {
+	addr := l.Addr().Network() + " " + l.Addr().String()
+	var err error
+	if srv.TLSConfig != nil {
+		log.Printf("Server starting on %s with TLS, serving %s routes", addr, l.Spec.Routes)
+		err = srv.ServeTLS(l, "", "")
+	} else {
+		log.Printf("Server starting on %s, serving %s routes", addr, l.Spec.Routes)
+		err = srv.Serve(l)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
+
+// newLimiter creates the rate limiter selected by cfg.RateLimitStore. The
+// returned function releases its connections.
+func newLimiter(cfg *config.Config, database db.Store) (ratelimit.Limiter, func(), error) {
+	if _, err := ratelimit.ParseAlgorithm(cfg.RateLimitAlgorithm); err != nil {
+		return nil, nil, fmt.Errorf("invalid -rate-limit-algorithm: %v", err)
+	}
+	switch cfg.RateLimitStore {
+	case "memory":
+		return ratelimit.NewMemoryLimiter(), func() {}, nil
+	case "sql":
+		return ratelimit.NewSharedLimiter(database), func() {}, nil
+	case "redis":
+		redisStore, err := ratelimit.NewRedisStore(cfg.RedisURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to configure Redis: %v", err)
+		}
+		return ratelimit.NewSharedLimiter(redisStore), func() { redisStore.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown rate limit store %q", cfg.RateLimitStore)
+	}
+}
+
+// listFlag collects the values of a flag that may be given several times
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *listFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// listenerSpecs reads the -listen flags. Without any the server listens on
+// port on all addresses, as it did before listeners could be configured.
+func listenerSpecs(values []string, port int) ([]listener.Spec, error) {
+	if len(values) == 0 {
+		return []listener.Spec{{Network: listener.NetworkTCP, Address: fmt.Sprintf(":%d", port), Routes: "all", TLS: true}}, nil
+	}
+	specs := make([]listener.Spec, len(values))
+	for i, value := range values {
+		spec, err := listener.Parse(value)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(api.RouteSets, spec.Routes) {
+			return nil, fmt.Errorf("invalid listener %q: unknown route set %q, expected one of %s", value, spec.Routes, strings.Join(api.RouteSets, ", "))
+		}
+		specs[i] = spec
+	}
+	return specs, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// imageFormatList reads the -image-formats flag. Formats are named as sniffed
+// from image data, so jpg is accepted for jpeg.
+func imageFormatList(value string) []string {
+	formats := splitList(strings.ToLower(value))
+	for i, format := range formats {
+		if format == "jpg" {
+			formats[i] = "jpeg"
+		}
+	}
+	return formats
+}
@@ -2,146 +2,502 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
+	"math"
+	"mime"
 	"net/http"
-	"sync"
+	"strconv"
 	"time"
 
+	"github.com/erock530/go-ollama-api/internal/batch"
+	"github.com/erock530/go-ollama-api/internal/cache"
+	"github.com/erock530/go-ollama-api/internal/coalesce"
+	"github.com/erock530/go-ollama-api/internal/concurrency"
 	"github.com/erock530/go-ollama-api/internal/config"
 	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/jobs"
+	"github.com/erock530/go-ollama-api/internal/jwtauth"
+	"github.com/erock530/go-ollama-api/internal/metrics"
 	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+	"github.com/erock530/go-ollama-api/internal/ratelimit"
+	"github.com/erock530/go-ollama-api/internal/scheduler"
+	"github.com/erock530/go-ollama-api/internal/tlsconfig"
+	"github.com/erock530/go-ollama-api/internal/webhook"
 
 	"github.com/gorilla/mux"
 )
 
-var (
-	rateLimits = make(map[string]*RateLimitInfo)
-	rateMutex  sync.RWMutex
+// Option configures optional dependencies of the API routes
+type Option func(*options)
+
+// options holds the dependencies that SetupRoutes wires into the handlers
+type options struct {
+	limiter   ratelimit.Limiter
+	inFlight  *concurrency.Limiter
+	metrics   *metrics.Registry
+	scheduler *scheduler.Scheduler
+	ollama    *ollama.Client
+	backends  []*ollama.Client
+	jobs      *jobs.Pool
+	batches   *batch.Manager
+	cache     *cache.Cache
+	orgs      db.OrgStore
+	build     models.BuildInfo
+	webhooks  *webhook.Notifier
+	jwt       *jwtauth.Authenticator
+}
+
+// contextKey is the type of the request context keys set by this package
+type contextKey int
+
+const (
+	// apiKeyContextKey holds the *models.APIKey authenticated by rateLimitMiddleware
+	apiKeyContextKey contextKey = iota
+	// cacheLookupContextKey holds the *cacheLookup of a cacheable request
+	cacheLookupContextKey
+	// requestIDContextKey holds the request ID set by requestIDMiddleware
+	requestIDContextKey
 )
 
-// RateLimitInfo tracks rate limiting information for an API key
-type RateLimitInfo struct {
-	Tokens    int
-	LastUsed  time.Time
-	RateLimit int
+// CoalescableRoutes are the routes that can be listed in cfg.CoalesceRoutes
+var CoalescableRoutes = []string{"/generate", "/chat"}
+
+// WithLimiter sets the rate limiter shared by all API keys. Without it an
+// in-memory limiter is used, which only works for a single replica.
+func WithLimiter(limiter ratelimit.Limiter) Option {
+	return func(o *options) {
+		o.limiter = limiter
+	}
+}
+
+// WithConcurrencyLimiter sets the limiter bounding generations in flight.
+// Without it one is created from cfg.MaxConcurrent.
+func WithConcurrencyLimiter(limiter *concurrency.Limiter) Option {
+	return func(o *options) {
+		o.inFlight = limiter
+	}
+}
+
+// WithMetrics sets the registry served on /metrics. Without it a new
+// registry is created.
+func WithMetrics(registry *metrics.Registry) Option {
+	return func(o *options) {
+		o.metrics = registry
+	}
+}
+
+// WithScheduler sets the queue generations wait in before reaching Ollama.
+// Without it one is created from the cfg.Queue settings.
+func WithScheduler(s *scheduler.Scheduler) Option {
+	return func(o *options) {
+		o.scheduler = s
+	}
+}
+
+// WithOllama sets the client used to reach Ollama. Without it one is
+// created for cfg.OllamaURL.
+func WithOllama(client *ollama.Client) Option {
+	return func(o *options) {
+		o.ollama = client
+	}
+}
+
+// WithBackends sets the clients of the Ollama servers that model management
+// requests fan out to. Without it they are created from cfg.OllamaBackends.
+func WithBackends(clients ...*ollama.Client) Option {
+	return func(o *options) {
+		o.backends = clients
+	}
+}
+
+// WithJobs enables the asynchronous /jobs API backed by pool
+func WithJobs(pool *jobs.Pool) Option {
+	return func(o *options) {
+		o.jobs = pool
+	}
+}
+
+// WithBatches enables the /batches API for uploading JSONL batch files
+func WithBatches(manager *batch.Manager) Option {
+	return func(o *options) {
+		o.batches = manager
+	}
+}
+
+// WithCache enables the response cache for deterministic requests. Keys use
+// it unless they opt out, or, with cfg.CacheOptIn, only if they opt in.
+func WithCache(c *cache.Cache) Option {
+	return func(o *options) {
+		o.cache = c
+	}
 }
 
 // SetupRoutes configures the API routes
-func SetupRoutes(r *mux.Router, db db.DBInterface, cfg *config.Config) {
+func SetupRoutes(r *mux.Router, db db.DBInterface, cfg *config.Config, opts ...Option) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.limiter == nil {
+		o.limiter = ratelimit.NewMemoryLimiter()
+	}
+	if o.inFlight == nil {
+		o.inFlight = concurrency.NewLimiter(cfg.MaxConcurrent)
+	}
+	if o.metrics == nil {
+		o.metrics = metrics.NewRegistry()
+	}
+	if o.scheduler == nil {
+		o.scheduler = scheduler.New(scheduler.Config{
+			Parallel: cfg.QueueParallel,
+			MaxDepth: cfg.QueueMaxDepth,
+			Timeout:  cfg.QueueTimeout,
+		}, o.metrics)
+	}
+
+	if o.ollama == nil {
+		o.ollama = ollama.NewClient(cfg.OllamaURL, cfg.Upstream, o.metrics)
+	}
+
+	if o.backends == nil {
+		o.backends = []*ollama.Client{o.ollama}
+		for _, url := range cfg.OllamaBackends {
+			if url != cfg.OllamaURL {
+				o.backends = append(o.backends, ollama.NewClient(url, cfg.Upstream, nil))
+			}
+		}
+	}
+
+	// Pulls and creates stream for as long as the model takes to download
+	// or build, so their clients have no upstream timeouts
+	transfers := make([]*ollama.Client, len(o.backends))
+	for i, client := range o.backends {
+		transfers[i] = ollama.NewClient(client.URL(), cfg.Upstream.WithoutTimeouts(), nil)
+	}
+
+	group := coalesce.NewGroup(o.metrics)
+	coalesced := func(route string) *coalesce.Group {
+		for _, enabled := range cfg.CoalesceRoutes {
+			if enabled == route {
+				return group
+			}
+		}
+		return nil
+	}
+
+	var responses *responseCache
+	if o.cache != nil {
+		responses = &responseCache{cache: o.cache, optIn: cfg.CacheOptIn}
+	}
+
+	r.NotFoundHandler = requestIDMiddleware(http.HandlerFunc(notFoundHandler))
+	r.MethodNotAllowedHandler = requestIDMiddleware(http.HandlerFunc(methodNotAllowedHandler))
+	r.Use(requestIDMiddleware)
+	access := newIPAccess(cfg, o.metrics, o.webhooks)
 	r.Use(func(next http.Handler) http.Handler {
-		return rateLimitMiddleware(next, db)
+		return rateLimitMiddleware(next, db, cfg, o.limiter, responses, access, o.jwt)
 	})
 
-	r.HandleFunc("/health", healthCheckHandler(db)).Methods("GET")
-	r.HandleFunc("/generate", generateHandler(db, cfg)).Methods("POST")
+	r.HandleFunc("/health", healthCheckHandler(db, o.inFlight, o.ollama)).Methods("GET")
+	r.Handle("/metrics", o.metrics.Handler()).Methods("GET")
+	r.HandleFunc("/livez", livezHandler).Methods("GET")
+	r.HandleFunc("/readyz", readyzHandler(db, o.backends)).Methods("GET")
+	r.HandleFunc("/status", statusHandler(db, o.ollama, o.backends, o.inFlight, o.scheduler, o.build)).Methods("GET")
+	r.HandleFunc("/usage", requireScope(models.ScopeUsageRead, usageHandler(db))).Methods("GET")
+	r.HandleFunc("/generate", requireScope(generateRoute.scope, generationHandler(generateRoute, db, cfg, o.ollama, o.inFlight, o.scheduler, coalesced("/generate")))).Methods("POST")
+	r.HandleFunc("/chat", requireScope(chatRoute.scope, generationHandler(chatRoute, db, cfg, o.ollama, o.inFlight, o.scheduler, coalesced("/chat")))).Methods("POST")
+
+	// Model management mirrors Ollama's own API
+	r.HandleFunc("/api/tags", requireScope(models.ScopeModelsRead, listModelsHandler(ollama.TagsPath, o.backends, true))).Methods("GET")
+	r.HandleFunc("/api/ps", requireScope(models.ScopeModelsRead, listModelsHandler(ollama.PsPath, o.backends, false))).Methods("GET")
+	r.HandleFunc("/api/show", requireScope(models.ScopeModelsRead, showModelHandler(o.backends))).Methods("POST")
+	r.HandleFunc("/api/pull", requireScope(models.ScopeModelsWrite, manageModelHandler(http.MethodPost, ollama.PullPath, transfers, true))).Methods("POST")
+	r.HandleFunc("/api/create", requireScope(models.ScopeModelsWrite, manageModelHandler(http.MethodPost, ollama.CreatePath, transfers, true))).Methods("POST")
+	r.HandleFunc("/api/copy", requireScope(models.ScopeModelsWrite, manageModelHandler(http.MethodPost, ollama.CopyPath, o.backends, false))).Methods("POST")
+	r.HandleFunc("/api/delete", requireScope(models.ScopeModelsWrite, manageModelHandler(http.MethodDelete, ollama.DeletePath, o.backends, false))).Methods("DELETE")
+
+	if o.jobs != nil {
+		r.HandleFunc("/jobs", submitJobHandler(o.jobs, cfg)).Methods("POST")
+		r.HandleFunc("/jobs/{id}", getJobHandler(o.jobs)).Methods("GET")
+		r.HandleFunc("/jobs/{id}", cancelJobHandler(o.jobs)).Methods("DELETE")
+	}
+	if o.batches != nil {
+		r.HandleFunc("/batches", submitBatchHandler(o.batches)).Methods("POST")
+		r.HandleFunc("/batches/{id}", getBatchHandler(o.batches)).Methods("GET")
+		r.HandleFunc("/batches/{id}/results", batchResultsHandler(o.batches)).Methods("GET")
+		r.HandleFunc("/batches/{id}", cancelBatchHandler(o.batches)).Methods("DELETE")
+	}
+	if o.orgs != nil {
+		r.HandleFunc("/admin/orgs", requireScope(models.ScopeAdmin, listOrgsHandler(o.orgs))).Methods("GET")
+		r.HandleFunc("/admin/orgs", requireScope(models.ScopeAdmin, createOrgHandler(o.orgs))).Methods("POST")
+		r.HandleFunc("/admin/orgs/{id}", requireScope(models.ScopeAdmin, getOrgHandler(o.orgs))).Methods("GET")
+		r.HandleFunc("/admin/orgs/{id}", requireScope(models.ScopeAdmin, updateOrgHandler(o.orgs))).Methods("PUT")
+		r.HandleFunc("/admin/orgs/{id}", requireScope(models.ScopeAdmin, deleteOrgHandler(o.orgs))).Methods("DELETE")
+		r.HandleFunc("/admin/orgs/{id}/keys", requireScope(models.ScopeAdmin, addOrgKeyHandler(o.orgs))).Methods("POST")
+		r.HandleFunc("/admin/orgs/{id}/usage", requireScope(models.ScopeAdmin, orgUsageHandler(o.orgs))).Methods("GET")
+	}
 }
 
-// rateLimitMiddleware handles API key validation and rate limiting
-func rateLimitMiddleware(next http.Handler, db db.DBInterface) http.Handler {
+// rateLimitMiddleware handles API key validation and rate limiting. Requests
+// answered from the response cache are not rate limited. With tokens set,
+// bearer tokens are accepted in place of API keys.
+func rateLimitMiddleware(next http.Handler, db db.DBInterface, cfg *config.Config, limiter ratelimit.Limiter, responses *responseCache, access *ipAccess, tokens *jwtauth.Authenticator) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip rate limiting for health check endpoint
-		if r.URL.Path == "/health" {
+		// Skip rate limiting for the health check, probe and metrics endpoints
+		if probePaths[r.URL.Path] {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Read the entire body
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "Error reading request body", http.StatusBadRequest)
+		// Denied addresses are turned away before anything else
+		addr, denied := access.denied(r)
+		if denied {
+			access.reject(w, r, addr, ipReasonDenied, "")
 			return
 		}
 
-		// Parse the request to get the API key
-		var req struct {
-			APIKey string `json:"apikey"`
+		// Read JSON bodies up front, within the size limit, so the key lookup,
+		// the cache and the handler can all use them. Uploaded JSONL files
+		// have their own limit.
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete && !isJSONLines(r) {
+			body, err := readBody(w, r, cfg.MaxBodyBytes)
+			if errors.Is(err, errBodyTooLarge) {
+				writeBodyTooLarge(w, r, cfg.MaxBodyBytes)
+				return
+			}
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Error reading request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		apiKey, ok := authenticateToken(w, r, db, tokens)
+		if !ok {
+			return
+		}
+		key, err := requestAPIKey(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if apiKey != nil {
+			key = apiKey.Key
+		}
+		// Without a key, a verified client certificate may stand in for one
+		if apiKey == nil && key == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			key, err = db.GetCertIdentityKey(tlsconfig.Identities(r.TLS.VerifiedChains[0][0])...)
+			if err != nil {
+				log.Printf("Error checking client certificate: %v", err)
+				writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+				return
+			}
+			if key == "" {
+				writeError(w, r, http.StatusForbidden, codeInvalidAPIKey, "Client certificate is not mapped to an API key")
+				return
+			}
 		}
-		if err := json.Unmarshal(body, &req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		if key == "" {
+			writeError(w, r, http.StatusBadRequest, codeMissingAPIKey, "API key is required")
 			return
 		}
 
-		// Reset the body with the original content
-		r.Body = io.NopCloser(bytes.NewBuffer(body))
+		if apiKey == nil {
+			if apiKey, err = db.GetAPIKey(key); err != nil {
+				log.Printf("Error checking API key: %v", err)
+				writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+				return
+			}
+			if apiKey == nil {
+				writeError(w, r, http.StatusForbidden, codeInvalidAPIKey, "Invalid API key")
+				return
+			}
+		}
+		if !apiKey.Active {
+			writeError(w, r, http.StatusForbidden, codeAPIKeyDeactivated, "API key is deactivated")
+			return
+		}
+		if !access.allowed(addr, apiKey) {
+			access.reject(w, r, addr, ipReasonNotAllowed, apiKey.Key)
+			return
+		}
+		// Handlers see the limits the key takes from its plan
+		apiKey = apiKey.Effective()
 
-		if req.APIKey == "" {
-			http.Error(w, "API key is required", http.StatusBadRequest)
+		// Reads such as polling a job are authenticated but not counted
+		ctx := context.WithValue(r.Context(), apiKeyContextKey, apiKey)
+		if r.Method == http.MethodGet {
+			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
 
-		apiKey, err := db.GetAPIKey(req.APIKey)
+		// Cache hits do not count against the rate limit either
+		if responses != nil {
+			if lookup := responses.lookup(r, apiKey); lookup != nil {
+				ctx = context.WithValue(ctx, cacheLookupContextKey, lookup)
+				if lookup.response != nil {
+					next.ServeHTTP(w, r.WithContext(ctx))
+					return
+				}
+			}
+		}
+
+		// The key's organization has a rate limit of its own, shared by all
+		// of its keys. It is checked first, so that requests it refuses do
+		// not use up the key's own limit.
+		e, err := checkOrgRateLimit(r.Context(), limiter, cfg, apiKey.Org)
 		if err != nil {
-			log.Printf("Error checking API key: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Printf("Error checking organization rate limit: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
 			return
 		}
-		if apiKey == nil {
-			http.Error(w, "Invalid API key", http.StatusForbidden)
+		if e != nil {
+			writeErrorResponse(w, r, http.StatusTooManyRequests, *e)
 			return
 		}
-		if !apiKey.Active {
-			http.Error(w, "API key is deactivated", http.StatusForbidden)
+
+		algorithm := apiKey.RateLimitAlgorithm
+		if algorithm == "" {
+			algorithm = cfg.RateLimitAlgorithm
+		}
+		result, err := limiter.Allow(r.Context(), key, ratelimit.Limit{
+			Algorithm: ratelimit.Algorithm(algorithm),
+			Requests:  apiKey.RateLimit,
+			Period:    time.Minute,
+			Burst:     apiKey.RateLimitBurst,
+		})
+		if err != nil {
+			log.Printf("Error checking rate limit: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
 			return
 		}
 
-		rateMutex.Lock()
-		info, exists := rateLimits[req.APIKey]
-		if !exists {
-			info = &RateLimitInfo{
-				Tokens:    apiKey.Tokens,
-				LastUsed:  apiKey.LastUsed,
-				RateLimit: apiKey.RateLimit,
-			}
-			rateLimits[req.APIKey] = info
+		setRateLimitHeaders(w, result)
+		if !result.Allowed {
+			writeErrorResponse(w, r, http.StatusTooManyRequests, models.ErrorResponse{
+				Error:      "Rate limit exceeded. Try again later.",
+				Code:       codeRateLimited,
+				RetryAfter: int(math.Ceil(result.RetryAfter.Seconds())),
+			})
+			return
 		}
 
-		currentTime := time.Now()
-		if currentTime.Sub(info.LastUsed) >= time.Minute {
-			info.Tokens = info.RateLimit
+		if err := db.UpdateAPIKeyUsage(key, result.Remaining); err != nil {
+			log.Printf("Error updating API key usage: %v", err)
 		}
 
-		if info.Tokens > 0 {
-			info.Tokens--
-			info.LastUsed = currentTime
-			rateMutex.Unlock()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
-			if err := db.UpdateAPIKeyUsage(req.APIKey, info.Tokens); err != nil {
-				log.Printf("Error updating API key usage: %v", err)
-			}
+// requestAPIKey finds the API key of a request in the X-API-Key header, the
+// apikey query parameter or the "apikey" field of a JSON body, in that order.
+// A body that has been read is put back for the handler.
+func requestAPIKey(r *http.Request) (string, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key, nil
+	}
+	if key := r.URL.Query().Get("apikey"); key != "" {
+		return key, nil
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodDelete {
+		return "", nil
+	}
+	// Uploaded JSONL files cannot carry the key
+	if isJSONLines(r) {
+		return "", nil
+	}
 
-			next.ServeHTTP(w, r)
-		} else {
-			rateMutex.Unlock()
-			http.Error(w, "Rate limit exceeded. Try again later.", http.StatusTooManyRequests)
+	// Read the entire body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", errors.New("Error reading request body")
+	}
+
+	// Reset the body with the original content
+	r.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	var req struct {
+		APIKey string `json:"apikey"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", errors.New("Invalid request body")
+	}
+	return req.APIKey, nil
+}
+
+// isJSONLines reports whether a request uploads a JSONL file
+func isJSONLines(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-ndjson" || mediaType == "application/jsonl"
+}
+
+// requireScope lets only keys with scope call a handler
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiKey := apiKeyFromContext(r.Context()); apiKey == nil || !apiKey.HasScope(scope) {
+			writeInsufficientScope(w, r, scope)
+			return
 		}
-	})
+		next(w, r)
+	}
+}
+
+// apiKeyFromContext returns the API key authenticated for the request
+func apiKeyFromContext(ctx context.Context) *models.APIKey {
+	apiKey, _ := ctx.Value(apiKeyContextKey).(*models.APIKey)
+	return apiKey
+}
+
+// setRateLimitHeaders tells the client where it stands against its limit.
+// Retry-After is only sent with 429 responses and is rounded up so that a
+// client retrying on time is never rejected again.
+func setRateLimitHeaders(w http.ResponseWriter, result ratelimit.Result) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(float64(result.ResetAt.UnixNano())/1e9)), 10))
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(result.RetryAfter.Seconds())), 10))
+	}
 }
 
 // healthCheckHandler handles the health check endpoint
-func healthCheckHandler(db db.DBInterface) http.HandlerFunc {
+func healthCheckHandler(db db.DBInterface, inFlight *concurrency.Limiter, client *ollama.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		apiKey := r.URL.Query().Get("apikey")
 		if apiKey == "" {
-			http.Error(w, "API key is required", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, codeMissingAPIKey, "API key is required")
 			return
 		}
 
 		key, err := db.GetAPIKey(apiKey)
 		if err != nil {
 			log.Printf("Error checking API key: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
 			return
 		}
 		if key == nil {
-			http.Error(w, "Invalid API key", http.StatusForbidden)
+			writeError(w, r, http.StatusForbidden, codeInvalidAPIKey, "Invalid API key")
 			return
 		}
 
 		response := models.APIResponse{
 			Status:    "API is healthy",
 			Timestamp: time.Now(),
+			Data: models.HealthStatus{
+				InFlightStatus: models.InFlightStatus{
+					InFlight:      inFlight.InFlight(key.Key),
+					MaxConcurrent: key.Effective().MaxConcurrent,
+					TotalInFlight: inFlight.Total(),
+					MaxTotal:      inFlight.Global(),
+				},
+				Upstream: upstreamStatus(client),
+			},
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -149,52 +505,15 @@ func healthCheckHandler(db db.DBInterface) http.HandlerFunc {
 	}
 }
 
-// generateHandler handles the generate endpoint that proxies to Ollama
-func generateHandler(db db.DBInterface, cfg *config.Config) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var req models.GenerateRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
-			return
-		}
-
-		// Create request to Ollama API
-		ollamaReq := struct {
-			Model  string   `json:"model"`
-			Prompt string   `json:"prompt"`
-			Stream bool     `json:"stream"`
-			Images []string `json:"images,omitempty"`
-			Raw    bool     `json:"raw"`
-		}{
-			Model:  req.Model,
-			Prompt: req.Prompt,
-			Stream: req.Stream,
-			Images: req.Images,
-			Raw:    req.Raw,
-		}
-
-		ollamaBody, err := json.Marshal(ollamaReq)
-		if err != nil {
-			http.Error(w, "Error preparing request", http.StatusInternalServerError)
-			return
-		}
-
-		ollamaResp, err := http.Post(cfg.OllamaURL+"/api/generate", "application/json", bytes.NewBuffer(ollamaBody))
-		if err != nil {
-			log.Printf("Error making request to Ollama API: %v", err)
-			http.Error(w, "Error making request to Ollama API", http.StatusInternalServerError)
-			return
-		}
-		defer ollamaResp.Body.Close()
-
-		// Log API usage
-		if err := db.LogAPIUsage(req.APIKey); err != nil {
-			log.Printf("Error logging API usage: %v", err)
-		}
-
-		// Forward Ollama response
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(ollamaResp.StatusCode)
-		io.Copy(w, ollamaResp.Body)
+// upstreamStatus reports the circuit breaker of the Ollama client
+func upstreamStatus(client *ollama.Client) models.UpstreamStatus {
+	breaker := client.Status()
+	status := models.UpstreamStatus{
+		Breaker:             breaker.State.String(),
+		ConsecutiveFailures: breaker.Failures,
+	}
+	if !breaker.RetryAt.IsZero() {
+		status.RetryAt = &breaker.RetryAt
 	}
+	return status
 }
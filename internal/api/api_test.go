@@ -2,15 +2,26 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/erock530/go-ollama-api/internal/concurrency"
 	"github.com/erock530/go-ollama-api/internal/config"
 	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/metrics"
 	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ratelimit"
+	"github.com/erock530/go-ollama-api/internal/scheduler"
 	"github.com/gorilla/mux"
 )
 
@@ -20,11 +31,26 @@ var _ db.DBInterface = (*MockDB)(nil)
 // MockDB implements the necessary database methods for testing
 type MockDB struct {
 	apiKeys map[string]*models.APIKey
+	// certIdentities maps client certificate identities to keys
+	certIdentities map[string]string
+	orgs           map[string]*models.Org
+	plans          map[string]*models.Plan
+
+	mu        sync.Mutex
+	usage     map[string]int
+	orgTokens map[string]int64
+	keyTokens map[string]int64
+
+	// pingErr is returned by PingContext
+	pingErr error
 }
 
 func NewMockDB() *MockDB {
 	return &MockDB{
-		apiKeys: make(map[string]*models.APIKey),
+		apiKeys:   make(map[string]*models.APIKey),
+		usage:     make(map[string]int),
+		orgTokens: make(map[string]int64),
+		keyTokens: make(map[string]int64),
 	}
 }
 
@@ -43,10 +69,73 @@ func (m *MockDB) UpdateAPIKeyUsage(key string, tokens int) error {
 	return nil
 }
 
-func (m *MockDB) LogAPIUsage(key string) error {
+func (m *MockDB) LogAPIUsage(key, orgID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.usage[key]++
+	return nil
+}
+
+// GetUsageReport reports the usage logged so far as one bucket per key
+func (m *MockDB) GetUsageReport(key string, since time.Time, granularity models.UsageGranularity) ([]models.UsageBucket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var buckets []models.UsageBucket
+	if requests := m.usage[key]; requests > 0 {
+		buckets = append(buckets, models.UsageBucket{Key: key, Period: time.Now().Truncate(time.Hour), Requests: int64(requests)})
+	}
+	return buckets, nil
+}
+
+// GetOrgTokens returns the tokens an org has used, whatever the day
+func (m *MockDB) GetOrgTokens(orgID string, day time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.orgTokens[orgID], nil
+}
+
+func (m *MockDB) AddOrgTokens(orgID string, day time.Time, tokens int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.orgTokens[orgID] += tokens
+	return nil
+}
+
+// GetKeyTokens returns the tokens a key has used, whatever the day
+func (m *MockDB) GetKeyTokens(key string, day time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keyTokens[key], nil
+}
+
+func (m *MockDB) AddKeyTokens(key string, day time.Time, tokens int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keyTokens[key] += tokens
 	return nil
 }
 
+func (m *MockDB) GetCertIdentityKey(identities ...string) (string, error) {
+	for _, identity := range identities {
+		if key, ok := m.certIdentities[identity]; ok {
+			return key, nil
+		}
+	}
+	return "", nil
+}
+
+func (m *MockDB) GetOrg(id string) (*models.Org, error) {
+	return m.orgs[id], nil
+}
+
+func (m *MockDB) GetPlan(name string) (*models.Plan, error) {
+	return m.plans[name], nil
+}
+
+func (m *MockDB) PingContext(ctx context.Context) error {
+	return m.pingErr
+}
+
 func (m *MockDB) Close() error {
 	return nil
 }
@@ -140,10 +229,7 @@ func TestRateLimitMiddleware(t *testing.T) {
 	mockServer := mockOllamaServer()
 	defer mockServer.Close()
 
-	// Reset rate limits before test
-	rateMutex.Lock()
-	rateLimits = make(map[string]*RateLimitInfo)
-	rateMutex.Unlock()
+	limiter := ratelimit.NewMemoryLimiter()
 
 	mockDB := NewMockDB()
 	mockDB.apiKeys["valid-key"] = &models.APIKey{
@@ -167,7 +253,7 @@ func TestRateLimitMiddleware(t *testing.T) {
 		Port:      8080,
 		OllamaURL: mockServer.URL,
 	}
-	SetupRoutes(router, mockDB, cfg)
+	SetupRoutes(router, mockDB, cfg, WithLimiter(limiter))
 
 	tests := []struct {
 		name           string
@@ -198,9 +284,7 @@ func TestRateLimitMiddleware(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Reset rate limits and API key state before each test case
-			rateMutex.Lock()
-			rateLimits = make(map[string]*RateLimitInfo)
-			rateMutex.Unlock()
+			limiter.Reset()
 
 			// Reset API key tokens
 			if tt.apiKey == "valid-key" {
@@ -237,9 +321,322 @@ func TestRateLimitMiddleware(t *testing.T) {
 	}
 }
 
+func TestRateLimitHeaders(t *testing.T) {
+	mockServer := mockOllamaServer()
+	defer mockServer.Close()
+
+	mockDB := NewMockDB()
+	mockDB.apiKeys["valid-key"] = &models.APIKey{
+		Key:                "valid-key",
+		Active:             true,
+		RateLimit:          2,
+		RateLimitAlgorithm: "token_bucket",
+	}
+
+	router := mux.NewRouter()
+	cfg := &config.Config{
+		Port:      8080,
+		OllamaURL: mockServer.URL,
+	}
+	SetupRoutes(router, mockDB, cfg, WithLimiter(ratelimit.NewMemoryLimiter()))
+
+	send := func() *httptest.ResponseRecorder {
+		body := []byte(`{"apikey": "valid-key", "model": "test-model", "prompt": "test prompt"}`)
+		req, err := http.NewRequest("POST", "/generate", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("first request: got status %d", rr.Code)
+	}
+	if got := rr.Header().Get("X-RateLimit-Limit"); got != "2" {
+		t.Errorf("X-RateLimit-Limit = %q, want 2", got)
+	}
+	if got := rr.Header().Get("X-RateLimit-Remaining"); got != "1" {
+		t.Errorf("X-RateLimit-Remaining = %q, want 1", got)
+	}
+	if reset, err := strconv.ParseInt(rr.Header().Get("X-RateLimit-Reset"), 10, 64); err != nil || reset < time.Now().Unix() {
+		t.Errorf("X-RateLimit-Reset = %q, want a future Unix time", rr.Header().Get("X-RateLimit-Reset"))
+	}
+	if rr.Header().Get("Retry-After") != "" {
+		t.Error("Retry-After set on an allowed request")
+	}
+
+	send()
+	rr = send()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("third request: got status %d, want 429", rr.Code)
+	}
+	// One token is earned back every 30 seconds
+	if got := rr.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+	if got := rr.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("X-RateLimit-Remaining = %q, want 0", got)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	// The mock Ollama server holds every generation until unblocked
+	unblock := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"response": "mocked response"})
+	}))
+	defer mockServer.Close()
+
+	mockDB := NewMockDB()
+	mockDB.apiKeys["valid-key"] = &models.APIKey{
+		Key:           "valid-key",
+		Active:        true,
+		RateLimit:     100,
+		MaxConcurrent: 1,
+	}
+
+	tests := []struct {
+		name           string
+		wait           time.Duration
+		expectedStatus int
+	}{
+		{name: "Reject Immediately", wait: 0, expectedStatus: http.StatusTooManyRequests},
+		{name: "Wait For Slot", wait: 5 * time.Second, expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unblock = make(chan struct{})
+			inFlight := concurrency.NewLimiter(0)
+			router := mux.NewRouter()
+			cfg := &config.Config{
+				Port:            8080,
+				OllamaURL:       mockServer.URL,
+				ConcurrencyWait: tt.wait,
+			}
+			SetupRoutes(router, mockDB, cfg, WithConcurrencyLimiter(inFlight))
+
+			send := func() int {
+				body := []byte(`{"apikey": "valid-key", "model": "test-model", "prompt": "test prompt"}`)
+				req := httptest.NewRequest("POST", "/generate", bytes.NewBuffer(body))
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				return rr.Code
+			}
+
+			first := make(chan int)
+			go func() { first <- send() }()
+			for inFlight.InFlight("valid-key") == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			// The health check reports the generation in flight
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest("GET", "/health?apikey=valid-key", nil))
+			var health struct {
+				Data models.InFlightStatus `json:"data"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&health); err != nil {
+				t.Fatal(err)
+			}
+			if health.Data.InFlight != 1 || health.Data.MaxConcurrent != 1 || health.Data.TotalInFlight != 1 {
+				t.Errorf("unexpected in-flight status: %+v", health.Data)
+			}
+
+			second := make(chan int)
+			go func() { second <- send() }()
+			if tt.wait > 0 {
+				// Let the second request start waiting before the slot frees up
+				time.Sleep(20 * time.Millisecond)
+			} else if status := <-second; status != tt.expectedStatus {
+				t.Errorf("second request: got status %d, want %d", status, tt.expectedStatus)
+			}
+
+			close(unblock)
+			if status := <-first; status != http.StatusOK {
+				t.Errorf("first request: got status %d, want 200", status)
+			}
+			if tt.wait > 0 {
+				if status := <-second; status != tt.expectedStatus {
+					t.Errorf("second request: got status %d, want %d", status, tt.expectedStatus)
+				}
+			}
+			if inFlight.Total() != 0 {
+				t.Errorf("%d generations still in flight", inFlight.Total())
+			}
+		})
+	}
+}
+
+func TestQueue(t *testing.T) {
+	unblock := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"response": "mocked response"})
+	}))
+	defer mockServer.Close()
+
+	mockDB := NewMockDB()
+	for _, key := range []string{"key-a", "key-b", "key-c"} {
+		mockDB.apiKeys[key] = &models.APIKey{Key: key, Active: true, RateLimit: 100}
+	}
+
+	registry := metrics.NewRegistry()
+	queue := scheduler.New(scheduler.Config{Parallel: 1, MaxDepth: 2}, registry)
+	router := mux.NewRouter()
+	cfg := &config.Config{Port: 8080, OllamaURL: mockServer.URL}
+	SetupRoutes(router, mockDB, cfg, WithMetrics(registry), WithScheduler(queue))
+
+	gateway := httptest.NewServer(router)
+	defer gateway.Close()
+
+	// send reports the queue position of every 102 Processing response on
+	// queued, then returns the final response. With notify it asks for them.
+	send := func(key string, notify bool, queued chan<- string) *http.Response {
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusProcessing {
+					queued <- header.Get("X-Queue-Position")
+				}
+				return nil
+			},
+		}
+		body := `{"apikey": "` + key + `", "model": "test-model", "prompt": "test prompt"}`
+		req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "POST", gateway.URL+"/generate", strings.NewReader(body))
+		if notify {
+			req.Header.Set("X-Queue-Notify", "processing")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return &http.Response{Header: http.Header{}}
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	firstQueued := make(chan string, 1)
+	first := make(chan *http.Response)
+	go func() { first <- send("key-a", true, firstQueued) }()
+	for queue.Running() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Without asking, a queued request is not sent a 102
+	secondQueued := make(chan string, 1)
+	second := make(chan *http.Response)
+	go func() { second <- send("key-b", false, secondQueued) }()
+	for queue.Depth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A request that asks gets its position while it is still waiting
+	thirdQueued := make(chan string, 1)
+	third := make(chan *http.Response)
+	go func() { third <- send("key-c", true, thirdQueued) }()
+	select {
+	case position := <-thirdQueued:
+		if position != "2" {
+			t.Errorf("third request: queue position %q while waiting, want 2", position)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("third request: no queue position while waiting")
+	}
+
+	// The queue holds two requests, so a fourth is turned away
+	if resp := send("key-a", false, make(chan string, 1)); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("fourth request: got status %d, want 503", resp.StatusCode)
+	}
+
+	close(unblock)
+	if resp := <-first; resp.StatusCode != http.StatusOK || len(firstQueued) != 0 || resp.Header.Get("X-Queue-Position") != "" {
+		t.Errorf("first request: status %d, queue position %q; want 200 and none", resp.StatusCode, resp.Header.Get("X-Queue-Position"))
+	}
+	if resp := <-second; resp.StatusCode != http.StatusOK || len(secondQueued) != 0 || resp.Header.Get("X-Queue-Position") != "1" {
+		t.Errorf("second request: status %d, queue position %q, %d informational responses; want 200, 1 and none", resp.StatusCode, resp.Header.Get("X-Queue-Position"), len(secondQueued))
+	}
+	if resp := <-third; resp.StatusCode != http.StatusOK || resp.Header.Get("X-Queue-Position") != "2" {
+		t.Errorf("third request: status %d, queue position %q; want 200 and 2", resp.StatusCode, resp.Header.Get("X-Queue-Position"))
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("metrics: got status %d", rr.Code)
+	}
+	for _, want := range []string{
+		`ollama_api_queue_wait_seconds_count{priority="normal"} 3`,
+		`ollama_api_queue_rejected_total{reason="full"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, rr.Body.String())
+		}
+	}
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
 	}
 	return b
 }
+
+func TestGeneratePassthrough(t *testing.T) {
+	var received map[string]interface{}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = nil
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Write([]byte(`{"model":"test-model","response":"{}","done":true}`))
+	}))
+	defer mockServer.Close()
+
+	mockDB := NewMockDB()
+	mockDB.apiKeys["open"] = &models.APIKey{Key: "open", Active: true, RateLimit: 100}
+	mockDB.apiKeys["limited"] = &models.APIKey{Key: "limited", Active: true, RateLimit: 100,
+		MaxNumCtx: 4096, MaxNumPredict: 128, MaxKeepAlive: 10 * time.Minute}
+
+	router := mux.NewRouter()
+	SetupRoutes(router, mockDB, &config.Config{Port: 8080, OllamaURL: mockServer.URL})
+
+	request := `"model":"test-model","prompt":"hi","suffix":"end","system":"be brief","template":"{{ .Prompt }}",` +
+		`"context":[1,2,3],"format":{"type":"object"},"keep_alive":-1,"think":true,` +
+		`"options":{"temperature":0.2,"num_ctx":32768,"stop":["\n"]}`
+	send := func(key string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/generate", strings.NewReader(`{"apikey":"`+key+`",`+request+`}`)))
+		return rr
+	}
+
+	rr := send("open")
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Options-Clamped") != "" {
+		t.Fatalf("status %d, clamped %q", rr.Code, rr.Header().Get("X-Options-Clamped"))
+	}
+	var want map[string]interface{}
+	json.Unmarshal([]byte(`{`+request+`,"stream":false,"raw":false}`), &want)
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("Ollama received %v, want %v", received, want)
+	}
+
+	rr = send("limited")
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Options-Clamped") != "num_ctx, num_predict, keep_alive" {
+		t.Fatalf("status %d, clamped %q", rr.Code, rr.Header().Get("X-Options-Clamped"))
+	}
+	options := received["options"].(map[string]interface{})
+	if options["num_ctx"] != float64(4096) || options["num_predict"] != float64(128) || received["keep_alive"] != "10m0s" ||
+		options["temperature"] != 0.2 || received["system"] != "be brief" {
+		t.Errorf("Ollama received %v", received)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/generate",
+		strings.NewReader(`{"apikey":"limited","model":"test-model","prompt":"hi","keep_alive":"a while"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid keep_alive: status %d, want 400", rr.Code)
+	}
+}
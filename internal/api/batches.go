@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/erock530/go-ollama-api/internal/batch"
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// maxBatchSize bounds an uploaded batch file
+const maxBatchSize = 100 << 20
+
+// submitBatchHandler queues an uploaded JSONL file of requests. The body is
+// the file itself, so the API key comes from the header or query string.
+func submitBatchHandler(manager *batch.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rejectTokenKey(w, r, "Batches") {
+			return
+		}
+		concurrency := 1
+		if value := r.URL.Query().Get("concurrency"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				writeErrorResponse(w, r, http.StatusBadRequest, models.ErrorResponse{
+					Error: "concurrency must be a positive number",
+					Code:  codeInvalidRequest,
+					Field: "concurrency",
+				})
+				return
+			}
+			concurrency = n
+		}
+
+		input, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchSize))
+		if err != nil {
+			writeBodyTooLarge(w, r, maxBatchSize)
+			return
+		}
+
+		apiKey := apiKeyFromContext(r.Context())
+		b, err := manager.Submit(apiKey.Key, input, concurrency)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		w.Header().Set("Location", "/batches/"+b.ID)
+		writeBatch(w, http.StatusAccepted, b)
+	}
+}
+
+// getBatchHandler returns the progress of a batch
+func getBatchHandler(manager *batch.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b := ownBatch(w, r, manager)
+		if b == nil {
+			return
+		}
+		writeBatch(w, http.StatusOK, b)
+	}
+}
+
+// batchResultsHandler streams the results of a batch as JSONL. Results are
+// available while the batch is still running.
+func batchResultsHandler(manager *batch.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b := ownBatch(w, r, manager)
+		if b == nil {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if err := manager.WriteResults(b.ID, w); err != nil {
+			log.Printf("Error writing batch results: %v", err)
+		}
+	}
+}
+
+// cancelBatchHandler stops a queued or running batch
+func cancelBatchHandler(manager *batch.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b := ownBatch(w, r, manager)
+		if b == nil {
+			return
+		}
+
+		err := manager.Cancel(b.ID)
+		if errors.Is(err, db.ErrNotFound) {
+			writeError(w, r, http.StatusConflict, codeConflict, "Batch has already finished")
+			return
+		}
+		if err != nil {
+			log.Printf("Error cancelling batch: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+
+		b, err = manager.Get(b.ID)
+		if err != nil {
+			log.Printf("Error reading batch: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+		writeBatch(w, http.StatusOK, b)
+	}
+}
+
+// ownBatch loads the batch named in the URL, hiding batches of other keys
+// like ownJob does. On failure the error response has been written and nil
+// is returned.
+func ownBatch(w http.ResponseWriter, r *http.Request, manager *batch.Manager) *models.Batch {
+	b, err := manager.Get(mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Error reading batch: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return nil
+	}
+	if b == nil || b.Key != apiKeyFromContext(r.Context()).Key {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Batch not found")
+		return nil
+	}
+	return b
+}
+
+// writeBatch sends a batch as JSON
+func writeBatch(w http.ResponseWriter, status int, b *models.Batch) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(b)
+}
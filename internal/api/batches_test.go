@@ -0,0 +1,122 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/batch"
+	"github.com/erock530/go-ollama-api/internal/concurrency"
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+	"github.com/erock530/go-ollama-api/internal/ratelimit"
+	"github.com/erock530/go-ollama-api/internal/scheduler"
+	"github.com/gorilla/mux"
+)
+
+func TestBatchesAPI(t *testing.T) {
+	mockServer := mockOllamaServer()
+	defer mockServer.Close()
+
+	database, err := db.OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	for _, key := range []string{"owner-key", "other-key"} {
+		if err := database.CreateAPIKey(&models.APIKey{Key: key, Active: true, RateLimit: 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := ollama.NewClient(mockServer.URL, ollama.Config{}, nil)
+	limiter := ratelimit.NewMemoryLimiter()
+	cfg := &config.Config{Port: 8080, OllamaURL: mockServer.URL, MaxPromptChars: 20}
+	runner := batch.NewRunner(database, client, limiter, concurrency.NewLimiter(0), scheduler.New(scheduler.Config{}, nil), batch.Config{CheckInput: InputCheck(cfg)})
+	manager := batch.NewManager(database, runner, batch.ManagerConfig{MaxConcurrency: 2, PollInterval: 10 * time.Millisecond})
+	ctx, stop := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		manager.Run(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		stop()
+		<-stopped
+	}()
+
+	router := mux.NewRouter()
+	SetupRoutes(router, database, cfg, WithOllama(client), WithLimiter(limiter), WithBatches(manager))
+
+	send := func(method, path, key string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	input := []byte(`{"custom_id": "a", "url": "/api/generate", "body": {"model": "test-model", "prompt": "hi"}}
+{"custom_id": "b", "url": "/api/embed", "body": {"model": "test-model", "input": "hi"}}
+{"custom_id": "c", "url": "/api/chat", "body": {"model": "test-model", "messages": [{"role": "user", "content": "far longer than the prompt limit"}]}}
+`)
+	rr := send("POST", "/batches?concurrency=8", "owner-key", input)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("submit: got status %d: %s", rr.Code, rr.Body.String())
+	}
+	var b models.Batch
+	if err := json.NewDecoder(rr.Body).Decode(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.ID == "" || b.Total != 3 || b.Concurrency != 2 || rr.Header().Get("Location") != "/batches/"+b.ID {
+		t.Errorf("unexpected submit response: %+v, Location %q", b, rr.Header().Get("Location"))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.Status.Finished() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		rr = send("GET", "/batches/"+b.ID, "owner-key", nil)
+		b = models.Batch{}
+		json.NewDecoder(rr.Body).Decode(&b)
+	}
+	if b.Status != models.BatchCompleted || b.Succeeded != 2 || b.Failed != 1 {
+		t.Errorf("unexpected finished batch: %+v", b)
+	}
+
+	rr = send("GET", "/batches/"+b.ID+"/results", "owner-key", nil)
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if rr.Code != http.StatusOK || len(lines) != 3 || !strings.Contains(lines[0], `"custom_id":"a"`) {
+		t.Errorf("results: got status %d:\n%s", rr.Code, rr.Body.String())
+	}
+	// Lines over the input limits fail with the limit's code, as they would
+	// on their own
+	var tooLong models.BatchResult
+	json.Unmarshal([]byte(lines[len(lines)-1]), &tooLong)
+	if tooLong.CustomID != "c" || tooLong.Status != batch.StatusFailed || tooLong.StatusCode != http.StatusRequestEntityTooLarge || tooLong.Code != codePromptTooLong {
+		t.Errorf("result of a line over the prompt limit: %+v", tooLong)
+	}
+
+	if rr := send("GET", "/batches/"+b.ID+"/results", "other-key", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("results with another key: got status %d, want 404", rr.Code)
+	}
+	if rr := send("POST", "/batches", "", input); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "API key is required") {
+		t.Errorf("submit without a key: got status %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := send("POST", "/batches", "owner-key", []byte(`{"custom_id": "a"}`)); rr.Code != http.StatusBadRequest {
+		t.Errorf("submit invalid batch: got status %d, want 400", rr.Code)
+	}
+	if rr := send("DELETE", "/batches/"+b.ID, "owner-key", nil); rr.Code != http.StatusConflict {
+		t.Errorf("cancel finished batch: got status %d, want 409", rr.Code)
+	}
+}
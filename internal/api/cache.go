@@ -0,0 +1,190 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/erock530/go-ollama-api/internal/cache"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+)
+
+// cachedRoutes maps the routes whose responses can be cached to the Ollama
+// endpoint they call
+var cachedRoutes = map[string]string{
+	"/generate": ollama.GeneratePath,
+}
+
+// responseCache decides which requests use the cache
+type responseCache struct {
+	cache *cache.Cache
+	// optIn means keys without their own setting do not use the cache
+	optIn bool
+}
+
+// cacheLookup is the outcome of looking a request up in the cache
+type cacheLookup struct {
+	cache *cache.Cache
+	key   string
+	// response is the cached response, nil on a miss
+	response []byte
+	// store is false when the client asked for the response not to be kept
+	store bool
+	// status is reported in the X-Cache header: HIT, MISS or BYPASS
+	status string
+}
+
+// lookup checks the cache for a request to a cached route. It returns nil
+// if the request does not use the cache at all.
+func (c *responseCache) lookup(r *http.Request, apiKey *models.APIKey) *cacheLookup {
+	path, ok := cachedRoutes[r.URL.Path]
+	if !ok || r.Method != http.MethodPost {
+		return nil
+	}
+	switch apiKey.ResponseCache {
+	case "off":
+		return nil
+	case "":
+		if c.optIn {
+			return nil
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil
+	}
+	r.Body = io.NopCloser(bytes.NewBuffer(body))
+	if !cache.Deterministic(body) {
+		return nil
+	}
+	// Keys with different option limits get different responses
+	clamped, _, err := ollama.LimitsFor(apiKey).Apply(path, body)
+	if err != nil {
+		return nil
+	}
+	key, err := cache.Key(path, clamped)
+	if err != nil {
+		return nil
+	}
+
+	lookup := &cacheLookup{cache: c.cache, key: key, store: true, status: "MISS"}
+	noCache := false
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache":
+			noCache = true
+		case "no-store":
+			lookup.store = false
+		}
+	}
+	if noCache {
+		lookup.status = "BYPASS"
+		return lookup
+	}
+	if lookup.response = c.cache.Get(key); lookup.response != nil {
+		lookup.status = "HIT"
+	}
+	return lookup
+}
+
+// cacheLookupFromContext returns the cache lookup done for the request, if any
+func cacheLookupFromContext(ctx context.Context) *cacheLookup {
+	lookup, _ := ctx.Value(cacheLookupContextKey).(*cacheLookup)
+	return lookup
+}
+
+// save caches a successful upstream response body. Streamed responses are
+// assembled into the single document a non-streaming request would get.
+func (l *cacheLookup) save(body []byte, stream bool) {
+	if !l.store {
+		return
+	}
+	if stream {
+		body = assembleStream(body)
+	}
+	var fields map[string]json.RawMessage
+	if body == nil || json.Unmarshal(body, &fields) != nil || fields["error"] != nil {
+		return
+	}
+	var compact bytes.Buffer
+	if json.Compact(&compact, body) != nil {
+		return
+	}
+	l.cache.Put(l.key, compact.Bytes())
+}
+
+// assembleStream joins the NDJSON chunks of a streamed generation into one
+// response: the final chunk, holding the statistics, with the full text.
+// It returns nil if the stream did not finish.
+func assembleStream(body []byte) []byte {
+	var text strings.Builder
+	var last map[string]json.RawMessage
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, len(body)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var chunk map[string]json.RawMessage
+		if err := json.Unmarshal(line, &chunk); err != nil || chunk["error"] != nil {
+			return nil
+		}
+		var piece string
+		json.Unmarshal(chunk["response"], &piece)
+		text.WriteString(piece)
+		last = chunk
+	}
+
+	var done bool
+	if last == nil || json.Unmarshal(last["done"], &done) != nil || !done {
+		return nil
+	}
+	last["response"], _ = json.Marshal(text.String())
+	response, err := json.Marshal(last)
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// writeCachedResponse sends a cached response. Streaming requests get it
+// replayed as NDJSON chunks of about one word each, ending with a chunk
+// that holds the statistics like Ollama's own.
+func writeCachedResponse(w http.ResponseWriter, r *http.Request, response []byte, stream bool) {
+	if !stream {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+		return
+	}
+
+	var final map[string]json.RawMessage
+	if err := json.Unmarshal(response, &final); err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	var text string
+	json.Unmarshal(final["response"], &text)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	for _, piece := range strings.SplitAfter(text, " ") {
+		if piece == "" {
+			continue
+		}
+		encoder.Encode(map[string]interface{}{
+			"model":      final["model"],
+			"created_at": final["created_at"],
+			"response":   piece,
+			"done":       false,
+		})
+	}
+	final["response"] = json.RawMessage(`""`)
+	encoder.Encode(final)
+}
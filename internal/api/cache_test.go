@@ -0,0 +1,102 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/erock530/go-ollama-api/internal/cache"
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/gorilla/mux"
+)
+
+func TestResponseCache(t *testing.T) {
+	var upstream atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.Add(1)
+		var req models.GenerateRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Stream {
+			w.Write([]byte(`{"model":"test-model","response":"Hello ","done":false}` + "\n"))
+			w.Write([]byte(`{"model":"test-model","response":"world","done":false}` + "\n"))
+			w.Write([]byte(`{"model":"test-model","response":"","done":true,"eval_count":2}` + "\n"))
+			return
+		}
+		w.Write([]byte(`{"model":"test-model","response":"Hello world","done":true,"eval_count":2}`))
+	}))
+	defer mockServer.Close()
+
+	mockDB := NewMockDB()
+	mockDB.apiKeys["key-a"] = &models.APIKey{Key: "key-a", Active: true, RateLimit: 100}
+	mockDB.apiKeys["limited"] = &models.APIKey{Key: "limited", Active: true, RateLimit: 1}
+	mockDB.apiKeys["opted-out"] = &models.APIKey{Key: "opted-out", Active: true, RateLimit: 100, ResponseCache: "off"}
+
+	router := mux.NewRouter()
+	cfg := &config.Config{Port: 8080, OllamaURL: mockServer.URL}
+	SetupRoutes(router, mockDB, cfg, WithCache(cache.New(nil, cache.Config{}, nil)))
+
+	send := func(key, prompt string, stream bool, options string, headers ...string) *httptest.ResponseRecorder {
+		body := `{"apikey":"` + key + `","model":"test-model","prompt":"` + prompt + `","stream":` + strconv.FormatBool(stream)
+		if options != "" {
+			body += `,"options":` + options
+		}
+		req := httptest.NewRequest("POST", "/generate", bytes.NewBufferString(body+"}"))
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	expect := func(name string, rr *httptest.ResponseRecorder, xCache string, calls int32) {
+		t.Helper()
+		if rr.Code != http.StatusOK || rr.Header().Get("X-Cache") != xCache || upstream.Load() != calls {
+			t.Errorf("%s: status %d, X-Cache %q, %d upstream calls; want 200, %q, %d",
+				name, rr.Code, rr.Header().Get("X-Cache"), upstream.Load(), xCache, calls)
+		}
+	}
+
+	// The limited key may make one request a minute, but hits are free
+	expect("miss", send("limited", "hi", false, `{"temperature":0}`), "MISS", 1)
+	for i := 0; i < 3; i++ {
+		rr := send("limited", "hi", false, `{"temperature":0}`)
+		expect("hit", rr, "HIT", 1)
+		if rr.Body.String() != `{"model":"test-model","response":"Hello world","done":true,"eval_count":2}` {
+			t.Errorf("hit body = %s", rr.Body.String())
+		}
+	}
+
+	// A streaming request is answered with the cached response in chunks
+	rr := send("key-a", "hi", true, `{"temperature":0}`)
+	expect("streamed hit", rr, "HIT", 1)
+	var text strings.Builder
+	var last map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(rr.Body.String()), "\n") {
+		last = nil
+		if err := json.Unmarshal([]byte(line), &last); err != nil {
+			t.Fatalf("chunk is not JSON: %s", line)
+		}
+		text.WriteString(last["response"].(string))
+	}
+	if text.String() != "Hello world" || last["done"] != true || last["eval_count"] != float64(2) {
+		t.Errorf("unexpected replay:\n%s", rr.Body.String())
+	}
+
+	// A streamed miss is assembled and can be served without streaming
+	expect("streamed miss", send("key-a", "other", true, `{"seed":7}`), "MISS", 2)
+	rr = send("key-a", "other", false, `{"seed":7}`)
+	expect("assembled hit", rr, "HIT", 2)
+	if !strings.Contains(rr.Body.String(), `"response":"Hello world"`) || !strings.Contains(rr.Body.String(), `"eval_count":2`) {
+		t.Errorf("assembled hit body = %s", rr.Body.String())
+	}
+
+	expect("no-cache", send("key-a", "hi", false, `{"temperature":0}`, "Cache-Control", "no-cache"), "BYPASS", 3)
+	expect("random sampling", send("key-a", "hi", false, `{"temperature":0.7}`), "", 4)
+	expect("opted out", send("opted-out", "hi", false, `{"temperature":0}`), "", 5)
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/gorilla/mux"
+)
+
+func TestClientCertAuth(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"response":"ok","done":true}`))
+	}))
+	defer mockServer.Close()
+
+	mockDB := NewMockDB()
+	for _, key := range []string{"key-cert", "key-header"} {
+		mockDB.apiKeys[key] = &models.APIKey{Key: key, Active: true, RateLimit: 100}
+	}
+	mockDB.certIdentities = map[string]string{"dns:app.example.org": "key-cert"}
+	router := mux.NewRouter()
+	SetupRoutes(router, mockDB, &config.Config{Port: 8080, OllamaURL: mockServer.URL})
+
+	// send makes a request over a connection that presented cert, if any
+	send := func(cert *x509.Certificate, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/generate", bytes.NewBufferString(`{"model":"llama3","prompt":"hi"}`))
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+				VerifiedChains:   [][]*x509.Certificate{{cert}},
+			}
+		}
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	expect := func(rr *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		var e models.ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &e)
+		if rr.Code != status || e.Code != code {
+			t.Fatalf("status %d, body %s; want %d %q", rr.Code, rr.Body.String(), status, code)
+		}
+	}
+
+	mapped := &x509.Certificate{Subject: pkix.Name{CommonName: "app"}, DNSNames: []string{"app.example.org"}}
+	unmapped := &x509.Certificate{Subject: pkix.Name{CommonName: "other"}}
+
+	expect(send(mapped, ""), http.StatusOK, "")
+	if mockDB.usage["key-cert"] != 1 {
+		t.Errorf("usage of the mapped key = %d, want 1", mockDB.usage["key-cert"])
+	}
+	expect(send(unmapped, ""), http.StatusForbidden, "invalid_api_key")
+	expect(send(nil, ""), http.StatusBadRequest, "missing_api_key")
+
+	// An API key sent with the request takes precedence over the certificate
+	expect(send(mapped, "key-header"), http.StatusOK, "")
+	if mockDB.usage["key-header"] != 1 || mockDB.usage["key-cert"] != 1 {
+		t.Errorf("usage = %v, want one request for each key", mockDB.usage)
+	}
+
+	// Certificates that were not verified are ignored
+	req := httptest.NewRequest("POST", "/generate", bytes.NewBufferString(`{"model":"llama3","prompt":"hi"}`))
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{mapped}}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	expect(rr, http.StatusBadRequest, "missing_api_key")
+}
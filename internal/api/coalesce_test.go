@@ -0,0 +1,119 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/metrics"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/gorilla/mux"
+)
+
+func TestCoalescing(t *testing.T) {
+	// A fake Ollama that counts calls and holds them until released
+	var calls atomic.Int32
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		var req models.GenerateRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		<-release
+		json.NewEncoder(w).Encode(map[string]interface{}{"model": req.Model, "response": fmt.Sprintf("call %d", n), "done": true, "prompt_eval_count": 3, "eval_count": 4})
+	}))
+	defer mockServer.Close()
+
+	mockDB := NewMockDB()
+	keys := []string{"key-a", "key-b", "key-c", "key-d"}
+	for _, key := range keys {
+		mockDB.apiKeys[key] = &models.APIKey{Key: key, Active: true, RateLimit: 100}
+	}
+
+	setup := func(routes ...string) (*mux.Router, *metrics.Registry) {
+		router := mux.NewRouter()
+		registry := metrics.NewRegistry()
+		cfg := &config.Config{Port: 8080, OllamaURL: mockServer.URL, CoalesceRoutes: routes}
+		SetupRoutes(router, mockDB, cfg, WithMetrics(registry))
+		return router, registry
+	}
+	send := func(router *mux.Router, key string, stream bool) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"apikey":%q,"model":"test-model","prompt":"hi","stream":%v}`, key, stream)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/generate", bytes.NewBufferString(body)))
+		return rr
+	}
+	// fanOut sends a request for each key at once and releases the fake
+	// Ollama once ready reports that all of them have arrived
+	fanOut := func(router *mux.Router, stream bool, ready func() bool) []*httptest.ResponseRecorder {
+		results := make([]*httptest.ResponseRecorder, len(keys))
+		var wg sync.WaitGroup
+		for i, key := range keys {
+			wg.Add(1)
+			go func(i int, key string) {
+				defer wg.Done()
+				results[i] = send(router, key, stream)
+			}(i, key)
+		}
+		for deadline := time.Now().Add(5 * time.Second); !ready() && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+		wg.Wait()
+		release = make(chan struct{})
+		return results
+	}
+
+	router, registry := setup("/generate")
+	results := fanOut(router, false, func() bool {
+		var out strings.Builder
+		registry.Write(&out)
+		return strings.Contains(out.String(), fmt.Sprintf(`ollama_api_coalesced_requests_total{route="/generate"} %d`, len(keys)-1))
+	})
+	if calls.Load() != 1 {
+		t.Errorf("%d upstream calls for identical requests, want 1", calls.Load())
+	}
+	coalesced := 0
+	for i, rr := range results {
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"response":"call 1"`) {
+			t.Errorf("%s: %d %s", keys[i], rr.Code, rr.Body.String())
+		}
+		if rr.Header().Get("X-Coalesced") == "true" {
+			coalesced++
+		}
+	}
+	if coalesced != len(keys)-1 {
+		t.Errorf("%d responses marked as coalesced, want %d", coalesced, len(keys)-1)
+	}
+	// Every key pays for the tokens of the response it got
+	for _, key := range keys {
+		if mockDB.usage[key] != 1 {
+			t.Errorf("usage of %s = %d, want 1", key, mockDB.usage[key])
+		}
+		if mockDB.keyTokens[key] != 7 {
+			t.Errorf("tokens of %s = %d, want 7", key, mockDB.keyTokens[key])
+		}
+	}
+
+	// Streaming requests are never coalesced
+	calls.Store(0)
+	fanOut(router, true, func() bool { return calls.Load() == int32(len(keys)) })
+	if calls.Load() != int32(len(keys)) {
+		t.Errorf("%d upstream calls for streaming requests, want %d", calls.Load(), len(keys))
+	}
+
+	// Nor are requests to routes that are not configured for it
+	calls.Store(0)
+	router, _ = setup()
+	fanOut(router, false, func() bool { return calls.Load() == int32(len(keys)) })
+	if calls.Load() != int32(len(keys)) {
+		t.Errorf("%d upstream calls without coalescing, want %d", calls.Load(), len(keys))
+	}
+}
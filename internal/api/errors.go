@@ -0,0 +1,214 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+)
+
+// Error codes. They are part of the API and must not change.
+const (
+	codeMissingAPIKey       = "missing_api_key"
+	codeInvalidAPIKey       = "invalid_api_key"
+	codeInvalidToken        = "invalid_token"
+	codeAPIKeyDeactivated   = "api_key_deactivated"
+	codeIPDenied            = "ip_denied"
+	codeIPNotAllowed        = "ip_not_allowed"
+	codeInvalidRequest      = "invalid_request"
+	codeBodyTooLarge        = "body_too_large"
+	codePromptTooLong       = "prompt_too_long"
+	codeTooManyImages       = "too_many_images"
+	codeInvalidImage        = "invalid_image"
+	codeImageTooLarge       = "image_too_large"
+	codeUnsupportedImage    = "unsupported_image_format"
+	codeNotFound            = "not_found"
+	codeMethodNotAllowed    = "method_not_allowed"
+	codeConflict            = "conflict"
+	codeRateLimited         = "rate_limited"
+	codeOrgRateLimited      = "org_rate_limited"
+	codeOrgQuotaExceeded    = "org_quota_exceeded"
+	codeTokenQuotaExceeded  = "token_quota_exceeded"
+	codeConcurrencyLimited  = "concurrency_limited"
+	codeServerBusy          = "server_busy"
+	codeInternal            = "internal_error"
+	codeModelNotFound       = "model_not_found"
+	codeModelNotAllowed     = "model_not_allowed"
+	codeInsufficientScope   = "insufficient_scope"
+	codeUpstreamUnavailable = "upstream_unavailable"
+	codeUpstreamTimeout     = "upstream_timeout"
+	codeCircuitOpen         = "upstream_circuit_open"
+	codeUpstreamBusy        = "upstream_busy"
+	codeUpstreamError       = "upstream_error"
+	codeSchemaMismatch      = "schema_mismatch"
+)
+
+// Retry hints for errors that usually pass quickly but have no exact time
+const (
+	concurrencyRetryAfter = time.Second
+	busyRetryAfter        = 5 * time.Second
+)
+
+// requestIDHeader carries the request ID to and from clients
+const requestIDHeader = "X-Request-ID"
+
+// requestIDMiddleware gives every request an ID, taken from the client's
+// X-Request-ID header if it sent a usable one, and returns it in the
+// response header
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	})
+}
+
+// validRequestID accepts IDs of up to 128 printable ASCII characters
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDFromContext returns the ID of the request, if it has one
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// writeError sends an error response with a code and message
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeErrorResponse(w, r, status, models.ErrorResponse{Code: code, Error: message})
+}
+
+// writeErrorResponse sends an error response, adding the request ID and
+// a Retry-After header when the error has a retry hint
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, status int, e models.ErrorResponse) {
+	e.RequestID = requestIDFromContext(r.Context())
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// retryAfterSeconds rounds a retry hint up to whole seconds
+func retryAfterSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// writeInsufficientScope answers a request the API key lacks the scope for
+func writeInsufficientScope(w http.ResponseWriter, r *http.Request, scope string) {
+	writeErrorResponse(w, r, http.StatusForbidden, models.ErrorResponse{
+		Error:         fmt.Sprintf("API key lacks the %s scope", scope),
+		Code:          codeInsufficientScope,
+		RequiredScope: scope,
+	})
+}
+
+// writeModelNotAllowed rejects a request for a model the key may not use
+func writeModelNotAllowed(w http.ResponseWriter, r *http.Request, model string) {
+	writeErrorResponse(w, r, http.StatusForbidden, models.ErrorResponse{
+		Error: fmt.Sprintf("API key may not use the model %q", model),
+		Code:  codeModelNotAllowed,
+		Field: "model",
+	})
+}
+
+// notFoundHandler answers requests for unknown routes
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, codeNotFound, "No such endpoint")
+}
+
+// methodNotAllowedHandler answers requests with a method a route does not support
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+}
+
+// upstreamError maps an error response from Ollama into the status and
+// body the gateway answers with
+func upstreamError(resp *http.Response) (int, models.ErrorResponse) {
+	var upstream struct {
+		Error string `json:"error"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(body, &upstream) != nil || upstream.Error == "" {
+		upstream.Error = strings.TrimSpace(string(body))
+	}
+	if upstream.Error == "" {
+		upstream.Error = http.StatusText(resp.StatusCode)
+	}
+
+	e := models.ErrorResponse{Error: upstream.Error}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		// Ollama answers 404 when the model has not been pulled
+		e.Code = codeModelNotFound
+		return http.StatusNotFound, e
+	case http.StatusBadRequest:
+		e.Code = codeInvalidRequest
+		return http.StatusBadRequest, e
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		// Ollama is at its own request limit
+		e.Code = codeUpstreamBusy
+		e.RetryAfter = retryAfterSeconds(busyRetryAfter)
+		return http.StatusServiceUnavailable, e
+	}
+	e.Code = codeUpstreamError
+	return http.StatusBadGateway, e
+}
+
+// writeUpstreamFailure answers a request whose call to Ollama failed.
+// Nothing is written if the client went away.
+func writeUpstreamFailure(w http.ResponseWriter, r *http.Request, client *ollama.Client, err error) {
+	switch {
+	case r.Context().Err() != nil:
+		return
+	case errors.Is(err, ollama.ErrCircuitOpen):
+		retryAfter := busyRetryAfter
+		if wait := time.Until(client.Status().RetryAt); wait > 0 {
+			retryAfter = wait
+		}
+		writeErrorResponse(w, r, http.StatusServiceUnavailable, models.ErrorResponse{
+			Error:      "Ollama is failing, requests are paused",
+			Code:       codeCircuitOpen,
+			RetryAfter: retryAfterSeconds(retryAfter),
+		})
+	case errors.Is(err, ollama.ErrTimeout):
+		writeError(w, r, http.StatusGatewayTimeout, codeUpstreamTimeout, "Ollama did not respond in time")
+	default:
+		writeErrorResponse(w, r, http.StatusBadGateway, models.ErrorResponse{
+			Error:      "Ollama is unavailable",
+			Code:       codeUpstreamUnavailable,
+			RetryAfter: retryAfterSeconds(busyRetryAfter),
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+	"github.com/gorilla/mux"
+)
+
+func TestErrorResponses(t *testing.T) {
+	// A fake Ollama that fails the way the model name asks it to
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req models.GenerateRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Model {
+		case "missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"model \"missing\" not found, try pulling it first"}`))
+		case "busy":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":"server busy, please try again"}`))
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("llama runner process has terminated"))
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"response": "ok", "done": true})
+		}
+	}))
+	defer mockServer.Close()
+
+	mockDB := NewMockDB()
+	mockDB.apiKeys["key-a"] = &models.APIKey{Key: "key-a", Active: true, RateLimit: 1}
+	mockDB.apiKeys["key-off"] = &models.APIKey{Key: "key-off", RateLimit: 100}
+	mockDB.apiKeys["key-b"] = &models.APIKey{Key: "key-b", Active: true, RateLimit: 100}
+	router := mux.NewRouter()
+	SetupRoutes(router, mockDB, &config.Config{Port: 8080, OllamaURL: mockServer.URL, RateLimitAlgorithm: "fixed"})
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		status     int
+		code       string
+		retryAfter bool
+	}{
+		{"missing key", "POST", "/generate", `{"model":"m"}`, http.StatusBadRequest, "missing_api_key", false},
+		{"unknown key", "POST", "/generate", `{"apikey":"nope","model":"m"}`, http.StatusForbidden, "invalid_api_key", false},
+		{"deactivated key", "POST", "/generate", `{"apikey":"key-off","model":"m"}`, http.StatusForbidden, "api_key_deactivated", false},
+		{"invalid body", "POST", "/generate?apikey=key-b", `not json`, http.StatusBadRequest, "invalid_request", false},
+		{"first request", "POST", "/generate", `{"apikey":"key-a","model":"m"}`, http.StatusOK, "", false},
+		{"rate limited", "POST", "/generate", `{"apikey":"key-a","model":"m"}`, http.StatusTooManyRequests, "rate_limited", true},
+		{"model not found", "POST", "/generate", `{"apikey":"key-b","model":"missing"}`, http.StatusNotFound, "model_not_found", false},
+		{"upstream busy", "POST", "/generate", `{"apikey":"key-b","model":"busy"}`, http.StatusServiceUnavailable, "upstream_busy", true},
+		{"upstream error", "POST", "/generate", `{"apikey":"key-b","model":"broken"}`, http.StatusBadGateway, "upstream_error", false},
+		{"unknown route", "GET", "/nowhere", "", http.StatusNotFound, "not_found", false},
+		{"wrong method", "GET", "/generate", "", http.StatusMethodNotAllowed, "method_not_allowed", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("X-Request-ID", "req-"+strings.ReplaceAll(tt.name, " ", "-"))
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rr.Code, tt.status, rr.Body.String())
+			}
+			if rr.Header().Get("X-Request-ID") != req.Header.Get("X-Request-ID") {
+				t.Errorf("X-Request-ID = %q", rr.Header().Get("X-Request-ID"))
+			}
+			if tt.code == "" {
+				return
+			}
+			var e models.ErrorResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &e); err != nil {
+				t.Fatalf("body is not JSON: %s", rr.Body.String())
+			}
+			if e.Code != tt.code || e.Error == "" || e.RequestID != req.Header.Get("X-Request-ID") {
+				t.Errorf("body %s, want code %s", rr.Body.String(), tt.code)
+			}
+			if (e.RetryAfter > 0) != tt.retryAfter || (rr.Header().Get("Retry-After") != "") != tt.retryAfter {
+				t.Errorf("retry_after %d, Retry-After %q", e.RetryAfter, rr.Header().Get("Retry-After"))
+			}
+		})
+	}
+
+	// Upstream messages are kept, and requests without a usable ID get one
+	req := httptest.NewRequest("POST", "/generate", strings.NewReader(`{"apikey":"key-b","model":"missing"}`))
+	req.Header.Set("X-Request-ID", "bad id\n")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var e models.ErrorResponse
+	json.Unmarshal(rr.Body.Bytes(), &e)
+	if !strings.Contains(e.Error, "try pulling it first") || len(e.RequestID) != 24 || rr.Header().Get("X-Request-ID") != e.RequestID {
+		t.Errorf("body %s, X-Request-ID %q", rr.Body.String(), rr.Header().Get("X-Request-ID"))
+	}
+}
+
+func TestUpstreamFailures(t *testing.T) {
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer mockServer.Close()
+	defer close(release)
+
+	mockDB := NewMockDB()
+	mockDB.apiKeys["key-a"] = &models.APIKey{Key: "key-a", Active: true, RateLimit: 100}
+	client := ollama.NewClient(mockServer.URL, ollama.Config{
+		HeaderTimeout:    50 * time.Millisecond,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Hour,
+	}, nil)
+	router := mux.NewRouter()
+	SetupRoutes(router, mockDB, &config.Config{Port: 8080, OllamaURL: mockServer.URL}, WithOllama(client))
+
+	send := func() (*httptest.ResponseRecorder, models.ErrorResponse) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/generate", strings.NewReader(`{"apikey":"key-a","model":"m"}`)))
+		var e models.ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &e)
+		return rr, e
+	}
+
+	// A hung Ollama times out, which opens the breaker
+	if rr, e := send(); rr.Code != http.StatusGatewayTimeout || e.Code != "upstream_timeout" {
+		t.Errorf("hung: status %d, body %s", rr.Code, rr.Body.String())
+	}
+	if rr, e := send(); rr.Code != http.StatusServiceUnavailable || e.Code != "upstream_circuit_open" || e.RetryAfter < 3590 {
+		t.Errorf("open: status %d, body %s", rr.Code, rr.Body.String())
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/health?apikey=key-a", nil))
+	var health struct {
+		Data models.HealthStatus `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &health)
+	if upstream := health.Data.Upstream; upstream.Breaker != "open" || upstream.ConsecutiveFailures != 1 || upstream.RetryAt == nil {
+		t.Errorf("health: %s", rr.Body.String())
+	}
+}
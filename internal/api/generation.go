@@ -0,0 +1,466 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/erock530/go-ollama-api/internal/cache"
+	"github.com/erock530/go-ollama-api/internal/coalesce"
+	"github.com/erock530/go-ollama-api/internal/concurrency"
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+	"github.com/erock530/go-ollama-api/internal/quota"
+	"github.com/erock530/go-ollama-api/internal/scheduler"
+	"github.com/erock530/go-ollama-api/internal/schema"
+)
+
+// generationRoute is a gateway route that proxies generations to Ollama
+type generationRoute struct {
+	// name is the gateway route, such as /generate
+	name string
+	// path is the Ollama endpoint it calls
+	path string
+	// scope is the scope a key needs to call it
+	scope string
+	// decode parses a client request
+	decode func(body io.Reader) (generationRequest, error)
+}
+
+// generationRequest is a decoded request to a generation route
+type generationRequest interface {
+	// fields returns the gateway's own settings of the request
+	fields() generationFields
+	// body returns the request to send to Ollama, without the gateway's fields
+	body() ([]byte, error)
+	// input returns the content checked against the input limits
+	input() generationInput
+	// answer returns the text of a non-streaming Ollama response
+	answer(response []byte) (string, error)
+	// repair asks the model to answer again, fixing the problems found in
+	// its previous answer
+	repair(answer, problems string)
+}
+
+// generationFields are the parts of a generation request the gateway acts on
+type generationFields struct {
+	key           string
+	model         string
+	stream        bool
+	format        json.RawMessage
+	schemaRetries int
+}
+
+var (
+	generateRoute = generationRoute{name: "/generate", path: ollama.GeneratePath, scope: models.ScopeGenerate, decode: decodeGenerate}
+	chatRoute     = generationRoute{name: "/chat", path: ollama.ChatPath, scope: models.ScopeChat, decode: decodeChat}
+
+	// jobRoutes are the routes whose requests each type of job runs
+	jobRoutes = map[string]generationRoute{"generate": generateRoute, "chat": chatRoute}
+)
+
+// generateRequest is a request to /generate
+type generateRequest struct {
+	models.GenerateRequest
+}
+
+func decodeGenerate(body io.Reader) (generationRequest, error) {
+	var req generateRequest
+	err := json.NewDecoder(body).Decode(&req.GenerateRequest)
+	return &req, err
+}
+
+func (req *generateRequest) fields() generationFields {
+	return generationFields{key: req.APIKey, model: req.Model, stream: req.Stream, format: req.Format, schemaRetries: req.SchemaRetries}
+}
+
+func (req *generateRequest) body() ([]byte, error) {
+	upstream := req.GenerateRequest
+	upstream.APIKey = ""
+	upstream.SchemaRetries = 0
+	return json.Marshal(upstream)
+}
+
+func (req *generateRequest) input() generationInput {
+	return generationInput{
+		field:  "prompt",
+		text:   []string{req.System, req.Prompt, req.Suffix},
+		images: req.Images,
+	}
+}
+
+func (req *generateRequest) answer(response []byte) (string, error) {
+	var resp struct {
+		Response *string `json:"response"`
+	}
+	if err := json.Unmarshal(response, &resp); err != nil || resp.Response == nil {
+		return "", errors.New("response has no text")
+	}
+	return *resp.Response, nil
+}
+
+func (req *generateRequest) repair(answer, problems string) {
+	req.Prompt += "\n\n" + repairPrompt(answer, problems)
+}
+
+// chatRequest is a request to /chat
+type chatRequest struct {
+	models.ChatRequest
+}
+
+func decodeChat(body io.Reader) (generationRequest, error) {
+	var req chatRequest
+	err := json.NewDecoder(body).Decode(&req.ChatRequest)
+	return &req, err
+}
+
+func (req *chatRequest) fields() generationFields {
+	return generationFields{key: req.APIKey, model: req.Model, stream: req.Stream, format: req.Format, schemaRetries: req.SchemaRetries}
+}
+
+func (req *chatRequest) body() ([]byte, error) {
+	upstream := req.ChatRequest
+	upstream.APIKey = ""
+	upstream.SchemaRetries = 0
+	return json.Marshal(upstream)
+}
+
+func (req *chatRequest) input() generationInput {
+	in := generationInput{field: "messages"}
+	for _, message := range req.Messages {
+		in.text = append(in.text, message.Content)
+		in.images = append(in.images, message.Images...)
+	}
+	return in
+}
+
+func (req *chatRequest) answer(response []byte) (string, error) {
+	var resp struct {
+		Message *models.ChatMessage `json:"message"`
+	}
+	if err := json.Unmarshal(response, &resp); err != nil || resp.Message == nil {
+		return "", errors.New("response has no message")
+	}
+	return resp.Message.Content, nil
+}
+
+func (req *chatRequest) repair(answer, problems string) {
+	req.Messages = append(req.Messages,
+		models.ChatMessage{Role: "assistant", Content: answer},
+		models.ChatMessage{Role: "user", Content: repairPrompt(answer, problems)},
+	)
+}
+
+// repairPrompt asks the model to fix an answer that did not match the schema
+func repairPrompt(answer, problems string) string {
+	return "Your previous answer was:\n" + answer +
+		"\n\nIt does not match the required JSON schema:\n" + problems +
+		"\nAnswer again with only JSON that matches the schema."
+}
+
+// responseSchema returns the schema a request's response must match, or nil
+// if the request does not ask for one. Only complete responses can be
+// checked, so streaming requests are not validated.
+func responseSchema(fields generationFields) (*schema.Schema, error) {
+	if fields.stream || len(fields.format) == 0 || fields.format[0] != '{' {
+		return nil, nil
+	}
+	return schema.Compile(fields.format)
+}
+
+// schemaFailure is the details of a schema_mismatch error, answered to a
+// request whose responses never matched its schema
+type schemaFailure struct {
+	Attempts         int            `json:"attempts"`
+	ValidationErrors []schema.Error `json:"validation_errors"`
+	Response         string         `json:"response"`
+}
+
+// generationHandler handles a route that proxies generations to Ollama.
+// With group set, identical non-streaming requests in flight at the same
+// time share one upstream call.
+func generationHandler(route generationRoute, db db.DBInterface, cfg *config.Config, client *ollama.Client, inFlight *concurrency.Limiter, queue *scheduler.Scheduler, group *coalesce.Group) http.HandlerFunc {
+	inputs := newInputLimits(cfg)
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := route.decode(r.Body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request body")
+			return
+		}
+		if status, e := inputs.check(req.input()); e != nil {
+			writeErrorResponse(w, r, status, *e)
+			return
+		}
+		fields := req.fields()
+
+		apiKey := apiKeyFromContext(r.Context())
+		if apiKey == nil {
+			apiKey = &models.APIKey{Key: fields.key}
+		}
+		// Keys sent in a header are not in the body
+		fields.key = apiKey.Key
+		if !apiKey.AllowsModel(fields.model) {
+			writeModelNotAllowed(w, r, fields.model)
+			return
+		}
+
+		// Cache hits use no generation slot and are not logged as usage
+		lookup := cacheLookupFromContext(r.Context())
+		if lookup != nil {
+			w.Header().Set("X-Cache", lookup.status)
+			if lookup.response != nil {
+				writeCachedResponse(w, r, lookup.response, fields.stream)
+				return
+			}
+		}
+
+		e, err := checkTokenQuota(db, apiKey)
+		if err != nil {
+			log.Printf("Error checking token quota: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+		if e != nil {
+			writeErrorResponse(w, r, http.StatusTooManyRequests, *e)
+			return
+		}
+
+		validator, err := responseSchema(fields)
+		if err != nil {
+			writeErrorResponse(w, r, http.StatusBadRequest, models.ErrorResponse{Error: err.Error(), Code: codeInvalidRequest, Field: "format"})
+			return
+		}
+		retries := fields.schemaRetries
+		if retries < 0 || validator == nil {
+			retries = 0
+		}
+		if retries > cfg.SchemaMaxRetries {
+			retries = cfg.SchemaMaxRetries
+		}
+
+		// Create request to Ollama API, keeping the options within the key's limits
+		limits := ollama.LimitsFor(apiKey)
+		upstreamBody := func() ([]byte, []string, error) {
+			body, err := req.body()
+			if err != nil {
+				return nil, nil, err
+			}
+			return limits.Apply(route.path, body)
+		}
+		ollamaBody, clamped, err := upstreamBody()
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if len(clamped) > 0 {
+			w.Header().Set("X-Options-Clamped", strings.Join(clamped, ", "))
+		}
+
+		// Wait for an identical request already in flight, or lead a new call
+		leading := false
+		var shared *coalesce.Response
+		if group != nil && !fields.stream {
+			if key, err := cache.Key(route.path, ollamaBody); err == nil {
+				key += "\n" + strconv.Itoa(retries)
+				call, leader := group.Join(route.name, key)
+				if leader {
+					leading = true
+					defer func() { group.Finish(route.name, key, call, shared) }()
+				} else {
+					response, err := call.Wait(r.Context())
+					if err == nil {
+						writeSharedResponse(w, r, db, apiKey, response)
+						return
+					}
+					if !errors.Is(err, coalesce.ErrAbandoned) {
+						// The client went away while waiting
+						return
+					}
+					// The leader gave up, so make the call ourselves
+				}
+			}
+		}
+
+		// Hold a generation slot until the response has been fully streamed
+		release, err := inFlight.Acquire(r.Context(), fields.key, apiKey.MaxConcurrent, cfg.ConcurrencyWait)
+		if errors.Is(err, concurrency.ErrKeyLimit) || errors.Is(err, concurrency.ErrGlobalLimit) {
+			writeErrorResponse(w, r, http.StatusTooManyRequests, models.ErrorResponse{
+				Error:      "Too many concurrent requests. Try again later.",
+				Code:       codeConcurrencyLimited,
+				RetryAfter: retryAfterSeconds(concurrencyRetryAfter),
+			})
+			return
+		}
+		if err != nil {
+			// The client went away while waiting
+			return
+		}
+		defer release()
+
+		// Wait for our turn at the backend
+		ticket, err := queue.Acquire(r.Context(), scheduler.Request{
+			Key:      fields.key,
+			Priority: scheduler.Priority(apiKey.Priority),
+			Weight:   apiKey.QueueWeight,
+			Queued: func(position int) {
+				w.Header().Set("X-Queue-Position", strconv.Itoa(position))
+				// Clients that ask for it are told their place in line now
+				// rather than once they are dispatched. Many HTTP clients
+				// take an unexpected 1xx for the final response, so it is
+				// never sent unasked.
+				if r.ProtoAtLeast(1, 1) && strings.EqualFold(r.Header.Get("X-Queue-Notify"), "processing") {
+					w.WriteHeader(http.StatusProcessing)
+				}
+			},
+		})
+		if errors.Is(err, scheduler.ErrQueueFull) || errors.Is(err, scheduler.ErrQueueTimeout) {
+			writeErrorResponse(w, r, http.StatusServiceUnavailable, models.ErrorResponse{
+				Error:      "Server is busy. Try again later.",
+				Code:       codeServerBusy,
+				RetryAfter: retryAfterSeconds(busyRetryAfter),
+			})
+			return
+		}
+		if err != nil {
+			return
+		}
+		defer ticket.Release()
+
+		for attempt := 1; ; attempt++ {
+			ollamaResp, err := client.Post(r.Context(), route.path, ollamaBody)
+			if err != nil {
+				log.Printf("Error making request to Ollama API: %v", err)
+				writeUpstreamFailure(w, r, client, err)
+				return
+			}
+
+			// Log API usage once per client request, however many repairs
+			// it takes
+			if attempt == 1 {
+				if err := db.LogAPIUsage(fields.key, apiKey.OrgID); err != nil {
+					log.Printf("Error logging API usage: %v", err)
+				}
+			}
+
+			// Errors from Ollama are answered in the gateway's own format
+			if ollamaResp.StatusCode != http.StatusOK {
+				status, e := upstreamError(ollamaResp)
+				ollamaResp.Body.Close()
+				writeErrorResponse(w, r, status, e)
+				if leading {
+					body, _ := json.Marshal(e)
+					shared = &coalesce.Response{StatusCode: status, Body: body}
+				}
+				return
+			}
+
+			// Forward Ollama response
+			w.Header().Set("Content-Type", "application/json")
+			if validator == nil {
+				defer ollamaResp.Body.Close()
+				if !leading && lookup == nil {
+					var tail ollama.TokenTail
+					io.Copy(w, io.TeeReader(ollamaResp.Body, &tail))
+					quota.Charge(db, apiKey, tail.UsedTokens())
+					return
+				}
+				var captured bytes.Buffer
+				_, err := io.Copy(w, io.TeeReader(ollamaResp.Body, &captured))
+				quota.Charge(db, apiKey, ollama.UsedTokens(captured.Bytes()))
+				if err != nil {
+					return
+				}
+				if leading {
+					shared = &coalesce.Response{StatusCode: http.StatusOK, Body: captured.Bytes()}
+				}
+				if lookup != nil {
+					lookup.save(captured.Bytes(), fields.stream)
+				}
+				return
+			}
+
+			// Check the answer against the schema before sending it on
+			response, err := io.ReadAll(ollamaResp.Body)
+			ollamaResp.Body.Close()
+			if err != nil {
+				return
+			}
+			quota.Charge(db, apiKey, ollama.UsedTokens(response))
+			answer, err := req.answer(response)
+			var problems []schema.Error
+			if err != nil {
+				problems = []schema.Error{{Path: "$", Message: err.Error()}}
+			} else {
+				problems = validator.Validate([]byte(answer))
+			}
+			w.Header().Set("X-Schema-Attempts", strconv.Itoa(attempt))
+
+			if problems != nil && attempt <= retries {
+				var list strings.Builder
+				for _, problem := range problems {
+					list.WriteString("- " + problem.String() + "\n")
+				}
+				req.repair(answer, list.String())
+				if ollamaBody, _, err = upstreamBody(); err != nil {
+					writeError(w, r, http.StatusInternalServerError, codeInternal, "Error preparing request")
+					return
+				}
+				continue
+			}
+			if problems != nil {
+				e := models.ErrorResponse{
+					Error: "response does not match the schema",
+					Code:  codeSchemaMismatch,
+					Details: schemaFailure{
+						Attempts:         attempt,
+						ValidationErrors: problems,
+						Response:         answer,
+					},
+				}
+				writeErrorResponse(w, r, http.StatusUnprocessableEntity, e)
+				if leading {
+					body, _ := json.Marshal(e)
+					shared = &coalesce.Response{StatusCode: http.StatusUnprocessableEntity, Body: body}
+				}
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			w.Write(response)
+			if leading {
+				shared = &coalesce.Response{StatusCode: http.StatusOK, Body: response}
+			}
+			if lookup != nil {
+				lookup.save(response, false)
+			}
+			return
+		}
+	}
+}
+
+// writeSharedResponse answers a coalesced request with the response of the
+// call it joined. The usage is logged and the tokens charged against its own
+// key, and errors carry its own request ID.
+func writeSharedResponse(w http.ResponseWriter, r *http.Request, db db.DBInterface, apiKey *models.APIKey, response *coalesce.Response) {
+	if err := db.LogAPIUsage(apiKey.Key, apiKey.OrgID); err != nil {
+		log.Printf("Error logging API usage: %v", err)
+	}
+	w.Header().Set("X-Coalesced", "true")
+	if response.StatusCode != http.StatusOK {
+		var e models.ErrorResponse
+		json.Unmarshal(response.Body, &e)
+		writeErrorResponse(w, r, response.StatusCode, e)
+		return
+	}
+	quota.Charge(db, apiKey, ollama.UsedTokens(response.Body))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.StatusCode)
+	w.Write(response.Body)
+}
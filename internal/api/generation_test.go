@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/gorilla/mux"
+)
+
+func TestSchemaValidation(t *testing.T) {
+	// A fake Ollama that answers with broken JSON until it is asked to
+	// repair its answer
+	var requests []map[string]interface{}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+
+		answer := `{"name": "Ada", "age": "unknown"}`
+		if body, _ := json.Marshal(req); strings.Contains(string(body), "Answer again with only JSON") {
+			answer = `{"name": "Ada", "age": 36}`
+		}
+		if r.URL.Path == "/api/chat" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"message": map[string]string{"role": "assistant", "content": answer}, "done": true})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"response": answer, "done": true})
+	}))
+	defer mockServer.Close()
+
+	mockDB := NewMockDB()
+	mockDB.apiKeys["key-a"] = &models.APIKey{Key: "key-a", Active: true, RateLimit: 100}
+	router := mux.NewRouter()
+	SetupRoutes(router, mockDB, &config.Config{Port: 8080, OllamaURL: mockServer.URL, SchemaMaxRetries: 2})
+
+	format := `{"type":"object","properties":{"name":{"type":"string"},"age":{"type":"integer"}},"required":["name","age"]}`
+	send := func(path, body string) *httptest.ResponseRecorder {
+		requests = nil
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return rr
+	}
+
+	// Without retries the invalid answer is reported
+	rr := send("/generate", `{"apikey":"key-a","model":"m","prompt":"Who?","format":`+format+`}`)
+	var e struct {
+		Code    string        `json:"code"`
+		Details schemaFailure `json:"details"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &e)
+	failure := e.Details
+	if rr.Code != http.StatusUnprocessableEntity || e.Code != "schema_mismatch" || failure.Attempts != 1 || len(failure.ValidationErrors) != 1 ||
+		failure.ValidationErrors[0].Path != "$.age" || failure.Response != `{"name": "Ada", "age": "unknown"}` {
+		t.Errorf("status %d, body %s", rr.Code, rr.Body.String())
+	}
+	if _, ok := requests[0]["schema_retries"]; ok || requests[0]["format"] == nil {
+		t.Errorf("Ollama received %v", requests[0])
+	}
+
+	// With a retry the model is asked to repair its answer, and the
+	// request is still logged once
+	usage := mockDB.usage["key-a"]
+	rr = send("/generate", `{"apikey":"key-a","model":"m","prompt":"Who?","schema_retries":1,"format":`+format+`}`)
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Schema-Attempts") != "2" || !strings.Contains(rr.Body.String(), `\"age\": 36`) {
+		t.Errorf("status %d, attempts %s, body %s", rr.Code, rr.Header().Get("X-Schema-Attempts"), rr.Body.String())
+	}
+	if logged := mockDB.usage["key-a"] - usage; logged != 1 {
+		t.Errorf("repaired request logged %d times, want 1", logged)
+	}
+	if prompt := requests[1]["prompt"].(string); !strings.HasPrefix(prompt, "Who?\n\n") || !strings.Contains(prompt, "$.age: expected integer, got string") {
+		t.Errorf("repair prompt = %q", prompt)
+	}
+
+	// Chat repairs continue the conversation
+	rr = send("/chat", `{"apikey":"key-a","model":"m","messages":[{"role":"user","content":"Who?"}],"schema_retries":5,"format":`+format+`}`)
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Schema-Attempts") != "2" {
+		t.Errorf("chat: status %d, body %s", rr.Code, rr.Body.String())
+	}
+	if messages := requests[1]["messages"].([]interface{}); len(messages) != 3 ||
+		messages[1].(map[string]interface{})["role"] != "assistant" || messages[2].(map[string]interface{})["role"] != "user" {
+		t.Errorf("repair messages = %v", messages)
+	}
+
+	// JSON mode responses are passed on unchecked
+	if rr = send("/generate", `{"apikey":"key-a","model":"m","prompt":"Who?","format":"json"}`); rr.Code != http.StatusOK {
+		t.Errorf("JSON mode: status %d", rr.Code)
+	}
+	if rr = send("/generate", `{"apikey":"key-a","model":"m","prompt":"Who?","format":{"pattern":"("}}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid schema: status %d, want 400", rr.Code)
+	}
+}
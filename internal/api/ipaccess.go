@@ -0,0 +1,98 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"net/netip"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/ipfilter"
+	"github.com/erock530/go-ollama-api/internal/metrics"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/webhook"
+)
+
+// Reasons a request is rejected for its address, used as the metric label
+// and in webhook events
+const (
+	ipReasonDenied     = "denied"
+	ipReasonNotAllowed = "not_allowed"
+)
+
+// ipRejectedEvent is the webhook event sent for rejected requests
+const ipRejectedEvent = "ip_rejected"
+
+// WithWebhooks sets the notifier that sends events to the registered
+// webhooks, such as refused requests with cfg.IPRejectionWebhooks
+func WithWebhooks(n *webhook.Notifier) Option {
+	return func(o *options) {
+		o.webhooks = n
+	}
+}
+
+// ipAccess checks the address of each client against the global deny list
+// and the allowlist of its API key
+type ipAccess struct {
+	resolver *ipfilter.Resolver
+	deny     ipfilter.List
+	rejected *metrics.Counter
+	// webhooks is nil unless rejections are sent to the webhooks
+	webhooks *webhook.Notifier
+}
+
+// newIPAccess reads the trusted proxies and deny list of cfg. Invalid
+// entries are logged and left out; the server checks them at startup.
+func newIPAccess(cfg *config.Config, registry *metrics.Registry, webhooks *webhook.Notifier) *ipAccess {
+	trusted, err := ipfilter.ParseList(cfg.TrustedProxies)
+	if err != nil {
+		log.Printf("Ignoring trusted proxy: %v", err)
+	}
+	deny, err := ipfilter.ParseList(cfg.DenyCIDRs)
+	if err != nil {
+		log.Printf("Ignoring deny list entry: %v", err)
+	}
+	a := &ipAccess{
+		resolver: ipfilter.NewResolver(trusted),
+		deny:     deny,
+		rejected: registry.NewCounter("ollama_api_ip_rejections_total",
+			"Requests rejected for the client address, by reason", "reason"),
+	}
+	if cfg.IPRejectionWebhooks {
+		a.webhooks = webhooks
+	}
+	return a
+}
+
+// denied reports whether the client of r is on the deny list, and returns
+// its address
+func (a *ipAccess) denied(r *http.Request) (netip.Addr, bool) {
+	addr := a.resolver.ClientIP(r)
+	return addr, addr.IsValid() && a.deny.Contains(addr)
+}
+
+// allowed reports whether apiKey may be used from addr. A key without an
+// allowlist may be used from anywhere; one whose list has no valid entries
+// from nowhere.
+func (a *ipAccess) allowed(addr netip.Addr, apiKey *models.APIKey) bool {
+	if len(apiKey.AllowedCIDRs) == 0 {
+		return true
+	}
+	allowed, _ := ipfilter.ParseList(apiKey.AllowedCIDRs)
+	return addr.IsValid() && allowed.Contains(addr)
+}
+
+// reject answers a request refused for its address, and logs, counts and
+// reports it. key is empty if the request was refused before its key was
+// looked up.
+func (a *ipAccess) reject(w http.ResponseWriter, r *http.Request, addr netip.Addr, reason, key string) {
+	log.Printf("Rejected request to %s from %s: %s", r.URL.Path, addr, reason)
+	a.rejected.Inc(reason)
+	if a.webhooks != nil {
+		a.webhooks.Notify(webhook.Event{Event: ipRejectedEvent, APIKey: key, IP: addr.String(), Reason: reason})
+	}
+	if reason == ipReasonDenied {
+		writeError(w, r, http.StatusForbidden, codeIPDenied, "Requests from this address are not allowed")
+		return
+	}
+	writeError(w, r, http.StatusForbidden, codeIPNotAllowed, "API key may not be used from this address")
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/metrics"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/webhook"
+	"github.com/gorilla/mux"
+)
+
+func TestIPAccess(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"response":"ok","done":true}`))
+	}))
+	defer mockServer.Close()
+	events := make(chan webhook.Event, 10)
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhook.Event
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer hookServer.Close()
+
+	database, err := db.OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if err := database.AddWebhook(hookServer.URL); err != nil {
+		t.Fatal(err)
+	}
+	keys := []*models.APIKey{
+		{Key: "key-any", Active: true, RateLimit: 100},
+		{Key: "key-office", Active: true, RateLimit: 100, AllowedCIDRs: []string{"198.51.100.0/24"}},
+	}
+	for _, key := range keys {
+		if err := database.CreateAPIKey(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	registry := metrics.NewRegistry()
+	router := mux.NewRouter()
+	cfg := &config.Config{
+		Port:                8080,
+		OllamaURL:           mockServer.URL,
+		TrustedProxies:      []string{"10.0.0.0/8"},
+		DenyCIDRs:           []string{"203.0.113.0/24"},
+		IPRejectionWebhooks: true,
+	}
+	notifier := webhook.NewNotifier(database, webhook.Config{})
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go notifier.Run(ctx)
+	SetupRoutes(router, database, cfg, WithMetrics(registry), WithWebhooks(notifier))
+
+	// Requests come from a proxy at 10.0.0.1 on behalf of client
+	send := func(path, key, client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, bytes.NewBufferString(`{"model":"llama3","prompt":"hi"}`))
+		req.RemoteAddr = "10.0.0.1:40000"
+		req.Header.Set("X-Forwarded-For", client)
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	expect := func(rr *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		var e models.ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &e)
+		if rr.Code != status || e.Code != code {
+			t.Fatalf("status %d, body %s; want %d %q", rr.Code, rr.Body.String(), status, code)
+		}
+	}
+	expectEvent := func(reason, ip, key string) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.Event != "ip_rejected" || event.Reason != reason || event.IP != ip || event.APIKey != key || event.Timestamp.IsZero() {
+				t.Errorf("webhook event %+v; want %s from %s with %q", event, reason, ip, key)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no webhook event for %s from %s", reason, ip)
+		}
+	}
+
+	expect(send("/generate", "key-any", "192.0.2.1"), http.StatusOK, "")
+	expect(send("/generate", "key-office", "198.51.100.7"), http.StatusOK, "")
+
+	// The allowlist is checked against the client behind the proxy, not
+	// the proxy itself
+	expect(send("/generate", "key-office", "192.0.2.1"), http.StatusForbidden, "ip_not_allowed")
+	expectEvent("not_allowed", "192.0.2.1", "key-office")
+
+	// Denied clients are refused whatever their key, even a missing one,
+	// but not on the probes
+	expect(send("/generate", "key-any", "203.0.113.5"), http.StatusForbidden, "ip_denied")
+	expectEvent("denied", "203.0.113.5", "")
+	expect(send("/generate", "", "203.0.113.5"), http.StatusForbidden, "ip_denied")
+	req := httptest.NewRequest("GET", "/livez", nil)
+	req.RemoteAddr = "203.0.113.5:40000"
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("/livez from a denied address: status %d", rr.Code)
+	}
+
+	// The repeated rejection was counted but not sent again
+	select {
+	case event := <-events:
+		t.Errorf("unexpected webhook event %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+	rr = httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`ollama_api_ip_rejections_total{reason="denied"} 2`,
+		`ollama_api_ip_rejections_total{reason="not_allowed"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), line) {
+			t.Errorf("metrics do not contain %s", line)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/jobs"
+	"github.com/erock530/go-ollama-api/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// submitJobHandler queues a generate or chat request and returns at once
+func submitJobHandler(pool *jobs.Pool, cfg *config.Config) http.HandlerFunc {
+	inputs := newInputLimits(cfg)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rejectTokenKey(w, r, "Jobs") {
+			return
+		}
+		var req struct {
+			APIKey      string          `json:"apikey"`
+			Type        string          `json:"type"`
+			Request     json.RawMessage `json:"request"`
+			CallbackURL string          `json:"callback_url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request body")
+			return
+		}
+		if req.Type == "" {
+			req.Type = "generate"
+		}
+		// Jobs are held to the same input limits; other problems with the
+		// request are reported by Submit
+		apiKey := apiKeyFromContext(r.Context())
+		if route, ok := jobRoutes[req.Type]; ok {
+			if !apiKey.HasScope(route.scope) {
+				writeInsufficientScope(w, r, route.scope)
+				return
+			}
+			if generation, err := route.decode(bytes.NewReader(req.Request)); err == nil {
+				if status, e := inputs.check(generation.input()); e != nil {
+					writeErrorResponse(w, r, status, *e)
+					return
+				}
+				if model := generation.fields().model; !apiKey.AllowsModel(model) {
+					writeModelNotAllowed(w, r, model)
+					return
+				}
+			}
+		}
+
+		job, err := pool.Submit(apiKey.Key, req.Type, req.Request, req.CallbackURL)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		writeJob(w, http.StatusAccepted, job)
+	}
+}
+
+// getJobHandler returns the status and, once finished, the result of a job
+func getJobHandler(pool *jobs.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job := ownJob(w, r, pool)
+		if job == nil {
+			return
+		}
+		writeJob(w, http.StatusOK, job)
+	}
+}
+
+// cancelJobHandler cancels a queued or running job
+func cancelJobHandler(pool *jobs.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job := ownJob(w, r, pool)
+		if job == nil {
+			return
+		}
+
+		err := pool.Cancel(job.ID)
+		if errors.Is(err, db.ErrNotFound) {
+			writeError(w, r, http.StatusConflict, codeConflict, "Job has already finished")
+			return
+		}
+		if err != nil {
+			log.Printf("Error cancelling job: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+
+		job, err = pool.Get(job.ID)
+		if err != nil {
+			log.Printf("Error reading job: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+		writeJob(w, http.StatusOK, job)
+	}
+}
+
+// ownJob loads the job named in the URL. Jobs of other keys are reported as
+// missing so that job IDs cannot be probed. On failure the error response
+// has been written and nil is returned.
+func ownJob(w http.ResponseWriter, r *http.Request, pool *jobs.Pool) *models.Job {
+	job, err := pool.Get(mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Error reading job: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return nil
+	}
+	if job == nil || job.Key != apiKeyFromContext(r.Context()).Key {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Job not found")
+		return nil
+	}
+	return job
+}
+
+// writeJob sends a job as JSON
+func writeJob(w http.ResponseWriter, status int, job *models.Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(job)
+}
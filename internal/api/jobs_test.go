@@ -0,0 +1,104 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/concurrency"
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/jobs"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+	"github.com/erock530/go-ollama-api/internal/scheduler"
+	"github.com/gorilla/mux"
+)
+
+func TestJobsAPI(t *testing.T) {
+	mockServer := mockOllamaServer()
+	defer mockServer.Close()
+
+	database, err := db.OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	for _, key := range []string{"owner-key", "other-key"} {
+		if err := database.CreateAPIKey(&models.APIKey{Key: key, Active: true, RateLimit: 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := ollama.NewClient(mockServer.URL, ollama.Config{}, nil)
+	pool := jobs.NewPool(database, client, concurrency.NewLimiter(0), scheduler.New(scheduler.Config{}, nil), jobs.Config{PollInterval: 10 * time.Millisecond})
+	ctx, stop := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		stop()
+		<-stopped
+	}()
+
+	router := mux.NewRouter()
+	cfg := &config.Config{Port: 8080, OllamaURL: mockServer.URL}
+	SetupRoutes(router, database, cfg, WithOllama(client), WithJobs(pool))
+
+	send := func(method, path, key string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send("POST", "/jobs", "", []byte(`{"apikey": "owner-key", "type": "generate", "request": {"model": "test-model", "prompt": "hi"}}`))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("submit: got status %d: %s", rr.Code, rr.Body.String())
+	}
+	var job models.Job
+	if err := json.NewDecoder(rr.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	if job.ID == "" || job.Status != models.JobQueued || rr.Header().Get("Location") != "/jobs/"+job.ID {
+		t.Errorf("unexpected submit response: %+v, Location %q", job, rr.Header().Get("Location"))
+	}
+
+	// Poll with the key in the query string until the job is done
+	deadline := time.Now().Add(5 * time.Second)
+	for !job.Status.Finished() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		rr = send("GET", "/jobs/"+job.ID+"?apikey=owner-key", "", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("get: got status %d: %s", rr.Code, rr.Body.String())
+		}
+		job = models.Job{}
+		json.NewDecoder(rr.Body).Decode(&job)
+	}
+	if job.Status != models.JobSucceeded || !bytes.Contains(job.Result, []byte("mocked response")) {
+		t.Errorf("unexpected finished job: %+v", job)
+	}
+
+	if rr := send("GET", "/jobs/"+job.ID, "other-key", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("get with another key: got status %d, want 404", rr.Code)
+	}
+	if rr := send("GET", "/jobs/"+job.ID, "", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("get without a key: got status %d, want 400", rr.Code)
+	}
+	if rr := send("DELETE", "/jobs/"+job.ID, "owner-key", nil); rr.Code != http.StatusConflict {
+		t.Errorf("cancel finished job: got status %d, want 409", rr.Code)
+	}
+	if rr := send("POST", "/jobs", "owner-key", []byte(`{"type": "generate", "request": {"prompt": "hi"}}`)); rr.Code != http.StatusBadRequest {
+		t.Errorf("submit without a model: got status %d, want 400", rr.Code)
+	}
+}
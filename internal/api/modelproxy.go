@@ -0,0 +1,294 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+)
+
+const (
+	// maxManageBody bounds the body of a model management request
+	maxManageBody = 1 << 20
+	// maxProgressLine bounds a line of streamed pull or create progress
+	maxProgressLine = 1 << 20
+)
+
+// backendResponse is the response of one backend to a fanned out request.
+// The body of resp has been read into body.
+type backendResponse struct {
+	client *ollama.Client
+	resp   *http.Response
+	body   []byte
+	err    error
+}
+
+// upstreamError maps the error response of the backend, which may be
+// read more than once
+func (b backendResponse) upstreamError() (int, models.ErrorResponse) {
+	b.resp.Body = io.NopCloser(bytes.NewReader(b.body))
+	return upstreamError(b.resp)
+}
+
+// fanOut sends a request to every backend at once and reads the responses
+func fanOut(ctx context.Context, backends []*ollama.Client, method, path string, body []byte) []backendResponse {
+	responses := make([]backendResponse, len(backends))
+	var wg sync.WaitGroup
+	for i, client := range backends {
+		wg.Add(1)
+		go func(i int, client *ollama.Client) {
+			defer wg.Done()
+			result := backendResponse{client: client}
+			result.resp, result.err = client.Do(ctx, method, path, body)
+			if result.err == nil {
+				result.body, result.err = io.ReadAll(result.resp.Body)
+				result.resp.Body.Close()
+			}
+			responses[i] = result
+		}(i, client)
+	}
+	wg.Wait()
+	return responses
+}
+
+// writeBackendFailure answers a request that no backend served with the
+// failure of one of them
+func writeBackendFailure(w http.ResponseWriter, r *http.Request, failed backendResponse) {
+	if failed.err != nil {
+		writeUpstreamFailure(w, r, failed.client, failed.err)
+		return
+	}
+	status, e := failed.upstreamError()
+	writeErrorResponse(w, r, status, e)
+}
+
+// listModelsHandler serves /api/tags and /api/ps. The models of all backends
+// are listed together, leaving out those the key may not use. With
+// distinct set, a model on several backends is listed once.
+func listModelsHandler(path string, backends []*ollama.Client, distinct bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey := apiKeyFromContext(r.Context())
+		list := []json.RawMessage{}
+		seen := make(map[string]bool)
+		failures := 0
+		var firstFailure *backendResponse
+		responses := fanOut(r.Context(), backends, http.MethodGet, path, nil)
+		for i, response := range responses {
+			if response.err != nil || response.resp.StatusCode != http.StatusOK {
+				failures++
+				if firstFailure == nil {
+					firstFailure = &responses[i]
+				}
+				continue
+			}
+			var body struct {
+				Models []json.RawMessage `json:"models"`
+			}
+			json.Unmarshal(response.body, &body)
+			for _, model := range body.Models {
+				var names struct {
+					Name  string `json:"name"`
+					Model string `json:"model"`
+				}
+				json.Unmarshal(model, &names)
+				if names.Name == "" {
+					names.Name = names.Model
+				}
+				if !apiKey.AllowsModel(names.Name) || (distinct && seen[names.Name]) {
+					continue
+				}
+				seen[names.Name] = true
+				list = append(list, model)
+			}
+		}
+
+		if failures == len(backends) {
+			writeBackendFailure(w, r, *firstFailure)
+			return
+		}
+		if failures > 0 {
+			w.Header().Set("X-Backends-Failed", strconv.Itoa(failures))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"models": list})
+	}
+}
+
+// modelName reads the model a model management request is about. Ollama
+// accepts it as model or, in older clients, name.
+func modelName(body []byte) string {
+	var req struct {
+		Model string `json:"model"`
+		Name  string `json:"name"`
+	}
+	json.Unmarshal(body, &req)
+	if req.Model != "" {
+		return req.Model
+	}
+	return req.Name
+}
+
+// showModelHandler serves /api/show from the first backend that has the model
+func showModelHandler(backends []*ollama.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || !json.Valid(body) {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request body")
+			return
+		}
+		if model := modelName(body); !apiKeyFromContext(r.Context()).AllowsModel(model) {
+			writeModelNotAllowed(w, r, model)
+			return
+		}
+
+		var failed *backendResponse
+		for _, client := range backends {
+			response := backendResponse{client: client}
+			response.resp, response.err = client.Post(r.Context(), ollama.ShowPath, body)
+			if response.err == nil {
+				response.body, response.err = io.ReadAll(response.resp.Body)
+				response.resp.Body.Close()
+			}
+			if response.err == nil && response.resp.StatusCode == http.StatusOK {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(response.body)
+				return
+			}
+			// A backend without the model does not hide a failing one
+			if failed == nil || failed.err == nil && failed.resp.StatusCode == http.StatusNotFound {
+				failed = &response
+			}
+		}
+		writeBackendFailure(w, r, *failed)
+	}
+}
+
+// manageModelHandler serves the admin routes that change models, such as
+// /api/pull, on every backend. Pull and create progress is streamed unless
+// the request sets "stream": false.
+func manageModelHandler(method, path string, backends []*ollama.Client, streams bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(w, r, maxManageBody)
+		if errors.Is(err, errBodyTooLarge) {
+			writeBodyTooLarge(w, r, maxManageBody)
+			return
+		}
+		if err != nil || !json.Valid(body) {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request body")
+			return
+		}
+		if streams {
+			var req struct {
+				Stream *bool `json:"stream"`
+			}
+			json.Unmarshal(body, &req)
+			if req.Stream == nil || *req.Stream {
+				streamProgress(w, r, path, backends, body)
+				return
+			}
+		}
+
+		responses := fanOut(r.Context(), backends, method, path, body)
+		var results []models.BackendResult
+		failures := 0
+		for _, response := range responses {
+			result := models.BackendResult{Backend: response.client.URL()}
+			switch {
+			case response.err != nil:
+				result.Error = response.err.Error()
+			case response.resp.StatusCode != http.StatusOK:
+				result.Status = response.resp.StatusCode
+				_, e := response.upstreamError()
+				result.Error = e.Error
+			default:
+				result.Status = http.StatusOK
+			}
+			if result.Error != "" {
+				failures++
+			}
+			results = append(results, result)
+		}
+
+		switch {
+		case failures == 0:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(responses[0].body)
+		case len(backends) == 1:
+			writeBackendFailure(w, r, responses[0])
+		default:
+			writeErrorResponse(w, r, http.StatusBadGateway, models.ErrorResponse{
+				Error:   fmt.Sprintf("%d of %d backends failed", failures, len(backends)),
+				Code:    codeUpstreamError,
+				Details: map[string]interface{}{"backends": results},
+			})
+		}
+	}
+}
+
+// streamProgress streams the progress of a pull or create from every
+// backend as NDJSON. With several backends each line names its backend.
+func streamProgress(w http.ResponseWriter, r *http.Request, path string, backends []*ollama.Client, body []byte) {
+	var mu sync.Mutex
+	flusher, _ := w.(http.Flusher)
+	writeLine := func(client *ollama.Client, line []byte) {
+		if len(backends) > 1 {
+			var fields map[string]json.RawMessage
+			if json.Unmarshal(line, &fields) == nil {
+				fields["backend"], _ = json.Marshal(client.URL())
+				line, _ = json.Marshal(fields)
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write(append(line, '\n'))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	writeFailure := func(client *ollama.Client, message string) {
+		line, _ := json.Marshal(map[string]string{"error": message})
+		writeLine(client, line)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	var wg sync.WaitGroup
+	for _, client := range backends {
+		wg.Add(1)
+		go func(client *ollama.Client) {
+			defer wg.Done()
+			resp, err := client.Post(r.Context(), path, body)
+			if err != nil {
+				writeFailure(client, err.Error())
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				_, e := upstreamError(resp)
+				writeFailure(client, e.Error)
+				return
+			}
+
+			scanner := bufio.NewScanner(resp.Body)
+			scanner.Buffer(make([]byte, 64<<10), maxProgressLine)
+			for scanner.Scan() {
+				if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+					writeLine(client, append([]byte(nil), line...))
+				}
+			}
+			if err := scanner.Err(); err != nil && r.Context().Err() == nil {
+				writeFailure(client, err.Error())
+			}
+		}(client)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+	"github.com/gorilla/mux"
+)
+
+// fakeBackend serves a model list and pull progress like Ollama
+func fakeBackend(t *testing.T, names ...string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			var list []map[string]string
+			for _, name := range names {
+				list = append(list, map[string]string{"name": name, "model": name})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"models": list})
+		case "/api/show":
+			var req struct {
+				Model string `json:"model"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			for _, name := range names {
+				if name == req.Model {
+					w.Write([]byte(`{"modelfile":"FROM ` + name + `"}`))
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"model '` + req.Model + `' not found"}`))
+		case "/api/pull":
+			w.Write([]byte("{\"status\":\"pulling manifest\"}\n{\"status\":\"success\"}\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestModelManagement(t *testing.T) {
+	first := fakeBackend(t, "llama3:latest", "qwen2.5:7b", "mistral:latest")
+	second := fakeBackend(t, "llama3:latest", "qwen2.5:14b")
+
+	mockDB := NewMockDB()
+	mockDB.apiKeys["key-a"] = &models.APIKey{Key: "key-a", Active: true, RateLimit: 100, AllowedModels: []string{"llama3", "qwen2.5:*"}}
+	mockDB.apiKeys["key-admin"] = &models.APIKey{Key: "key-admin", Active: true, RateLimit: 100, Scopes: []string{models.ScopeAdmin}}
+	router := mux.NewRouter()
+	SetupRoutes(router, mockDB, &config.Config{Port: 8080, OllamaURL: first.URL, OllamaBackends: []string{first.URL, second.URL}})
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+
+	// Models are listed once, without those the key may not use
+	rr := send("GET", "/api/tags?apikey=key-a", "")
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &tags)
+	var names []string
+	for _, model := range tags.Models {
+		names = append(names, model.Name)
+	}
+	if got := strings.Join(names, ","); rr.Code != http.StatusOK || got != "llama3:latest,qwen2.5:7b,qwen2.5:14b" {
+		t.Errorf("tags: status %d, models %s", rr.Code, got)
+	}
+
+	// Show is answered by the backend that has the model
+	if rr := send("POST", "/api/show?apikey=key-a", `{"model":"qwen2.5:14b"}`); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "qwen2.5:14b") {
+		t.Errorf("show: status %d, body %s", rr.Code, rr.Body.String())
+	}
+	if rr := send("POST", "/api/show?apikey=key-admin", `{"model":"phi3"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("show of a missing model: status %d", rr.Code)
+	}
+
+	var e models.ErrorResponse
+	rr = send("POST", "/api/show?apikey=key-a", `{"model":"mistral"}`)
+	json.Unmarshal(rr.Body.Bytes(), &e)
+	if rr.Code != http.StatusForbidden || e.Code != "model_not_allowed" || e.Field != "model" {
+		t.Errorf("show of a model not allowed: status %d, body %s", rr.Code, rr.Body.String())
+	}
+	rr = send("POST", "/generate", `{"apikey":"key-a","model":"mistral","prompt":"hi"}`)
+	json.Unmarshal(rr.Body.Bytes(), &e)
+	if rr.Code != http.StatusForbidden || e.Code != "model_not_allowed" {
+		t.Errorf("generate with a model not allowed: status %d, body %s", rr.Code, rr.Body.String())
+	}
+
+	// Changing models takes the models:write scope
+	rr = send("POST", "/api/pull?apikey=key-a", `{"model":"llama3"}`)
+	json.Unmarshal(rr.Body.Bytes(), &e)
+	if rr.Code != http.StatusForbidden || e.Code != "insufficient_scope" || e.RequiredScope != models.ScopeModelsWrite {
+		t.Errorf("pull without models:write: status %d, body %s", rr.Code, rr.Body.String())
+	}
+
+	// Progress from every backend is streamed, naming the backend
+	rr = send("POST", "/api/pull?apikey=key-admin", `{"model":"llama3"}`)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("pull: status %d, body %s", rr.Code, rr.Body.String())
+	}
+	successes := map[string]bool{}
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var line struct {
+			Status  string `json:"status"`
+			Backend string `json:"backend"`
+		}
+		json.Unmarshal(scanner.Bytes(), &line)
+		if line.Status == "success" {
+			successes[line.Backend] = true
+		}
+	}
+	if len(successes) != 2 || !successes[first.URL] || !successes[second.URL] {
+		t.Errorf("pull progress: %s", rr.Body.String())
+	}
+}
+
+func TestSlowPull(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Slower than every upstream timeout before the first byte
+		time.Sleep(150 * time.Millisecond)
+		w.Write([]byte("{\"status\":\"success\"}\n"))
+	}))
+	defer backend.Close()
+
+	mockDB := NewMockDB()
+	mockDB.apiKeys["key-admin"] = &models.APIKey{Key: "key-admin", Active: true, RateLimit: 100, Scopes: []string{models.ScopeAdmin}}
+	router := mux.NewRouter()
+	upstream := ollama.Config{HeaderTimeout: 50 * time.Millisecond, IdleTimeout: 50 * time.Millisecond, Timeout: 50 * time.Millisecond}
+	SetupRoutes(router, mockDB, &config.Config{Port: 8080, OllamaURL: backend.URL, Upstream: upstream})
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/pull?apikey=key-admin", strings.NewReader(`{"model":"llama3","stream":false}`)))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "success") {
+		t.Errorf("slow pull: status %d, body %s", rr.Code, rr.Body.String())
+	}
+}
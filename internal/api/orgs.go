@@ -0,0 +1,299 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ratelimit"
+	"github.com/gorilla/mux"
+)
+
+// WithOrgs enables the /admin/orgs API for managing organizations
+func WithOrgs(store db.OrgStore) Option {
+	return func(o *options) {
+		o.orgs = store
+	}
+}
+
+// checkOrgRateLimit counts a request against the rate limit its key's
+// organization shares with its other keys. It returns the error to answer
+// with if the limit is used up.
+func checkOrgRateLimit(ctx context.Context, limiter ratelimit.Limiter, cfg *config.Config, org *models.Org) (*models.ErrorResponse, error) {
+	if org == nil || org.RateLimit <= 0 {
+		return nil, nil
+	}
+	result, err := limiter.Allow(ctx, org.LimitKey(), ratelimit.Limit{
+		Algorithm: ratelimit.Algorithm(cfg.RateLimitAlgorithm),
+		Requests:  org.RateLimit,
+		Period:    time.Minute,
+	})
+	if err != nil || result.Allowed {
+		return nil, err
+	}
+	return &models.ErrorResponse{
+		Error:      fmt.Sprintf("Organization %s rate limit exceeded. Try again later.", org.ID),
+		Code:       codeOrgRateLimited,
+		RetryAfter: int(math.Ceil(result.RetryAfter.Seconds())),
+		Limit:      int64(org.RateLimit),
+	}, nil
+}
+
+// orgRequest is the body of a request that creates or changes an
+// organization
+type orgRequest struct {
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	RateLimit     int      `json:"rate_limit"`
+	TokenQuota    int64    `json:"token_quota"`
+	AllowedModels []string `json:"allowed_models"`
+}
+
+// decodeOrg reads and checks an organization from a request body,
+// answering the request itself if it is invalid
+func decodeOrg(w http.ResponseWriter, r *http.Request) (*models.Org, bool) {
+	var req orgRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request body")
+		return nil, false
+	}
+	invalid := func(field, message string) (*models.Org, bool) {
+		writeErrorResponse(w, r, http.StatusBadRequest, models.ErrorResponse{Error: message, Code: codeInvalidRequest, Field: field})
+		return nil, false
+	}
+	if req.RateLimit < 0 {
+		return invalid("rate_limit", "rate_limit must not be negative")
+	}
+	if req.TokenQuota < 0 {
+		return invalid("token_quota", "token_quota must not be negative")
+	}
+	for _, model := range req.AllowedModels {
+		if _, err := path.Match(model, ""); err != nil || model == "" || strings.Contains(model, ",") {
+			return invalid("allowed_models", fmt.Sprintf("invalid model pattern %q", model))
+		}
+	}
+	return &models.Org{
+		ID:            req.ID,
+		Name:          req.Name,
+		RateLimit:     req.RateLimit,
+		TokenQuota:    req.TokenQuota,
+		AllowedModels: req.AllowedModels,
+	}, true
+}
+
+// orgStatus adds the key count and today's tokens to an organization
+func orgStatus(store db.OrgStore, org *models.Org) (models.OrgStatus, error) {
+	status := models.OrgStatus{Org: *org}
+	if status.AllowedModels == nil {
+		status.AllowedModels = []string{}
+	}
+	var err error
+	if status.Keys, err = store.CountOrgKeys(org.ID); err != nil {
+		return status, err
+	}
+	status.TokensToday, err = store.GetOrgTokens(org.ID, time.Now())
+	return status, err
+}
+
+// writeOrg sends an organization with its key count and tokens
+func writeOrg(w http.ResponseWriter, r *http.Request, store db.OrgStore, status int, org *models.Org) {
+	body, err := orgStatus(store, org)
+	if err != nil {
+		log.Printf("Error reading organization: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	writeJSON(w, status, body)
+}
+
+// findOrg reads the organization named in the path, answering the request
+// itself if it does not exist
+func findOrg(w http.ResponseWriter, r *http.Request, store db.OrgStore) *models.Org {
+	org, err := store.GetOrg(mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Error reading organization: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return nil
+	}
+	if org == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Organization not found")
+		return nil
+	}
+	return org
+}
+
+// listOrgsHandler lists all organizations
+func listOrgsHandler(store db.OrgStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgs, err := store.ListOrgs()
+		if err != nil {
+			log.Printf("Error listing organizations: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+		list := make([]models.OrgStatus, 0, len(orgs))
+		for i := range orgs {
+			status, err := orgStatus(store, &orgs[i])
+			if err != nil {
+				log.Printf("Error reading organization: %v", err)
+				writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+				return
+			}
+			list = append(list, status)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"orgs": list})
+	}
+}
+
+// createOrgHandler creates an organization
+func createOrgHandler(store db.OrgStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		org, ok := decodeOrg(w, r)
+		if !ok {
+			return
+		}
+		if !models.ValidOrgID(org.ID) {
+			writeErrorResponse(w, r, http.StatusBadRequest, models.ErrorResponse{
+				Error: "id must be 1 to 64 lowercase letters, digits, - or _",
+				Code:  codeInvalidRequest,
+				Field: "id",
+			})
+			return
+		}
+		if existing, err := store.GetOrg(org.ID); err != nil || existing != nil {
+			if err != nil {
+				log.Printf("Error reading organization: %v", err)
+				writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+				return
+			}
+			writeError(w, r, http.StatusConflict, codeConflict, "Organization already exists")
+			return
+		}
+		if err := store.CreateOrg(org); err != nil {
+			log.Printf("Error creating organization: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+		created, err := store.GetOrg(org.ID)
+		if err != nil || created == nil {
+			created = org
+		}
+		w.Header().Set("Location", "/admin/orgs/"+org.ID)
+		writeOrg(w, r, store, http.StatusCreated, created)
+	}
+}
+
+// getOrgHandler returns an organization
+func getOrgHandler(store db.OrgStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if org := findOrg(w, r, store); org != nil {
+			writeOrg(w, r, store, http.StatusOK, org)
+		}
+	}
+}
+
+// updateOrgHandler replaces the settings of an organization
+func updateOrgHandler(store db.OrgStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		existing := findOrg(w, r, store)
+		if existing == nil {
+			return
+		}
+		org, ok := decodeOrg(w, r)
+		if !ok {
+			return
+		}
+		org.ID, org.CreatedAt = existing.ID, existing.CreatedAt
+		if err := store.UpdateOrg(org); err != nil {
+			log.Printf("Error updating organization: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+		writeOrg(w, r, store, http.StatusOK, org)
+	}
+}
+
+// deleteOrgHandler removes an organization that owns no keys
+func deleteOrgHandler(store db.OrgStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := store.DeleteOrg(mux.Vars(r)["id"])
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			writeError(w, r, http.StatusNotFound, codeNotFound, "Organization not found")
+		case errors.Is(err, db.ErrInUse):
+			writeError(w, r, http.StatusConflict, codeConflict, "Organization still owns keys or is the default organization")
+		case err != nil:
+			log.Printf("Error deleting organization: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// addOrgKeyHandler moves an API key into an organization. The key is sent
+// in the body so that it stays out of access logs.
+func addOrgKeyHandler(store db.OrgStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		org := findOrg(w, r, store)
+		if org == nil {
+			return
+		}
+		var req struct {
+			Key string `json:"key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" {
+			writeErrorResponse(w, r, http.StatusBadRequest, models.ErrorResponse{Error: "key is required", Code: codeInvalidRequest, Field: "key"})
+			return
+		}
+		apiKey, err := store.GetAPIKey(req.Key)
+		if err != nil {
+			log.Printf("Error reading API key: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+		if apiKey == nil {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "API key not found")
+			return
+		}
+		apiKey.OrgID = org.ID
+		if err := store.UpdateAPIKey(apiKey); err != nil {
+			log.Printf("Error updating API key: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// orgUsageHandler reports the usage of all the keys of an organization
+func orgUsageHandler(store db.OrgStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		org := findOrg(w, r, store)
+		if org == nil {
+			return
+		}
+		report, ok := usageQuery(w, r)
+		if !ok {
+			return
+		}
+		buckets, err := store.GetOrgUsageReport(org.ID, report.Since, report.Granularity)
+		if err != nil {
+			log.Printf("Error getting usage report: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+		report.Org = org.ID
+		writeUsageReport(w, report, buckets)
+	}
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ratelimit"
+	"github.com/gorilla/mux"
+)
+
+func TestOrgs(t *testing.T) {
+	// Every generation uses 20 tokens
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"response":"ok","done":true,"prompt_eval_count":5,"eval_count":15}`))
+	}))
+	defer mockServer.Close()
+
+	database, err := db.OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	keys := map[string][]string{"admin-key": {models.ScopeAdmin}, "key-a": nil, "key-b": nil}
+	for key, scopes := range keys {
+		if err := database.CreateAPIKey(&models.APIKey{Key: key, Active: true, RateLimit: 100, Scopes: scopes}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := mux.NewRouter()
+	cfg := &config.Config{Port: 8080, OllamaURL: mockServer.URL}
+	SetupRoutes(router, database, cfg, WithLimiter(ratelimit.NewMemoryLimiter()), WithOrgs(database))
+
+	send := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	generate := func(key, model string) *httptest.ResponseRecorder {
+		return send("POST", "/generate", key, `{"model":"`+model+`","prompt":"hi"}`)
+	}
+	expectError := func(rr *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		var e models.ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &e)
+		if rr.Code != status || e.Code != code {
+			t.Fatalf("status %d, body %s; want %d %s", rr.Code, rr.Body.String(), status, code)
+		}
+	}
+
+	// Managing organizations needs the admin scope
+	expectError(send("GET", "/admin/orgs", "key-a", ""), http.StatusForbidden, "insufficient_scope")
+
+	rr := send("POST", "/admin/orgs", "admin-key", `{"id":"acme","name":"Acme","token_quota":30,"allowed_models":["llama3*"]}`)
+	if rr.Code != http.StatusCreated || rr.Header().Get("Location") != "/admin/orgs/acme" {
+		t.Fatalf("create: status %d, body %s", rr.Code, rr.Body.String())
+	}
+	expectError(send("POST", "/admin/orgs", "admin-key", `{"id":"acme"}`), http.StatusConflict, "conflict")
+	expectError(send("POST", "/admin/orgs", "admin-key", `{"id":"Not Valid"}`), http.StatusBadRequest, "invalid_request")
+	expectError(send("POST", "/admin/orgs/missing/keys", "admin-key", `{"key":"key-a"}`), http.StatusNotFound, "not_found")
+	expectError(send("POST", "/admin/orgs/acme/keys", "admin-key", `{"key":"missing"}`), http.StatusNotFound, "not_found")
+	for _, key := range []string{"key-a", "key-b"} {
+		if rr := send("POST", "/admin/orgs/acme/keys", "admin-key", `{"key":"`+key+`"}`); rr.Code != http.StatusNoContent {
+			t.Fatalf("add %s: status %d, body %s", key, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Keys inherit the organization's model policy
+	expectError(generate("key-a", "mistral"), http.StatusForbidden, "model_not_allowed")
+
+	// The token quota is shared: 20 + 20 tokens use up the 30 of the day
+	if rr := generate("key-a", "llama3"); rr.Code != http.StatusOK {
+		t.Fatalf("first generation: status %d, body %s", rr.Code, rr.Body.String())
+	}
+	if rr := generate("key-b", "llama3"); rr.Code != http.StatusOK {
+		t.Fatalf("second generation: status %d, body %s", rr.Code, rr.Body.String())
+	}
+	rr = generate("key-a", "llama3")
+	expectError(rr, http.StatusTooManyRequests, "org_quota_exceeded")
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("quota error has no Retry-After header")
+	}
+	// Keys of other organizations are not affected
+	if rr := generate("admin-key", "mistral"); rr.Code != http.StatusOK {
+		t.Fatalf("default org generation: status %d, body %s", rr.Code, rr.Body.String())
+	}
+
+	var status models.OrgStatus
+	rr = send("GET", "/admin/orgs/acme", "admin-key", "")
+	json.Unmarshal(rr.Body.Bytes(), &status)
+	if rr.Code != http.StatusOK || status.Keys != 2 || status.TokensToday != 40 || status.Name != "Acme" {
+		t.Errorf("get: status %d, body %s", rr.Code, rr.Body.String())
+	}
+
+	// Lifting the quota and setting a pooled rate limit of 2 a minute
+	rr = send("PUT", "/admin/orgs/acme", "admin-key", `{"name":"Acme","rate_limit":2}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("update: status %d, body %s", rr.Code, rr.Body.String())
+	}
+	if rr := generate("key-a", "mistral"); rr.Code != http.StatusOK {
+		t.Fatalf("after update: status %d, body %s", rr.Code, rr.Body.String())
+	}
+	if rr := generate("key-b", "mistral"); rr.Code != http.StatusOK {
+		t.Fatalf("after update: status %d, body %s", rr.Code, rr.Body.String())
+	}
+	expectError(generate("key-a", "mistral"), http.StatusTooManyRequests, "org_rate_limited")
+
+	var list struct {
+		Orgs []models.OrgStatus `json:"orgs"`
+	}
+	rr = send("GET", "/admin/orgs", "admin-key", "")
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	if rr.Code != http.StatusOK || len(list.Orgs) != 2 || list.Orgs[0].ID != "acme" || list.Orgs[1].ID != models.DefaultOrgID {
+		t.Errorf("list: status %d, body %s", rr.Code, rr.Body.String())
+	}
+
+	var report models.UsageReport
+	rr = send("GET", "/admin/orgs/acme/usage?granularity=hourly", "admin-key", "")
+	json.Unmarshal(rr.Body.Bytes(), &report)
+	if rr.Code != http.StatusOK || report.Org != "acme" || report.Total == 0 {
+		t.Errorf("usage: status %d, body %s", rr.Code, rr.Body.String())
+	}
+	for _, bucket := range report.Buckets {
+		if bucket.Org != "acme" {
+			t.Errorf("usage bucket of org %q", bucket.Org)
+		}
+	}
+
+	expectError(send("DELETE", "/admin/orgs/acme", "admin-key", ""), http.StatusConflict, "conflict")
+	expectError(send("DELETE", "/admin/orgs/missing", "admin-key", ""), http.StatusNotFound, "not_found")
+}
+
+func TestOrgRateLimitCheckedFirst(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"response":"ok","done":true}`))
+	}))
+	defer mockServer.Close()
+
+	org := &models.Org{ID: "acme", RateLimit: 1}
+	mockDB := NewMockDB()
+	mockDB.apiKeys["key-a"] = &models.APIKey{Key: "key-a", Active: true, RateLimit: 3, OrgID: org.ID, Org: org}
+	limiter := ratelimit.NewMemoryLimiter()
+	router := mux.NewRouter()
+	SetupRoutes(router, mockDB, &config.Config{Port: 8080, OllamaURL: mockServer.URL, RateLimitAlgorithm: "token_bucket"}, WithLimiter(limiter))
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("POST", "/generate", bytes.NewBufferString(`{"model":"llama3","prompt":"hi"}`))
+		req.Header.Set("X-API-Key", "key-a")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Fatalf("request %d: status %d, body %s; want %d", i+1, rr.Code, rr.Body.String(), want)
+		}
+	}
+
+	// Only the request the organization let through counted against the key
+	result, err := limiter.Allow(context.Background(), "key-a", ratelimit.Limit{Algorithm: ratelimit.TokenBucket, Requests: 3, Period: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Remaining != 1 {
+		t.Errorf("key has %d requests left, want 1", result.Remaining)
+	}
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ratelimit"
+	"github.com/gorilla/mux"
+)
+
+func TestPlans(t *testing.T) {
+	// Every generation uses 20 tokens
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"response":"ok","done":true,"prompt_eval_count":5,"eval_count":15}`))
+	}))
+	defer mockServer.Close()
+
+	database, err := db.OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	plan := &models.Plan{Name: "trial", RateLimit: 2, AllowedModels: []string{"llama3"}}
+	if err := database.CreatePlan(plan); err != nil {
+		t.Fatal(err)
+	}
+	// key-plan takes everything from the plan; key-own overrides the rate
+	// limit and models
+	keys := []*models.APIKey{
+		{Key: "key-plan", Active: true, PlanName: "trial"},
+		{Key: "key-own", Active: true, PlanName: "trial", RateLimit: 100, AllowedModels: []string{"mistral"}},
+	}
+	for _, key := range keys {
+		if err := database.CreateAPIKey(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	limiter := ratelimit.NewMemoryLimiter()
+	router := mux.NewRouter()
+	SetupRoutes(router, database, &config.Config{Port: 8080, OllamaURL: mockServer.URL}, WithLimiter(limiter))
+
+	generate := func(key, model string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/generate", bytes.NewBufferString(`{"model":"`+model+`","prompt":"hi"}`))
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	expect := func(rr *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		var e models.ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &e)
+		if rr.Code != status || e.Code != code {
+			t.Fatalf("status %d, body %s; want %d %q", rr.Code, rr.Body.String(), status, code)
+		}
+	}
+
+	expect(generate("key-plan", "mistral"), http.StatusForbidden, "model_not_allowed")
+	expect(generate("key-own", "llama3"), http.StatusForbidden, "model_not_allowed")
+
+	// The plan allows 2 requests a minute, and the model check above
+	// already used one
+	expect(generate("key-plan", "llama3"), http.StatusOK, "")
+	expect(generate("key-plan", "llama3"), http.StatusTooManyRequests, "rate_limited")
+	for i := 0; i < 3; i++ {
+		expect(generate("key-own", "mistral"), http.StatusOK, "")
+	}
+
+	// Changing the plan changes its keys without a restart
+	plan.RateLimit = 100
+	plan.TokenQuota = 50
+	if err := database.UpdatePlan(plan); err != nil {
+		t.Fatal(err)
+	}
+	limiter.Reset()
+	// 20 tokens were used before; the second of these crosses the quota of
+	// 50, and only then are requests turned away
+	expect(generate("key-plan", "llama3"), http.StatusOK, "")
+	expect(generate("key-plan", "llama3"), http.StatusOK, "")
+	rr := generate("key-plan", "llama3")
+	expect(rr, http.StatusTooManyRequests, "token_quota_exceeded")
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("quota error has no Retry-After header")
+	}
+
+	// key-own has used 60 tokens before the plan had a quota, so it is over
+	// the plan's quota too unless it overrides it
+	expect(generate("key-own", "mistral"), http.StatusTooManyRequests, "token_quota_exceeded")
+	key, err := database.GetAPIKey("key-own")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.TokenQuota = 1000
+	if err := database.UpdateAPIKey(key); err != nil {
+		t.Fatal(err)
+	}
+	expect(generate("key-own", "mistral"), http.StatusOK, "")
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/quota"
+)
+
+// checkTokenQuota returns the error to answer a generation with if its key,
+// or the key's organization, has used up today's tokens
+func checkTokenQuota(db db.DBInterface, apiKey *models.APIKey) (*models.ErrorResponse, error) {
+	now := time.Now()
+	err := quota.Check(db, apiKey, now)
+	var exceeded *quota.ExceededError
+	if !errors.As(err, &exceeded) {
+		return nil, err
+	}
+	e := &models.ErrorResponse{
+		Error:      fmt.Sprintf("API key has used its %d tokens for today", exceeded.Quota),
+		Code:       codeTokenQuotaExceeded,
+		RetryAfter: retryAfterSeconds(exceeded.ResetAt.Sub(now)),
+		Limit:      exceeded.Quota,
+	}
+	if exceeded.Org != "" {
+		e.Error = fmt.Sprintf("Organization %s has used its %d tokens for today", exceeded.Org, exceeded.Quota)
+		e.Code = codeOrgQuotaExceeded
+	}
+	return e, nil
+}
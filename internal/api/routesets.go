@@ -0,0 +1,49 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RouteSets are the sets of routes a listener can serve
+var RouteSets = []string{"all", "api", "admin", "probes"}
+
+// LimitRoutes returns a handler that passes requests for the routes in set
+// on to handler, and answers the others with 404 and not_found as if they
+// did not exist. "api" is every route but /admin, "admin" is /admin and
+// "probes" is the health, metrics and status endpoints, which "admin"
+// serves as well.
+func LimitRoutes(handler http.Handler, set string) (http.Handler, error) {
+	var allowed func(path string) bool
+	switch set {
+	case "all":
+		return handler, nil
+	case "api":
+		allowed = func(path string) bool { return !isAdminPath(path) }
+	case "admin":
+		allowed = func(path string) bool { return isAdminPath(path) || isProbePath(path) }
+	case "probes":
+		allowed = isProbePath
+	default:
+		return nil, fmt.Errorf("unknown route set %q, expected one of %s", set, strings.Join(RouteSets, ", "))
+	}
+	notFound := requestIDMiddleware(http.HandlerFunc(notFoundHandler))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(r.URL.Path) {
+			notFound.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}), nil
+}
+
+// isAdminPath reports whether path is one of the /admin routes
+func isAdminPath(path string) bool {
+	return path == "/admin" || strings.HasPrefix(path, "/admin/")
+}
+
+// isProbePath reports whether path is a health, metrics or status endpoint
+func isProbePath(path string) bool {
+	return probePaths[path] || path == "/status"
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLimitRoutes(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// Whether each path is served on each route set
+	paths := []string{"/livez", "/status", "/generate", "/admin/orgs"}
+	tests := map[string][]bool{
+		"all":    {true, true, true, true},
+		"api":    {true, true, true, false},
+		"admin":  {true, true, false, true},
+		"probes": {true, true, false, false},
+	}
+	for set, served := range tests {
+		handler, err := LimitRoutes(next, set)
+		if err != nil {
+			t.Fatalf("LimitRoutes(%s): %v", set, err)
+		}
+		for i, path := range paths {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+			if served[i] && rr.Code != http.StatusOK {
+				t.Errorf("%s on %s routes: status %d, want 200", path, set, rr.Code)
+			}
+			if !served[i] && (rr.Code != http.StatusNotFound || rr.Header().Get(requestIDHeader) == "") {
+				t.Errorf("%s on %s routes: status %d, request ID %q; want 404", path, set, rr.Code, rr.Header().Get(requestIDHeader))
+			}
+		}
+	}
+
+	if _, err := LimitRoutes(next, "everything"); err == nil {
+		t.Error("LimitRoutes accepted an unknown route set")
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/gorilla/mux"
+)
+
+func TestScopes(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			w.Write([]byte(`{"models":[]}`))
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"response": "ok", "done": true})
+		}
+	}))
+	defer mockServer.Close()
+
+	mockDB := NewMockDB()
+	mockDB.apiKeys["key-default"] = &models.APIKey{Key: "key-default", Active: true, RateLimit: 100}
+	mockDB.apiKeys["key-chat"] = &models.APIKey{Key: "key-chat", Active: true, RateLimit: 100, Scopes: []string{models.ScopeChat}}
+	mockDB.apiKeys["key-read"] = &models.APIKey{Key: "key-read", Active: true, RateLimit: 100, Scopes: models.ScopePresets["readonly"]}
+	mockDB.apiKeys["key-admin"] = &models.APIKey{Key: "key-admin", Active: true, RateLimit: 100, Scopes: []string{models.ScopeAdmin}}
+	router := mux.NewRouter()
+	SetupRoutes(router, mockDB, &config.Config{Port: 8080, OllamaURL: mockServer.URL})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		scope  string
+	}{
+		{"default key generates", "POST", "/generate", `{"apikey":"key-default","model":"m"}`, http.StatusOK, ""},
+		{"default key lists models", "GET", "/api/tags?apikey=key-default", "", http.StatusOK, ""},
+		{"default key cannot pull", "POST", "/api/pull?apikey=key-default", `{"model":"m","stream":false}`, http.StatusForbidden, models.ScopeModelsWrite},
+		{"chat key chats", "POST", "/chat", `{"apikey":"key-chat","model":"m"}`, http.StatusOK, ""},
+		{"chat key cannot generate", "POST", "/generate", `{"apikey":"key-chat","model":"m"}`, http.StatusForbidden, models.ScopeGenerate},
+		{"chat key cannot list models", "GET", "/api/tags?apikey=key-chat", "", http.StatusForbidden, models.ScopeModelsRead},
+		{"chat key cannot read usage", "GET", "/usage?apikey=key-chat", "", http.StatusForbidden, models.ScopeUsageRead},
+		{"read key cannot chat", "POST", "/chat", `{"apikey":"key-read","model":"m"}`, http.StatusForbidden, models.ScopeChat},
+		{"read key reads its usage", "GET", "/usage?apikey=key-read", "", http.StatusOK, ""},
+		{"read key cannot read other usage", "GET", "/usage?apikey=key-read&key=key-default", "", http.StatusForbidden, models.ScopeAdmin},
+		{"admin key has every scope", "POST", "/generate", `{"apikey":"key-admin","model":"m"}`, http.StatusOK, ""},
+		{"invalid granularity", "GET", "/usage?apikey=key-admin&granularity=weekly", "", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if rr.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rr.Code, tt.status, rr.Body.String())
+			}
+			if tt.scope == "" {
+				return
+			}
+			var e models.ErrorResponse
+			json.Unmarshal(rr.Body.Bytes(), &e)
+			if e.Code != "insufficient_scope" || e.RequiredScope != tt.scope || !strings.Contains(e.Error, tt.scope) {
+				t.Errorf("body %s, want required scope %s", rr.Body.String(), tt.scope)
+			}
+		})
+	}
+
+	// Admins may read the usage of any key
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/usage?apikey=key-admin&key=key-default&granularity=hourly", nil))
+	var report models.UsageReport
+	json.Unmarshal(rr.Body.Bytes(), &report)
+	if rr.Code != http.StatusOK || report.Key != "key-default" || report.Granularity != models.UsageHourly || report.Total == 0 {
+		t.Errorf("usage of another key: status %d, body %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestExpandScopes(t *testing.T) {
+	scopes, err := models.ExpandScopes([]string{"inference", "usage:read", "chat"})
+	if err != nil || strings.Join(scopes, ",") != "generate,chat,embed,models:read,usage:read" {
+		t.Errorf("ExpandScopes = %v, %v", scopes, err)
+	}
+	if _, err := models.ExpandScopes([]string{"superuser"}); err == nil {
+		t.Error("unknown scope was accepted")
+	}
+}
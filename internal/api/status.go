@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/concurrency"
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+	"github.com/erock530/go-ollama-api/internal/scheduler"
+)
+
+// checkTimeout bounds each dependency check of the readiness and status
+// endpoints
+const checkTimeout = 2 * time.Second
+
+// probePaths are served without an API key so that orchestrators can call
+// them
+var probePaths = map[string]bool{
+	"/health":  true,
+	"/metrics": true,
+	"/livez":   true,
+	"/readyz":  true,
+}
+
+// WithBuildInfo sets the build reported by the status endpoint
+func WithBuildInfo(info models.BuildInfo) Option {
+	return func(o *options) {
+		o.build = info
+	}
+}
+
+// livezHandler reports that the process is up. It checks nothing else, so
+// a failing dependency never gets the gateway restarted.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler reports whether the gateway can serve requests: the
+// database and at least one Ollama backend must answer
+func readyzHandler(db db.DBInterface, backends []*ollama.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := models.ReadinessReport{Status: "ready", Checks: runChecks(r.Context(), db, backends)}
+		status := http.StatusOK
+		if !ready(report.Checks) {
+			report.Status, status = "not ready", http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	}
+}
+
+// statusHandler reports the build, dependencies, backend and queue of the
+// gateway. The Ollama version and loaded models are those of client, which
+// serves generations.
+func statusHandler(db db.DBInterface, client *ollama.Client, backends []*ollama.Client, inFlight *concurrency.Limiter, queue *scheduler.Scheduler, build models.BuildInfo) http.HandlerFunc {
+	started := time.Now()
+	build.GoVersion = runtime.Version()
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := models.ServerStatus{
+			Status:    "ready",
+			Timestamp: time.Now(),
+			Build:     build,
+			Uptime:    time.Since(started).Round(time.Second).String(),
+			Checks:    runChecks(r.Context(), db, backends),
+			Ollama: models.OllamaStatus{
+				LoadedModels: []models.LoadedModel{},
+				Upstream:     upstreamStatus(client),
+			},
+			Queue:         models.QueueStatus{Depth: queue.Depth(), Running: queue.Running()},
+			TotalInFlight: inFlight.Total(),
+			MaxTotal:      inFlight.Global(),
+		}
+		if !ready(status.Checks) {
+			status.Status = "not ready"
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+		defer cancel()
+		status.Ollama.Version, _ = client.Version(ctx)
+		if loaded, err := client.LoadedModels(ctx); err == nil && loaded != nil {
+			status.Ollama.LoadedModels = loaded
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// runChecks checks the database and every Ollama backend at the same time.
+// The ollama check passes if any backend answers. With more than one
+// backend, each is also reported on its own as ollama: and its URL.
+func runChecks(ctx context.Context, db db.DBInterface, backends []*ollama.Client) map[string]models.CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		"database": db.PingContext,
+	}
+	for _, client := range backends {
+		client := client
+		checks[backendCheckName(client)] = func(ctx context.Context) error {
+			_, err := client.Version(ctx)
+			return err
+		}
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]models.CheckResult, len(checks)+1)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			start := time.Now()
+			err := check(ctx)
+			result := models.CheckResult{Status: "ok", LatencyMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				result.Status, result.Error = "fail", err.Error()
+			}
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	// The fastest backend that answered stands for all of them
+	ollamaResult := models.CheckResult{Status: "fail", Error: "no Ollama backend is reachable"}
+	for _, client := range backends {
+		result := results[backendCheckName(client)]
+		if result.Status == "ok" && (ollamaResult.Status != "ok" || result.LatencyMS < ollamaResult.LatencyMS) {
+			ollamaResult = result
+		}
+	}
+	if len(backends) == 1 {
+		name := backendCheckName(backends[0])
+		ollamaResult = results[name]
+		delete(results, name)
+	}
+	results["ollama"] = ollamaResult
+	return results
+}
+
+// backendCheckName names the check of one Ollama backend
+func backendCheckName(client *ollama.Client) string {
+	return "ollama:" + client.URL()
+}
+
+// ready reports whether the checks allow serving requests: the database
+// and at least one Ollama backend must be up. A backend that is down on its
+// own does not make the gateway unready.
+func ready(checks map[string]models.CheckResult) bool {
+	return checks["database"].Status == "ok" && checks["ollama"].Status == "ok"
+}
+
+// writeJSON sends v as JSON with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
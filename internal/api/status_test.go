@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/gorilla/mux"
+)
+
+func TestProbes(t *testing.T) {
+	ollamaUp := true
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ollamaUp {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/version":
+			w.Write([]byte(`{"version":"0.5.7"}`))
+		case "/api/ps":
+			w.Write([]byte(`{"models":[{"name":"llama3:latest","size":5137025024,"size_vram":5137025024,"expires_at":"2024-06-04T14:38:31Z"}]}`))
+		}
+	}))
+	defer mockServer.Close()
+
+	mockDB := NewMockDB()
+	mockDB.apiKeys["key-a"] = &models.APIKey{Key: "key-a", Active: true, RateLimit: 100}
+	router := mux.NewRouter()
+	SetupRoutes(router, mockDB, &config.Config{Port: 8080, OllamaURL: mockServer.URL},
+		WithBuildInfo(models.BuildInfo{Version: "1.2.3", CommitHash: "abc123"}))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	if rr := get("/livez"); rr.Code != http.StatusOK {
+		t.Errorf("livez: status %d", rr.Code)
+	}
+
+	readiness := func() (int, models.ReadinessReport) {
+		rr := get("/readyz")
+		var report models.ReadinessReport
+		json.Unmarshal(rr.Body.Bytes(), &report)
+		return rr.Code, report
+	}
+	if code, report := readiness(); code != http.StatusOK || report.Status != "ready" ||
+		report.Checks["database"].Status != "ok" || report.Checks["ollama"].Status != "ok" {
+		t.Errorf("readyz: status %d, report %+v", code, report)
+	}
+
+	mockDB.pingErr = errors.New("database is locked")
+	if code, report := readiness(); code != http.StatusServiceUnavailable || report.Status != "not ready" ||
+		report.Checks["database"].Error != "database is locked" || report.Checks["ollama"].Status != "ok" {
+		t.Errorf("readyz with the database down: status %d, report %+v", code, report)
+	}
+	mockDB.pingErr = nil
+
+	ollamaUp = false
+	if code, report := readiness(); code != http.StatusServiceUnavailable || report.Checks["ollama"].Status != "fail" {
+		t.Errorf("readyz with Ollama down: status %d, report %+v", code, report)
+	}
+	var down models.ServerStatus
+	if rr := get("/status?apikey=key-a"); rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &down) != nil || down.Status != "not ready" {
+		t.Errorf("status with Ollama down: %d %s", rr.Code, rr.Body.String())
+	}
+	ollamaUp = true
+
+	// The detailed status needs a key
+	if rr := get("/status"); rr.Code != http.StatusBadRequest {
+		t.Errorf("status without a key: status %d", rr.Code)
+	}
+	rr := get("/status?apikey=key-a")
+	var status models.ServerStatus
+	json.Unmarshal(rr.Body.Bytes(), &status)
+	if rr.Code != http.StatusOK || status.Status != "ready" || status.Build.Version != "1.2.3" || status.Build.GoVersion == "" ||
+		status.Ollama.Version != "0.5.7" || len(status.Ollama.LoadedModels) != 1 || status.Ollama.LoadedModels[0].Name != "llama3:latest" ||
+		status.Ollama.Upstream.Breaker != "closed" {
+		t.Errorf("status: %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestReadinessWithSeveralBackends(t *testing.T) {
+	up := []bool{true, true}
+	servers := make([]*httptest.Server, len(up))
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !up[i] {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(`{"version":"0.5.7"}`))
+		}))
+		defer servers[i].Close()
+	}
+
+	router := mux.NewRouter()
+	SetupRoutes(router, NewMockDB(), &config.Config{Port: 8080, OllamaURL: servers[0].URL, OllamaBackends: []string{servers[0].URL, servers[1].URL}})
+	readiness := func() (int, models.ReadinessReport) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+		var report models.ReadinessReport
+		json.Unmarshal(rr.Body.Bytes(), &report)
+		return rr.Code, report
+	}
+	first, second := "ollama:"+servers[0].URL, "ollama:"+servers[1].URL
+
+	if code, report := readiness(); code != http.StatusOK || report.Checks["ollama"].Status != "ok" ||
+		report.Checks[first].Status != "ok" || report.Checks[second].Status != "ok" {
+		t.Errorf("readyz: status %d, report %+v", code, report)
+	}
+
+	// One backend is enough, even if it does not serve generations
+	up[0] = false
+	if code, report := readiness(); code != http.StatusOK || report.Checks["ollama"].Status != "ok" ||
+		report.Checks[first].Status != "fail" || report.Checks[second].Status != "ok" {
+		t.Errorf("readyz with one backend down: status %d, report %+v", code, report)
+	}
+
+	up[1] = false
+	if code, report := readiness(); code != http.StatusServiceUnavailable || report.Status != "not ready" ||
+		report.Checks["ollama"].Status != "fail" || report.Checks[second].Status != "fail" {
+		t.Errorf("readyz with all backends down: status %d, report %+v", code, report)
+	}
+}
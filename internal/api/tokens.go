@@ -0,0 +1,153 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/jwtauth"
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// tokenKeyPrefix starts the virtual API keys of token subjects, which rate
+// limits and usage are recorded under
+const tokenKeyPrefix = "jwt:"
+
+// WithJWT accepts bearer tokens verified by auth alongside API keys
+func WithJWT(auth *jwtauth.Authenticator) Option {
+	return func(o *options) {
+		o.jwt = auth
+	}
+}
+
+// bearerToken returns the token of an Authorization: Bearer header
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// authenticateToken verifies the bearer token of a request, if it has one
+// and tokens are accepted, and returns the virtual API key it stands for.
+// A rejected token is answered, and false returned.
+func authenticateToken(w http.ResponseWriter, r *http.Request, db db.DBInterface, tokens *jwtauth.Authenticator) (*models.APIKey, bool) {
+	token := bearerToken(r)
+	if tokens == nil || token == "" {
+		return nil, true
+	}
+	identity, err := tokens.Verify(token)
+	if err != nil {
+		writeInvalidToken(w, r, http.StatusUnauthorized, "Invalid token: "+strings.TrimPrefix(err.Error(), jwtauth.ErrInvalidToken.Error()+": "))
+		return nil, false
+	}
+	apiKey, msg, err := tokenAPIKey(db, identity, tokens.Config())
+	if err != nil {
+		log.Printf("Error mapping token of %s: %v", identity.Subject, err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return nil, false
+	}
+	if apiKey == nil {
+		writeInvalidToken(w, r, http.StatusForbidden, msg)
+		return nil, false
+	}
+	return apiKey, true
+}
+
+// tokenAPIKey builds the virtual API key of a token's identity. It has the
+// scopes, plan and organization of the token and is limited like a stored
+// key with them. A token without any scope of the gateway, or whose plan or
+// organization does not exist, is returned as an error message for the
+// client.
+func tokenAPIKey(db db.DBInterface, identity *jwtauth.Identity, cfg jwtauth.Config) (*models.APIKey, string, error) {
+	apiKey := &models.APIKey{
+		Key:          tokenKeyPrefix + identity.Subject,
+		Active:       true,
+		OrgID:        identity.Org,
+		PlanName:     identity.Plan,
+		TokenSubject: identity.Subject,
+	}
+	apiKey.Scopes = tokenScopes(identity.Scopes, cfg)
+	if len(apiKey.Scopes) == 0 {
+		// An empty list would mean the default scopes, which nobody granted
+		return nil, "Token grants no scope of this gateway", nil
+	}
+
+	if apiKey.PlanName == "" {
+		return nil, "Token does not name a plan", nil
+	}
+	plan, err := db.GetPlan(apiKey.PlanName)
+	if err != nil {
+		return nil, "", err
+	}
+	if plan == nil {
+		return nil, fmt.Sprintf("Token plan %q does not exist", apiKey.PlanName), nil
+	}
+	apiKey.Plan = plan
+
+	if apiKey.OrgID == "" {
+		apiKey.OrgID = models.DefaultOrgID
+	}
+	org, err := db.GetOrg(apiKey.OrgID)
+	if err != nil {
+		return nil, "", err
+	}
+	if org == nil {
+		return nil, fmt.Sprintf("Token organization %q does not exist", apiKey.OrgID), nil
+	}
+	apiKey.Org = org
+	return apiKey, "", nil
+}
+
+// tokenScopes returns the scopes of the gateway named in a token's scopes
+// claim. Identity providers add scopes of their own, such as openid, which
+// are left out, as are presets and the admin scope unless cfg allows them.
+func tokenScopes(names []string, cfg jwtauth.Config) []string {
+	var granted []string
+	for _, name := range names {
+		_, preset := models.ScopePresets[name]
+		if preset && !cfg.AllowPresets {
+			continue
+		}
+		scopes, err := models.ExpandScopes([]string{name})
+		if err != nil {
+			continue
+		}
+		if !cfg.AllowAdmin && hasAdmin(scopes) {
+			continue
+		}
+		granted = append(granted, scopes...)
+	}
+	granted, _ = models.ExpandScopes(granted)
+	return granted
+}
+
+// hasAdmin reports whether scopes include the admin scope
+func hasAdmin(scopes []string) bool {
+	for _, scope := range scopes {
+		if scope == models.ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectTokenKey refuses work that is run later for a bearer token, since
+// the virtual key it would run as is not saved. It reports whether it did.
+func rejectTokenKey(w http.ResponseWriter, r *http.Request, what string) bool {
+	if apiKeyFromContext(r.Context()).TokenSubject == "" {
+		return false
+	}
+	writeError(w, r, http.StatusBadRequest, codeInvalidRequest, what+" cannot be submitted with a bearer token, use an API key")
+	return true
+}
+
+// writeInvalidToken rejects a bearer token, with the challenge RFC 6750
+// asks for
+func writeInvalidToken(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	writeError(w, r, status, codeInvalidToken, msg)
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/jwtauth"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/gorilla/mux"
+)
+
+func TestBearerTokens(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"response":"ok","done":true}`))
+	}))
+	defer mockServer.Close()
+
+	// Tokens are signed locally with a key the gateway reads from a file
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(signer.Public())
+	keyFile := filepath.Join(t.TempDir(), "sso.pem")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+	auth, err := jwtauth.New(jwtauth.Config{KeyFile: keyFile, Issuer: "https://sso.example.org", Audience: "gateway"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(claims map[string]interface{}) string {
+		c := map[string]interface{}{"iss": "https://sso.example.org", "aud": "gateway", "sub": "alice", "scope": "openid generate", "plan": "basic", "exp": time.Now().Add(time.Hour).Unix()}
+		for k, v := range claims {
+			c[k] = v
+		}
+		h, _ := json.Marshal(map[string]string{"alg": "ES256", "typ": "JWT"})
+		p, _ := json.Marshal(c)
+		signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(p)
+		digest := sha256.Sum256([]byte(signed))
+		r, s, _ := ecdsa.Sign(rand.Reader, signer, digest[:])
+		return signed + "." + base64.RawURLEncoding.EncodeToString(append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...))
+	}
+
+	mockDB := NewMockDB()
+	mockDB.apiKeys["key-static"] = &models.APIKey{Key: "key-static", Active: true, RateLimit: 100}
+	mockDB.plans = map[string]*models.Plan{"basic": {Name: "basic", RateLimit: 1}}
+	mockDB.orgs = map[string]*models.Org{models.DefaultOrgID: {ID: models.DefaultOrgID}, "research": {ID: "research"}}
+	router := mux.NewRouter()
+	SetupRoutes(router, mockDB, &config.Config{Port: 8080, OllamaURL: mockServer.URL, RateLimitAlgorithm: "fixed"}, WithJWT(auth))
+
+	send := func(token, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/generate", bytes.NewBufferString(`{"model":"llama3","prompt":"hi"}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	expect := func(rr *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		var e models.ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &e)
+		if rr.Code != status || e.Code != code {
+			t.Fatalf("status %d, body %s; want %d %q", rr.Code, rr.Body.String(), status, code)
+		}
+		if code == "invalid_token" && rr.Header().Get("WWW-Authenticate") != `Bearer error="invalid_token"` {
+			t.Errorf("WWW-Authenticate = %q", rr.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// The token's subject is limited by its plan and its usage logged like
+	// a stored key's
+	expect(send(sign(nil), ""), http.StatusOK, "")
+	if mockDB.usage["jwt:alice"] != 1 {
+		t.Errorf("usage = %v, want one request of jwt:alice", mockDB.usage)
+	}
+	expect(send(sign(nil), ""), http.StatusTooManyRequests, "rate_limited")
+	// A different subject has a limit of its own
+	expect(send(sign(map[string]interface{}{"sub": "bob", "org": "research"}), ""), http.StatusOK, "")
+
+	// Scopes come from the token, leaving out those of the identity provider
+	expect(send(sign(map[string]interface{}{"sub": "carol", "scope": "openid chat"}), ""), http.StatusForbidden, "insufficient_scope")
+	// A token without any scope of the gateway does not get the default ones
+	expect(send(sign(map[string]interface{}{"sub": "dave", "scope": "openid profile"}), ""), http.StatusForbidden, "invalid_token")
+	expect(send(sign(map[string]interface{}{"sub": "dave", "scope": nil}), ""), http.StatusForbidden, "invalid_token")
+	// Presets are not taken from tokens unless allowed
+	expect(send(sign(map[string]interface{}{"sub": "erin", "scope": "inference"}), ""), http.StatusForbidden, "invalid_token")
+
+	expect(send(sign(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}), ""), http.StatusUnauthorized, "invalid_token")
+	expect(send(sign(map[string]interface{}{"aud": "other"}), ""), http.StatusUnauthorized, "invalid_token")
+	expect(send("not-a-token", "key-static"), http.StatusUnauthorized, "invalid_token")
+	expect(send(sign(map[string]interface{}{"plan": "gold"}), ""), http.StatusForbidden, "invalid_token")
+	expect(send(sign(map[string]interface{}{"plan": nil}), ""), http.StatusForbidden, "invalid_token")
+	expect(send(sign(map[string]interface{}{"org": "nope"}), ""), http.StatusForbidden, "invalid_token")
+
+	// Static keys keep working alongside tokens
+	expect(send("", "key-static"), http.StatusOK, "")
+}
+
+func TestTokenScopes(t *testing.T) {
+	tests := []struct {
+		name  string
+		claim []string
+		cfg   jwtauth.Config
+		want  []string
+	}{
+		{"identity provider scopes", []string{"openid", "profile"}, jwtauth.Config{}, nil},
+		{"single scopes", []string{"openid", "chat", "generate", "chat"}, jwtauth.Config{}, []string{"chat", "generate"}},
+		{"preset not allowed", []string{"inference"}, jwtauth.Config{}, nil},
+		{"preset allowed", []string{"readonly"}, jwtauth.Config{AllowPresets: true}, []string{"models:read", "usage:read"}},
+		{"admin not allowed", []string{"admin", "chat"}, jwtauth.Config{AllowPresets: true}, []string{"chat"}},
+		{"admin preset not allowed", []string{"full"}, jwtauth.Config{AllowPresets: true}, nil},
+		{"admin allowed", []string{"admin"}, jwtauth.Config{AllowAdmin: true}, []string{"admin"}},
+		{"admin preset allowed", []string{"full"}, jwtauth.Config{AllowPresets: true, AllowAdmin: true}, []string{"admin"}},
+	}
+	for _, tt := range tests {
+		got := tokenScopes(tt.claim, tt.cfg)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: scopes = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
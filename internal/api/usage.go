@@ -0,0 +1,90 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// maxUsageDays bounds how far back a usage report reaches
+const maxUsageDays = 366
+
+// usageHandler reports the usage of the calling key, in the same buckets as
+// the usage CLI command. Admin keys may ask for another key's usage.
+func usageHandler(db db.DBInterface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey := apiKeyFromContext(r.Context())
+		key := apiKey.Key
+		if other := r.URL.Query().Get("key"); other != "" && other != key {
+			if !apiKey.HasScope(models.ScopeAdmin) {
+				writeInsufficientScope(w, r, models.ScopeAdmin)
+				return
+			}
+			key = other
+		}
+
+		report, ok := usageQuery(w, r)
+		if !ok {
+			return
+		}
+		buckets, err := db.GetUsageReport(key, report.Since, report.Granularity)
+		if err != nil {
+			log.Printf("Error getting usage report: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+		report.Key = key
+		writeUsageReport(w, report, buckets)
+	}
+}
+
+// usageQuery reads the granularity and days parameters of a usage report,
+// answering the request itself if they are invalid
+func usageQuery(w http.ResponseWriter, r *http.Request) (models.UsageReport, bool) {
+	query := r.URL.Query()
+	report := models.UsageReport{Granularity: models.UsageDaily}
+	switch value := query.Get("granularity"); value {
+	case "", string(models.UsageDaily):
+	case string(models.UsageHourly):
+		report.Granularity = models.UsageHourly
+	default:
+		writeErrorResponse(w, r, http.StatusBadRequest, models.ErrorResponse{
+			Error: "granularity must be hourly or daily",
+			Code:  codeInvalidRequest,
+			Field: "granularity",
+		})
+		return report, false
+	}
+
+	days := 7
+	if value := query.Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxUsageDays {
+			writeErrorResponse(w, r, http.StatusBadRequest, models.ErrorResponse{
+				Error: "days must be a number from 1 to " + strconv.Itoa(maxUsageDays),
+				Code:  codeInvalidRequest,
+				Field: "days",
+			})
+			return report, false
+		}
+		days = n
+	}
+	report.Since = time.Now().AddDate(0, 0, -days)
+	return report, true
+}
+
+// writeUsageReport sends a usage report with its buckets and total
+func writeUsageReport(w http.ResponseWriter, report models.UsageReport, buckets []models.UsageBucket) {
+	report.Buckets = buckets
+	if report.Buckets == nil {
+		report.Buckets = []models.UsageBucket{}
+	}
+	for _, bucket := range buckets {
+		report.Total += bucket.Requests
+	}
+	writeJSON(w, http.StatusOK, report)
+}
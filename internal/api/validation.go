@@ -0,0 +1,190 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// errBodyTooLarge is returned when a request body exceeds cfg.MaxBodyBytes
+var errBodyTooLarge = errors.New("request body is too large")
+
+// writeBodyTooLarge rejects a request whose body exceeded limit bytes
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	writeErrorResponse(w, r, http.StatusRequestEntityTooLarge, models.ErrorResponse{
+		Error: fmt.Sprintf("request body is larger than %d bytes", limit),
+		Code:  codeBodyTooLarge,
+		Limit: limit,
+	})
+}
+
+// readBody reads a request body of at most limit bytes, zero for no limit
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	body := r.Body
+	if limit > 0 {
+		body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	data, err := io.ReadAll(body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, errBodyTooLarge
+	}
+	return data, err
+}
+
+// generationInput is the content of a generation request that is checked
+// against the input limits
+type generationInput struct {
+	// field names the request field holding the text
+	field  string
+	text   []string
+	images []string
+}
+
+// inputLimits bounds the content of generation requests. Zero values are
+// unlimited.
+type inputLimits struct {
+	maxChars      int
+	maxTokens     int
+	maxImages     int
+	maxImageBytes int64
+	// formats are the allowed image formats, such as png; empty allows any
+	formats map[string]bool
+}
+
+// newInputLimits reads the input limits from the configuration
+func newInputLimits(cfg *config.Config) inputLimits {
+	l := inputLimits{
+		maxChars:      cfg.MaxPromptChars,
+		maxTokens:     cfg.MaxPromptTokens,
+		maxImages:     cfg.MaxImages,
+		maxImageBytes: cfg.MaxImageBytes,
+	}
+	if len(cfg.ImageFormats) > 0 {
+		l.formats = make(map[string]bool)
+		for _, format := range cfg.ImageFormats {
+			l.formats[format] = true
+		}
+	}
+	return l
+}
+
+// InputCheck returns a check of generation requests to the Ollama paths
+// against the input limits of cfg, so that batches are held to the same
+// limits as /generate and /chat. It returns the status code and error to
+// fail a request with, or nil if it is within them. Bodies that do not
+// decode are left for Ollama to reject.
+func InputCheck(cfg *config.Config) func(path string, body []byte) (int, *models.ErrorResponse) {
+	inputs := newInputLimits(cfg)
+	return func(path string, body []byte) (int, *models.ErrorResponse) {
+		for _, route := range jobRoutes {
+			if route.path != path {
+				continue
+			}
+			generation, err := route.decode(bytes.NewReader(body))
+			if err != nil {
+				return 0, nil
+			}
+			return inputs.check(generation.input())
+		}
+		return 0, nil
+	}
+}
+
+// estimateTokens approximates the tokens of a text at about four
+// characters per token, which is close for English and most models
+func estimateTokens(chars int) int {
+	return (chars + 3) / 4
+}
+
+// check returns the status and error to answer a request whose input
+// breaks a limit with, or nil if it is within them
+func (l inputLimits) check(in generationInput) (int, *models.ErrorResponse) {
+	chars := 0
+	for _, text := range in.text {
+		chars += utf8.RuneCountInString(text)
+	}
+	if l.maxChars > 0 && chars > l.maxChars {
+		return http.StatusRequestEntityTooLarge, &models.ErrorResponse{
+			Error: fmt.Sprintf("%s is longer than %d characters", in.field, l.maxChars),
+			Code:  codePromptTooLong,
+			Field: in.field,
+			Limit: int64(l.maxChars),
+		}
+	}
+	if l.maxTokens > 0 && estimateTokens(chars) > l.maxTokens {
+		return http.StatusRequestEntityTooLarge, &models.ErrorResponse{
+			Error: fmt.Sprintf("%s is longer than an estimated %d tokens", in.field, l.maxTokens),
+			Code:  codePromptTooLong,
+			Field: in.field,
+			Limit: int64(l.maxTokens),
+		}
+	}
+
+	if l.maxImages > 0 && len(in.images) > l.maxImages {
+		return http.StatusRequestEntityTooLarge, &models.ErrorResponse{
+			Error: fmt.Sprintf("request has more than %d images", l.maxImages),
+			Code:  codeTooManyImages,
+			Field: "images",
+			Limit: int64(l.maxImages),
+		}
+	}
+	if l.maxImageBytes == 0 && l.formats == nil {
+		return 0, nil
+	}
+	for i, image := range in.images {
+		field := fmt.Sprintf("images[%d]", i)
+		data, err := base64.StdEncoding.DecodeString(image)
+		if err != nil {
+			return http.StatusBadRequest, &models.ErrorResponse{
+				Error: field + " is not valid base64",
+				Code:  codeInvalidImage,
+				Field: field,
+			}
+		}
+		if l.maxImageBytes > 0 && int64(len(data)) > l.maxImageBytes {
+			return http.StatusRequestEntityTooLarge, &models.ErrorResponse{
+				Error: fmt.Sprintf("%s is larger than %d bytes", field, l.maxImageBytes),
+				Code:  codeImageTooLarge,
+				Field: field,
+				Limit: l.maxImageBytes,
+			}
+		}
+		if format := imageFormat(data); l.formats != nil && !l.formats[format] {
+			return http.StatusBadRequest, &models.ErrorResponse{
+				Error: fmt.Sprintf("%s is in %s format, allowed formats are %s", field, format, strings.Join(sortedFormats(l.formats), ", ")),
+				Code:  codeUnsupportedImage,
+				Field: field,
+			}
+		}
+	}
+	return 0, nil
+}
+
+// imageFormat sniffs the format of an image, such as png or jpeg, from its
+// content. It returns "unknown" for data that is not a recognised image.
+func imageFormat(data []byte) string {
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") {
+		return "unknown"
+	}
+	return strings.TrimPrefix(contentType, "image/")
+}
+
+func sortedFormats(formats map[string]bool) []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
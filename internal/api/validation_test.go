@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/erock530/go-ollama-api/internal/config"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/gorilla/mux"
+)
+
+func TestInputLimits(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"response":"ok","done":true}`))
+	}))
+	defer mockServer.Close()
+
+	mockDB := NewMockDB()
+	mockDB.apiKeys["key-a"] = &models.APIKey{Key: "key-a", Active: true, RateLimit: 100}
+	router := mux.NewRouter()
+	SetupRoutes(router, mockDB, &config.Config{
+		Port:            8080,
+		OllamaURL:       mockServer.URL,
+		MaxBodyBytes:    1000,
+		MaxPromptChars:  40,
+		MaxPromptTokens: 5,
+		MaxImages:       2,
+		MaxImageBytes:   64,
+		ImageFormats:    []string{"png", "jpeg"},
+	})
+
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 16)))
+	gif := base64.StdEncoding.EncodeToString([]byte("GIF89a" + strings.Repeat("\x00", 16)))
+	large := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 64)))
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"within limits", "/generate", `{"model":"m","prompt":"Describe","images":["` + png + `"]}`, http.StatusOK, ""},
+		{"body too large", "/generate", `{"model":"m","prompt":"` + strings.Repeat("a", 1000) + `"}`, http.StatusRequestEntityTooLarge, "body_too_large"},
+		{"too many characters", "/generate", `{"model":"m","prompt":"` + strings.Repeat("é", 41) + `"}`, http.StatusRequestEntityTooLarge, "prompt_too_long"},
+		{"too many tokens", "/generate", `{"model":"m","prompt":"hello world","system":"answer briefly"}`, http.StatusRequestEntityTooLarge, "prompt_too_long"},
+		{"chat messages count together", "/chat", `{"model":"m","messages":[{"role":"user","content":"hello world"},{"role":"user","content":"and a bit more"}]}`, http.StatusRequestEntityTooLarge, "prompt_too_long"},
+		{"too many images", "/chat", `{"model":"m","messages":[{"role":"user","content":"hi","images":["` + png + `","` + png + `"]},{"role":"user","content":"hi","images":["` + png + `"]}]}`, http.StatusRequestEntityTooLarge, "too_many_images"},
+		{"image too large", "/generate", `{"model":"m","prompt":"hi","images":["` + large + `"]}`, http.StatusRequestEntityTooLarge, "image_too_large"},
+		{"not base64", "/generate", `{"model":"m","prompt":"hi","images":["not base64!"]}`, http.StatusBadRequest, "invalid_image"},
+		{"format not allowed", "/generate", `{"model":"m","prompt":"hi","images":["` + png + `","` + gif + `"]}`, http.StatusBadRequest, "unsupported_image_format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			req.Header.Set("X-API-Key", "key-a")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rr.Code, tt.status, rr.Body.String())
+			}
+			if tt.code == "" {
+				return
+			}
+			var e models.ErrorResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &e); err != nil || e.Code != tt.code || e.Error == "" {
+				t.Errorf("body %s, want code %s", rr.Body.String(), tt.code)
+			}
+		})
+	}
+}
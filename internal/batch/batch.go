@@ -0,0 +1,443 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/concurrency"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+	"github.com/erock530/go-ollama-api/internal/quota"
+	"github.com/erock530/go-ollama-api/internal/ratelimit"
+	"github.com/erock530/go-ollama-api/internal/scheduler"
+)
+
+// Result statuses
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// endpoints are the Ollama paths a batch request may call, with the scope
+// each needs. Generations are answered as one JSON document, so stream is
+// forced off for them.
+var endpoints = map[string]struct {
+	generation bool
+	scope      string
+}{
+	ollama.GeneratePath:   {generation: true, scope: models.ScopeGenerate},
+	ollama.ChatPath:       {generation: true, scope: models.ScopeChat},
+	ollama.EmbedPath:      {scope: models.ScopeEmbed},
+	ollama.EmbeddingsPath: {scope: models.ScopeEmbed},
+}
+
+// Request is one line of a batch input file
+type Request struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method,omitempty"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// ReadRequests parses and validates a JSONL batch input, skipping blank
+// lines. Custom IDs must be unique since they are how results are matched
+// to requests, and how an interrupted batch knows what is left to do.
+func ReadRequests(r io.Reader) ([]Request, error) {
+	var requests []Request
+	seen := make(map[string]bool)
+	reader := bufio.NewReader(r)
+	for lineNumber := 1; ; lineNumber++ {
+		// Lines holding images can be far longer than bufio.Scanner allows
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			req, verr := parseRequest(trimmed)
+			if verr == nil && seen[req.CustomID] {
+				verr = fmt.Errorf("duplicate custom_id %q", req.CustomID)
+			}
+			if verr != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNumber, verr)
+			}
+			seen[req.CustomID] = true
+			requests = append(requests, req)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if len(requests) == 0 {
+		return nil, errors.New("batch contains no requests")
+	}
+	return requests, nil
+}
+
+// parseRequest decodes and checks one input line
+func parseRequest(line []byte) (Request, error) {
+	var req Request
+	if err := json.Unmarshal(line, &req); err != nil {
+		return req, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if req.CustomID == "" {
+		return req, errors.New("custom_id is required")
+	}
+	if req.Method != "" && req.Method != http.MethodPost {
+		return req, fmt.Errorf("unsupported method %q", req.Method)
+	}
+	if _, ok := endpoints[req.URL]; !ok {
+		return req, fmt.Errorf("unsupported url %q", req.URL)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(req.Body, &fields); err != nil || fields == nil {
+		return req, errors.New("body must be a JSON object")
+	}
+	if _, ok := fields["model"]; !ok {
+		return req, errors.New("body must name a model")
+	}
+	return req, nil
+}
+
+// KeyStore is the persistence a Runner needs to charge requests to a key
+// and its organization
+type KeyStore interface {
+	GetAPIKey(key string) (*models.APIKey, error)
+	UpdateAPIKeyUsage(key string, tokens int) error
+	LogAPIUsage(key, orgID string) error
+	quota.Store
+}
+
+// Config holds the Runner settings
+type Config struct {
+	// RateLimitAlgorithm applies to keys that do not set their own
+	RateLimitAlgorithm string
+	// MaxAttempts is how many times a request is sent while Ollama is
+	// unreachable or overloaded before it fails
+	MaxAttempts int
+	// RetryBackoff is the wait before the first retry, doubled after each
+	RetryBackoff time.Duration
+	// CheckInput, if set, checks the body of a generation request to path
+	// against the input limits. It returns the status code and error to
+	// fail the request with, or nil if it is within them.
+	CheckInput func(path string, body []byte) (int, *models.ErrorResponse)
+}
+
+// Runner executes batch requests against Ollama under one API key's quota:
+// each request counts against the key's rate limit, holds one of the key's
+// generation slots, waits in the request queue with the key's priority, and
+// is logged as usage of the key.
+type Runner struct {
+	keys     KeyStore
+	client   *ollama.Client
+	limiter  ratelimit.Limiter
+	inFlight *concurrency.Limiter
+	queue    *scheduler.Scheduler
+	cfg      Config
+}
+
+// NewRunner creates a batch runner. Requests hold a slot of inFlight while
+// they run, so batches share the concurrency limits of synchronous requests.
+func NewRunner(keys KeyStore, client *ollama.Client, limiter ratelimit.Limiter, inFlight *concurrency.Limiter, queue *scheduler.Scheduler, cfg Config) *Runner {
+	if cfg.RateLimitAlgorithm == "" {
+		cfg.RateLimitAlgorithm = string(ratelimit.DefaultAlgorithm)
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 3
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = time.Second
+	}
+	return &Runner{keys: keys, client: client, limiter: limiter, inFlight: inFlight, queue: queue, cfg: cfg}
+}
+
+// Run sends requests on behalf of key, at most concurrency at once (and no
+// more than the key's own concurrency limit). Requests whose custom ID is in
+// done are skipped. Every other request's result is passed to save together
+// with its index in requests; save is never called concurrently.
+//
+// Run returns once every request has a result, or early when ctx is done or
+// save fails. Requests interrupted by ctx get no result, so running the
+// remaining ones later resumes the batch.
+func (r *Runner) Run(ctx context.Context, key string, requests []Request, concurrency int, done map[string]bool, save func(index int, result models.BatchResult) error) error {
+	apiKey, err := r.keys.GetAPIKey(key)
+	if err != nil {
+		return err
+	}
+	if apiKey == nil {
+		return errors.New("invalid API key")
+	}
+	if !apiKey.Active {
+		return errors.New("API key is deactivated")
+	}
+	apiKey = apiKey.Effective()
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if apiKey.MaxConcurrent > 0 && concurrency > apiKey.MaxConcurrent {
+		concurrency = apiKey.MaxConcurrent
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		saveErr error
+		wg      sync.WaitGroup
+	)
+	indexes := make(chan int)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				result, err := r.execute(ctx, apiKey, requests[index])
+				if err != nil {
+					continue
+				}
+				mu.Lock()
+				if saveErr == nil {
+					if saveErr = save(index, result); saveErr != nil {
+						cancel()
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for index, req := range requests {
+		if done[req.CustomID] {
+			continue
+		}
+		select {
+		case indexes <- index:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if saveErr != nil {
+		return saveErr
+	}
+	return ctx.Err()
+}
+
+// execute sends one request, retrying while Ollama is unreachable or
+// overloaded. It only returns an error if ctx is done first.
+func (r *Runner) execute(ctx context.Context, apiKey *models.APIKey, req Request) (models.BatchResult, error) {
+	result := models.BatchResult{CustomID: req.CustomID, Status: StatusFailed}
+	if scope := endpoints[req.URL].scope; !apiKey.HasScope(scope) {
+		result.StatusCode = http.StatusForbidden
+		result.Error = fmt.Sprintf("API key lacks the %s scope", scope)
+		return result, nil
+	}
+	if r.cfg.CheckInput != nil && endpoints[req.URL].generation {
+		if status, e := r.cfg.CheckInput(req.URL, req.Body); e != nil {
+			result.StatusCode, result.Code, result.Error = status, e.Code, e.Error
+			return result, nil
+		}
+	}
+
+	body := []byte(req.Body)
+	if endpoints[req.URL].generation {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(req.Body, &fields); err != nil {
+			result.Error = fmt.Sprintf("invalid body: %v", err)
+			return result, nil
+		}
+		fields["stream"] = json.RawMessage("false")
+		var err error
+		if body, err = json.Marshal(fields); err != nil {
+			result.Error = err.Error()
+			return result, nil
+		}
+	}
+	body, _, err := ollama.LimitsFor(apiKey).Apply(req.URL, body)
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid body: %v", err)
+		return result, nil
+	}
+	var target struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(body, &target)
+	if !apiKey.AllowsModel(target.Model) {
+		result.StatusCode = http.StatusForbidden
+		result.Error = fmt.Sprintf("API key may not use the model %q", target.Model)
+		return result, nil
+	}
+	if err := quota.Check(r.keys, apiKey, time.Now()); err != nil {
+		var exceeded *quota.ExceededError
+		if !errors.As(err, &exceeded) {
+			return result, err
+		}
+		result.StatusCode = http.StatusTooManyRequests
+		result.Error = err.Error()
+		return result, nil
+	}
+
+	backoff := r.cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		statusCode, response, err := r.send(ctx, apiKey, req.URL, body)
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+
+		retry := err != nil || statusCode == http.StatusTooManyRequests || statusCode >= 500
+		if !retry || attempt == r.cfg.MaxAttempts {
+			result.StatusCode = statusCode
+			switch {
+			case err != nil:
+				result.Error = err.Error()
+			case statusCode == http.StatusOK:
+				result.Status = StatusSucceeded
+				result.Response = jsonResponse(response)
+			default:
+				result.Error = upstreamError(response)
+			}
+			return result, nil
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return result, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// send waits for the key's quota, a generation slot and a turn at the
+// backend, then posts body to Ollama and returns the response
+func (r *Runner) send(ctx context.Context, apiKey *models.APIKey, path string, body []byte) (int, []byte, error) {
+	if err := r.waitForQuota(ctx, apiKey); err != nil {
+		return 0, nil, err
+	}
+
+	// Wait for a slot under the key's concurrency limit, which synchronous
+	// generations share
+	release, err := r.inFlight.Acquire(ctx, apiKey.Key, apiKey.MaxConcurrent, -1)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer release()
+
+	ticket, err := r.queue.Acquire(ctx, scheduler.Request{
+		Key:      apiKey.Key,
+		Priority: scheduler.Priority(apiKey.Priority),
+		Weight:   apiKey.QueueWeight,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer ticket.Release()
+
+	resp, err := r.client.Post(ctx, path, body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error making request to Ollama API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if err := r.keys.LogAPIUsage(apiKey.Key, apiKey.OrgID); err != nil {
+		log.Printf("Error logging API usage: %v", err)
+	}
+
+	response, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading Ollama response: %v", err)
+	}
+	quota.Charge(r.keys, apiKey, ollama.UsedTokens(response))
+	return resp.StatusCode, response, nil
+}
+
+// waitForQuota blocks until the rate limit of the key's organization, and
+// then the key's own, allow another request. The organization comes first,
+// like in the gateway's middleware, so that waiting on it does not spend
+// the key's budget.
+func (r *Runner) waitForQuota(ctx context.Context, apiKey *models.APIKey) error {
+	if org := apiKey.Org; org != nil && org.RateLimit > 0 {
+		_, err := r.waitForLimit(ctx, org.LimitKey(), ratelimit.Limit{
+			Algorithm: ratelimit.Algorithm(r.cfg.RateLimitAlgorithm),
+			Requests:  org.RateLimit,
+			Period:    time.Minute,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	algorithm := apiKey.RateLimitAlgorithm
+	if algorithm == "" {
+		algorithm = r.cfg.RateLimitAlgorithm
+	}
+	result, err := r.waitForLimit(ctx, apiKey.Key, ratelimit.Limit{
+		Algorithm: ratelimit.Algorithm(algorithm),
+		Requests:  apiKey.RateLimit,
+		Period:    time.Minute,
+		Burst:     apiKey.RateLimitBurst,
+	})
+	if err != nil {
+		return err
+	}
+	if err := r.keys.UpdateAPIKeyUsage(apiKey.Key, result.Remaining); err != nil {
+		log.Printf("Error updating API key usage: %v", err)
+	}
+	return nil
+}
+
+// waitForLimit blocks until limit allows a request for key
+func (r *Runner) waitForLimit(ctx context.Context, key string, limit ratelimit.Limit) (ratelimit.Result, error) {
+	for {
+		result, err := r.limiter.Allow(ctx, key, limit)
+		if err != nil {
+			return result, fmt.Errorf("error checking rate limit: %v", err)
+		}
+		if result.Allowed {
+			return result, nil
+		}
+
+		wait := result.RetryAfter
+		if wait <= 0 {
+			wait = 100 * time.Millisecond
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return result, ctx.Err()
+		}
+	}
+}
+
+// jsonResponse returns an Ollama response for embedding in a result, quoting
+// it as a string if it is not valid JSON
+func jsonResponse(response []byte) json.RawMessage {
+	if json.Valid(response) {
+		return response
+	}
+	quoted, _ := json.Marshal(string(response))
+	return quoted
+}
+
+// upstreamError extracts the message from an Ollama error response
+func upstreamError(response []byte) string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(response, &body) == nil && body.Error != "" {
+		return body.Error
+	}
+	return string(bytes.TrimSpace(response))
+}
@@ -0,0 +1,428 @@
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/concurrency"
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+	"github.com/erock530/go-ollama-api/internal/ratelimit"
+	"github.com/erock530/go-ollama-api/internal/scheduler"
+)
+
+// testInput has one request of each kind and one for a missing model
+const testInput = `{"custom_id": "gen", "url": "/api/generate", "body": {"model": "llama3", "prompt": "hi", "stream": true}}
+
+{"custom_id": "chat", "method": "POST", "url": "/api/chat", "body": {"model": "llama3", "messages": []}}
+{"custom_id": "embed", "url": "/api/embed", "body": {"model": "nomic-embed-text", "input": "hi"}}
+{"custom_id": "missing", "url": "/api/generate", "body": {"model": "missing", "prompt": "hi"}}
+`
+
+// fakeOllama answers like Ollama and records the requests it was sent
+type fakeOllama struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies map[string]map[string]interface{}
+}
+
+func newFakeOllama(t *testing.T) *fakeOllama {
+	f := &fakeOllama{bodies: make(map[string]map[string]interface{})}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.mu.Lock()
+		f.bodies[r.URL.Path+" "+body["model"].(string)] = body
+		f.mu.Unlock()
+
+		switch {
+		case body["model"] == "missing":
+			http.Error(w, `{"error":"model 'missing' not found"}`, http.StatusNotFound)
+		case r.URL.Path == ollama.EmbedPath:
+			w.Write([]byte(`{"embeddings":[[0.1,0.2]]}`))
+		default:
+			w.Write([]byte(`{"response":"hello","done":true}` + "\n"))
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeOllama) requests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.bodies)
+}
+
+func openTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	database, err := db.OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err := database.CreateAPIKey(&models.APIKey{Key: "key-a", Active: true, RateLimit: 600}); err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+func newTestRunner(database *db.DB, ollamaURL string, limiter ratelimit.Limiter) *Runner {
+	if limiter == nil {
+		limiter = ratelimit.NewMemoryLimiter()
+	}
+	return NewRunner(database, ollama.NewClient(ollamaURL, ollama.Config{}, nil), limiter, concurrency.NewLimiter(0), scheduler.New(scheduler.Config{}, nil), Config{RetryBackoff: time.Millisecond})
+}
+
+func TestReadRequests(t *testing.T) {
+	requests, err := ReadRequests(strings.NewReader(testInput))
+	if err != nil {
+		t.Fatalf("ReadRequests failed: %v", err)
+	}
+	if len(requests) != 4 || requests[1].CustomID != "chat" || requests[2].URL != ollama.EmbedPath {
+		t.Errorf("unexpected requests: %+v", requests)
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "Empty", input: "\n\n", want: "no requests"},
+		{name: "Invalid JSON", input: `{"custom_id": "a"`, want: "line 1: invalid JSON"},
+		{name: "Missing ID", input: `{"url": "/api/generate", "body": {"model": "llama3"}}`, want: "custom_id is required"},
+		{name: "Unknown URL", input: `{"custom_id": "a", "url": "/api/pull", "body": {"model": "llama3"}}`, want: "unsupported url"},
+		{name: "Wrong Method", input: `{"custom_id": "a", "method": "GET", "url": "/api/chat", "body": {"model": "llama3"}}`, want: "unsupported method"},
+		{name: "Missing Model", input: `{"custom_id": "a", "url": "/api/chat", "body": {}}`, want: "must name a model"},
+		{
+			name:  "Duplicate ID",
+			input: `{"custom_id": "a", "url": "/api/chat", "body": {"model": "llama3"}}` + "\n" + `{"custom_id": "a", "url": "/api/chat", "body": {"model": "llama3"}}`,
+			want:  `line 2: duplicate custom_id "a"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadRequests(strings.NewReader(tt.input))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ReadRequests = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunnerResults(t *testing.T) {
+	fake := newFakeOllama(t)
+	runner := newTestRunner(openTestDB(t), fake.URL, nil)
+	requests, _ := ReadRequests(strings.NewReader(testInput))
+
+	results := make(map[string]models.BatchResult)
+	err := runner.Run(context.Background(), "key-a", requests, 2, nil, func(index int, result models.BatchResult) error {
+		if requests[index].CustomID != result.CustomID {
+			t.Errorf("result %s saved for request %d", result.CustomID, index)
+		}
+		results[result.CustomID] = result
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	for _, id := range []string{"gen", "chat", "embed"} {
+		if results[id].Status != StatusSucceeded || results[id].StatusCode != http.StatusOK {
+			t.Errorf("result %s = %+v, want success", id, results[id])
+		}
+	}
+	if string(results["embed"].Response) != `{"embeddings":[[0.1,0.2]]}` {
+		t.Errorf("embed response = %s", results["embed"].Response)
+	}
+	if missing := results["missing"]; missing.Status != StatusFailed || missing.StatusCode != http.StatusNotFound || missing.Error != "model 'missing' not found" {
+		t.Errorf("missing model result = %+v", missing)
+	}
+	if stream := fake.bodies[ollama.GeneratePath+" llama3"]["stream"]; stream != false {
+		t.Errorf("generate was sent with stream = %v, want false", stream)
+	}
+}
+
+func TestRunnerChecksScopes(t *testing.T) {
+	fake := newFakeOllama(t)
+	database := openTestDB(t)
+	if err := database.CreateAPIKey(&models.APIKey{Key: "key-chat", Active: true, RateLimit: 600, Scopes: []string{models.ScopeChat}}); err != nil {
+		t.Fatal(err)
+	}
+	runner := newTestRunner(database, fake.URL, nil)
+	requests, _ := ReadRequests(strings.NewReader(testInput))
+
+	results := make(map[string]models.BatchResult)
+	err := runner.Run(context.Background(), "key-chat", requests, 1, nil, func(index int, result models.BatchResult) error {
+		results[result.CustomID] = result
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if results["chat"].Status != StatusSucceeded {
+		t.Errorf("chat result = %+v, want success", results["chat"])
+	}
+	if embed := results["embed"]; embed.StatusCode != http.StatusForbidden || !strings.Contains(embed.Error, "embed scope") {
+		t.Errorf("embed result = %+v, want 403", embed)
+	}
+	if fake.requests() != 1 {
+		t.Errorf("%d requests reached Ollama, want 1", fake.requests())
+	}
+}
+
+func TestRunnerRetriesOverloadedBackend(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		n := calls
+		mu.Unlock()
+		if n == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"response":"hello"}`))
+	}))
+	defer server.Close()
+
+	runner := newTestRunner(openTestDB(t), server.URL, nil)
+	requests := []Request{{CustomID: "a", URL: ollama.GeneratePath, Body: []byte(`{"model":"llama3"}`)}}
+	var result models.BatchResult
+	err := runner.Run(context.Background(), "key-a", requests, 1, nil, func(index int, r models.BatchResult) error {
+		result = r
+		return nil
+	})
+	if err != nil || result.Status != StatusSucceeded || calls != 2 {
+		t.Errorf("Run = %v, result %+v after %d calls; want success after 2", err, result, calls)
+	}
+}
+
+// denyOnce rejects the first request it sees
+type denyOnce struct {
+	mu     sync.Mutex
+	denied bool
+}
+
+func (d *denyOnce) Allow(ctx context.Context, key string, limit ratelimit.Limit) (ratelimit.Result, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.denied {
+		d.denied = true
+		return ratelimit.Result{Allowed: false, RetryAfter: 10 * time.Millisecond}, nil
+	}
+	return ratelimit.Result{Allowed: true}, nil
+}
+
+func TestRunnerWaitsForRateLimit(t *testing.T) {
+	fake := newFakeOllama(t)
+	limiter := &denyOnce{}
+	runner := newTestRunner(openTestDB(t), fake.URL, limiter)
+
+	requests := []Request{{CustomID: "a", URL: ollama.GeneratePath, Body: []byte(`{"model":"llama3"}`)}}
+	var result models.BatchResult
+	err := runner.Run(context.Background(), "key-a", requests, 1, nil, func(index int, r models.BatchResult) error {
+		result = r
+		return nil
+	})
+	if err != nil || result.Status != StatusSucceeded || !limiter.denied {
+		t.Errorf("Run = %v, result %+v; want success after waiting", err, result)
+	}
+}
+
+func TestRunnerWaitsForKeyConcurrency(t *testing.T) {
+	fake := newFakeOllama(t)
+	database := openTestDB(t)
+	if err := database.CreateAPIKey(&models.APIKey{Key: "key-single", Active: true, RateLimit: 600, MaxConcurrent: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A synchronous generation holds the key's only slot
+	inFlight := concurrency.NewLimiter(0)
+	release, err := inFlight.Acquire(context.Background(), "key-single", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := NewRunner(database, ollama.NewClient(fake.URL, ollama.Config{}, nil), ratelimit.NewMemoryLimiter(), inFlight, scheduler.New(scheduler.Config{}, nil), Config{})
+
+	requests := []Request{{CustomID: "a", URL: ollama.GeneratePath, Body: []byte(`{"model":"llama3"}`)}}
+	done := make(chan models.BatchResult, 1)
+	go runner.Run(context.Background(), "key-single", requests, 1, nil, func(index int, result models.BatchResult) error {
+		done <- result
+		return nil
+	})
+	time.Sleep(100 * time.Millisecond)
+	if fake.requests() != 0 {
+		t.Fatal("batch request ran while its key was at its concurrency limit")
+	}
+
+	release()
+	select {
+	case result := <-done:
+		if result.Status != StatusSucceeded {
+			t.Errorf("result %+v, want success", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch request did not run once the slot was free")
+	}
+}
+
+// denyOrgs turns away every request of an organization and records the
+// keys it was asked about
+type denyOrgs struct {
+	mu    sync.Mutex
+	asked []string
+}
+
+func (d *denyOrgs) Allow(ctx context.Context, key string, limit ratelimit.Limit) (ratelimit.Result, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.asked = append(d.asked, key)
+	if strings.HasPrefix(key, "org:") {
+		return ratelimit.Result{Allowed: false, RetryAfter: 10 * time.Millisecond}, nil
+	}
+	return ratelimit.Result{Allowed: true}, nil
+}
+
+func TestRunnerChecksOrgRateLimitFirst(t *testing.T) {
+	fake := newFakeOllama(t)
+	database := openTestDB(t)
+	if err := database.CreateOrg(&models.Org{ID: "acme", Name: "Acme", RateLimit: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.CreateAPIKey(&models.APIKey{Key: "key-acme", Active: true, RateLimit: 600, OrgID: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	limiter := &denyOrgs{}
+	runner := newTestRunner(database, fake.URL, limiter)
+
+	// A batch held up by its organization does not spend the key's budget
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	requests := []Request{{CustomID: "a", URL: ollama.GeneratePath, Body: []byte(`{"model":"llama3"}`)}}
+	runner.Run(ctx, "key-acme", requests, 1, nil, func(index int, result models.BatchResult) error {
+		t.Errorf("result %+v while the organization was at its limit", result)
+		return nil
+	})
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	for _, key := range limiter.asked {
+		if key != "org:acme" {
+			t.Errorf("rate limit of %s checked while the organization was at its limit", key)
+		}
+	}
+	if len(limiter.asked) == 0 || fake.requests() != 0 {
+		t.Errorf("asked %v, %d requests sent; want only the organization asked", limiter.asked, fake.requests())
+	}
+}
+
+func TestResultsFileResume(t *testing.T) {
+	fake := newFakeOllama(t)
+	runner := newTestRunner(openTestDB(t), fake.URL, nil)
+	requests, _ := ReadRequests(strings.NewReader(testInput))
+
+	// A previous run finished "gen" and was killed while writing "chat"
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	previous := `{"custom_id":"gen","status":"succeeded","status_code":200,"response":{"response":"earlier"}}` + "\n" + `{"custom_id":"chat","sta`
+	if err := os.WriteFile(path, []byte(previous), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := OpenResultsFile(path)
+	if err != nil {
+		t.Fatalf("OpenResultsFile failed: %v", err)
+	}
+	if done := results.Done(); len(done) != 1 || !done["gen"] {
+		t.Errorf("Done = %v, want only gen", done)
+	}
+	if err := runner.Run(context.Background(), "key-a", requests, 2, results.Done(), results.Save); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	results.Close()
+
+	if n := fake.requests(); n != 3 {
+		t.Errorf("Ollama got %d requests, want 3", n)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[0], "earlier") {
+		t.Errorf("unexpected results file:\n%s", content)
+	}
+	for _, line := range lines {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("results line is not JSON: %s", line)
+		}
+	}
+}
+
+func TestManagerResumesInterruptedBatch(t *testing.T) {
+	fake := newFakeOllama(t)
+	database := openTestDB(t)
+
+	// A previous gateway saved one result and died with the batch claimed
+	batch := &models.Batch{ID: "batch-1", Key: "key-a", Total: 4, Concurrency: 2}
+	if err := database.CreateBatch(batch, []byte(testInput)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.ClaimBatch(time.Now(), time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.SaveBatchResult("batch-1", 0, &models.BatchResult{CustomID: "gen", Status: StatusSucceeded}); err != nil {
+		t.Fatal(err)
+	}
+
+	manager := NewManager(database, newTestRunner(database, fake.URL, nil), ManagerConfig{PollInterval: 10 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		manager.Run(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		batch, err := manager.Get("batch-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch.Status.Finished() {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	batch, _ = manager.Get("batch-1")
+	if batch.Status != models.BatchCompleted || batch.Succeeded != 3 || batch.Failed != 1 {
+		t.Errorf("unexpected batch: %+v", batch)
+	}
+	if n := fake.requests(); n != 3 {
+		t.Errorf("Ollama got %d requests, want 3", n)
+	}
+
+	var out strings.Builder
+	if err := manager.WriteResults("batch-1", &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[0], `"gen"`) || !strings.Contains(lines[3], `"missing"`) {
+		t.Errorf("results not in input order:\n%s", out.String())
+	}
+}
@@ -0,0 +1,98 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// ResultsFile appends batch results to a JSONL file. Results already in the
+// file when it is opened count as done, so running a batch again with the
+// same results file resumes it.
+type ResultsFile struct {
+	mu   sync.Mutex
+	file *os.File
+	done map[string]bool
+}
+
+// OpenResultsFile opens or creates a results file. A partly written last
+// line, left behind when a previous run was killed, is removed.
+func OpenResultsFile(path string) (*ResultsFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(map[string]bool)
+	var complete int64
+	reader := bufio.NewReader(file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		complete += int64(len(line))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var result models.BatchResult
+		if err := json.Unmarshal(line, &result); err != nil || result.CustomID == "" {
+			file.Close()
+			return nil, fmt.Errorf("%s line %d is not a batch result", path, lineNumber)
+		}
+		done[result.CustomID] = true
+	}
+
+	if err := file.Truncate(complete); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(complete, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &ResultsFile{file: file, done: done}, nil
+}
+
+// Done returns the custom IDs that already have a result
+func (f *ResultsFile) Done() map[string]bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	done := make(map[string]bool, len(f.done))
+	for id := range f.done {
+		done[id] = true
+	}
+	return done
+}
+
+// Save appends a result as one line. The index is not needed since each
+// result carries its custom ID.
+func (f *ResultsFile) Save(index int, result models.BatchResult) error {
+	line, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	f.done[result.CustomID] = true
+	return nil
+}
+
+// Close closes the file
+func (f *ResultsFile) Close() error {
+	return f.file.Close()
+}
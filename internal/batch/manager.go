@@ -0,0 +1,282 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// errBatchCancelled is the cancellation cause of a batch cancelled by its owner
+var errBatchCancelled = errors.New("batch cancelled")
+
+// Store is the persistence the Manager needs
+type Store interface {
+	KeyStore
+
+	CreateBatch(batch *models.Batch, input []byte) error
+	GetBatch(id string) (*models.Batch, error)
+	GetBatchInput(id string) ([]byte, error)
+	ClaimBatch(now, leaseUntil time.Time) (*models.Batch, error)
+	RenewBatchLease(id string, leaseUntil time.Time) (models.BatchStatus, error)
+	FinishBatch(id string, status models.BatchStatus, message string) error
+	RequeueBatch(id string) error
+	CancelBatch(id string) error
+	SaveBatchResult(batchID string, line int, result *models.BatchResult) error
+	BatchResultIDs(batchID string) (map[string]bool, error)
+	EachBatchResult(batchID string, fn func(result []byte) error) error
+}
+
+// ManagerConfig holds the settings of uploaded batches
+type ManagerConfig struct {
+	// Workers is the number of batches executed at once
+	Workers int
+	// MaxConcurrency caps the requests a single batch sends at once
+	MaxConcurrency int
+	// Lease is how long a running batch stays claimed without a heartbeat.
+	// After that another worker resumes it.
+	Lease time.Duration
+	// PollInterval is how often idle workers look for batches uploaded to
+	// other replicas
+	PollInterval time.Duration
+}
+
+// Manager runs uploaded batches in the background. Batches and their
+// results live in the Store, so a batch interrupted by a restart is resumed
+// by the next gateway to claim it.
+type Manager struct {
+	store  Store
+	runner *Runner
+	cfg    ManagerConfig
+	wake   chan struct{}
+
+	mu      sync.Mutex
+	running map[string]context.CancelCauseFunc
+}
+
+// NewManager creates a batch manager. Call Run to start it.
+func NewManager(store Store, runner *Runner, cfg ManagerConfig) *Manager {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.MaxConcurrency <= 0 {
+		cfg.MaxConcurrency = 1
+	}
+	if cfg.Lease <= 0 {
+		cfg.Lease = time.Minute
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	return &Manager{
+		store:   store,
+		runner:  runner,
+		cfg:     cfg,
+		wake:    make(chan struct{}, 1),
+		running: make(map[string]context.CancelCauseFunc),
+	}
+}
+
+// Submit validates a JSONL input and queues it as a batch for key
+func (m *Manager) Submit(key string, input []byte, concurrency int) (*models.Batch, error) {
+	requests, err := ReadRequests(bytes.NewReader(input))
+	if err != nil {
+		return nil, err
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if concurrency > m.cfg.MaxConcurrency {
+		concurrency = m.cfg.MaxConcurrency
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	batch := &models.Batch{
+		ID:          id,
+		Key:         key,
+		Total:       len(requests),
+		Concurrency: concurrency,
+	}
+	if err := m.store.CreateBatch(batch, input); err != nil {
+		return nil, err
+	}
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+	return batch, nil
+}
+
+// Get returns a batch, or nil if it does not exist
+func (m *Manager) Get(id string) (*models.Batch, error) {
+	return m.store.GetBatch(id)
+}
+
+// Cancel cancels a queued or running batch, keeping the results saved so far
+func (m *Manager) Cancel(id string) error {
+	if err := m.store.CancelBatch(id); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if cancel, ok := m.running[id]; ok {
+		cancel(errBatchCancelled)
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+// WriteResults writes the results saved so far as JSONL, in input order
+func (m *Manager) WriteResults(id string, w io.Writer) error {
+	return m.store.EachBatchResult(id, func(result []byte) error {
+		_, err := w.Write(append(result, '\n'))
+		return err
+	})
+}
+
+// Run executes batches until ctx is done. Batches still running at that
+// point are put back in the queue.
+func (m *Manager) Run(ctx context.Context) {
+	var workers sync.WaitGroup
+	for i := 0; i < m.cfg.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			m.work(ctx)
+		}()
+	}
+	workers.Wait()
+}
+
+// work claims and executes batches until ctx is done
+func (m *Manager) work(ctx context.Context) {
+	for {
+		now := time.Now()
+		batch, err := m.store.ClaimBatch(now, now.Add(m.cfg.Lease))
+		if err != nil {
+			log.Printf("Error claiming batch: %v", err)
+		}
+		if batch != nil {
+			m.execute(ctx, batch)
+			continue
+		}
+
+		select {
+		case <-m.wake:
+		case <-time.After(m.cfg.PollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// execute runs the requests of a claimed batch that have no result yet
+func (m *Manager) execute(ctx context.Context, batch *models.Batch) {
+	batchCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	m.mu.Lock()
+	m.running[batch.ID] = cancel
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.running, batch.ID)
+		m.mu.Unlock()
+	}()
+
+	stopHeartbeat := m.heartbeat(batchCtx, batch.ID, cancel)
+	runErr := m.run(batchCtx, batch)
+	stopHeartbeat()
+
+	switch {
+	case context.Cause(batchCtx) == errBatchCancelled:
+		// Already recorded by Cancel
+		return
+	case ctx.Err() != nil:
+		// The gateway is shutting down: another worker resumes the batch
+		if err := m.store.RequeueBatch(batch.ID); err != nil {
+			log.Printf("Error requeueing batch %s: %v", batch.ID, err)
+		}
+		return
+	}
+
+	status, message := models.BatchCompleted, ""
+	if runErr != nil {
+		status, message = models.BatchFailed, runErr.Error()
+	}
+	if err := m.store.FinishBatch(batch.ID, status, message); err != nil {
+		log.Printf("Error finishing batch %s: %v", batch.ID, err)
+	}
+}
+
+// run loads the batch input and executes what is left of it
+func (m *Manager) run(ctx context.Context, batch *models.Batch) error {
+	input, err := m.store.GetBatchInput(batch.ID)
+	if err != nil {
+		return err
+	}
+	requests, err := ReadRequests(bytes.NewReader(input))
+	if err != nil {
+		return err
+	}
+	done, err := m.store.BatchResultIDs(batch.ID)
+	if err != nil {
+		return err
+	}
+
+	return m.runner.Run(ctx, batch.Key, requests, batch.Concurrency, done, func(index int, result models.BatchResult) error {
+		return m.store.SaveBatchResult(batch.ID, index, &result)
+	})
+}
+
+// heartbeat renews the batch's lease until stopped, cancelling the batch if
+// it was cancelled on another replica
+func (m *Manager) heartbeat(ctx context.Context, id string, cancel context.CancelCauseFunc) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(m.cfg.Lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				status, err := m.store.RenewBatchLease(id, time.Now().Add(m.cfg.Lease))
+				if err != nil {
+					log.Printf("Error renewing lease of batch %s: %v", id, err)
+				} else if status != models.BatchRunning {
+					cancel(errBatchCancelled)
+					return
+				}
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// newID generates a random batch ID
+func newID() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
@@ -0,0 +1,282 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/metrics"
+)
+
+// keyFields are the request fields that can change a response. Others, such
+// as stream and keep_alive, only change how it is delivered.
+var keyFields = []string{
+	"model", "prompt", "suffix", "system", "template", "context", "messages",
+	"tools", "format", "options", "images", "raw", "think",
+}
+
+// Key returns a canonical hash of a request to an Ollama endpoint. Requests
+// that differ only in field order, whitespace, delivery fields or fields set
+// to their zero value hash the same.
+func Key(path string, request []byte) (string, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(request, &fields); err != nil {
+		return "", err
+	}
+
+	selected := make(map[string]interface{})
+	for _, name := range keyFields {
+		if value, ok := fields[name]; ok && !isZero(value) {
+			selected[name] = value
+		}
+	}
+	// encoding/json sorts map keys, which makes the encoding canonical
+	canonical, err := json.Marshal(selected)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(append([]byte(path+"\n"), canonical...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// isZero reports whether a decoded JSON value means the same as leaving the
+// field out
+func isZero(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// Deterministic reports whether a request asks for reproducible sampling,
+// with a temperature of zero or a fixed seed. Only such requests are worth
+// caching; anything else is expected to give a different answer each time.
+func Deterministic(request []byte) bool {
+	var req struct {
+		Options struct {
+			Temperature *float64 `json:"temperature"`
+			Seed        *int64   `json:"seed"`
+		} `json:"options"`
+	}
+	if err := json.Unmarshal(request, &req); err != nil {
+		return false
+	}
+	return (req.Options.Temperature != nil && *req.Options.Temperature == 0) || req.Options.Seed != nil
+}
+
+// Store is the persistent tier of the cache, shared by gateway replicas and
+// kept across restarts
+type Store interface {
+	GetCachedResponse(key string, now time.Time) ([]byte, time.Time, error)
+	PutCachedResponse(key string, response []byte, createdAt, expiresAt time.Time) error
+	PruneCachedResponses(now time.Time, maxEntries int) (int64, error)
+}
+
+// Config holds the cache settings
+type Config struct {
+	// TTL is how long a response is served from the cache
+	TTL time.Duration
+	// MemoryBytes bounds the size of the responses held in memory
+	MemoryBytes int64
+	// MaxEntryBytes is the largest response that is cached
+	MaxEntryBytes int
+	// StoreEntries bounds the number of responses in the Store, zero for
+	// no limit
+	StoreEntries int
+	// PruneInterval is how often expired and excess responses are deleted
+	// from the Store
+	PruneInterval time.Duration
+}
+
+// Cache holds Ollama responses in a memory LRU backed by an optional Store.
+// It is safe for concurrent use.
+type Cache struct {
+	store Store
+	cfg   Config
+	now   func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+
+	hits     *metrics.Counter
+	misses   *metrics.Counter
+	hitCount atomic.Int64
+	lookups  atomic.Int64
+}
+
+// entry is a response held in memory
+type entry struct {
+	key       string
+	response  []byte
+	expiresAt time.Time
+}
+
+// New creates a cache. store may be nil for a memory-only cache. Metrics are
+// registered with registry if it is not nil.
+func New(store Store, cfg Config, registry *metrics.Registry) *Cache {
+	if cfg.TTL <= 0 {
+		cfg.TTL = time.Hour
+	}
+	if cfg.MemoryBytes <= 0 {
+		cfg.MemoryBytes = 64 << 20
+	}
+	if cfg.MaxEntryBytes <= 0 {
+		cfg.MaxEntryBytes = 1 << 20
+	}
+	if cfg.PruneInterval <= 0 {
+		cfg.PruneInterval = 10 * time.Minute
+	}
+	c := &Cache{
+		store:   store,
+		cfg:     cfg,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	if registry != nil {
+		c.hits = registry.NewCounter("ollama_api_cache_hits_total",
+			"Requests answered from the response cache.", "tier")
+		c.misses = registry.NewCounter("ollama_api_cache_misses_total",
+			"Cacheable requests that were not in the response cache.")
+		registry.NewGaugeFunc("ollama_api_cache_hit_ratio", "Share of cacheable requests answered from the cache.",
+			c.HitRatio)
+		registry.NewGaugeFunc("ollama_api_cache_memory_bytes", "Size of the responses cached in memory.",
+			func() float64 {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				return float64(c.size)
+			})
+	}
+	return c
+}
+
+// Get returns the response cached under key, or nil
+func (c *Cache) Get(key string) []byte {
+	c.lookups.Add(1)
+	now := c.now()
+
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*entry)
+		if now.Before(e.expiresAt) {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			c.hit("memory")
+			return e.response
+		}
+		c.remove(elem)
+	}
+	c.mu.Unlock()
+
+	if c.store != nil {
+		response, expiresAt, err := c.store.GetCachedResponse(key, now)
+		if err != nil {
+			log.Printf("Error reading cached response: %v", err)
+		} else if response != nil {
+			c.remember(key, response, expiresAt)
+			c.hit("store")
+			return response
+		}
+	}
+
+	if c.misses != nil {
+		c.misses.Inc()
+	}
+	return nil
+}
+
+// Put caches a response under key. Responses larger than MaxEntryBytes are
+// not cached.
+func (c *Cache) Put(key string, response []byte) {
+	if len(response) > c.cfg.MaxEntryBytes {
+		return
+	}
+	now := c.now()
+	expiresAt := now.Add(c.cfg.TTL)
+	c.remember(key, response, expiresAt)
+
+	if c.store != nil {
+		if err := c.store.PutCachedResponse(key, response, now, expiresAt); err != nil {
+			log.Printf("Error storing cached response: %v", err)
+		}
+	}
+}
+
+// HitRatio returns the share of lookups answered from the cache since start
+func (c *Cache) HitRatio() float64 {
+	lookups := c.lookups.Load()
+	if lookups == 0 {
+		return 0
+	}
+	return float64(c.hitCount.Load()) / float64(lookups)
+}
+
+// Run prunes the Store every PruneInterval until ctx is done
+func (c *Cache) Run(ctx context.Context) {
+	if c.store == nil {
+		return
+	}
+	ticker := time.NewTicker(c.cfg.PruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := c.store.PruneCachedResponses(c.now(), c.cfg.StoreEntries); err != nil {
+				log.Printf("Error pruning response cache: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// hit records a lookup answered by tier
+func (c *Cache) hit(tier string) {
+	c.hitCount.Add(1)
+	if c.hits != nil {
+		c.hits.Inc(tier)
+	}
+}
+
+// remember adds a response to the memory tier, evicting the least recently
+// used ones to stay within MemoryBytes
+func (c *Cache) remember(key string, response []byte, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&entry{key: key, response: response, expiresAt: expiresAt})
+	c.size += int64(len(response))
+
+	for c.size > c.cfg.MemoryBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops an element from the memory tier. c.mu must be held.
+func (c *Cache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*entry)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.response))
+}
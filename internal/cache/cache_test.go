@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/metrics"
+)
+
+func TestKey(t *testing.T) {
+	base, err := Key("/api/generate", []byte(`{"model":"llama3","prompt":"hi","options":{"temperature":0,"seed":1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	same := []string{
+		`{"options": {"seed": 1, "temperature": 0}, "prompt": "hi", "model": "llama3"}`,
+		`{"model":"llama3","prompt":"hi","options":{"temperature":0,"seed":1},"stream":true,"keep_alive":"5m","apikey":"k"}`,
+		`{"model":"llama3","prompt":"hi","options":{"temperature":0.0,"seed":1},"raw":false,"images":[],"system":""}`,
+	}
+	for _, request := range same {
+		if key, _ := Key("/api/generate", []byte(request)); key != base {
+			t.Errorf("Key(%s) differs from the equivalent request", request)
+		}
+	}
+
+	different := []string{
+		`{"model":"llama3","prompt":"hi!","options":{"temperature":0,"seed":1}}`,
+		`{"model":"mistral","prompt":"hi","options":{"temperature":0,"seed":1}}`,
+		`{"model":"llama3","prompt":"hi","options":{"temperature":0,"seed":2}}`,
+		`{"model":"llama3","prompt":"hi","options":{"temperature":0,"seed":1},"raw":true}`,
+		`{"model":"llama3","prompt":"hi","options":{"temperature":0,"seed":1},"images":["aGk="]}`,
+	}
+	for _, request := range different {
+		if key, _ := Key("/api/generate", []byte(request)); key == base {
+			t.Errorf("Key(%s) matches a different request", request)
+		}
+	}
+	if key, _ := Key("/api/chat", []byte(`{"model":"llama3","prompt":"hi","options":{"temperature":0,"seed":1}}`)); key == base {
+		t.Error("Key does not depend on the endpoint")
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	tests := map[string]bool{
+		`{"model":"llama3","options":{"temperature":0}}`:             true,
+		`{"model":"llama3","options":{"seed":42,"temperature":0.8}}`: true,
+		`{"model":"llama3","options":{"temperature":0.2}}`:           false,
+		`{"model":"llama3"}`: false,
+		`not json`:           false,
+	}
+	for request, want := range tests {
+		if got := Deterministic([]byte(request)); got != want {
+			t.Errorf("Deterministic(%s) = %v, want %v", request, got, want)
+		}
+	}
+}
+
+func TestMemoryTier(t *testing.T) {
+	registry := metrics.NewRegistry()
+	c := New(nil, Config{TTL: time.Minute, MemoryBytes: 10, MaxEntryBytes: 8}, registry)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.Put("a", []byte("aaaa"))
+	c.Put("b", []byte("bbbb"))
+	c.Get("a")
+	// Evicts b, the least recently used
+	c.Put("c", []byte("cccc"))
+	// Too large to cache
+	c.Put("d", []byte("ddddddddd"))
+
+	for key, want := range map[string]string{"a": "aaaa", "b": "", "c": "cccc", "d": ""} {
+		if got := string(c.Get(key)); got != want {
+			t.Errorf("Get(%s) = %q, want %q", key, got, want)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if got := c.Get("a"); got != nil {
+		t.Errorf("Get after the TTL = %q, want nil", got)
+	}
+
+	// 3 hits out of 6 lookups
+	if ratio := c.HitRatio(); ratio != 0.5 {
+		t.Errorf("HitRatio = %v, want 0.5", ratio)
+	}
+	var out strings.Builder
+	registry.Write(&out)
+	if !strings.Contains(out.String(), `ollama_api_cache_hits_total{tier="memory"} 3`) ||
+		!strings.Contains(out.String(), "ollama_api_cache_misses_total 3") {
+		t.Errorf("unexpected metrics:\n%s", out.String())
+	}
+}
+
+func TestStoreTier(t *testing.T) {
+	database, err := db.OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	first := New(database, Config{TTL: time.Minute}, nil)
+	first.Put("a", []byte(`{"response":"hi"}`))
+
+	// Another replica, or this one after a restart, finds it in the database
+	second := New(database, Config{TTL: time.Minute}, nil)
+	if got := string(second.Get("a")); got != `{"response":"hi"}` {
+		t.Errorf("Get from the store = %q", got)
+	}
+	second.mu.Lock()
+	_, promoted := second.entries["a"]
+	second.mu.Unlock()
+	if !promoted {
+		t.Error("store hit was not kept in memory")
+	}
+
+	third := New(database, Config{TTL: time.Minute}, nil)
+	third.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if got := third.Get("a"); got != nil {
+		t.Errorf("Get of an expired stored response = %q, want nil", got)
+	}
+}
@@ -2,23 +2,35 @@ package cli
 
 import (
 	"crypto/rand"
-	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/ipfilter"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ratelimit"
+	"github.com/erock530/go-ollama-api/internal/scheduler"
+	"github.com/erock530/go-ollama-api/internal/tlsconfig"
 )
 
+// defaultRateLimit is the requests per minute of keys without a plan unless
+// changed with setratelimit
+const defaultRateLimit = 10
+
 // CLI represents the command-line interface
 type CLI struct {
-	db *db.DB
+	db db.Store
 }
 
 // NewCLI creates a new CLI instance
-func NewCLI(db *db.DB) *CLI {
+func NewCLI(db db.Store) *CLI {
 	return &CLI{db: db}
 }
 
@@ -34,11 +46,11 @@ func (c *CLI) HandleCommand(input string) {
 
 	switch command {
 	case "generatekey":
-		c.generateKey()
+		c.generateKeys(1, args)
 	case "generatekeys":
 		if len(args) > 0 {
 			if count, err := strconv.Atoi(args[0]); err == nil {
-				c.generateKeys(count)
+				c.generateKeys(count, args[1:])
 			} else {
 				fmt.Println("Invalid number of keys")
 			}
@@ -53,6 +65,122 @@ func (c *CLI) HandleCommand(input string) {
 		} else {
 			fmt.Println("Please specify the API key to remove")
 		}
+	case "setratelimit":
+		if len(args) > 1 {
+			c.setRateLimit(args[0], args[1:])
+		} else {
+			fmt.Println("Usage: setratelimit <key> <requests/min> [algorithm] [burst]")
+		}
+	case "setconcurrency":
+		if len(args) > 1 {
+			c.setConcurrency(args[0], args[1])
+		} else {
+			fmt.Println("Usage: setconcurrency <key> <max in flight, 0 for unlimited>")
+		}
+	case "setpriority":
+		if len(args) > 1 {
+			c.setPriority(args[0], args[1:])
+		} else {
+			fmt.Println("Usage: setpriority <key> <high|normal|low> [weight]")
+		}
+	case "setlimits":
+		if len(args) > 1 {
+			c.setLimits(args[0], args[1:])
+		} else {
+			fmt.Println("Usage: setlimits <key> [num_ctx=n] [num_predict=n] [keep_alive=duration]")
+		}
+	case "setcache":
+		if len(args) > 1 {
+			c.setCache(args[0], args[1])
+		} else {
+			fmt.Println("Usage: setcache <key> <on|off|default>")
+		}
+	case "setmodels":
+		if len(args) > 0 {
+			c.setModels(args[0], args[1:])
+		} else {
+			fmt.Println("Usage: setmodels <key> [model ...]")
+		}
+	case "setcidrs":
+		if len(args) > 0 {
+			c.setCIDRs(args[0], args[1:])
+		} else {
+			fmt.Println("Usage: setcidrs <key> [cidr ...]")
+		}
+	case "setscopes":
+		if len(args) > 0 {
+			c.setScopes(args[0], args[1:])
+		} else {
+			fmt.Println("Usage: setscopes <key> [scope ...]")
+		}
+	case "scopes":
+		c.listScopes()
+	case "setquota":
+		if len(args) > 1 {
+			c.setQuota(args[0], args[1])
+		} else {
+			fmt.Println("Usage: setquota <key> <tokens per day>")
+		}
+	case "listplans":
+		c.listPlans()
+	case "createplan":
+		if len(args) > 0 {
+			c.createPlan(args[0], args[1:])
+		} else {
+			fmt.Println("Usage: createplan <name> [limit=value ...]")
+		}
+	case "updateplan":
+		if len(args) > 1 {
+			c.updatePlan(args[0], args[1:])
+		} else {
+			fmt.Println("Usage: updateplan <name> <limit=value ...>")
+		}
+	case "deleteplan":
+		if len(args) > 0 {
+			c.deletePlan(args[0])
+		} else {
+			fmt.Println("Please specify the plan to delete")
+		}
+	case "setplan":
+		if len(args) > 1 {
+			c.setPlan(args[0], args[1])
+		} else {
+			fmt.Println("Usage: setplan <key> <plan|none>")
+		}
+	case "createorg":
+		if len(args) > 0 {
+			c.createOrg(args[0], strings.Join(args[1:], " "))
+		} else {
+			fmt.Println("Usage: createorg <id> [name]")
+		}
+	case "listorgs":
+		c.listOrgs()
+	case "setorg":
+		if len(args) > 1 {
+			c.setOrg(args[0], args[1])
+		} else {
+			fmt.Println("Usage: setorg <key> <org>")
+		}
+	case "setorglimits":
+		if len(args) > 1 {
+			c.setOrgLimits(args[0], args[1:])
+		} else {
+			fmt.Println("Usage: setorglimits <org> [rate_limit=n] [token_quota=n]")
+		}
+	case "setorgmodels":
+		if len(args) > 0 {
+			c.setOrgModels(args[0], args[1:])
+		} else {
+			fmt.Println("Usage: setorgmodels <org> [model ...]")
+		}
+	case "deleteorg":
+		if len(args) > 0 {
+			c.deleteOrg(args[0])
+		} else {
+			fmt.Println("Please specify the organization to delete")
+		}
+	case "orgusage":
+		c.orgUsageReport(args)
 	case "addwebhook":
 		if len(args) > 0 {
 			c.addWebhook(args[0])
@@ -71,6 +199,28 @@ func (c *CLI) HandleCommand(input string) {
 		}
 	case "listwebhooks":
 		c.listWebhooks()
+	case "mapcert":
+		if len(args) > 1 {
+			c.mapCert(args[0], strings.Join(args[1:], " "))
+		} else {
+			fmt.Println("Usage: mapcert <key> <identity>")
+		}
+	case "unmapcert":
+		if len(args) > 0 {
+			c.unmapCert(strings.Join(args, " "))
+		} else {
+			fmt.Println("Usage: unmapcert <identity>")
+		}
+	case "listcerts":
+		c.listCerts()
+	case "usage":
+		c.usageReport(args)
+	case "db":
+		if len(args) > 0 && args[0] == "migrate" {
+			c.migrate(args[1:])
+		} else {
+			fmt.Println("Usage: db migrate status|up [steps]|down [steps]")
+		}
 	case "help":
 		c.printHelp()
 	default:
@@ -78,19 +228,21 @@ func (c *CLI) HandleCommand(input string) {
 	}
 }
 
-// generateKey generates a single API key
-func (c *CLI) generateKey() {
+// generateKey generates a single API key with the given scopes
+func (c *CLI) generateKey(scopes []string) {
 	key, err := generateRandomKey()
 	if err != nil {
 		log.Printf("Error generating key: %v", err)
 		return
 	}
 
-	_, err = c.db.Exec(`
-		INSERT INTO apiKeys (key, rate_limit) 
-		VALUES (?, 10)`,
-		key,
-	)
+	err = c.db.CreateAPIKey(&models.APIKey{
+		Key:       key,
+		Tokens:    10,
+		RateLimit: defaultRateLimit,
+		Active:    true,
+		Scopes:    scopes,
+	})
 	if err != nil {
 		log.Printf("Error saving API key: %v", err)
 		return
@@ -99,45 +251,114 @@ func (c *CLI) generateKey() {
 	fmt.Printf("Generated API key: %s\n", key)
 }
 
-// generateKeys generates multiple API keys
-func (c *CLI) generateKeys(count int) {
+// generateKeys generates multiple API keys. Scopes and presets may be named;
+// without any the keys get the default scopes.
+func (c *CLI) generateKeys(count int, names []string) {
+	scopes, err := models.ExpandScopes(names)
+	if err != nil {
+		printScopeError(err)
+		return
+	}
 	for i := 0; i < count; i++ {
-		c.generateKey()
+		c.generateKey(scopes)
 	}
 }
 
 // listKeys lists all API keys
 func (c *CLI) listKeys() {
-	rows, err := c.db.Query(`
-		SELECT key, created_at, last_used, tokens, rate_limit, active, description 
-		FROM apiKeys
-	`)
+	keys, err := c.db.ListAPIKeys()
 	if err != nil {
 		log.Printf("Error listing API keys: %v", err)
 		return
 	}
-	defer rows.Close()
+	plans, err := c.db.ListPlans()
+	if err != nil {
+		log.Printf("Error listing plans: %v", err)
+		return
+	}
+	planByName := make(map[string]*models.Plan, len(plans))
+	for i := range plans {
+		planByName[plans[i].Name] = &plans[i]
+	}
 
 	fmt.Println("\nAPI Keys:")
 	fmt.Println("----------------------------------------")
-	for rows.Next() {
-		var key string
-		var description sql.NullString
-		var createdAt, lastUsed string
-		var tokens, rateLimit int
-		var active bool
-		if err := rows.Scan(&key, &createdAt, &lastUsed, &tokens, &rateLimit, &active, &description); err != nil {
-			log.Printf("Error scanning row: %v", err)
-			continue
-		}
-		fmt.Printf("Key: %s\n", key)
-		fmt.Printf("Created: %s\n", createdAt)
-		fmt.Printf("Last Used: %s\n", lastUsed)
-		fmt.Printf("Tokens: %d\n", tokens)
-		fmt.Printf("Rate Limit: %d\n", rateLimit)
-		fmt.Printf("Active: %v\n", active)
-		if description.Valid {
-			fmt.Printf("Description: %s\n", description.String)
+	for _, key := range keys {
+		key.Plan = planByName[key.PlanName]
+		// The limits shown are the ones in force, marked where they come
+		// from the plan rather than the key
+		effective := key.Effective()
+		from := func(own bool) string {
+			if own || key.Plan == nil {
+				return ""
+			}
+			return " (plan)"
+		}
+
+		fmt.Printf("Key: %s\n", key.Key)
+		fmt.Printf("Created: %s\n", key.CreatedAt.Format(time.RFC3339))
+		fmt.Printf("Last Used: %s\n", key.LastUsed.Format(time.RFC3339))
+		if key.PlanName != "" {
+			if key.Plan == nil {
+				fmt.Printf("Plan: %s (missing)\n", key.PlanName)
+			} else {
+				fmt.Printf("Plan: %s\n", key.PlanName)
+			}
+		}
+		fmt.Printf("Tokens: %d\n", key.Tokens)
+		fmt.Printf("Rate Limit: %d%s\n", effective.RateLimit, from(key.RateLimit > 0))
+		if effective.RateLimitAlgorithm != "" {
+			fmt.Printf("Algorithm: %s%s\n", effective.RateLimitAlgorithm, from(key.RateLimitAlgorithm != ""))
+		}
+		if effective.RateLimitBurst > 0 {
+			fmt.Printf("Burst: %d%s\n", effective.RateLimitBurst, from(key.RateLimitBurst > 0))
+		}
+		used, err := c.db.GetKeyTokens(key.Key, time.Now())
+		if err != nil {
+			log.Printf("Error reading API key tokens: %v", err)
+			return
+		}
+		if effective.TokenQuota > 0 {
+			fmt.Printf("Tokens Today: %d of %d%s\n", used, effective.TokenQuota, from(key.TokenQuota > 0))
+		} else if used > 0 {
+			fmt.Printf("Tokens Today: %d\n", used)
+		}
+		if effective.MaxConcurrent > 0 {
+			fmt.Printf("Max Concurrent: %d%s\n", effective.MaxConcurrent, from(key.MaxConcurrent > 0))
+		}
+		if effective.Priority != "" {
+			fmt.Printf("Priority: %s%s\n", effective.Priority, from(key.Priority != ""))
+		}
+		if effective.QueueWeight > 0 {
+			fmt.Printf("Queue Weight: %d%s\n", effective.QueueWeight, from(key.QueueWeight > 0))
+		}
+		if key.MaxNumCtx > 0 {
+			fmt.Printf("Max num_ctx: %d\n", key.MaxNumCtx)
+		}
+		if key.MaxNumPredict > 0 {
+			fmt.Printf("Max num_predict: %d\n", key.MaxNumPredict)
+		}
+		if key.MaxKeepAlive > 0 {
+			fmt.Printf("Max keep_alive: %v\n", key.MaxKeepAlive)
+		}
+		if key.ResponseCache != "" {
+			fmt.Printf("Response Cache: %s\n", key.ResponseCache)
+		}
+		if len(effective.AllowedModels) > 0 {
+			fmt.Printf("Allowed Models: %s%s\n", strings.Join(effective.AllowedModels, ", "), from(len(key.AllowedModels) > 0))
+		}
+		if len(key.AllowedCIDRs) > 0 {
+			fmt.Printf("Allowed CIDRs: %s\n", strings.Join(key.AllowedCIDRs, ", "))
+		}
+		if len(key.Scopes) > 0 {
+			fmt.Printf("Scopes: %s\n", strings.Join(key.Scopes, ", "))
+		} else {
+			fmt.Printf("Scopes: %s (default)\n", strings.Join(models.DefaultScopes, ", "))
+		}
+		fmt.Printf("Organization: %s\n", key.OrgID)
+		fmt.Printf("Active: %v\n", key.Active)
+		if key.Description.Valid {
+			fmt.Printf("Description: %s\n", key.Description.String)
 		}
 		fmt.Println("----------------------------------------")
 	}
@@ -145,23 +366,739 @@ func (c *CLI) listKeys() {
 
 // removeKey removes an API key
 func (c *CLI) removeKey(key string) {
-	result, err := c.db.Exec("DELETE FROM apiKeys WHERE key = ?", key)
+	err := c.db.DeleteAPIKey(key)
+	if errors.Is(err, db.ErrNotFound) {
+		fmt.Println("No API key found with that value")
+		return
+	}
 	if err != nil {
 		log.Printf("Error removing API key: %v", err)
 		return
 	}
+	fmt.Println("API key removed successfully")
+}
+
+// setRateLimit changes the rate limit of an API key. The algorithm and burst
+// are optional; "default" clears the algorithm so the server default applies.
+func (c *CLI) setRateLimit(key string, args []string) {
+	apiKey, err := c.db.GetAPIKey(key)
+	if err != nil {
+		log.Printf("Error reading API key: %v", err)
+		return
+	}
+	if apiKey == nil {
+		fmt.Println("No API key found with that value")
+		return
+	}
+
+	requests, err := strconv.Atoi(args[0])
+	if err != nil || requests <= 0 {
+		fmt.Println("Invalid number of requests per minute")
+		return
+	}
+	apiKey.RateLimit = requests
+
+	if len(args) > 1 {
+		name := args[1]
+		if name == "default" {
+			name = ""
+		}
+		algorithm, err := ratelimit.ParseAlgorithm(name)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		apiKey.RateLimitAlgorithm = string(algorithm)
+	}
+	if len(args) > 2 {
+		burst, err := strconv.Atoi(args[2])
+		if err != nil || burst < 0 {
+			fmt.Println("Invalid burst")
+			return
+		}
+		apiKey.RateLimitBurst = burst
+	}
+
+	if err := c.db.UpdateAPIKey(apiKey); err != nil {
+		log.Printf("Error updating API key: %v", err)
+		return
+	}
+	fmt.Println("Rate limit updated successfully")
+}
+
+// setConcurrency changes how many generations an API key may have in flight
+func (c *CLI) setConcurrency(key, value string) {
+	max, err := strconv.Atoi(value)
+	if err != nil || max < 0 {
+		fmt.Println("Invalid number of concurrent requests")
+		return
+	}
+
+	apiKey, err := c.db.GetAPIKey(key)
+	if err != nil {
+		log.Printf("Error reading API key: %v", err)
+		return
+	}
+	if apiKey == nil {
+		fmt.Println("No API key found with that value")
+		return
+	}
+
+	apiKey.MaxConcurrent = max
+	if err := c.db.UpdateAPIKey(apiKey); err != nil {
+		log.Printf("Error updating API key: %v", err)
+		return
+	}
+	fmt.Println("Concurrency limit updated successfully")
+}
+
+// setPriority changes the scheduling class and weight of an API key
+func (c *CLI) setPriority(key string, args []string) {
+	priority, err := scheduler.ParsePriority(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	apiKey, err := c.db.GetAPIKey(key)
+	if err != nil {
+		log.Printf("Error reading API key: %v", err)
+		return
+	}
+	if apiKey == nil {
+		fmt.Println("No API key found with that value")
+		return
+	}
+
+	apiKey.Priority = string(priority)
+	if len(args) > 1 {
+		weight, err := strconv.Atoi(args[1])
+		if err != nil || weight < 1 {
+			fmt.Println("Invalid weight")
+			return
+		}
+		apiKey.QueueWeight = weight
+	}
+
+	if err := c.db.UpdateAPIKey(apiKey); err != nil {
+		log.Printf("Error updating API key: %v", err)
+		return
+	}
+	fmt.Println("Priority updated successfully")
+}
+
+// setLimits changes the Ollama options limits of an API key. Limits that
+// are not given are left as they are; a value of 0 removes a limit.
+func (c *CLI) setLimits(key string, args []string) {
+	apiKey, err := c.db.GetAPIKey(key)
+	if err != nil {
+		log.Printf("Error reading API key: %v", err)
+		return
+	}
+	if apiKey == nil {
+		fmt.Println("No API key found with that value")
+		return
+	}
+
+	for _, arg := range args {
+		name, value, _ := strings.Cut(arg, "=")
+		switch name {
+		case "num_ctx", "num_predict":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				fmt.Printf("Invalid %s limit %q\n", name, value)
+				return
+			}
+			if name == "num_ctx" {
+				apiKey.MaxNumCtx = n
+			} else {
+				apiKey.MaxNumPredict = n
+			}
+		case "keep_alive":
+			d, err := time.ParseDuration(value)
+			if value == "0" {
+				d, err = 0, nil
+			}
+			if err != nil || d < 0 || d%time.Second != 0 {
+				fmt.Printf("Invalid keep_alive limit %q, expected whole seconds such as 30m\n", value)
+				return
+			}
+			apiKey.MaxKeepAlive = d
+		default:
+			fmt.Printf("Unknown limit %q, expected num_ctx, num_predict or keep_alive\n", name)
+			return
+		}
+	}
+
+	if err := c.db.UpdateAPIKey(apiKey); err != nil {
+		log.Printf("Error updating API key: %v", err)
+		return
+	}
+	fmt.Println("Option limits updated successfully")
+}
+
+// setCache opts an API key in or out of the response cache. "default"
+// follows the server's -cache-opt-in setting.
+func (c *CLI) setCache(key, mode string) {
+	switch mode {
+	case "on", "off":
+	case "default":
+		mode = ""
+	default:
+		fmt.Println("Cache setting must be on, off or default")
+		return
+	}
+
+	apiKey, err := c.db.GetAPIKey(key)
+	if err != nil {
+		log.Printf("Error reading API key: %v", err)
+		return
+	}
+	if apiKey == nil {
+		fmt.Println("No API key found with that value")
+		return
+	}
+
+	apiKey.ResponseCache = mode
+	if err := c.db.UpdateAPIKey(apiKey); err != nil {
+		log.Printf("Error updating API key: %v", err)
+		return
+	}
+	fmt.Println("Response cache setting updated successfully")
+}
+
+// setModels limits the models an API key may use. Models may use *
+// wildcards, such as qwen2.5:*; no models allows all.
+func (c *CLI) setModels(key string, allowed []string) {
+	for _, model := range allowed {
+		if _, err := path.Match(model, ""); err != nil || strings.Contains(model, ",") {
+			fmt.Printf("Invalid model pattern %q\n", model)
+			return
+		}
+	}
+
+	apiKey, err := c.db.GetAPIKey(key)
+	if err != nil {
+		log.Printf("Error reading API key: %v", err)
+		return
+	}
+	if apiKey == nil {
+		fmt.Println("No API key found with that value")
+		return
+	}
+
+	apiKey.AllowedModels = allowed
+	if err := c.db.UpdateAPIKey(apiKey); err != nil {
+		log.Printf("Error updating API key: %v", err)
+		return
+	}
+	fmt.Println("Allowed models updated successfully")
+}
+
+// setCIDRs limits the addresses an API key may be used from to the given
+// CIDRs or single addresses; none allows all
+func (c *CLI) setCIDRs(key string, entries []string) {
+	list, err := ipfilter.ParseList(entries)
+	if err != nil {
+		fmt.Printf("Cannot set allowed CIDRs: %v\n", err)
+		return
+	}
+
+	apiKey, err := c.db.GetAPIKey(key)
+	if err != nil {
+		log.Printf("Error reading API key: %v", err)
+		return
+	}
+	if apiKey == nil {
+		fmt.Println("No API key found with that value")
+		return
+	}
+
+	apiKey.AllowedCIDRs = nil
+	for _, prefix := range list {
+		apiKey.AllowedCIDRs = append(apiKey.AllowedCIDRs, prefix.String())
+	}
+	if err := c.db.UpdateAPIKey(apiKey); err != nil {
+		log.Printf("Error updating API key: %v", err)
+		return
+	}
+	fmt.Println("Allowed CIDRs updated successfully")
+}
+
+// setScopes replaces the scopes of an API key with the named scopes and
+// presets; none restores the default scopes
+func (c *CLI) setScopes(key string, names []string) {
+	scopes, err := models.ExpandScopes(names)
+	if err != nil {
+		printScopeError(err)
+		return
+	}
+
+	apiKey, err := c.db.GetAPIKey(key)
+	if err != nil {
+		log.Printf("Error reading API key: %v", err)
+		return
+	}
+	if apiKey == nil {
+		fmt.Println("No API key found with that value")
+		return
+	}
+
+	apiKey.Scopes = scopes
+	if err := c.db.UpdateAPIKey(apiKey); err != nil {
+		log.Printf("Error updating API key: %v", err)
+		return
+	}
+	fmt.Println("Scopes updated successfully")
+}
+
+// listScopes prints the scopes and the presets that bundle them
+func (c *CLI) listScopes() {
+	fmt.Printf("\nScopes: %s\n", strings.Join(models.AllScopes, ", "))
+	fmt.Printf("Default: %s\n", strings.Join(models.DefaultScopes, ", "))
+	fmt.Println("Presets:")
+	presets := make([]string, 0, len(models.ScopePresets))
+	for name := range models.ScopePresets {
+		presets = append(presets, name)
+	}
+	sort.Strings(presets)
+	for _, name := range presets {
+		fmt.Printf("  %-10s %s\n", name, strings.Join(models.ScopePresets[name], ", "))
+	}
+}
+
+// printScopeError reports an unknown scope or preset
+func printScopeError(err error) {
+	fmt.Printf("Invalid scopes: %v. Type 'scopes' to list them.\n", err)
+}
+
+// setQuota changes the tokens an API key may use per UTC day. Zero removes
+// the key's own quota, leaving it unlimited or with its plan's.
+func (c *CLI) setQuota(key, value string) {
+	tokens, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || tokens < 0 {
+		fmt.Println("Invalid number of tokens per day")
+		return
+	}
+
+	apiKey, err := c.db.GetAPIKey(key)
+	if err != nil {
+		log.Printf("Error reading API key: %v", err)
+		return
+	}
+	if apiKey == nil {
+		fmt.Println("No API key found with that value")
+		return
+	}
+
+	apiKey.TokenQuota = tokens
+	if err := c.db.UpdateAPIKey(apiKey); err != nil {
+		log.Printf("Error updating API key: %v", err)
+		return
+	}
+	fmt.Println("Token quota updated successfully")
+}
+
+// listPlans lists all plans with their limits
+func (c *CLI) listPlans() {
+	plans, err := c.db.ListPlans()
+	if err != nil {
+		log.Printf("Error listing plans: %v", err)
+		return
+	}
+
+	fmt.Println("\nPlans:")
+	fmt.Println("----------------------------------------")
+	for _, plan := range plans {
+		fmt.Printf("Name: %s\n", plan.Name)
+		fmt.Printf("Rate Limit: %d\n", plan.RateLimit)
+		if plan.RateLimitAlgorithm != "" {
+			fmt.Printf("Algorithm: %s\n", plan.RateLimitAlgorithm)
+		}
+		if plan.RateLimitBurst > 0 {
+			fmt.Printf("Burst: %d\n", plan.RateLimitBurst)
+		}
+		if plan.TokenQuota > 0 {
+			fmt.Printf("Token Quota: %d per day\n", plan.TokenQuota)
+		}
+		if plan.MaxConcurrent > 0 {
+			fmt.Printf("Max Concurrent: %d\n", plan.MaxConcurrent)
+		}
+		if plan.Priority != "" {
+			fmt.Printf("Priority: %s\n", plan.Priority)
+		}
+		if plan.QueueWeight > 0 {
+			fmt.Printf("Queue Weight: %d\n", plan.QueueWeight)
+		}
+		if len(plan.AllowedModels) > 0 {
+			fmt.Printf("Allowed Models: %s\n", strings.Join(plan.AllowedModels, ", "))
+		}
+		fmt.Println("----------------------------------------")
+	}
+}
+
+// setPlanLimits changes the limits of a plan given as limit=value
+// arguments, leaving the others as they are
+func setPlanLimits(plan *models.Plan, args []string) error {
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("expected limit=value, got %q", arg)
+		}
+		switch name {
+		case "rate_limit", "burst", "max_concurrent", "weight":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid %s %q", name, value)
+			}
+			switch name {
+			case "rate_limit":
+				plan.RateLimit = n
+			case "burst":
+				plan.RateLimitBurst = n
+			case "max_concurrent":
+				plan.MaxConcurrent = n
+			default:
+				plan.QueueWeight = n
+			}
+		case "token_quota":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid token_quota %q", value)
+			}
+			plan.TokenQuota = n
+		case "algorithm":
+			if value == "default" {
+				value = ""
+			}
+			algorithm, err := ratelimit.ParseAlgorithm(value)
+			if err != nil {
+				return err
+			}
+			plan.RateLimitAlgorithm = string(algorithm)
+		case "priority":
+			priority, err := scheduler.ParsePriority(value)
+			if err != nil {
+				return err
+			}
+			plan.Priority = string(priority)
+		case "models":
+			plan.AllowedModels = splitModels(value)
+			for _, model := range plan.AllowedModels {
+				if _, err := path.Match(model, ""); err != nil {
+					return fmt.Errorf("invalid model pattern %q", model)
+				}
+			}
+		default:
+			return fmt.Errorf("unknown limit %q, expected rate_limit, algorithm, burst, token_quota, max_concurrent, priority, weight or models", name)
+		}
+	}
+	return nil
+}
+
+// splitModels reads a comma-separated list of models; an empty value is
+// no models
+func splitModels(value string) []string {
+	var list []string
+	for _, model := range strings.Split(value, ",") {
+		if model != "" {
+			list = append(list, model)
+		}
+	}
+	return list
+}
+
+// createPlan creates a plan with the given limits
+func (c *CLI) createPlan(name string, args []string) {
+	if !models.ValidPlanName(name) {
+		fmt.Println("Plan names are 1 to 64 lowercase letters, digits, - or _")
+		return
+	}
+	existing, err := c.db.GetPlan(name)
+	if err != nil {
+		log.Printf("Error reading plan: %v", err)
+		return
+	}
+	if existing != nil {
+		fmt.Println("A plan with that name already exists")
+		return
+	}
+
+	plan := &models.Plan{Name: name}
+	if err := setPlanLimits(plan, args); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if plan.RateLimit == 0 {
+		fmt.Println("A plan needs a rate_limit")
+		return
+	}
+	if err := c.db.CreatePlan(plan); err != nil {
+		log.Printf("Error creating plan: %v", err)
+		return
+	}
+	fmt.Printf("Created plan: %s\n", name)
+}
 
-	if rows, _ := result.RowsAffected(); rows == 0 {
+// updatePlan changes the limits of a plan. Its keys use the new limits from
+// their next request on.
+func (c *CLI) updatePlan(name string, args []string) {
+	plan, err := c.db.GetPlan(name)
+	if err != nil {
+		log.Printf("Error reading plan: %v", err)
+		return
+	}
+	if plan == nil {
+		fmt.Println("No plan found with that name")
+		return
+	}
+
+	if err := setPlanLimits(plan, args); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if plan.RateLimit == 0 {
+		fmt.Println("A plan needs a rate_limit")
+		return
+	}
+	if err := c.db.UpdatePlan(plan); err != nil {
+		log.Printf("Error updating plan: %v", err)
+		return
+	}
+	fmt.Println("Plan updated successfully")
+}
+
+// deletePlan deletes a plan no key uses
+func (c *CLI) deletePlan(name string) {
+	err := c.db.DeletePlan(name)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		fmt.Println("No plan found with that name")
+	case errors.Is(err, db.ErrInUse):
+		fmt.Println("The plan is still used by keys")
+	case err != nil:
+		log.Printf("Error deleting plan: %v", err)
+	default:
+		fmt.Println("Plan deleted successfully")
+	}
+}
+
+// setPlan moves an API key onto a plan. The key's own limits are cleared so
+// that it takes all of them from the plan; set them again to override the
+// plan. "none" takes the key off its plan, keeping the limits it had as its
+// own.
+func (c *CLI) setPlan(key, name string) {
+	apiKey, err := c.db.GetAPIKey(key)
+	if err != nil {
+		log.Printf("Error reading API key: %v", err)
+		return
+	}
+	if apiKey == nil {
 		fmt.Println("No API key found with that value")
+		return
+	}
+
+	if name == "none" {
+		apiKey = apiKey.Effective()
+		apiKey.PlanName = ""
+		if apiKey.RateLimit <= 0 {
+			apiKey.RateLimit = defaultRateLimit
+		}
 	} else {
-		fmt.Println("API key removed successfully")
+		plan, err := c.db.GetPlan(name)
+		if err != nil {
+			log.Printf("Error reading plan: %v", err)
+			return
+		}
+		if plan == nil {
+			fmt.Println("No plan found with that name")
+			return
+		}
+		apiKey.ClearOverrides()
+		apiKey.PlanName = plan.Name
+	}
+
+	if err := c.db.UpdateAPIKey(apiKey); err != nil {
+		log.Printf("Error updating API key: %v", err)
+		return
+	}
+	fmt.Println("Plan updated successfully")
+}
+
+// createOrg creates an organization with no limits
+func (c *CLI) createOrg(id, name string) {
+	if !models.ValidOrgID(id) {
+		fmt.Println("Organization IDs are 1 to 64 lowercase letters, digits, - or _")
+		return
+	}
+	existing, err := c.db.GetOrg(id)
+	if err != nil {
+		log.Printf("Error reading organization: %v", err)
+		return
+	}
+	if existing != nil {
+		fmt.Println("An organization with that ID already exists")
+		return
+	}
+	if name == "" {
+		name = id
+	}
+	if err := c.db.CreateOrg(&models.Org{ID: id, Name: name}); err != nil {
+		log.Printf("Error creating organization: %v", err)
+		return
+	}
+	fmt.Printf("Created organization: %s\n", id)
+}
+
+// listOrgs lists all organizations with their limits and today's tokens
+func (c *CLI) listOrgs() {
+	orgs, err := c.db.ListOrgs()
+	if err != nil {
+		log.Printf("Error listing organizations: %v", err)
+		return
+	}
+
+	fmt.Println("\nOrganizations:")
+	fmt.Println("----------------------------------------")
+	for _, org := range orgs {
+		keys, err := c.db.CountOrgKeys(org.ID)
+		if err != nil {
+			log.Printf("Error counting organization keys: %v", err)
+			return
+		}
+		tokens, err := c.db.GetOrgTokens(org.ID, time.Now())
+		if err != nil {
+			log.Printf("Error reading organization tokens: %v", err)
+			return
+		}
+		fmt.Printf("ID: %s\n", org.ID)
+		fmt.Printf("Name: %s\n", org.Name)
+		fmt.Printf("Created: %s\n", org.CreatedAt.Format(time.RFC3339))
+		fmt.Printf("Keys: %d\n", keys)
+		if org.RateLimit > 0 {
+			fmt.Printf("Rate Limit: %d\n", org.RateLimit)
+		}
+		if org.TokenQuota > 0 {
+			fmt.Printf("Tokens Today: %d of %d\n", tokens, org.TokenQuota)
+		} else {
+			fmt.Printf("Tokens Today: %d\n", tokens)
+		}
+		if len(org.AllowedModels) > 0 {
+			fmt.Printf("Allowed Models: %s\n", strings.Join(org.AllowedModels, ", "))
+		}
+		fmt.Println("----------------------------------------")
+	}
+}
+
+// findOrg reads an organization, printing a message if it does not exist
+func (c *CLI) findOrg(id string) *models.Org {
+	org, err := c.db.GetOrg(id)
+	if err != nil {
+		log.Printf("Error reading organization: %v", err)
+		return nil
+	}
+	if org == nil {
+		fmt.Println("No organization found with that ID")
+	}
+	return org
+}
+
+// setOrg moves an API key into an organization
+func (c *CLI) setOrg(key, orgID string) {
+	if c.findOrg(orgID) == nil {
+		return
+	}
+	apiKey, err := c.db.GetAPIKey(key)
+	if err != nil {
+		log.Printf("Error reading API key: %v", err)
+		return
+	}
+	if apiKey == nil {
+		fmt.Println("No API key found with that value")
+		return
+	}
+
+	apiKey.OrgID = orgID
+	if err := c.db.UpdateAPIKey(apiKey); err != nil {
+		log.Printf("Error updating API key: %v", err)
+		return
+	}
+	fmt.Println("Organization updated successfully")
+}
+
+// setOrgLimits changes the requests per minute and daily tokens an
+// organization's keys share. Limits that are not given are left unchanged.
+func (c *CLI) setOrgLimits(id string, args []string) {
+	org := c.findOrg(id)
+	if org == nil {
+		return
+	}
+
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		n, err := strconv.ParseInt(value, 10, 64)
+		if !ok || err != nil || n < 0 {
+			fmt.Printf("Invalid limit %q\n", arg)
+			return
+		}
+		switch name {
+		case "rate_limit":
+			org.RateLimit = int(n)
+		case "token_quota":
+			org.TokenQuota = n
+		default:
+			fmt.Printf("Unknown limit %q. Use rate_limit or token_quota.\n", name)
+			return
+		}
+	}
+
+	if err := c.db.UpdateOrg(org); err != nil {
+		log.Printf("Error updating organization: %v", err)
+		return
+	}
+	fmt.Println("Organization limits updated successfully")
+}
+
+// setOrgModels limits the models all of an organization's keys may use, on
+// top of any limits of the keys themselves; no models allows all
+func (c *CLI) setOrgModels(id string, allowed []string) {
+	for _, model := range allowed {
+		if _, err := path.Match(model, ""); err != nil || strings.Contains(model, ",") {
+			fmt.Printf("Invalid model pattern %q\n", model)
+			return
+		}
+	}
+	org := c.findOrg(id)
+	if org == nil {
+		return
+	}
+
+	org.AllowedModels = allowed
+	if err := c.db.UpdateOrg(org); err != nil {
+		log.Printf("Error updating organization: %v", err)
+		return
+	}
+	fmt.Println("Allowed models updated successfully")
+}
+
+// deleteOrg deletes an organization that owns no keys
+func (c *CLI) deleteOrg(id string) {
+	err := c.db.DeleteOrg(id)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		fmt.Println("No organization found with that ID")
+	case errors.Is(err, db.ErrInUse):
+		fmt.Println("The organization still owns keys or is the default organization")
+	case err != nil:
+		log.Printf("Error deleting organization: %v", err)
+	default:
+		fmt.Println("Organization deleted successfully")
 	}
 }
 
 // addWebhook adds a new webhook
 func (c *CLI) addWebhook(url string) {
-	_, err := c.db.Exec("INSERT INTO webhooks (url) VALUES (?)", url)
-	if err != nil {
+	if err := c.db.AddWebhook(url); err != nil {
 		log.Printf("Error adding webhook: %v", err)
 		return
 	}
@@ -170,53 +1107,252 @@ func (c *CLI) addWebhook(url string) {
 
 // deleteWebhook deletes a webhook
 func (c *CLI) deleteWebhook(id int64) {
-	result, err := c.db.Exec("DELETE FROM webhooks WHERE id = ?", id)
+	err := c.db.DeleteWebhook(id)
+	if errors.Is(err, db.ErrNotFound) {
+		fmt.Println("No webhook found with that ID")
+		return
+	}
 	if err != nil {
 		log.Printf("Error deleting webhook: %v", err)
 		return
 	}
-
-	if rows, _ := result.RowsAffected(); rows == 0 {
-		fmt.Println("No webhook found with that ID")
-	} else {
-		fmt.Println("Webhook deleted successfully")
-	}
+	fmt.Println("Webhook deleted successfully")
 }
 
 // listWebhooks lists all webhooks
 func (c *CLI) listWebhooks() {
-	rows, err := c.db.Query("SELECT id, url FROM webhooks")
+	webhooks, err := c.db.GetWebhooks()
 	if err != nil {
 		log.Printf("Error listing webhooks: %v", err)
 		return
 	}
-	defer rows.Close()
 
 	fmt.Println("\nWebhooks:")
 	fmt.Println("----------------------------------------")
-	for rows.Next() {
-		var id int64
-		var url string
-		if err := rows.Scan(&id, &url); err != nil {
-			log.Printf("Error scanning row: %v", err)
-			continue
-		}
-		fmt.Printf("ID: %d\n", id)
-		fmt.Printf("URL: %s\n", url)
+	for _, webhook := range webhooks {
+		fmt.Printf("ID: %d\n", webhook.ID)
+		fmt.Printf("URL: %s\n", webhook.URL)
 		fmt.Println("----------------------------------------")
 	}
 }
 
+// mapCert makes requests with a client certificate that has identity,
+// such as cn:app or dns:app.example.org, use an API key
+func (c *CLI) mapCert(key, identity string) {
+	if !tlsconfig.ValidIdentity(identity) {
+		fmt.Println("Identities are subject:, cn:, dns:, email:, uri: or ip: followed by a name")
+		return
+	}
+	apiKey, err := c.db.GetAPIKey(key)
+	if err != nil {
+		log.Printf("Error reading API key: %v", err)
+		return
+	}
+	if apiKey == nil {
+		fmt.Println("No API key found with that value")
+		return
+	}
+	if err := c.db.MapCertIdentity(identity, key); err != nil {
+		log.Printf("Error mapping certificate identity: %v", err)
+		return
+	}
+	fmt.Printf("Client certificates with %s now use the API key\n", identity)
+}
+
+// unmapCert removes the mapping of a client certificate identity
+func (c *CLI) unmapCert(identity string) {
+	err := c.db.UnmapCertIdentity(identity)
+	if errors.Is(err, db.ErrNotFound) {
+		fmt.Println("That identity is not mapped")
+		return
+	}
+	if err != nil {
+		log.Printf("Error unmapping certificate identity: %v", err)
+		return
+	}
+	fmt.Println("Certificate identity unmapped successfully")
+}
+
+// listCerts lists the client certificate identities mapped to API keys
+func (c *CLI) listCerts() {
+	identities, err := c.db.ListCertIdentities()
+	if err != nil {
+		log.Printf("Error listing certificate identities: %v", err)
+		return
+	}
+
+	fmt.Println("\nClient Certificate Identities:")
+	fmt.Println("----------------------------------------")
+	for _, identity := range identities {
+		fmt.Printf("Identity: %s\n", identity.Identity)
+		fmt.Printf("Key: %s\n", identity.Key)
+		fmt.Printf("Mapped: %s\n", identity.CreatedAt.Format(time.RFC3339))
+		fmt.Println("----------------------------------------")
+	}
+}
+
+// usageReport prints aggregated API usage
+func (c *CLI) usageReport(args []string) {
+	key, granularity, days := parseUsageArgs(args)
+	buckets, err := c.db.GetUsageReport(key, time.Now().AddDate(0, 0, -days), granularity)
+	if err != nil {
+		log.Printf("Error getting usage report: %v", err)
+		return
+	}
+	printUsage("API Usage", buckets, granularity, days)
+}
+
+// orgUsageReport prints aggregated API usage by organization
+func (c *CLI) orgUsageReport(args []string) {
+	org, granularity, days := parseUsageArgs(args)
+	buckets, err := c.db.GetOrgUsageReport(org, time.Now().AddDate(0, 0, -days), granularity)
+	if err != nil {
+		log.Printf("Error getting usage report: %v", err)
+		return
+	}
+	printUsage("Organization Usage", buckets, granularity, days)
+}
+
+// parseUsageArgs reads the optional key or organization, granularity and
+// number of days of a usage command
+func parseUsageArgs(args []string) (name string, granularity models.UsageGranularity, days int) {
+	granularity, days = models.UsageDaily, 7
+	for _, arg := range args {
+		switch {
+		case arg == string(models.UsageHourly) || arg == string(models.UsageDaily):
+			granularity = models.UsageGranularity(arg)
+		case isNumber(arg):
+			days, _ = strconv.Atoi(arg)
+		default:
+			name = arg
+		}
+	}
+	return name, granularity, days
+}
+
+// printUsage prints usage buckets with their total
+func printUsage(title string, buckets []models.UsageBucket, granularity models.UsageGranularity, days int) {
+	layout := "2006-01-02"
+	if granularity == models.UsageHourly {
+		layout = "2006-01-02 15:00"
+	}
+
+	fmt.Printf("\n%s (%s, last %d days):\n", title, granularity, days)
+	fmt.Println("----------------------------------------")
+	var total int64
+	for _, bucket := range buckets {
+		name := bucket.Key
+		if bucket.Org != "" {
+			name = bucket.Org
+		}
+		fmt.Printf("%s  %s  %d\n", bucket.Period.Format(layout), name, bucket.Requests)
+		total += bucket.Requests
+	}
+	fmt.Println("----------------------------------------")
+	fmt.Printf("Total requests: %d\n", total)
+}
+
+// migrate shows or changes the database schema version
+func (c *CLI) migrate(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: db migrate status|up [steps]|down [steps]")
+		return
+	}
+
+	steps := 0
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			fmt.Println("Invalid number of steps")
+			return
+		}
+		steps = n
+	}
+
+	switch args[0] {
+	case "status":
+		statuses, err := c.db.MigrationStatus()
+		if err != nil {
+			log.Printf("Error reading migration status: %v", err)
+			return
+		}
+		fmt.Println("\nMigrations:")
+		fmt.Println("----------------------------------------")
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%3d  %-30s %s\n", status.Version, status.Name, state)
+		}
+	case "up":
+		if steps == 0 {
+			steps = c.db.LatestVersion()
+		}
+		applied, err := c.db.MigrateUp(steps)
+		if err != nil {
+			log.Printf("Error applying migrations: %v", err)
+		}
+		fmt.Printf("Applied %d migrations\n", applied)
+	case "down":
+		if steps == 0 {
+			steps = 1
+		}
+		reverted, err := c.db.MigrateDown(steps)
+		if err != nil {
+			log.Printf("Error reverting migrations: %v", err)
+		}
+		fmt.Printf("Reverted %d migrations\n", reverted)
+	default:
+		fmt.Println("Usage: db migrate status|up [steps]|down [steps]")
+	}
+}
+
+// isNumber reports whether s is a non-negative integer
+func isNumber(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 32)
+	return err == nil
+}
+
 // printHelp prints available commands
 func (c *CLI) printHelp() {
 	fmt.Println("\nAvailable commands:")
-	fmt.Println("  generatekey           - Generate a single API key")
-	fmt.Println("  generatekeys <count>  - Generate multiple API keys")
+	fmt.Println("  generatekey [scope ...] - Generate a single API key with scopes or presets")
+	fmt.Println("  generatekeys <count> [scope ...] - Generate multiple API keys")
 	fmt.Println("  listkeys             - List all API keys")
 	fmt.Println("  removekey <key>      - Remove an API key")
+	fmt.Println("  setratelimit <key> <requests/min> [algorithm] [burst] - Change a key's rate limit")
+	fmt.Println("  setconcurrency <key> <n> - Limit a key's generations in flight (0 is unlimited)")
+	fmt.Println("  setpriority <key> <high|normal|low> [weight] - Change a key's queue priority")
+	fmt.Println("  setlimits <key> [num_ctx=n] [num_predict=n] [keep_alive=duration] - Limit a key's Ollama options")
+	fmt.Println("  setcache <key> <on|off|default> - Opt a key in or out of the response cache")
+	fmt.Println("  setmodels <key> [model ...] - Limit the models a key may use (none allows all)")
+	fmt.Println("  setcidrs <key> [cidr ...] - Limit the addresses a key may be used from (none allows all)")
+	fmt.Println("  setscopes <key> [scope ...] - Set a key's scopes or presets (none restores the default)")
+	fmt.Println("  scopes               - List the scopes and presets")
+	fmt.Println("  setquota <key> <tokens/day> - Limit the tokens a key may use per day (0 is unlimited or the plan's)")
+	fmt.Println("  listplans            - List all plans")
+	fmt.Println("  createplan <name> [limit=value ...] - Create a plan")
+	fmt.Println("  updateplan <name> <limit=value ...> - Change a plan's limits for all its keys")
+	fmt.Println("  deleteplan <name>    - Delete a plan no key uses")
+	fmt.Println("  setplan <key> <plan|none> - Move a key onto a plan, clearing its own limits")
+	fmt.Println("  createorg <id> [name] - Create an organization")
+	fmt.Println("  listorgs             - List all organizations")
+	fmt.Println("  setorg <key> <org>   - Move a key into an organization")
+	fmt.Println("  setorglimits <org> [rate_limit=n] [token_quota=n] - Change an organization's pooled limits (0 is unlimited)")
+	fmt.Println("  setorgmodels <org> [model ...] - Limit the models an organization's keys may use (none allows all)")
+	fmt.Println("  deleteorg <org>      - Delete an organization that owns no keys")
+	fmt.Println("  orgusage [org] [hourly|daily] [days] - Show API usage by organization")
 	fmt.Println("  addwebhook <url>     - Add a webhook URL")
 	fmt.Println("  deletewebhook <id>   - Delete a webhook")
 	fmt.Println("  listwebhooks         - List all webhooks")
+	fmt.Println("  mapcert <key> <identity> - Let client certificates with an identity use a key")
+	fmt.Println("  unmapcert <identity> - Remove a client certificate identity")
+	fmt.Println("  listcerts            - List client certificate identities")
+	fmt.Println("  usage [key] [hourly|daily] [days] - Show API usage (default: all keys, daily, 7 days)")
+	fmt.Println("  db migrate status    - Show database migration status")
+	fmt.Println("  db migrate up [n]    - Apply pending migrations (default: all)")
+	fmt.Println("  db migrate down [n]  - Revert applied migrations (default: 1)")
 	fmt.Println("  help                 - Show this help message")
 	fmt.Println("  exit                 - Exit the program")
 }
@@ -0,0 +1,94 @@
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/erock530/go-ollama-api/internal/metrics"
+)
+
+// ErrAbandoned is returned to the requests waiting on a call whose leader
+// gave up without an upstream response, for example because its client went
+// away or it was turned down by the concurrency limit. They should make
+// their own call instead.
+var ErrAbandoned = errors.New("coalesced call abandoned")
+
+// Response is an upstream response shared by coalesced requests
+type Response struct {
+	StatusCode int
+	Body       []byte
+}
+
+// Call is an upstream call in flight, shared by every request with the same key
+type Call struct {
+	done     chan struct{}
+	response *Response
+}
+
+// Group lets concurrent identical requests share one upstream call. The
+// first request for a key becomes the leader and makes the call; requests
+// arriving before it finishes wait for its response. It is safe for
+// concurrent use.
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*Call
+
+	coalesced *metrics.Counter
+}
+
+// NewGroup creates a Group. Metrics are registered with registry if it is
+// not nil.
+func NewGroup(registry *metrics.Registry) *Group {
+	g := &Group{calls: make(map[string]*Call)}
+	if registry != nil {
+		g.coalesced = registry.NewCounter("ollama_api_coalesced_requests_total",
+			"Requests answered by another request's upstream call.", "route")
+	}
+	return g
+}
+
+// Join returns the call in flight for key on route. leader is true if there
+// was none and the caller must make the call and Finish it.
+func (g *Group) Join(route, key string) (call *Call, leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if call, ok := g.calls[route+"\n"+key]; ok {
+		if g.coalesced != nil {
+			g.coalesced.Inc(route)
+		}
+		return call, false
+	}
+	call = &Call{done: make(chan struct{})}
+	g.calls[route+"\n"+key] = call
+	return call, true
+}
+
+// Finish hands the leader's response to the waiting requests. A nil
+// response means the call was abandoned. Requests joining afterwards start
+// a new call.
+func (g *Group) Finish(route, key string, call *Call, response *Response) {
+	g.mu.Lock()
+	if g.calls[route+"\n"+key] == call {
+		delete(g.calls, route+"\n"+key)
+	}
+	g.mu.Unlock()
+
+	call.response = response
+	close(call.done)
+}
+
+// Wait returns the response of the call. It returns ErrAbandoned if the
+// leader gave up, or the context's error if ctx is done first.
+func (c *Call) Wait(ctx context.Context) (*Response, error) {
+	select {
+	case <-c.done:
+		if c.response == nil {
+			return nil, ErrAbandoned
+		}
+		return c.response, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
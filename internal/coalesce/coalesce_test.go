@@ -0,0 +1,60 @@
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/metrics"
+)
+
+func TestGroup(t *testing.T) {
+	registry := metrics.NewRegistry()
+	g := NewGroup(registry)
+
+	call, leader := g.Join("/generate", "a")
+	if !leader {
+		t.Fatal("first request did not lead")
+	}
+	joined, leader := g.Join("/generate", "a")
+	if leader || joined != call {
+		t.Fatal("identical request did not join the call in flight")
+	}
+	if _, leader := g.Join("/chat", "a"); !leader {
+		t.Error("the same key on another route joined the call")
+	}
+
+	g.Finish("/generate", "a", call, &Response{StatusCode: 200, Body: []byte("hi")})
+	response, err := joined.Wait(context.Background())
+	if err != nil || string(response.Body) != "hi" {
+		t.Errorf("Wait = %v, %v", response, err)
+	}
+	if _, leader := g.Join("/generate", "a"); !leader {
+		t.Error("request after the call finished did not start a new one")
+	}
+
+	var out strings.Builder
+	registry.Write(&out)
+	if !strings.Contains(out.String(), `ollama_api_coalesced_requests_total{route="/generate"} 1`) {
+		t.Errorf("unexpected metrics:\n%s", out.String())
+	}
+}
+
+func TestAbandoned(t *testing.T) {
+	g := NewGroup(nil)
+	call, _ := g.Join("/generate", "a")
+	joined, _ := g.Join("/generate", "a")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := joined.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait with an expired context = %v", err)
+	}
+
+	g.Finish("/generate", "a", call, nil)
+	if _, err := joined.Wait(context.Background()); !errors.Is(err, ErrAbandoned) {
+		t.Errorf("Wait on an abandoned call = %v, want ErrAbandoned", err)
+	}
+}
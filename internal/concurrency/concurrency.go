@@ -0,0 +1,127 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrKeyLimit is returned when a key already has its maximum number of
+	// requests in flight
+	ErrKeyLimit = errors.New("too many concurrent requests for this API key")
+	// ErrGlobalLimit is returned when the server already has its maximum
+	// number of requests in flight
+	ErrGlobalLimit = errors.New("too many concurrent requests")
+)
+
+// Limiter bounds the number of requests in flight per key and in total.
+// It is safe for concurrent use.
+type Limiter struct {
+	mu sync.Mutex
+	// global is the maximum number of requests in flight across all keys,
+	// zero for unlimited
+	global   int
+	total    int
+	inFlight map[string]int
+	// released is closed and replaced whenever a slot is released, waking
+	// every waiter to check again
+	released chan struct{}
+}
+
+// NewLimiter creates a limiter allowing at most global requests in flight in
+// total. Zero means unlimited.
+func NewLimiter(global int) *Limiter {
+	return &Limiter{
+		global:   global,
+		inFlight: make(map[string]int),
+		released: make(chan struct{}),
+	}
+}
+
+// Acquire takes a slot for key, which may have at most max requests in flight
+// (zero for unlimited). If no slot is free it waits up to wait for one; a
+// zero wait fails immediately and a negative one waits until ctx is done. On
+// success the returned release function must
+// be called exactly once when the request is done.
+func (l *Limiter) Acquire(ctx context.Context, key string, max int, wait time.Duration) (release func(), err error) {
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		l.mu.Lock()
+		err := l.check(key, max)
+		if err == nil {
+			l.inFlight[key]++
+			l.total++
+			l.mu.Unlock()
+			return l.releaseFunc(key), nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		if wait == 0 {
+			return nil, err
+		}
+		select {
+		case <-released:
+		case <-timeout:
+			return nil, err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// check reports why key cannot take a slot, if it cannot. The caller holds l.mu.
+func (l *Limiter) check(key string, max int) error {
+	if max > 0 && l.inFlight[key] >= max {
+		return ErrKeyLimit
+	}
+	if l.global > 0 && l.total >= l.global {
+		return ErrGlobalLimit
+	}
+	return nil
+}
+
+// releaseFunc returns a function that gives back key's slot once
+func (l *Limiter) releaseFunc(key string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.inFlight[key]--; l.inFlight[key] == 0 {
+				delete(l.inFlight, key)
+			}
+			l.total--
+			close(l.released)
+			l.released = make(chan struct{})
+		})
+	}
+}
+
+// InFlight returns the number of requests in flight for key
+func (l *Limiter) InFlight(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight[key]
+}
+
+// Total returns the number of requests in flight across all keys
+func (l *Limiter) Total() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
+
+// Global returns the maximum number of requests in flight across all keys,
+// zero for unlimited
+func (l *Limiter) Global() int {
+	return l.global
+}
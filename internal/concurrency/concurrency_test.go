@@ -0,0 +1,113 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPerKeyLimit(t *testing.T) {
+	limiter := NewLimiter(0)
+	ctx := context.Background()
+
+	release1, err := limiter.Acquire(ctx, "key-a", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := limiter.Acquire(ctx, "key-a", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.Acquire(ctx, "key-a", 2, 0); !errors.Is(err, ErrKeyLimit) {
+		t.Errorf("third Acquire = %v, want ErrKeyLimit", err)
+	}
+
+	// Other keys are not affected
+	releaseB, err := limiter.Acquire(ctx, "key-b", 2, 0)
+	if err != nil {
+		t.Fatalf("Acquire for another key failed: %v", err)
+	}
+	if limiter.InFlight("key-a") != 2 || limiter.InFlight("key-b") != 1 || limiter.Total() != 3 {
+		t.Errorf("in flight = %d, %d, total %d; want 2, 1, 3",
+			limiter.InFlight("key-a"), limiter.InFlight("key-b"), limiter.Total())
+	}
+
+	release1()
+	release1() // releasing twice must not free a second slot
+	if _, err := limiter.Acquire(ctx, "key-a", 2, 0); err != nil {
+		t.Errorf("Acquire after release failed: %v", err)
+	}
+	if _, err := limiter.Acquire(ctx, "key-a", 2, 0); !errors.Is(err, ErrKeyLimit) {
+		t.Errorf("Acquire = %v, want ErrKeyLimit", err)
+	}
+
+	release2()
+	releaseB()
+	if limiter.InFlight("key-b") != 0 || limiter.Total() != 1 {
+		t.Errorf("in flight after release = %d, total %d; want 0, 1", limiter.InFlight("key-b"), limiter.Total())
+	}
+}
+
+func TestGlobalLimit(t *testing.T) {
+	limiter := NewLimiter(2)
+	ctx := context.Background()
+
+	for _, key := range []string{"key-a", "key-b"} {
+		if _, err := limiter.Acquire(ctx, key, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := limiter.Acquire(ctx, "key-c", 0, 0); !errors.Is(err, ErrGlobalLimit) {
+		t.Errorf("Acquire = %v, want ErrGlobalLimit", err)
+	}
+}
+
+func TestBoundedWait(t *testing.T) {
+	limiter := NewLimiter(0)
+	ctx := context.Background()
+
+	release, err := limiter.Acquire(ctx, "key", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A waiter gets the slot as soon as it is released
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		release()
+	}()
+	start := time.Now()
+	release, err = limiter.Acquire(ctx, "key", 1, 5*time.Second)
+	if err != nil {
+		t.Fatalf("waiting Acquire failed: %v", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("waited %v for a released slot", waited)
+	}
+
+	// A waiter gives up after the timeout
+	start = time.Now()
+	if _, err := limiter.Acquire(ctx, "key", 1, 30*time.Millisecond); !errors.Is(err, ErrKeyLimit) {
+		t.Errorf("Acquire = %v, want ErrKeyLimit", err)
+	}
+	if waited := time.Since(start); waited < 30*time.Millisecond {
+		t.Errorf("gave up after %v, before the timeout", waited)
+	}
+
+	// A waiter gives up when the request is cancelled
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := limiter.Acquire(cancelled, "key", 1, time.Second); !errors.Is(err, context.Canceled) {
+		t.Errorf("Acquire = %v, want context.Canceled", err)
+	}
+
+	// A negative wait only gives up when the request is cancelled
+	expiring, cancel := context.WithTimeout(ctx, 30*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.Acquire(expiring, "key", 1, -1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Acquire = %v, want context.DeadlineExceeded", err)
+	}
+
+	release()
+}
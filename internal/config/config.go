@@ -1,7 +1,137 @@
 package config
 
+import (
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/jwtauth"
+	"github.com/erock530/go-ollama-api/internal/listener"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+	"github.com/erock530/go-ollama-api/internal/tlsconfig"
+)
+
 // Config holds the application configuration
 type Config struct {
 	Port      int
 	OllamaURL string
+	// OllamaBackends lists every Ollama server that model management
+	// requests fan out to. Generations only go to OllamaURL. Empty means
+	// OllamaURL alone.
+	OllamaBackends []string
+	// Upstream holds the timeouts, retries and circuit breaker of requests
+	// to Ollama
+	Upstream ollama.Config
+
+	// Listeners are the addresses the server listens on, each serving its
+	// own set of routes
+	Listeners []listener.Spec
+
+	// TLS holds the certificate and client certificate settings of the
+	// listener; without a certificate the server speaks plain HTTP
+	TLS tlsconfig.Config
+	// TLSReloadInterval is how often the certificate files are checked for
+	// changes, zero to only reload them on SIGHUP
+	TLSReloadInterval time.Duration
+
+	// JWT holds the settings of bearer token authentication, which is off
+	// unless a JWKS URL or key file is set
+	JWT jwtauth.Config
+
+	// DatabaseDSN is a SQLite file path or a postgres:// connection URL
+	DatabaseDSN string
+	// DBPool holds the database connection pool settings
+	DBPool db.PoolConfig
+
+	// RateLimitStore selects where rate limit counters are kept: "memory",
+	// "sql" (the main database) or "redis"
+	RateLimitStore string
+	// RedisURL is the redis:// URL used when RateLimitStore is "redis"
+	RedisURL string
+	// RateLimitAlgorithm is used for API keys that do not set their own:
+	// "token_bucket", "sliding_window", "gcra" or "fixed_window"
+	RateLimitAlgorithm string
+
+	// MaxConcurrent is the most generations in flight across all keys,
+	// zero for unlimited. Keys can have their own lower limit.
+	MaxConcurrent int
+	// ConcurrencyWait is how long a request waits for a free generation
+	// slot before being rejected. Zero rejects immediately.
+	ConcurrencyWait time.Duration
+
+	// QueueParallel is how many generations are sent to Ollama at once;
+	// the rest wait in the scheduler queue. Zero disables queuing.
+	QueueParallel int
+	// QueueMaxDepth is the most requests that may wait, zero for unlimited
+	QueueMaxDepth int
+	// QueueTimeout is the longest a request may wait, zero for no limit
+	QueueTimeout time.Duration
+
+	// JobWorkers is how many asynchronous jobs run at once
+	JobWorkers int
+	// CallbackAllowCIDRs lists the loopback, private and link-local
+	// addresses job callbacks may be sent to
+	CallbackAllowCIDRs []string
+	// JobMaxAttempts is how many times a job interrupted by a gateway
+	// restart is started before it is marked failed
+	JobMaxAttempts int
+
+	// BatchWorkers is how many uploaded batches run at once
+	BatchWorkers int
+	// BatchMaxConcurrency caps the requests one batch sends at once
+	BatchMaxConcurrency int
+
+	// CacheEnabled turns on the response cache for deterministic requests
+	CacheEnabled bool
+	// CacheOptIn means only keys set to "on" use the cache; otherwise all
+	// keys use it unless set to "off"
+	CacheOptIn bool
+	// CacheTTL is how long a response is served from the cache
+	CacheTTL time.Duration
+	// CacheMemoryBytes bounds the responses cached in memory
+	CacheMemoryBytes int64
+	// CacheDBEntries bounds the responses cached in the database, zero
+	// for no limit. A negative value keeps the cache in memory only.
+	CacheDBEntries int
+
+	// MaxBodyBytes bounds the size of JSON request bodies, zero for no limit
+	MaxBodyBytes int64
+	// MaxPromptChars bounds the text of a generation request, the prompt
+	// with the system prompt and suffix or all chat messages; zero for no limit
+	MaxPromptChars int
+	// MaxPromptTokens bounds the same text in estimated tokens, zero for no limit
+	MaxPromptTokens int
+	// MaxImages bounds the images in a generation request, zero for no limit
+	MaxImages int
+	// MaxImageBytes bounds the decoded size of each image, zero for no limit
+	MaxImageBytes int64
+	// ImageFormats lists the accepted image formats, such as png and jpeg,
+	// sniffed from the image data. Empty accepts any.
+	ImageFormats []string
+
+	// SchemaMaxRetries caps the schema_retries a request may ask for
+	SchemaMaxRetries int
+
+	// TrustedProxies lists the CIDRs of the proxies whose Forwarded and
+	// X-Forwarded-For headers are believed when finding the client address
+	TrustedProxies []string
+	// DenyCIDRs lists the client addresses that are refused on every route
+	// but the probes
+	DenyCIDRs []string
+	// IPRejectionWebhooks sends an event to the webhooks when a request is
+	// refused for its address
+	IPRejectionWebhooks bool
+
+	// CoalesceRoutes lists the routes, such as "/generate", where identical
+	// concurrent requests share one upstream call
+	CoalesceRoutes []string
+
+	// UsageRetention is how long raw usage events are kept before being
+	// rolled up into hourly and daily aggregates. Zero keeps them forever.
+	UsageRetention time.Duration
+	// UsageHourlyRetention is how long hourly aggregates are kept
+	UsageHourlyRetention time.Duration
+	// UsageCompactInterval is how often usage compaction runs
+	UsageCompactInterval time.Duration
+	// VacuumInterval is how often the database runs an incremental vacuum
+	VacuumInterval time.Duration
 }
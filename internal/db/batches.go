@@ -0,0 +1,231 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// batchColumns lists the batches columns in the order scanBatch reads them,
+// followed by the result counts
+const batchColumns = `id, key, status, total, concurrency, error, created_at, started_at, finished_at,
+	(SELECT COUNT(*) FROM batchResults WHERE batch_id = batches.id AND status = 'succeeded'),
+	(SELECT COUNT(*) FROM batchResults WHERE batch_id = batches.id AND status = 'failed')`
+
+// scanBatch reads a row selected with batchColumns
+func scanBatch(row rowScanner) (*models.Batch, error) {
+	var batch models.Batch
+	var createdAt, startedAt, finishedAt int64
+	err := row.Scan(
+		&batch.ID,
+		&batch.Key,
+		&batch.Status,
+		&batch.Total,
+		&batch.Concurrency,
+		&batch.Error,
+		&createdAt,
+		&startedAt,
+		&finishedAt,
+		&batch.Succeeded,
+		&batch.Failed,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	batch.CreatedAt = time.UnixMilli(createdAt)
+	batch.StartedAt = optionalTime(startedAt)
+	batch.FinishedAt = optionalTime(finishedAt)
+	return &batch, nil
+}
+
+// CreateBatch stores a new queued batch with its input file
+func (db *DB) CreateBatch(batch *models.Batch, input []byte) error {
+	batch.Status = models.BatchQueued
+	if batch.CreatedAt.IsZero() {
+		batch.CreatedAt = time.Now()
+	}
+	_, err := db.exec(`
+		INSERT INTO batches (id, key, status, input, total, concurrency, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		batch.ID,
+		batch.Key,
+		batch.Status,
+		string(input),
+		batch.Total,
+		batch.Concurrency,
+		batch.CreatedAt.UnixMilli(),
+	)
+	return err
+}
+
+// GetBatch retrieves a batch by ID, returning nil if it does not exist
+func (db *DB) GetBatch(id string) (*models.Batch, error) {
+	batch, err := scanBatch(db.queryRow(`SELECT `+batchColumns+` FROM batches WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return batch, err
+}
+
+// GetBatchInput returns the input file a batch was created with
+func (db *DB) GetBatchInput(id string) ([]byte, error) {
+	var input string
+	err := db.queryRow(`SELECT input FROM batches WHERE id = ?`, id).Scan(&input)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return []byte(input), err
+}
+
+// ClaimBatch marks the oldest queued batch as running and returns it, or nil
+// if there is none. A running batch whose lease ran out before now has lost
+// its worker and is claimed again; its saved results are kept, so it resumes
+// where it stopped.
+func (db *DB) ClaimBatch(now, leaseUntil time.Time) (*models.Batch, error) {
+	for {
+		var id string
+		err := db.queryRow(`
+			SELECT id FROM batches
+			WHERE status = ? OR (status = ? AND lease_until < ?)
+			ORDER BY created_at, id LIMIT 1`,
+			models.BatchQueued, models.BatchRunning, now.UnixMilli()).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := db.exec(`
+			UPDATE batches
+			SET status = ?, lease_until = ?,
+				started_at = CASE WHEN started_at = 0 THEN ? ELSE started_at END
+			WHERE id = ? AND (status = ? OR (status = ? AND lease_until < ?))`,
+			models.BatchRunning, leaseUntil.UnixMilli(), now.UnixMilli(),
+			id, models.BatchQueued, models.BatchRunning, now.UnixMilli())
+		if err != nil {
+			return nil, err
+		}
+		if err := requireRowsAffected(res); err == ErrNotFound {
+			// Another worker claimed it first
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return db.GetBatch(id)
+	}
+}
+
+// RenewBatchLease extends the lease of a running batch and returns the
+// batch's status, which tells the worker whether it was cancelled meanwhile
+func (db *DB) RenewBatchLease(id string, leaseUntil time.Time) (models.BatchStatus, error) {
+	if _, err := db.exec(`UPDATE batches SET lease_until = ? WHERE id = ? AND status = ?`,
+		leaseUntil.UnixMilli(), id, models.BatchRunning); err != nil {
+		return "", err
+	}
+
+	var status models.BatchStatus
+	err := db.queryRow(`SELECT status FROM batches WHERE id = ?`, id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return status, err
+}
+
+// FinishBatch records that a running batch completed or failed. It returns
+// ErrNotFound if the batch is no longer running.
+func (db *DB) FinishBatch(id string, status models.BatchStatus, message string) error {
+	res, err := db.exec(`
+		UPDATE batches
+		SET status = ?, error = ?, finished_at = ?, lease_until = 0
+		WHERE id = ? AND status = ?`,
+		status, message, time.Now().UnixMilli(), id, models.BatchRunning)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(res)
+}
+
+// RequeueBatch puts a running batch back in the queue, for a worker that is
+// shutting down
+func (db *DB) RequeueBatch(id string) error {
+	res, err := db.exec(`UPDATE batches SET status = ?, lease_until = 0 WHERE id = ? AND status = ?`,
+		models.BatchQueued, id, models.BatchRunning)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(res)
+}
+
+// CancelBatch cancels a queued or running batch. Results saved so far are
+// kept. It returns ErrNotFound if there is no such unfinished batch.
+func (db *DB) CancelBatch(id string) error {
+	res, err := db.exec(`
+		UPDATE batches
+		SET status = ?, finished_at = ?, lease_until = 0
+		WHERE id = ? AND status IN (?, ?)`,
+		models.BatchCancelled, time.Now().UnixMilli(), id, models.BatchQueued, models.BatchRunning)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(res)
+}
+
+// SaveBatchResult stores the result of the request on the given line of a
+// batch. A result that is already stored is left alone.
+func (db *DB) SaveBatchResult(batchID string, line int, result *models.BatchResult) error {
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = db.exec(`
+		INSERT INTO batchResults (batch_id, custom_id, line, status, result)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (batch_id, custom_id) DO NOTHING`,
+		batchID, result.CustomID, line, result.Status, string(encoded))
+	return err
+}
+
+// BatchResultIDs returns the custom IDs of the requests of a batch that
+// already have a result
+func (db *DB) BatchResultIDs(batchID string) (map[string]bool, error) {
+	rows, err := db.query(`SELECT custom_id FROM batchResults WHERE batch_id = ?`, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// EachBatchResult calls fn with every stored result of a batch as JSON, in
+// the order of the input file, stopping at the first error
+func (db *DB) EachBatchResult(batchID string, fn func(result []byte) error) error {
+	rows, err := db.query(`SELECT result FROM batchResults WHERE batch_id = ? ORDER BY line`, batchID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+		if err := fn([]byte(result)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// GetCachedResponse returns the cached response stored under key and when it
+// expires, or nil if there is none or it expired before now
+func (db *DB) GetCachedResponse(key string, now time.Time) ([]byte, time.Time, error) {
+	var response string
+	var expiresAt int64
+	err := db.queryRow(`SELECT response, expires_at FROM responseCache WHERE key = ? AND expires_at > ?`,
+		key, now.UnixMilli()).Scan(&response, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return []byte(response), time.UnixMilli(expiresAt), nil
+}
+
+// PutCachedResponse stores a response under key, replacing any older one
+func (db *DB) PutCachedResponse(key string, response []byte, createdAt, expiresAt time.Time) error {
+	_, err := db.exec(`
+		INSERT INTO responseCache (key, response, created_at, expires_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE
+		SET response = excluded.response, created_at = excluded.created_at, expires_at = excluded.expires_at`,
+		key, string(response), createdAt.UnixMilli(), expiresAt.UnixMilli())
+	return err
+}
+
+// PruneCachedResponses deletes responses that expired before now and then
+// the oldest ones beyond maxEntries. A maxEntries of zero keeps any number.
+func (db *DB) PruneCachedResponses(now time.Time, maxEntries int) (int64, error) {
+	res, err := db.exec(`DELETE FROM responseCache WHERE expires_at <= ?`, now.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil || maxEntries <= 0 {
+		return deleted, err
+	}
+
+	// Keep the newest maxEntries; entries created in the same millisecond as
+	// the last one kept are kept too
+	res, err = db.exec(`
+		DELETE FROM responseCache
+		WHERE created_at < (SELECT created_at FROM responseCache ORDER BY created_at DESC LIMIT 1 OFFSET ?)`,
+		maxEntries-1)
+	if err != nil {
+		return deleted, err
+	}
+	evicted, err := res.RowsAffected()
+	return deleted + evicted, err
+}
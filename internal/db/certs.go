@@ -0,0 +1,59 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// MapCertIdentity makes requests with a client certificate that has
+// identity use key. An identity that was mapped before is moved to key.
+func (db *DB) MapCertIdentity(identity, key string) error {
+	_, err := db.exec(`
+		INSERT INTO certIdentities (identity, key) VALUES (?, ?)
+		ON CONFLICT (identity) DO UPDATE SET key = excluded.key`,
+		identity, key)
+	return err
+}
+
+// UnmapCertIdentity removes the mapping of identity
+func (db *DB) UnmapCertIdentity(identity string) error {
+	result, err := db.exec(`DELETE FROM certIdentities WHERE identity = ?`, identity)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
+}
+
+// ListCertIdentities retrieves all certificate identity mappings
+func (db *DB) ListCertIdentities() ([]models.CertIdentity, error) {
+	rows, err := db.query(`SELECT identity, key, created_at FROM certIdentities ORDER BY key, identity`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []models.CertIdentity
+	for rows.Next() {
+		var identity models.CertIdentity
+		if err := rows.Scan(&identity.Identity, &identity.Key, &identity.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// GetCertIdentityKey returns the key the first mapped identity of a client
+// certificate maps to, or "" if none is mapped
+func (db *DB) GetCertIdentityKey(identities ...string) (string, error) {
+	for _, identity := range identities {
+		var key string
+		err := db.queryRow(`SELECT key FROM certIdentities WHERE identity = ?`, identity).Scan(&key)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		return key, err
+	}
+	return "", nil
+}
@@ -0,0 +1,861 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// postgresDSNEnv names the environment variable that enables the PostgreSQL
+// conformance run. The database it points to is wiped by the tests.
+const postgresDSNEnv = "OLLAMA_API_TEST_POSTGRES_DSN"
+
+func TestSQLiteConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T) Store {
+		return openTestDB(t)
+	})
+}
+
+func TestPostgresConformance(t *testing.T) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+
+	runConformance(t, func(t *testing.T) Store {
+		database, err := Connect(dsn, PoolConfig{MaxOpenConns: 4})
+		if err != nil {
+			t.Fatalf("Failed to connect to PostgreSQL: %v", err)
+		}
+		t.Cleanup(func() { database.Close() })
+
+		// Start every test from an empty schema
+		if _, err := database.MigrateDown(database.LatestVersion()); err != nil {
+			t.Fatalf("Failed to reset schema: %v", err)
+		}
+		if _, err := database.Migrate(); err != nil {
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+		return database
+	})
+}
+
+// runConformance checks the behaviour every Store implementation must share
+func runConformance(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("Migrations", func(t *testing.T) {
+		store := newStore(t)
+
+		version, err := store.SchemaVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != store.LatestVersion() {
+			t.Errorf("schema version = %d, want %d", version, store.LatestVersion())
+		}
+
+		statuses, err := store.MigrationStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, status := range statuses {
+			if !status.Applied {
+				t.Errorf("migration %d is not applied", status.Version)
+			}
+		}
+	})
+
+	t.Run("APIKeys", func(t *testing.T) {
+		store := newStore(t)
+
+		if key, err := store.GetAPIKey("missing"); err != nil || key != nil {
+			t.Fatalf("GetAPIKey(missing) = %v, %v; want nil, nil", key, err)
+		}
+
+		err := store.CreateAPIKey(&models.APIKey{
+			Key:         "key-1",
+			Tokens:      10,
+			RateLimit:   10,
+			Active:      true,
+			Description: sql.NullString{String: "first", Valid: true},
+		})
+		if err != nil {
+			t.Fatalf("CreateAPIKey failed: %v", err)
+		}
+		if err := store.CreateAPIKey(&models.APIKey{Key: "key-2", Tokens: 5, RateLimit: 5}); err != nil {
+			t.Fatalf("CreateAPIKey failed: %v", err)
+		}
+		if err := store.CreateAPIKey(&models.APIKey{Key: "key-1"}); err == nil {
+			t.Error("expected error creating a duplicate key")
+		}
+
+		key, err := store.GetAPIKey("key-1")
+		if err != nil || key == nil {
+			t.Fatalf("GetAPIKey failed: %v, %v", key, err)
+		}
+		if key.Tokens != 10 || key.RateLimit != 10 || !key.Active || key.Description.String != "first" {
+			t.Errorf("unexpected key: %+v", key)
+		}
+		if key.CreatedAt.IsZero() {
+			t.Error("created_at was not set")
+		}
+		if key.OrgID != models.DefaultOrgID || key.Org == nil || key.Org.ID != models.DefaultOrgID {
+			t.Errorf("new key org = %q, %+v; want the default organization", key.OrgID, key.Org)
+		}
+
+		if err := store.UpdateAPIKeyUsage("key-1", 3); err != nil {
+			t.Fatalf("UpdateAPIKeyUsage failed: %v", err)
+		}
+		key, err = store.GetAPIKey("key-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.Tokens != 3 {
+			t.Errorf("tokens = %d, want 3", key.Tokens)
+		}
+
+		key.RateLimit = 20
+		key.RateLimitAlgorithm = "gcra"
+		key.RateLimitBurst = 5
+		key.MaxConcurrent = 2
+		key.Priority = "high"
+		key.QueueWeight = 3
+		key.MaxNumCtx = 8192
+		key.MaxNumPredict = 512
+		key.MaxKeepAlive = 30 * time.Minute
+		key.AllowedModels = []string{"llama3", "qwen2.5:*"}
+		key.Scopes = []string{"admin"}
+		key.AllowedCIDRs = []string{"10.0.0.0/8", "192.0.2.7"}
+		key.Active = false
+		if err := store.UpdateAPIKey(key); err != nil {
+			t.Fatalf("UpdateAPIKey failed: %v", err)
+		}
+		key, err = store.GetAPIKey("key-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.RateLimit != 20 || key.RateLimitAlgorithm != "gcra" || key.RateLimitBurst != 5 || key.MaxConcurrent != 2 ||
+			key.Priority != "high" || key.QueueWeight != 3 || key.Active || key.Tokens != 3 ||
+			key.MaxNumCtx != 8192 || key.MaxNumPredict != 512 || key.MaxKeepAlive != 30*time.Minute ||
+			!reflect.DeepEqual(key.AllowedModels, []string{"llama3", "qwen2.5:*"}) || !reflect.DeepEqual(key.Scopes, []string{"admin"}) ||
+			!reflect.DeepEqual(key.AllowedCIDRs, []string{"10.0.0.0/8", "192.0.2.7"}) {
+			t.Errorf("unexpected key after update: %+v", key)
+		}
+		if err := store.UpdateAPIKey(&models.APIKey{Key: "missing"}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("UpdateAPIKey(missing) = %v, want ErrNotFound", err)
+		}
+
+		keys, err := store.ListAPIKeys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 2 {
+			t.Fatalf("ListAPIKeys returned %d keys, want 2", len(keys))
+		}
+		if keys[1].Key == "key-2" && keys[1].Active {
+			t.Error("key-2 should be inactive")
+		}
+
+		if err := store.DeleteAPIKey("key-2"); err != nil {
+			t.Fatalf("DeleteAPIKey failed: %v", err)
+		}
+		if err := store.DeleteAPIKey("key-2"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("DeleteAPIKey(missing) = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Webhooks", func(t *testing.T) {
+		store := newStore(t)
+
+		for _, url := range []string{"http://example.com/a", "http://example.com/b"} {
+			if err := store.AddWebhook(url); err != nil {
+				t.Fatalf("AddWebhook failed: %v", err)
+			}
+		}
+
+		webhooks, err := store.GetWebhooks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(webhooks) != 2 || webhooks[0].URL != "http://example.com/a" {
+			t.Fatalf("unexpected webhooks: %+v", webhooks)
+		}
+
+		if err := store.DeleteWebhook(webhooks[0].ID); err != nil {
+			t.Fatalf("DeleteWebhook failed: %v", err)
+		}
+		if err := store.DeleteWebhook(webhooks[0].ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("DeleteWebhook(missing) = %v, want ErrNotFound", err)
+		}
+
+		webhooks, err = store.GetWebhooks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(webhooks) != 1 || webhooks[0].URL != "http://example.com/b" {
+			t.Errorf("unexpected webhooks after delete: %+v", webhooks)
+		}
+	})
+
+	t.Run("CertIdentities", func(t *testing.T) {
+		store := newStore(t)
+		for _, key := range []string{"key-a", "key-b"} {
+			if err := store.CreateAPIKey(&models.APIKey{Key: key, Active: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for identity, key := range map[string]string{"cn:client-a": "key-a", "dns:a.example.com": "key-a", "cn:client-b": "key-a"} {
+			if err := store.MapCertIdentity(identity, key); err != nil {
+				t.Fatalf("MapCertIdentity failed: %v", err)
+			}
+		}
+		// Mapping an identity again moves it to the new key
+		if err := store.MapCertIdentity("cn:client-b", "key-b"); err != nil {
+			t.Fatalf("MapCertIdentity failed: %v", err)
+		}
+
+		if key, err := store.GetCertIdentityKey("cn:unknown", "dns:a.example.com", "cn:client-b"); err != nil || key != "key-a" {
+			t.Errorf("GetCertIdentityKey = %q, %v; want key-a", key, err)
+		}
+		if key, err := store.GetCertIdentityKey("cn:client-b"); err != nil || key != "key-b" {
+			t.Errorf("GetCertIdentityKey(cn:client-b) = %q, %v; want key-b", key, err)
+		}
+		if key, err := store.GetCertIdentityKey("cn:unknown"); err != nil || key != "" {
+			t.Errorf("GetCertIdentityKey(cn:unknown) = %q, %v; want none", key, err)
+		}
+
+		identities, err := store.ListCertIdentities()
+		if err != nil || len(identities) != 3 || identities[0].Identity != "cn:client-a" || identities[2].Key != "key-b" ||
+			identities[0].CreatedAt.IsZero() {
+			t.Errorf("ListCertIdentities = %+v, %v", identities, err)
+		}
+
+		if err := store.UnmapCertIdentity("cn:client-a"); err != nil {
+			t.Fatalf("UnmapCertIdentity failed: %v", err)
+		}
+		if err := store.UnmapCertIdentity("cn:client-a"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("UnmapCertIdentity(missing) = %v, want ErrNotFound", err)
+		}
+
+		// Deleting a key removes its identities
+		if err := store.DeleteAPIKey("key-a"); err != nil {
+			t.Fatal(err)
+		}
+		if identities, err := store.ListCertIdentities(); err != nil || len(identities) != 1 || identities[0].Key != "key-b" {
+			t.Errorf("identities after deleting key-a: %+v, %v", identities, err)
+		}
+	})
+
+	t.Run("Usage", func(t *testing.T) {
+		store := newStore(t)
+
+		for _, key := range []string{"key-a", "key-a", "key-b"} {
+			if err := store.LogAPIUsage(key, models.DefaultOrgID); err != nil {
+				t.Fatalf("LogAPIUsage failed: %v", err)
+			}
+		}
+
+		since := time.Now().Add(-time.Hour)
+		totals := func() map[string]int64 {
+			t.Helper()
+			buckets, err := store.GetUsageReport("", since, models.UsageHourly)
+			if err != nil {
+				t.Fatalf("GetUsageReport failed: %v", err)
+			}
+			sums := make(map[string]int64)
+			for _, bucket := range buckets {
+				sums[bucket.Key] += bucket.Requests
+			}
+			return sums
+		}
+
+		before := totals()
+		if before["key-a"] != 2 || before["key-b"] != 1 {
+			t.Fatalf("unexpected usage before compaction: %v", before)
+		}
+
+		compacted, err := store.CompactUsage(time.Now().Add(time.Minute), time.Time{})
+		if err != nil {
+			t.Fatalf("CompactUsage failed: %v", err)
+		}
+		if compacted != 3 {
+			t.Errorf("compacted %d events, want 3", compacted)
+		}
+
+		after := totals()
+		if after["key-a"] != 2 || after["key-b"] != 1 {
+			t.Errorf("unexpected usage after compaction: %v", after)
+		}
+
+		daily, err := store.GetUsageReport("key-b", since, models.UsageDaily)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(daily) != 1 || daily[0].Requests != 1 || daily[0].Key != "key-b" {
+			t.Errorf("unexpected daily report: %+v", daily)
+		}
+
+		if err := store.IncrementalVacuum(); err != nil {
+			t.Errorf("IncrementalVacuum failed: %v", err)
+		}
+	})
+
+	t.Run("Orgs", func(t *testing.T) {
+		store := newStore(t)
+
+		orgs, err := store.ListOrgs()
+		if err != nil || len(orgs) != 1 || orgs[0].ID != models.DefaultOrgID {
+			t.Fatalf("ListOrgs = %+v, %v; want only the default organization", orgs, err)
+		}
+		if org, err := store.GetOrg("missing"); err != nil || org != nil {
+			t.Errorf("GetOrg(missing) = %+v, %v; want nil, nil", org, err)
+		}
+
+		acme := &models.Org{ID: "acme", Name: "Acme", RateLimit: 60, TokenQuota: 1000, AllowedModels: []string{"llama3*"}}
+		if err := store.CreateOrg(acme); err != nil {
+			t.Fatalf("CreateOrg failed: %v", err)
+		}
+		if err := store.CreateOrg(acme); err == nil {
+			t.Error("expected error creating a duplicate organization")
+		}
+		org, err := store.GetOrg("acme")
+		if err != nil || org == nil || org.Name != "Acme" || org.RateLimit != 60 || org.TokenQuota != 1000 ||
+			!reflect.DeepEqual(org.AllowedModels, []string{"llama3*"}) || org.CreatedAt.IsZero() {
+			t.Fatalf("GetOrg = %+v, %v", org, err)
+		}
+		org.Name, org.RateLimit, org.AllowedModels = "Acme Inc", 0, nil
+		if err := store.UpdateOrg(org); err != nil {
+			t.Fatalf("UpdateOrg failed: %v", err)
+		}
+		if org, err = store.GetOrg("acme"); err != nil || org.Name != "Acme Inc" || org.RateLimit != 0 || len(org.AllowedModels) != 0 {
+			t.Errorf("after UpdateOrg = %+v, %v", org, err)
+		}
+		if err := store.UpdateOrg(&models.Org{ID: "missing"}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("UpdateOrg(missing) = %v, want ErrNotFound", err)
+		}
+
+		for _, key := range []string{"key-a", "key-b", "key-c"} {
+			if err := store.CreateAPIKey(&models.APIKey{Key: key, Active: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, key := range []string{"key-a", "key-b"} {
+			apiKey, err := store.GetAPIKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			apiKey.OrgID = "acme"
+			if err := store.UpdateAPIKey(apiKey); err != nil {
+				t.Fatalf("UpdateAPIKey failed: %v", err)
+			}
+		}
+		key, err := store.GetAPIKey("key-a")
+		if err != nil || key.OrgID != "acme" || key.Org == nil || key.Org.Name != "Acme Inc" {
+			t.Errorf("key-a org = %+v, %v; want acme", key, err)
+		}
+		if count, err := store.CountOrgKeys("acme"); err != nil || count != 2 {
+			t.Errorf("CountOrgKeys = %d, %v; want 2", count, err)
+		}
+
+		if err := store.DeleteOrg("acme"); !errors.Is(err, ErrInUse) {
+			t.Errorf("DeleteOrg(with keys) = %v, want ErrInUse", err)
+		}
+		if err := store.DeleteOrg(models.DefaultOrgID); !errors.Is(err, ErrInUse) {
+			t.Errorf("DeleteOrg(default) = %v, want ErrInUse", err)
+		}
+		if err := store.DeleteOrg("missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("DeleteOrg(missing) = %v, want ErrNotFound", err)
+		}
+
+		now := time.Now()
+		for _, tokens := range []int64{100, 50} {
+			if err := store.AddOrgTokens("acme", now, tokens); err != nil {
+				t.Fatalf("AddOrgTokens failed: %v", err)
+			}
+		}
+		if tokens, err := store.GetOrgTokens("acme", now); err != nil || tokens != 150 {
+			t.Errorf("GetOrgTokens = %d, %v; want 150", tokens, err)
+		}
+		if tokens, err := store.GetOrgTokens("acme", now.AddDate(0, 0, -1)); err != nil || tokens != 0 {
+			t.Errorf("GetOrgTokens(yesterday) = %d, %v; want 0", tokens, err)
+		}
+
+		// Stored keys count toward the organization that owns them now, and
+		// keys that are not stored, such as those of bearer tokens, toward
+		// the one their usage was logged under. Usage of a key that is
+		// neither is left out.
+		logged := []struct{ key, org string }{
+			{"key-a", "acme"}, {"key-b", "acme"}, {"key-b", "acme"}, {"key-c", ""},
+			{"jwt:alice", "acme"}, {"jwt:bob", "research"}, {"jwt:old", ""},
+		}
+		for _, usage := range logged {
+			if err := store.LogAPIUsage(usage.key, usage.org); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := store.CompactUsage(time.Now().Add(time.Minute), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		// Usage logged after compaction is combined with the rollups
+		for _, key := range []string{"key-a", "jwt:alice"} {
+			if err := store.LogAPIUsage(key, "acme"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		since := time.Now().Add(-time.Hour)
+		buckets, err := store.GetOrgUsageReport("", since, models.UsageDaily)
+		if err != nil {
+			t.Fatalf("GetOrgUsageReport failed: %v", err)
+		}
+		sums := make(map[string]int64)
+		for _, bucket := range buckets {
+			if bucket.Key != "" {
+				t.Errorf("org bucket has key %q", bucket.Key)
+			}
+			sums[bucket.Org] += bucket.Requests
+		}
+		if !reflect.DeepEqual(sums, map[string]int64{"acme": 6, models.DefaultOrgID: 1, "research": 1}) {
+			t.Errorf("org usage = %v", sums)
+		}
+		buckets, err = store.GetOrgUsageReport("acme", since, models.UsageHourly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var acmeTotal int64
+		for _, bucket := range buckets {
+			if bucket.Org != "acme" {
+				t.Errorf("GetOrgUsageReport(acme) returned org %q", bucket.Org)
+			}
+			acmeTotal += bucket.Requests
+		}
+		if acmeTotal != 6 {
+			t.Errorf("acme hourly usage = %d, want 6", acmeTotal)
+		}
+
+		for _, key := range []string{"key-a", "key-b"} {
+			if err := store.DeleteAPIKey(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.DeleteOrg("acme"); err != nil {
+			t.Errorf("DeleteOrg failed: %v", err)
+		}
+	})
+
+	t.Run("Plans", func(t *testing.T) {
+		store := newStore(t)
+
+		plans, err := store.ListPlans()
+		if err != nil || len(plans) != 3 || plans[0].Name != "free" || plans[1].Name != "premium" || plans[2].Name != "standard" {
+			t.Fatalf("ListPlans = %+v, %v; want the seeded plans", plans, err)
+		}
+
+		plan := &models.Plan{Name: "team", RateLimit: 30, RateLimitAlgorithm: "gcra", RateLimitBurst: 5, TokenQuota: 5000,
+			MaxConcurrent: 2, Priority: "high", QueueWeight: 3, AllowedModels: []string{"llama3", "qwen2.5:*"}}
+		if err := store.CreatePlan(plan); err != nil {
+			t.Fatalf("CreatePlan failed: %v", err)
+		}
+		if err := store.CreatePlan(plan); err == nil {
+			t.Error("expected error creating a duplicate plan")
+		}
+		got, err := store.GetPlan("team")
+		if err != nil || got == nil || got.CreatedAt.IsZero() {
+			t.Fatalf("GetPlan = %+v, %v", got, err)
+		}
+		got.CreatedAt = time.Time{}
+		if !reflect.DeepEqual(got, plan) {
+			t.Errorf("GetPlan = %+v, want %+v", got, plan)
+		}
+		if got, err := store.GetPlan("missing"); err != nil || got != nil {
+			t.Errorf("GetPlan(missing) = %+v, %v; want nil, nil", got, err)
+		}
+
+		if err := store.CreateAPIKey(&models.APIKey{Key: "key-1", Active: true, PlanName: "team", TokenQuota: 100}); err != nil {
+			t.Fatal(err)
+		}
+		key, err := store.GetAPIKey("key-1")
+		if err != nil || key.PlanName != "team" || key.Plan == nil || key.Plan.RateLimit != 30 || key.TokenQuota != 100 {
+			t.Fatalf("GetAPIKey = %+v, %v; want the team plan attached", key, err)
+		}
+
+		plan.RateLimit = 60
+		plan.AllowedModels = nil
+		if err := store.UpdatePlan(plan); err != nil {
+			t.Fatalf("UpdatePlan failed: %v", err)
+		}
+		if key, err = store.GetAPIKey("key-1"); err != nil || key.Plan.RateLimit != 60 || len(key.Plan.AllowedModels) != 0 {
+			t.Errorf("plan after UpdatePlan = %+v, %v", key.Plan, err)
+		}
+		if err := store.UpdatePlan(&models.Plan{Name: "missing"}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("UpdatePlan(missing) = %v, want ErrNotFound", err)
+		}
+
+		if err := store.DeletePlan("team"); !errors.Is(err, ErrInUse) {
+			t.Errorf("DeletePlan(in use) = %v, want ErrInUse", err)
+		}
+		key.PlanName, key.TokenQuota = "", 0
+		if err := store.UpdateAPIKey(key); err != nil {
+			t.Fatal(err)
+		}
+		if key, err = store.GetAPIKey("key-1"); err != nil || key.PlanName != "" || key.Plan != nil || key.TokenQuota != 0 {
+			t.Errorf("key after leaving its plan = %+v, %v", key, err)
+		}
+		if err := store.DeletePlan("team"); err != nil {
+			t.Errorf("DeletePlan failed: %v", err)
+		}
+		if err := store.DeletePlan("team"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("DeletePlan(missing) = %v, want ErrNotFound", err)
+		}
+
+		now := time.Now()
+		for _, tokens := range []int64{20, 22} {
+			if err := store.AddKeyTokens("key-1", now, tokens); err != nil {
+				t.Fatalf("AddKeyTokens failed: %v", err)
+			}
+		}
+		if tokens, err := store.GetKeyTokens("key-1", now); err != nil || tokens != 42 {
+			t.Errorf("GetKeyTokens = %d, %v; want 42", tokens, err)
+		}
+		if tokens, err := store.GetKeyTokens("key-1", now.AddDate(0, 0, 1)); err != nil || tokens != 0 {
+			t.Errorf("GetKeyTokens(tomorrow) = %d, %v; want 0", tokens, err)
+		}
+	})
+
+	t.Run("RateCounters", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		window := time.Now().Truncate(time.Minute)
+		for want := int64(1); want <= 3; want++ {
+			hits, err := store.IncrementRateCounter(ctx, "key-a", window, time.Minute)
+			if err != nil {
+				t.Fatalf("IncrementRateCounter failed: %v", err)
+			}
+			if hits != want {
+				t.Errorf("hits = %d, want %d", hits, want)
+			}
+		}
+
+		// Other keys have their own counters
+		if hits, err := store.IncrementRateCounter(ctx, "key-b", window, time.Minute); err != nil || hits != 1 {
+			t.Errorf("key-b hits = %d, %v; want 1", hits, err)
+		}
+
+		// A new window starts from one, and a late hit from the old window
+		// does not reset it
+		next := window.Add(time.Minute)
+		if hits, err := store.IncrementRateCounter(ctx, "key-a", next, time.Minute); err != nil || hits != 1 {
+			t.Errorf("new window hits = %d, %v; want 1", hits, err)
+		}
+		if hits, err := store.IncrementRateCounter(ctx, "key-a", window, time.Minute); err != nil || hits != 2 {
+			t.Errorf("late hit = %d, %v; want 2", hits, err)
+		}
+	})
+
+	t.Run("RateState", func(t *testing.T) {
+		store := newStore(t)
+		ctx := context.Background()
+
+		var seen []string
+		for _, next := range []string{"one", "two"} {
+			err := store.UpdateRateState(ctx, "key-a", time.Minute, func(state []byte) ([]byte, error) {
+				seen = append(seen, string(state))
+				return []byte(next), nil
+			})
+			if err != nil {
+				t.Fatalf("UpdateRateState failed: %v", err)
+			}
+		}
+		if len(seen) != 2 || seen[0] != "" || seen[1] != "one" {
+			t.Errorf("update saw states %q, want [\"\" \"one\"]", seen)
+		}
+
+		// An error from update leaves the state untouched
+		failed := errors.New("failed")
+		err := store.UpdateRateState(ctx, "key-a", time.Minute, func(state []byte) ([]byte, error) {
+			return nil, failed
+		})
+		if !errors.Is(err, failed) {
+			t.Errorf("UpdateRateState = %v, want %v", err, failed)
+		}
+		store.UpdateRateState(ctx, "key-a", time.Minute, func(state []byte) ([]byte, error) {
+			if string(state) != "two" {
+				t.Errorf("state = %q, want %q", state, "two")
+			}
+			return state, nil
+		})
+	})
+
+	t.Run("Jobs", func(t *testing.T) {
+		store := newStore(t)
+		lease := time.Now().Add(time.Minute)
+
+		if job, err := store.ClaimJob(lease); err != nil || job != nil {
+			t.Fatalf("ClaimJob on an empty queue = %v, %v; want nil, nil", job, err)
+		}
+
+		for i, id := range []string{"job-1", "job-2"} {
+			err := store.CreateJob(&models.Job{
+				ID:          id,
+				Key:         "key-a",
+				Kind:        "generate",
+				Request:     []byte(`{"model":"llama3","prompt":"hi"}`),
+				CallbackURL: "http://example.com/done",
+				CreatedAt:   time.Now().Add(time.Duration(i) * time.Millisecond),
+			})
+			if err != nil {
+				t.Fatalf("CreateJob failed: %v", err)
+			}
+		}
+
+		job, err := store.GetJob("job-1")
+		if err != nil || job == nil {
+			t.Fatalf("GetJob = %v, %v", job, err)
+		}
+		if job.Status != models.JobQueued || job.Key != "key-a" || string(job.Request) != `{"model":"llama3","prompt":"hi"}` ||
+			job.CallbackURL != "http://example.com/done" || job.StartedAt != nil {
+			t.Errorf("unexpected job: %+v", job)
+		}
+		if missing, err := store.GetJob("missing"); err != nil || missing != nil {
+			t.Errorf("GetJob(missing) = %v, %v; want nil, nil", missing, err)
+		}
+
+		// Jobs are claimed oldest first
+		job, err = store.ClaimJob(lease)
+		if err != nil || job == nil || job.ID != "job-1" || job.Status != models.JobRunning || job.Attempts != 1 || job.StartedAt == nil {
+			t.Fatalf("ClaimJob = %+v, %v; want running job-1", job, err)
+		}
+		if status, err := store.RenewJobLease("job-1", lease); err != nil || status != models.JobRunning {
+			t.Errorf("RenewJobLease = %v, %v; want running", status, err)
+		}
+		if err := store.FinishJob("job-1", models.JobSucceeded, []byte(`{"response":"hello"}`), ""); err != nil {
+			t.Fatalf("FinishJob failed: %v", err)
+		}
+		job, err = store.GetJob("job-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != models.JobSucceeded || string(job.Result) != `{"response":"hello"}` || job.FinishedAt == nil {
+			t.Errorf("unexpected finished job: %+v", job)
+		}
+		if err := store.CancelJob("job-1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("CancelJob(finished) = %v, want ErrNotFound", err)
+		}
+
+		// A cancelled job cannot be finished by its worker
+		job, err = store.ClaimJob(lease)
+		if err != nil || job == nil || job.ID != "job-2" {
+			t.Fatalf("ClaimJob = %+v, %v; want job-2", job, err)
+		}
+		if err := store.CancelJob("job-2"); err != nil {
+			t.Fatalf("CancelJob failed: %v", err)
+		}
+		if status, err := store.RenewJobLease("job-2", lease); err != nil || status != models.JobCancelled {
+			t.Errorf("RenewJobLease = %v, %v; want cancelled", status, err)
+		}
+		if err := store.FinishJob("job-2", models.JobSucceeded, nil, ""); !errors.Is(err, ErrNotFound) {
+			t.Errorf("FinishJob(cancelled) = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("JobRecovery", func(t *testing.T) {
+		store := newStore(t)
+
+		created := time.Now()
+		for i, id := range []string{"retry-1", "exhausted", "retry-2", "alive"} {
+			job := &models.Job{ID: id, Key: "key-a", Kind: "generate", Request: []byte(`{}`), CreatedAt: created.Add(time.Duration(i) * time.Millisecond)}
+			if err := store.CreateJob(job); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Jobs are claimed in creation order. "exhausted" is claimed twice, the
+		// others once, and only "alive" keeps a valid lease.
+		expired := time.Now().Add(-time.Minute)
+		for _, lease := range []time.Time{expired, expired, expired, time.Now().Add(time.Hour)} {
+			if _, err := store.ClaimJob(lease); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.RequeueJob("exhausted"); err != nil {
+			t.Fatalf("RequeueJob failed: %v", err)
+		}
+		if err := store.RequeueJob("exhausted"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("RequeueJob(queued) = %v, want ErrNotFound", err)
+		}
+		for {
+			job, err := store.ClaimJob(expired)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if job == nil {
+				break
+			}
+		}
+
+		requeued, failed, err := store.RecoverJobs(time.Now(), 2)
+		if err != nil {
+			t.Fatalf("RecoverJobs failed: %v", err)
+		}
+		if requeued != 2 || failed != 1 {
+			t.Errorf("RecoverJobs = %d requeued, %d failed; want 2, 1", requeued, failed)
+		}
+
+		want := map[string]models.JobStatus{
+			"retry-1":   models.JobQueued,
+			"exhausted": models.JobFailed,
+			"retry-2":   models.JobQueued,
+			"alive":     models.JobRunning,
+		}
+		for id, status := range want {
+			job, err := store.GetJob(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if job.Status != status {
+				t.Errorf("job %s status = %s, want %s", id, job.Status, status)
+			}
+		}
+	})
+
+	t.Run("Batches", func(t *testing.T) {
+		store := newStore(t)
+		now := time.Now()
+
+		for i, id := range []string{"batch-1", "batch-2"} {
+			batch := &models.Batch{ID: id, Key: "key-a", Total: 2, Concurrency: 2, CreatedAt: now.Add(time.Duration(i) * time.Millisecond)}
+			if err := store.CreateBatch(batch, []byte(`{"custom_id":"a"}`+"\n")); err != nil {
+				t.Fatalf("CreateBatch failed: %v", err)
+			}
+		}
+		if input, err := store.GetBatchInput("batch-1"); err != nil || string(input) != `{"custom_id":"a"}`+"\n" {
+			t.Errorf("GetBatchInput = %q, %v", input, err)
+		}
+		if missing, err := store.GetBatch("missing"); err != nil || missing != nil {
+			t.Errorf("GetBatch(missing) = %v, %v; want nil, nil", missing, err)
+		}
+
+		// A batch whose worker died is claimed again once its lease runs out
+		batch, err := store.ClaimBatch(now, now.Add(-time.Second))
+		if err != nil || batch == nil || batch.ID != "batch-1" || batch.Status != models.BatchRunning || batch.StartedAt == nil {
+			t.Fatalf("ClaimBatch = %+v, %v; want running batch-1", batch, err)
+		}
+		batch, err = store.ClaimBatch(now, now.Add(time.Minute))
+		if err != nil || batch == nil || batch.ID != "batch-1" {
+			t.Fatalf("ClaimBatch = %+v, %v; want expired batch-1", batch, err)
+		}
+		if status, err := store.RenewBatchLease("batch-1", now.Add(time.Minute)); err != nil || status != models.BatchRunning {
+			t.Errorf("RenewBatchLease = %v, %v; want running", status, err)
+		}
+
+		results := []models.BatchResult{
+			{CustomID: "b", Status: "failed", StatusCode: 404, Error: "model not found"},
+			{CustomID: "a", Status: "succeeded", StatusCode: 200, Response: []byte(`{"response":"hi"}`)},
+		}
+		for i, result := range results {
+			if err := store.SaveBatchResult("batch-1", 1-i, &result); err != nil {
+				t.Fatalf("SaveBatchResult failed: %v", err)
+			}
+		}
+		// Saving a result twice keeps the first one
+		if err := store.SaveBatchResult("batch-1", 0, &models.BatchResult{CustomID: "a", Status: "failed"}); err != nil {
+			t.Fatalf("SaveBatchResult failed: %v", err)
+		}
+
+		ids, err := store.BatchResultIDs("batch-1")
+		if err != nil || len(ids) != 2 || !ids["a"] || !ids["b"] {
+			t.Errorf("BatchResultIDs = %v, %v", ids, err)
+		}
+		var saved []string
+		err = store.EachBatchResult("batch-1", func(result []byte) error {
+			saved = append(saved, string(result))
+			return nil
+		})
+		if err != nil || len(saved) != 2 ||
+			saved[0] != `{"custom_id":"a","status":"succeeded","status_code":200,"response":{"response":"hi"}}` ||
+			saved[1] != `{"custom_id":"b","status":"failed","status_code":404,"error":"model not found"}` {
+			t.Errorf("EachBatchResult = %q, %v", saved, err)
+		}
+
+		if err := store.FinishBatch("batch-1", models.BatchCompleted, ""); err != nil {
+			t.Fatalf("FinishBatch failed: %v", err)
+		}
+		batch, err = store.GetBatch("batch-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch.Status != models.BatchCompleted || batch.Succeeded != 1 || batch.Failed != 1 || batch.Total != 2 || batch.FinishedAt == nil {
+			t.Errorf("unexpected finished batch: %+v", batch)
+		}
+		if err := store.CancelBatch("batch-1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("CancelBatch(finished) = %v, want ErrNotFound", err)
+		}
+
+		// A cancelled batch cannot be finished or requeued by its worker
+		if batch, err := store.ClaimBatch(now, now.Add(time.Minute)); err != nil || batch == nil || batch.ID != "batch-2" {
+			t.Fatalf("ClaimBatch = %+v, %v; want batch-2", batch, err)
+		}
+		if err := store.CancelBatch("batch-2"); err != nil {
+			t.Fatalf("CancelBatch failed: %v", err)
+		}
+		if status, err := store.RenewBatchLease("batch-2", now.Add(time.Minute)); err != nil || status != models.BatchCancelled {
+			t.Errorf("RenewBatchLease = %v, %v; want cancelled", status, err)
+		}
+		if err := store.FinishBatch("batch-2", models.BatchCompleted, ""); !errors.Is(err, ErrNotFound) {
+			t.Errorf("FinishBatch(cancelled) = %v, want ErrNotFound", err)
+		}
+		if err := store.RequeueBatch("batch-2"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("RequeueBatch(cancelled) = %v, want ErrNotFound", err)
+		}
+		if batch, err := store.ClaimBatch(now, now.Add(time.Minute)); err != nil || batch != nil {
+			t.Errorf("ClaimBatch with nothing left = %+v, %v; want nil", batch, err)
+		}
+	})
+
+	t.Run("ResponseCache", func(t *testing.T) {
+		store := newStore(t)
+		now := time.Now()
+
+		if response, _, err := store.GetCachedResponse("missing", now); err != nil || response != nil {
+			t.Errorf("GetCachedResponse(missing) = %q, %v; want nil", response, err)
+		}
+		for i, key := range []string{"old", "middle", "new"} {
+			created := now.Add(time.Duration(i-3) * time.Second)
+			if err := store.PutCachedResponse(key, []byte(key), created, now.Add(time.Hour)); err != nil {
+				t.Fatalf("PutCachedResponse failed: %v", err)
+			}
+		}
+		if err := store.PutCachedResponse("expired", []byte("expired"), now.Add(-time.Hour), now.Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		// Replacing a response refreshes it
+		if err := store.PutCachedResponse("old", []byte("replaced"), now, now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		response, expiresAt, err := store.GetCachedResponse("old", now)
+		if err != nil || string(response) != "replaced" || expiresAt.UnixMilli() != now.Add(time.Hour).UnixMilli() {
+			t.Errorf("GetCachedResponse = %q, %v, %v", response, expiresAt, err)
+		}
+		if response, _, err := store.GetCachedResponse("expired", now); err != nil || response != nil {
+			t.Errorf("GetCachedResponse(expired) = %q, %v; want nil", response, err)
+		}
+
+		deleted, err := store.PruneCachedResponses(now, 2)
+		if err != nil || deleted != 2 {
+			t.Errorf("PruneCachedResponses = %d, %v; want 2", deleted, err)
+		}
+		for key, kept := range map[string]bool{"old": true, "middle": false, "new": true} {
+			response, _, err := store.GetCachedResponse(key, now)
+			if err != nil || (response != nil) != kept {
+				t.Errorf("after pruning %s = %q, %v; kept should be %v", key, response, err, kept)
+			}
+		}
+	})
+}
@@ -1,93 +1,274 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/erock530/go-ollama-api/internal/models"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// ErrNotFound is returned when a record to change or delete does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrInUse is returned when a record cannot be deleted because others
+// refer to it
+var ErrInUse = errors.New("in use")
+
 // DBInterface defines the interface for database operations
 type DBInterface interface {
 	GetAPIKey(key string) (*models.APIKey, error)
 	UpdateAPIKeyUsage(key string, tokens int) error
-	LogAPIUsage(key string) error
+	LogAPIUsage(key, orgID string) error
+	GetUsageReport(key string, since time.Time, granularity models.UsageGranularity) ([]models.UsageBucket, error)
+	GetOrgTokens(orgID string, day time.Time) (int64, error)
+	AddOrgTokens(orgID string, day time.Time, tokens int64) error
+	GetKeyTokens(key string, day time.Time) (int64, error)
+	AddKeyTokens(key string, day time.Time, tokens int64) error
+	GetCertIdentityKey(identities ...string) (string, error)
+	GetOrg(id string) (*models.Org, error)
+	GetPlan(name string) (*models.Plan, error)
+	PingContext(ctx context.Context) error
 	Close() error
 }
 
+// OrgStore manages organizations and the keys they own
+type OrgStore interface {
+	GetAPIKey(key string) (*models.APIKey, error)
+	UpdateAPIKey(key *models.APIKey) error
+
+	CreateOrg(org *models.Org) error
+	GetOrg(id string) (*models.Org, error)
+	UpdateOrg(org *models.Org) error
+	ListOrgs() ([]models.Org, error)
+	DeleteOrg(id string) error
+	CountOrgKeys(id string) (int, error)
+	GetOrgTokens(orgID string, day time.Time) (int64, error)
+	GetOrgUsageReport(orgID string, since time.Time, granularity models.UsageGranularity) ([]models.UsageBucket, error)
+}
+
+// Store is the full storage interface implemented by every database backend
+type Store interface {
+	DBInterface
+	OrgStore
+
+	CreateAPIKey(key *models.APIKey) error
+	UpdateAPIKey(key *models.APIKey) error
+	ListAPIKeys() ([]models.APIKey, error)
+	DeleteAPIKey(key string) error
+
+	CreatePlan(plan *models.Plan) error
+	GetPlan(name string) (*models.Plan, error)
+	UpdatePlan(plan *models.Plan) error
+	ListPlans() ([]models.Plan, error)
+	DeletePlan(name string) error
+
+	MapCertIdentity(identity, key string) error
+	UnmapCertIdentity(identity string) error
+	ListCertIdentities() ([]models.CertIdentity, error)
+
+	GetWebhooks() ([]models.Webhook, error)
+	AddWebhook(url string) error
+	DeleteWebhook(id int64) error
+
+	CompactUsage(rawBefore, hourlyBefore time.Time) (int64, error)
+	IncrementalVacuum() error
+
+	IncrementRateCounter(ctx context.Context, key string, windowStart time.Time, period time.Duration) (int64, error)
+	UpdateRateState(ctx context.Context, key string, ttl time.Duration, update func(state []byte) ([]byte, error)) error
+
+	CreateJob(job *models.Job) error
+	GetJob(id string) (*models.Job, error)
+	ClaimJob(leaseUntil time.Time) (*models.Job, error)
+	RenewJobLease(id string, leaseUntil time.Time) (models.JobStatus, error)
+	FinishJob(id string, status models.JobStatus, result []byte, message string) error
+	RequeueJob(id string) error
+	CancelJob(id string) error
+	RecoverJobs(now time.Time, maxAttempts int) (requeued, failed int64, err error)
+
+	CreateBatch(batch *models.Batch, input []byte) error
+	GetBatch(id string) (*models.Batch, error)
+	GetBatchInput(id string) ([]byte, error)
+	ClaimBatch(now, leaseUntil time.Time) (*models.Batch, error)
+	RenewBatchLease(id string, leaseUntil time.Time) (models.BatchStatus, error)
+	FinishBatch(id string, status models.BatchStatus, message string) error
+	RequeueBatch(id string) error
+	CancelBatch(id string) error
+	SaveBatchResult(batchID string, line int, result *models.BatchResult) error
+	BatchResultIDs(batchID string) (map[string]bool, error)
+	EachBatchResult(batchID string, fn func(result []byte) error) error
+
+	GetCachedResponse(key string, now time.Time) ([]byte, time.Time, error)
+	PutCachedResponse(key string, response []byte, createdAt, expiresAt time.Time) error
+	PruneCachedResponses(now time.Time, maxEntries int) (int64, error)
+
+	SchemaVersion() (int, error)
+	LatestVersion() int
+	MigrationStatus() ([]MigrationStatus, error)
+	Migrate() (int, error)
+	MigrateUp(steps int) (int, error)
+	MigrateDown(steps int) (int, error)
+}
+
+// PoolConfig holds connection pool settings
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
 // DB wraps the SQL database connection
 type DB struct {
 	*sql.DB
+	dialect dialect
 }
 
-// Ensure DB implements DBInterface
-var _ DBInterface = (*DB)(nil)
+// Ensure DB implements Store
+var _ Store = (*DB)(nil)
+
+// dialect identifies the SQL flavour of the underlying database
+type dialect int
+
+const (
+	sqliteDialect dialect = iota
+	postgresDialect
+)
 
-// InitDB initializes the database connection and creates tables
+// rebind converts ? placeholders to the dialect's placeholder syntax
+func (d dialect) rebind(query string) string {
+	if d != postgresDialect {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// InitDB initializes the database connection and applies pending migrations
 func InitDB() (*DB, error) {
-	db, err := sql.Open("sqlite3", "./apiKeys.db")
+	return OpenDB("./apiKeys.db")
+}
+
+// OpenDB opens the SQLite database at path and applies pending migrations
+func OpenDB(path string) (*DB, error) {
+	db, err := Open(path)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := createTables(db); err != nil {
+	if _, err := db.Migrate(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	return &DB{db}, nil
+	return db, nil
 }
 
-// createTables creates the necessary database tables if they don't exist
-func createTables(db *sql.DB) error {
-	// Create apiKeys table
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS apiKeys (
-			key TEXT PRIMARY KEY,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			last_used TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			tokens INTEGER DEFAULT 10,
-			rate_limit INTEGER DEFAULT 10,
-			active INTEGER DEFAULT 1,
-			description TEXT
-		)
-	`)
-	if err != nil {
-		return err
+// Open opens the SQLite database at path without applying migrations
+func Open(path string) (*DB, error) {
+	// Wait for locks instead of failing when replicas or background jobs
+	// write concurrently
+	if !strings.Contains(path, "?") {
+		path += "?_busy_timeout=5000"
 	}
+	return open("sqlite3", path, sqliteDialect)
+}
 
-	// Create apiUsage table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS apiUsage (
-			key TEXT,
-			timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
+// OpenPostgres opens a PostgreSQL database without applying migrations
+func OpenPostgres(dsn string) (*DB, error) {
+	return open("postgres", dsn, postgresDialect)
+}
+
+// Connect opens the database described by dsn without applying migrations.
+// postgres:// and postgresql:// URLs select PostgreSQL; anything else is
+// treated as a SQLite file path.
+func Connect(dsn string, pool PoolConfig) (*DB, error) {
+	var db *DB
+	var err error
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		db, err = OpenPostgres(dsn)
+	} else {
+		db, err = Open(strings.TrimPrefix(dsn, "sqlite://"))
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Create webhooks table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS webhooks (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			url TEXT NOT NULL
-		)
-	`)
+	if pool.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(pool.MaxOpenConns)
+	}
+	if pool.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	if pool.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	}
+	return db, nil
+}
+
+// open connects with the given driver and prepares the migrations table
+func open(driver, dsn string, d dialect) (*DB, error) {
+	conn, err := sql.Open(driver, dsn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	db := &DB{DB: conn, dialect: d}
+	if err := db.ensureMigrationsTable(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return db, nil
 }
 
-// GetAPIKey retrieves an API key from the database
-func (db *DB) GetAPIKey(key string) (*models.APIKey, error) {
+// exec runs a statement written with ? placeholders
+func (db *DB) exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.Exec(db.dialect.rebind(query), args...)
+}
+
+// query runs a query written with ? placeholders
+func (db *DB) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.Query(db.dialect.rebind(query), args...)
+}
+
+// queryRow runs a single-row query written with ? placeholders
+func (db *DB) queryRow(query string, args ...interface{}) *sql.Row {
+	return db.QueryRow(db.dialect.rebind(query), args...)
+}
+
+// apiKeyColumns lists the apiKeys columns in the order scanAPIKey reads them
+const apiKeyColumns = `key, created_at, last_used, tokens, rate_limit, active, description,
+	rate_limit_algorithm, rate_limit_burst, max_concurrent, priority, queue_weight, response_cache,
+	max_num_ctx, max_num_predict, max_keep_alive, allowed_models, scopes, org_id, token_quota, plan,
+	allowed_cidrs`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanAPIKey reads a row selected with apiKeyColumns
+func scanAPIKey(row rowScanner) (*models.APIKey, error) {
 	var apiKey models.APIKey
-	err := db.QueryRow(`
-		SELECT key, created_at, last_used, tokens, rate_limit, active, description 
-		FROM apiKeys WHERE key = ?`, key).Scan(
+	var maxKeepAlive int64
+	var allowedModels, scopes, allowedCIDRs string
+	err := row.Scan(
 		&apiKey.Key,
 		&apiKey.CreatedAt,
 		&apiKey.LastUsed,
@@ -95,21 +276,170 @@ func (db *DB) GetAPIKey(key string) (*models.APIKey, error) {
 		&apiKey.RateLimit,
 		&apiKey.Active,
 		&apiKey.Description,
+		&apiKey.RateLimitAlgorithm,
+		&apiKey.RateLimitBurst,
+		&apiKey.MaxConcurrent,
+		&apiKey.Priority,
+		&apiKey.QueueWeight,
+		&apiKey.ResponseCache,
+		&apiKey.MaxNumCtx,
+		&apiKey.MaxNumPredict,
+		&maxKeepAlive,
+		&allowedModels,
+		&scopes,
+		&apiKey.OrgID,
+		&apiKey.TokenQuota,
+		&apiKey.PlanName,
+		&allowedCIDRs,
 	)
+	if err != nil {
+		return nil, err
+	}
+	apiKey.MaxKeepAlive = time.Duration(maxKeepAlive) * time.Second
+	apiKey.AllowedModels = splitList(allowedModels)
+	apiKey.Scopes = splitList(scopes)
+	apiKey.AllowedCIDRs = splitList(allowedCIDRs)
+	return &apiKey, nil
+}
+
+// splitList reads a comma-separated list column. An empty column is an
+// empty list.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// GetAPIKey retrieves an API key from the database along with its
+// organization and plan
+func (db *DB) GetAPIKey(key string) (*models.APIKey, error) {
+	apiKey, err := scanAPIKey(db.queryRow(`SELECT `+apiKeyColumns+` FROM apiKeys WHERE key = ?`, key))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &apiKey, nil
+	if apiKey.Org, err = db.GetOrg(apiKey.OrgID); err != nil {
+		return nil, err
+	}
+	if apiKey.PlanName != "" {
+		if apiKey.Plan, err = db.GetPlan(apiKey.PlanName); err != nil {
+			return nil, err
+		}
+	}
+	return apiKey, nil
+}
+
+// CreateAPIKey stores a new API key. A key without an organization is
+// given to the default one.
+func (db *DB) CreateAPIKey(key *models.APIKey) error {
+	if key.OrgID == "" {
+		key.OrgID = models.DefaultOrgID
+	}
+	_, err := db.exec(`
+		INSERT INTO apiKeys (key, tokens, rate_limit, active, description, rate_limit_algorithm, rate_limit_burst,
+			max_concurrent, priority, queue_weight, response_cache, max_num_ctx, max_num_predict, max_keep_alive,
+			allowed_models, scopes, org_id, token_quota, plan, allowed_cidrs)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		key.Key,
+		key.Tokens,
+		key.RateLimit,
+		key.Active,
+		key.Description,
+		key.RateLimitAlgorithm,
+		key.RateLimitBurst,
+		key.MaxConcurrent,
+		key.Priority,
+		key.QueueWeight,
+		key.ResponseCache,
+		key.MaxNumCtx,
+		key.MaxNumPredict,
+		int64(key.MaxKeepAlive/time.Second),
+		strings.Join(key.AllowedModels, ","),
+		strings.Join(key.Scopes, ","),
+		key.OrgID,
+		key.TokenQuota,
+		key.PlanName,
+		strings.Join(key.AllowedCIDRs, ","),
+	)
+	return err
+}
+
+// UpdateAPIKey saves the settings of an existing API key. Usage fields
+// (created_at, last_used, tokens) are left untouched, as is the
+// organization if OrgID is empty.
+func (db *DB) UpdateAPIKey(key *models.APIKey) error {
+	result, err := db.exec(`
+		UPDATE apiKeys
+		SET rate_limit = ?, active = ?, description = ?, rate_limit_algorithm = ?, rate_limit_burst = ?,
+			max_concurrent = ?, priority = ?, queue_weight = ?, response_cache = ?,
+			max_num_ctx = ?, max_num_predict = ?, max_keep_alive = ?, allowed_models = ?, scopes = ?,
+			org_id = COALESCE(NULLIF(?, ''), org_id), token_quota = ?, plan = ?, allowed_cidrs = ?
+		WHERE key = ?`,
+		key.RateLimit,
+		key.Active,
+		key.Description,
+		key.RateLimitAlgorithm,
+		key.RateLimitBurst,
+		key.MaxConcurrent,
+		key.Priority,
+		key.QueueWeight,
+		key.ResponseCache,
+		key.MaxNumCtx,
+		key.MaxNumPredict,
+		int64(key.MaxKeepAlive/time.Second),
+		strings.Join(key.AllowedModels, ","),
+		strings.Join(key.Scopes, ","),
+		key.OrgID,
+		key.TokenQuota,
+		key.PlanName,
+		strings.Join(key.AllowedCIDRs, ","),
+		key.Key,
+	)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
+}
+
+// ListAPIKeys retrieves all API keys
+func (db *DB) ListAPIKeys() ([]models.APIKey, error) {
+	rows, err := db.query(`SELECT ` + apiKeyColumns + ` FROM apiKeys ORDER BY created_at, key`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []models.APIKey
+	for rows.Next() {
+		apiKey, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *apiKey)
+	}
+	return keys, rows.Err()
+}
+
+// DeleteAPIKey removes an API key along with its certificate identities
+func (db *DB) DeleteAPIKey(key string) error {
+	if _, err := db.exec("DELETE FROM certIdentities WHERE key = ?", key); err != nil {
+		return err
+	}
+	result, err := db.exec("DELETE FROM apiKeys WHERE key = ?", key)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
 }
 
 // UpdateAPIKeyUsage updates the usage information for an API key
 func (db *DB) UpdateAPIKeyUsage(key string, tokens int) error {
-	_, err := db.Exec(`
-		UPDATE apiKeys 
-		SET tokens = ?, last_used = ? 
+	_, err := db.exec(`
+		UPDATE apiKeys
+		SET tokens = ?, last_used = ?
 		WHERE key = ?`,
 		tokens,
 		time.Now(),
@@ -118,15 +448,15 @@ func (db *DB) UpdateAPIKeyUsage(key string, tokens int) error {
 	return err
 }
 
-// LogAPIUsage logs an API usage event
-func (db *DB) LogAPIUsage(key string) error {
-	_, err := db.Exec(`INSERT INTO apiUsage (key) VALUES (?)`, key)
+// LogAPIUsage logs an API usage event of a key owned by an organization
+func (db *DB) LogAPIUsage(key, orgID string) error {
+	_, err := db.exec(`INSERT INTO apiUsage (key, org_id) VALUES (?, ?)`, key, orgID)
 	return err
 }
 
 // GetWebhooks retrieves all webhook URLs
 func (db *DB) GetWebhooks() ([]models.Webhook, error) {
-	rows, err := db.Query("SELECT id, url FROM webhooks")
+	rows, err := db.query("SELECT id, url FROM webhooks ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
@@ -140,17 +470,32 @@ func (db *DB) GetWebhooks() ([]models.Webhook, error) {
 		}
 		webhooks = append(webhooks, webhook)
 	}
-	return webhooks, nil
+	return webhooks, rows.Err()
 }
 
 // AddWebhook adds a new webhook URL
 func (db *DB) AddWebhook(url string) error {
-	_, err := db.Exec("INSERT INTO webhooks (url) VALUES (?)", url)
+	_, err := db.exec("INSERT INTO webhooks (url) VALUES (?)", url)
 	return err
 }
 
 // DeleteWebhook deletes a webhook by ID
 func (db *DB) DeleteWebhook(id int64) error {
-	_, err := db.Exec("DELETE FROM webhooks WHERE id = ?", id)
-	return err
+	result, err := db.exec("DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
+}
+
+// requireRowsAffected returns ErrNotFound if a statement changed no rows
+func requireRowsAffected(result sql.Result) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// jobColumns lists the jobs columns in the order scanJob reads them
+const jobColumns = `id, key, kind, request, callback_url, status, result, error, attempts,
+	created_at, started_at, finished_at`
+
+// scanJob reads a row selected with jobColumns. Times are stored as Unix
+// milliseconds, with zero meaning unset.
+func scanJob(row rowScanner) (*models.Job, error) {
+	var job models.Job
+	var request, result string
+	var createdAt, startedAt, finishedAt int64
+	err := row.Scan(
+		&job.ID,
+		&job.Key,
+		&job.Kind,
+		&request,
+		&job.CallbackURL,
+		&job.Status,
+		&result,
+		&job.Error,
+		&job.Attempts,
+		&createdAt,
+		&startedAt,
+		&finishedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Request = []byte(request)
+	if result != "" {
+		job.Result = []byte(result)
+	}
+	job.CreatedAt = time.UnixMilli(createdAt)
+	job.StartedAt = optionalTime(startedAt)
+	job.FinishedAt = optionalTime(finishedAt)
+	return &job, nil
+}
+
+// optionalTime converts Unix milliseconds to a time, with zero meaning nil
+func optionalTime(millis int64) *time.Time {
+	if millis == 0 {
+		return nil
+	}
+	t := time.UnixMilli(millis)
+	return &t
+}
+
+// CreateJob stores a new queued job
+func (db *DB) CreateJob(job *models.Job) error {
+	job.Status = models.JobQueued
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = time.Now()
+	}
+	_, err := db.exec(`
+		INSERT INTO jobs (id, key, kind, request, callback_url, status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		job.ID,
+		job.Key,
+		job.Kind,
+		string(job.Request),
+		job.CallbackURL,
+		job.Status,
+		job.CreatedAt.UnixMilli(),
+	)
+	return err
+}
+
+// GetJob retrieves a job by ID, returning nil if it does not exist
+func (db *DB) GetJob(id string) (*models.Job, error) {
+	job, err := scanJob(db.queryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+// ClaimJob marks the oldest queued job as running and returns it, or nil if
+// none is queued. The claim is a single conditional update, so when several
+// workers race for the same job only one of them gets it. The job is leased
+// until leaseUntil; a running job whose lease ran out is considered lost.
+func (db *DB) ClaimJob(leaseUntil time.Time) (*models.Job, error) {
+	now := time.Now().UnixMilli()
+	for {
+		var id string
+		err := db.queryRow(`SELECT id FROM jobs WHERE status = ? ORDER BY created_at, id LIMIT 1`, models.JobQueued).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		job, err := scanJob(db.queryRow(`
+			UPDATE jobs
+			SET status = ?, attempts = attempts + 1, started_at = ?, lease_until = ?
+			WHERE id = ? AND status = ?
+			RETURNING `+jobColumns,
+			models.JobRunning, now, leaseUntil.UnixMilli(), id, models.JobQueued))
+		if err == sql.ErrNoRows {
+			// Another worker claimed it first
+			continue
+		}
+		return job, err
+	}
+}
+
+// RenewJobLease extends the lease of a running job and returns the job's
+// status, which tells the worker whether the job was cancelled meanwhile
+func (db *DB) RenewJobLease(id string, leaseUntil time.Time) (models.JobStatus, error) {
+	if _, err := db.exec(`UPDATE jobs SET lease_until = ? WHERE id = ? AND status = ?`,
+		leaseUntil.UnixMilli(), id, models.JobRunning); err != nil {
+		return "", err
+	}
+
+	var status models.JobStatus
+	err := db.queryRow(`SELECT status FROM jobs WHERE id = ?`, id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return status, err
+}
+
+// FinishJob records the outcome of a running job. It returns ErrNotFound if
+// the job is no longer running, for example because it was cancelled.
+func (db *DB) FinishJob(id string, status models.JobStatus, result []byte, message string) error {
+	res, err := db.exec(`
+		UPDATE jobs
+		SET status = ?, result = ?, error = ?, finished_at = ?, lease_until = 0
+		WHERE id = ? AND status = ?`,
+		status, string(result), message, time.Now().UnixMilli(), id, models.JobRunning)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(res)
+}
+
+// RequeueJob puts a running job back in the queue, for a worker that is
+// shutting down
+func (db *DB) RequeueJob(id string) error {
+	res, err := db.exec(`UPDATE jobs SET status = ?, lease_until = 0 WHERE id = ? AND status = ?`,
+		models.JobQueued, id, models.JobRunning)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(res)
+}
+
+// CancelJob cancels a queued or running job. It returns ErrNotFound if there
+// is no such unfinished job.
+func (db *DB) CancelJob(id string) error {
+	res, err := db.exec(`
+		UPDATE jobs
+		SET status = ?, finished_at = ?, lease_until = 0
+		WHERE id = ? AND status IN (?, ?)`,
+		models.JobCancelled, time.Now().UnixMilli(), id, models.JobQueued, models.JobRunning)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(res)
+}
+
+// RecoverJobs handles running jobs whose lease ran out before now because
+// their worker died. Jobs that have been attempted fewer than maxAttempts
+// times are queued again, the others are marked failed.
+func (db *DB) RecoverJobs(now time.Time, maxAttempts int) (requeued, failed int64, err error) {
+	res, err := db.exec(`
+		UPDATE jobs
+		SET status = ?, error = ?, finished_at = ?, lease_until = 0
+		WHERE status = ? AND lease_until < ? AND attempts >= ?`,
+		models.JobFailed, "worker stopped while running the job", now.UnixMilli(),
+		models.JobRunning, now.UnixMilli(), maxAttempts)
+	if err != nil {
+		return 0, 0, err
+	}
+	if failed, err = res.RowsAffected(); err != nil {
+		return 0, 0, err
+	}
+
+	res, err = db.exec(`
+		UPDATE jobs
+		SET status = ?, lease_until = 0
+		WHERE status = ? AND lease_until < ?`,
+		models.JobQueued, models.JobRunning, now.UnixMilli())
+	if err != nil {
+		return 0, 0, err
+	}
+	if requeued, err = res.RowsAffected(); err != nil {
+		return 0, 0, err
+	}
+	return requeued, failed, nil
+}
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Migration is a versioned, reversible schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus describes whether a migration has been applied
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// migrations returns the migrations for the database's dialect
+func (db *DB) migrations() []Migration {
+	if db.dialect == postgresDialect {
+		return postgresMigrations
+	}
+	return sqliteMigrations
+}
+
+// LatestVersion returns the schema version the code expects
+func (db *DB) LatestVersion() int {
+	migrations := db.migrations()
+	return migrations[len(migrations)-1].Version
+}
+
+// ensureMigrationsTable creates the table that tracks applied migrations
+func (db *DB) ensureMigrationsTable() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+// SchemaVersion returns the highest applied migration version, or 0 for an empty database
+func (db *DB) SchemaVersion() (int, error) {
+	var version sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// MigrationStatus returns every known migration and whether it has been applied
+func (db *DB) MigrationStatus() ([]MigrationStatus, error) {
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	migrations := db.migrations()
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.Version]
+		statuses = append(statuses, MigrationStatus{
+			Version:   m.Version,
+			Name:      m.Name,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+	return statuses, nil
+}
+
+// Migrate applies all pending migrations
+func (db *DB) Migrate() (int, error) {
+	return db.MigrateUp(len(db.migrations()))
+}
+
+// MigrateUp applies up to steps pending migrations in order and returns how
+// many were applied. Each migration runs in its own transaction.
+func (db *DB) MigrateUp(steps int) (int, error) {
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, m := range db.migrations() {
+		if applied >= steps {
+			break
+		}
+		if m.Version <= current {
+			continue
+		}
+
+		if err := db.runMigration(m, true); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts up to steps applied migrations, newest first, and
+// returns how many were reverted
+func (db *DB) MigrateDown(steps int) (int, error) {
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	migrations := db.migrations()
+	reverted := 0
+	for i := len(migrations) - 1; i >= 0 && reverted < steps; i-- {
+		m := migrations[i]
+		if m.Version > current {
+			continue
+		}
+
+		if err := db.runMigration(m, false); err != nil {
+			return reverted, fmt.Errorf("reverting migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		reverted++
+	}
+	return reverted, nil
+}
+
+// migrationLockID is the PostgreSQL advisory lock that serializes migrations
+// when several gateway replicas start at the same time
+const migrationLockID = 7265746
+
+// runMigration applies (up) or reverts a migration and records the change in
+// one transaction. A migration that another process applied or reverted in
+// the meantime is skipped.
+func (db *DB) runMigration(m Migration, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if db.dialect == postgresDialect {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+			return err
+		}
+	}
+
+	var count int
+	if err := tx.QueryRow(db.dialect.rebind(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`), m.Version).Scan(&count); err != nil {
+		return err
+	}
+	if (count > 0) == up {
+		return nil
+	}
+
+	script, record := m.Down, `DELETE FROM schema_migrations WHERE version = ?`
+	args := []interface{}{m.Version}
+	if up {
+		script, record = m.Up, `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`
+		args = append(args, m.Name)
+	}
+
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(db.dialect.rebind(record), args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
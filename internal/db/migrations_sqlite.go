@@ -0,0 +1,293 @@
+package db
+
+// sqliteMigrations lists the SQLite schema changes in the order they are
+// applied. Never edit a migration that has been released; add a new one
+// instead, together with its PostgreSQL counterpart in postgresMigrations.
+var sqliteMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: `
+			CREATE TABLE IF NOT EXISTS apiKeys (
+				key TEXT PRIMARY KEY,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				last_used TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				tokens INTEGER DEFAULT 10,
+				rate_limit INTEGER DEFAULT 10,
+				active INTEGER DEFAULT 1,
+				description TEXT
+			);
+			CREATE TABLE IF NOT EXISTS apiUsage (
+				key TEXT,
+				timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE TABLE IF NOT EXISTS webhooks (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				url TEXT NOT NULL
+			);`,
+		Down: `
+			DROP TABLE IF EXISTS webhooks;
+			DROP TABLE IF EXISTS apiUsage;
+			DROP TABLE IF EXISTS apiKeys;`,
+	},
+	{
+		Version: 2,
+		Name:    "usage rollups",
+		Up: `
+			CREATE INDEX IF NOT EXISTS idx_apiUsage_timestamp ON apiUsage (timestamp);
+			CREATE TABLE IF NOT EXISTS apiUsageHourly (
+				key TEXT NOT NULL,
+				hour TEXT NOT NULL,
+				requests INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (key, hour)
+			);
+			CREATE TABLE IF NOT EXISTS apiUsageDaily (
+				key TEXT NOT NULL,
+				day TEXT NOT NULL,
+				requests INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (key, day)
+			);`,
+		Down: `
+			DROP TABLE IF EXISTS apiUsageDaily;
+			DROP TABLE IF EXISTS apiUsageHourly;
+			DROP INDEX IF EXISTS idx_apiUsage_timestamp;`,
+	},
+	{
+		Version: 3,
+		Name:    "rate limit counters",
+		Up: `
+			CREATE TABLE IF NOT EXISTS rateLimitCounters (
+				key TEXT PRIMARY KEY,
+				window_start INTEGER NOT NULL,
+				hits INTEGER NOT NULL
+			);`,
+		Down: `DROP TABLE IF EXISTS rateLimitCounters;`,
+	},
+	{
+		Version: 4,
+		Name:    "rate limit algorithms",
+		Up: `
+			ALTER TABLE apiKeys ADD COLUMN rate_limit_algorithm TEXT NOT NULL DEFAULT '';
+			ALTER TABLE apiKeys ADD COLUMN rate_limit_burst INTEGER NOT NULL DEFAULT 0;
+			CREATE TABLE IF NOT EXISTS rateLimitState (
+				key TEXT PRIMARY KEY,
+				state TEXT NOT NULL,
+				version INTEGER NOT NULL
+			);`,
+		Down: `
+			DROP TABLE IF EXISTS rateLimitState;
+			ALTER TABLE apiKeys DROP COLUMN rate_limit_burst;
+			ALTER TABLE apiKeys DROP COLUMN rate_limit_algorithm;`,
+	},
+	{
+		Version: 5,
+		Name:    "per-key concurrency limits",
+		Up: `
+			ALTER TABLE apiKeys ADD COLUMN max_concurrent INTEGER NOT NULL DEFAULT 0;`,
+		Down: `
+			ALTER TABLE apiKeys DROP COLUMN max_concurrent;`,
+	},
+	{
+		Version: 6,
+		Name:    "scheduling priorities",
+		Up: `
+			ALTER TABLE apiKeys ADD COLUMN priority TEXT NOT NULL DEFAULT '';
+			ALTER TABLE apiKeys ADD COLUMN queue_weight INTEGER NOT NULL DEFAULT 0;`,
+		Down: `
+			ALTER TABLE apiKeys DROP COLUMN queue_weight;
+			ALTER TABLE apiKeys DROP COLUMN priority;`,
+	},
+	{
+		Version: 7,
+		Name:    "generation jobs",
+		Up: `
+			CREATE TABLE IF NOT EXISTS jobs (
+				id TEXT PRIMARY KEY,
+				key TEXT NOT NULL,
+				kind TEXT NOT NULL,
+				request TEXT NOT NULL,
+				callback_url TEXT NOT NULL DEFAULT '',
+				status TEXT NOT NULL,
+				result TEXT NOT NULL DEFAULT '',
+				error TEXT NOT NULL DEFAULT '',
+				attempts INTEGER NOT NULL DEFAULT 0,
+				created_at INTEGER NOT NULL,
+				started_at INTEGER NOT NULL DEFAULT 0,
+				finished_at INTEGER NOT NULL DEFAULT 0,
+				lease_until INTEGER NOT NULL DEFAULT 0
+			);
+			CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs (status, created_at);`,
+		Down: `
+			DROP INDEX IF EXISTS idx_jobs_status;
+			DROP TABLE IF EXISTS jobs;`,
+	},
+	{
+		Version: 8,
+		Name:    "batches",
+		Up: `
+			CREATE TABLE IF NOT EXISTS batches (
+				id TEXT PRIMARY KEY,
+				key TEXT NOT NULL,
+				status TEXT NOT NULL,
+				input TEXT NOT NULL,
+				total INTEGER NOT NULL DEFAULT 0,
+				concurrency INTEGER NOT NULL DEFAULT 1,
+				error TEXT NOT NULL DEFAULT '',
+				created_at INTEGER NOT NULL,
+				started_at INTEGER NOT NULL DEFAULT 0,
+				finished_at INTEGER NOT NULL DEFAULT 0,
+				lease_until INTEGER NOT NULL DEFAULT 0
+			);
+			CREATE INDEX IF NOT EXISTS idx_batches_status ON batches (status, created_at);
+			CREATE TABLE IF NOT EXISTS batchResults (
+				batch_id TEXT NOT NULL,
+				custom_id TEXT NOT NULL,
+				line INTEGER NOT NULL,
+				status TEXT NOT NULL,
+				result TEXT NOT NULL,
+				PRIMARY KEY (batch_id, custom_id)
+			);
+			CREATE INDEX IF NOT EXISTS idx_batchResults_line ON batchResults (batch_id, line);`,
+		Down: `
+			DROP INDEX IF EXISTS idx_batchResults_line;
+			DROP TABLE IF EXISTS batchResults;
+			DROP INDEX IF EXISTS idx_batches_status;
+			DROP TABLE IF EXISTS batches;`,
+	},
+	{
+		Version: 9,
+		Name:    "response cache",
+		Up: `
+			ALTER TABLE apiKeys ADD COLUMN response_cache TEXT NOT NULL DEFAULT '';
+			CREATE TABLE IF NOT EXISTS responseCache (
+				key TEXT PRIMARY KEY,
+				response TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				expires_at INTEGER NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_responseCache_created ON responseCache (created_at);`,
+		Down: `
+			DROP INDEX IF EXISTS idx_responseCache_created;
+			DROP TABLE IF EXISTS responseCache;
+			ALTER TABLE apiKeys DROP COLUMN response_cache;`,
+	},
+	{
+		Version: 10,
+		Name:    "option limits",
+		Up: `
+			ALTER TABLE apiKeys ADD COLUMN max_num_ctx INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE apiKeys ADD COLUMN max_num_predict INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE apiKeys ADD COLUMN max_keep_alive INTEGER NOT NULL DEFAULT 0;`,
+		Down: `
+			ALTER TABLE apiKeys DROP COLUMN max_keep_alive;
+			ALTER TABLE apiKeys DROP COLUMN max_num_predict;
+			ALTER TABLE apiKeys DROP COLUMN max_num_ctx;`,
+	},
+	{
+		Version: 11,
+		Name:    "model access",
+		Up: `
+			ALTER TABLE apiKeys ADD COLUMN allowed_models TEXT NOT NULL DEFAULT '';
+			ALTER TABLE apiKeys ADD COLUMN scopes TEXT NOT NULL DEFAULT '';`,
+		Down: `
+			ALTER TABLE apiKeys DROP COLUMN scopes;
+			ALTER TABLE apiKeys DROP COLUMN allowed_models;`,
+	},
+	{
+		Version: 12,
+		Name:    "organizations",
+		Up: `
+			CREATE TABLE IF NOT EXISTS orgs (
+				id TEXT PRIMARY KEY,
+				name TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				rate_limit INTEGER NOT NULL DEFAULT 0,
+				token_quota INTEGER NOT NULL DEFAULT 0,
+				allowed_models TEXT NOT NULL DEFAULT ''
+			);
+			INSERT INTO orgs (id, name) VALUES ('default', 'Default');
+			ALTER TABLE apiKeys ADD COLUMN org_id TEXT NOT NULL DEFAULT 'default';
+			CREATE INDEX IF NOT EXISTS idx_apiKeys_org_id ON apiKeys(org_id);
+			CREATE TABLE IF NOT EXISTS orgTokens (
+				org_id TEXT NOT NULL,
+				day TEXT NOT NULL,
+				tokens INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (org_id, day)
+			);`,
+		Down: `
+			DROP TABLE IF EXISTS orgTokens;
+			DROP INDEX IF EXISTS idx_apiKeys_org_id;
+			ALTER TABLE apiKeys DROP COLUMN org_id;
+			DROP TABLE IF EXISTS orgs;`,
+	},
+	{
+		Version: 13,
+		Name:    "plans",
+		Up: `
+			CREATE TABLE IF NOT EXISTS plans (
+				name TEXT PRIMARY KEY,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				rate_limit INTEGER NOT NULL DEFAULT 0,
+				rate_limit_algorithm TEXT NOT NULL DEFAULT '',
+				rate_limit_burst INTEGER NOT NULL DEFAULT 0,
+				token_quota INTEGER NOT NULL DEFAULT 0,
+				max_concurrent INTEGER NOT NULL DEFAULT 0,
+				priority TEXT NOT NULL DEFAULT '',
+				queue_weight INTEGER NOT NULL DEFAULT 0,
+				allowed_models TEXT NOT NULL DEFAULT ''
+			);
+			INSERT INTO plans (name, rate_limit, token_quota, max_concurrent, priority) VALUES
+				('free', 10, 100000, 1, 'low'),
+				('standard', 60, 1000000, 4, 'normal'),
+				('premium', 600, 0, 16, 'high');
+			ALTER TABLE apiKeys ADD COLUMN plan TEXT NOT NULL DEFAULT '';
+			ALTER TABLE apiKeys ADD COLUMN token_quota INTEGER NOT NULL DEFAULT 0;
+			CREATE INDEX IF NOT EXISTS idx_apiKeys_plan ON apiKeys(plan);
+			CREATE TABLE IF NOT EXISTS keyTokens (
+				key TEXT NOT NULL,
+				day TEXT NOT NULL,
+				tokens INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (key, day)
+			);`,
+		Down: `
+			DROP TABLE IF EXISTS keyTokens;
+			DROP INDEX IF EXISTS idx_apiKeys_plan;
+			ALTER TABLE apiKeys DROP COLUMN token_quota;
+			ALTER TABLE apiKeys DROP COLUMN plan;
+			DROP TABLE IF EXISTS plans;`,
+	},
+	{
+		Version: 14,
+		Name:    "IP allowlists",
+		Up: `
+			ALTER TABLE apiKeys ADD COLUMN allowed_cidrs TEXT NOT NULL DEFAULT '';`,
+		Down: `
+			ALTER TABLE apiKeys DROP COLUMN allowed_cidrs;`,
+	},
+	{
+		Version: 15,
+		Name:    "client certificate identities",
+		Up: `
+			CREATE TABLE IF NOT EXISTS certIdentities (
+				identity TEXT PRIMARY KEY,
+				key TEXT NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE INDEX IF NOT EXISTS idx_certIdentities_key ON certIdentities(key);`,
+		Down: `
+			DROP INDEX IF EXISTS idx_certIdentities_key;
+			DROP TABLE IF EXISTS certIdentities;`,
+	},
+	{
+		Version: 16,
+		Name:    "usage organizations",
+		Up: `
+			ALTER TABLE apiUsage ADD COLUMN org_id TEXT NOT NULL DEFAULT '';
+			ALTER TABLE apiUsageHourly ADD COLUMN org_id TEXT NOT NULL DEFAULT '';
+			ALTER TABLE apiUsageDaily ADD COLUMN org_id TEXT NOT NULL DEFAULT '';`,
+		Down: `
+			ALTER TABLE apiUsageDaily DROP COLUMN org_id;
+			ALTER TABLE apiUsageHourly DROP COLUMN org_id;
+			ALTER TABLE apiUsage DROP COLUMN org_id;`,
+	},
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// v100Schema is the schema created by v1.0.0, before migrations were tracked
+const v100Schema = `
+	CREATE TABLE IF NOT EXISTS apiKeys (
+		key TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		tokens INTEGER DEFAULT 10,
+		rate_limit INTEGER DEFAULT 10,
+		active INTEGER DEFAULT 1,
+		description TEXT
+	);
+	CREATE TABLE IF NOT EXISTS apiUsage (
+		key TEXT,
+		timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL
+	);`
+
+func createV100Database(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "apiKeys.db")
+
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	if _, err := raw.Exec(v100Schema); err != nil {
+		t.Fatalf("Failed to create v1.0.0 schema: %v", err)
+	}
+	if _, err := raw.Exec(`
+		INSERT INTO apiKeys (key, tokens, rate_limit, description) VALUES ('legacy-key', 7, 20, 'from v1.0.0');
+		INSERT INTO apiUsage (key) VALUES ('legacy-key');
+		INSERT INTO apiUsage (key) VALUES ('legacy-key');
+		INSERT INTO webhooks (url) VALUES ('http://example.com/hook');`); err != nil {
+		t.Fatalf("Failed to seed v1.0.0 data: %v", err)
+	}
+	return path
+}
+
+func assertLegacyData(t *testing.T, database *DB) {
+	t.Helper()
+
+	// Only the v1.0.0 columns are read: GetAPIKey expects the latest schema,
+	// which intermediate versions do not have
+	var key models.APIKey
+	err := database.QueryRow(`SELECT tokens, rate_limit, active, description FROM apiKeys WHERE key = 'legacy-key'`).
+		Scan(&key.Tokens, &key.RateLimit, &key.Active, &key.Description)
+	if err == sql.ErrNoRows {
+		t.Fatal("legacy key was lost")
+	}
+	if err != nil {
+		t.Fatalf("reading legacy key failed: %v", err)
+	}
+	if key.Tokens != 7 || key.RateLimit != 20 || !key.Active || key.Description.String != "from v1.0.0" {
+		t.Errorf("legacy key changed: %+v", key)
+	}
+
+	var usage int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM apiUsage WHERE key = 'legacy-key'`).Scan(&usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage != 2 {
+		t.Errorf("legacy usage rows = %d, want 2", usage)
+	}
+
+	webhooks, err := database.GetWebhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 1 || webhooks[0].URL != "http://example.com/hook" {
+		t.Errorf("legacy webhooks changed: %+v", webhooks)
+	}
+}
+
+func TestMigrateFromV100(t *testing.T) {
+	path := createV100Database(t)
+
+	database, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer database.Close()
+
+	version, err := database.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Fatalf("untracked v1.0.0 database has version %d, want 0", version)
+	}
+
+	applied, err := database.Migrate()
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if applied != len(sqliteMigrations) {
+		t.Errorf("applied %d migrations, want %d", applied, len(sqliteMigrations))
+	}
+
+	version, err = database.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != database.LatestVersion() {
+		t.Errorf("schema version = %d, want %d", version, database.LatestVersion())
+	}
+
+	assertLegacyData(t, database)
+
+	// Migrating again is a no-op
+	applied, err = database.Migrate()
+	if err != nil {
+		t.Fatalf("second Migrate failed: %v", err)
+	}
+	if applied != 0 {
+		t.Errorf("second Migrate applied %d migrations, want 0", applied)
+	}
+}
+
+func TestMigrateStepwise(t *testing.T) {
+	path := createV100Database(t)
+
+	database, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer database.Close()
+
+	// Apply one migration at a time, checking the data after each step
+	for i := range sqliteMigrations {
+		applied, err := database.MigrateUp(1)
+		if err != nil {
+			t.Fatalf("MigrateUp to version %d failed: %v", sqliteMigrations[i].Version, err)
+		}
+		if applied != 1 {
+			t.Fatalf("MigrateUp applied %d migrations, want 1", applied)
+		}
+		assertLegacyData(t, database)
+	}
+
+	statuses, err := database.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if !status.Applied {
+			t.Errorf("migration %d is not applied", status.Version)
+		}
+	}
+
+	// Revert everything but the initial schema, then migrate forward again
+	reverted, err := database.MigrateDown(len(sqliteMigrations) - 1)
+	if err != nil {
+		t.Fatalf("MigrateDown failed: %v", err)
+	}
+	if reverted != len(sqliteMigrations)-1 {
+		t.Errorf("reverted %d migrations, want %d", reverted, len(sqliteMigrations)-1)
+	}
+	version, err := database.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Errorf("schema version after down = %d, want 1", version)
+	}
+	assertLegacyData(t, database)
+
+	if _, err := database.Migrate(); err != nil {
+		t.Fatalf("Migrate after down failed: %v", err)
+	}
+	assertLegacyData(t, database)
+}
+
+func TestMigrationVersionsMatchAcrossDialects(t *testing.T) {
+	if len(sqliteMigrations) != len(postgresMigrations) {
+		t.Fatalf("%d SQLite migrations but %d PostgreSQL migrations", len(sqliteMigrations), len(postgresMigrations))
+	}
+	for i := range sqliteMigrations {
+		if sqliteMigrations[i].Version != postgresMigrations[i].Version || sqliteMigrations[i].Name != postgresMigrations[i].Name {
+			t.Errorf("migration %d differs: SQLite %d %q, PostgreSQL %d %q", i,
+				sqliteMigrations[i].Version, sqliteMigrations[i].Name,
+				postgresMigrations[i].Version, postgresMigrations[i].Name)
+		}
+		if i > 0 && sqliteMigrations[i].Version <= sqliteMigrations[i-1].Version {
+			t.Errorf("migration versions are not increasing at index %d", i)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// orgColumns lists the orgs columns in the order scanOrg reads them
+const orgColumns = `id, name, created_at, rate_limit, token_quota, allowed_models`
+
+// scanOrg reads a row selected with orgColumns
+func scanOrg(row rowScanner) (*models.Org, error) {
+	var org models.Org
+	var allowedModels string
+	err := row.Scan(&org.ID, &org.Name, &org.CreatedAt, &org.RateLimit, &org.TokenQuota, &allowedModels)
+	if err != nil {
+		return nil, err
+	}
+	org.AllowedModels = splitList(allowedModels)
+	return &org, nil
+}
+
+// CreateOrg stores a new organization
+func (db *DB) CreateOrg(org *models.Org) error {
+	_, err := db.exec(`
+		INSERT INTO orgs (id, name, rate_limit, token_quota, allowed_models)
+		VALUES (?, ?, ?, ?, ?)`,
+		org.ID,
+		org.Name,
+		org.RateLimit,
+		org.TokenQuota,
+		strings.Join(org.AllowedModels, ","),
+	)
+	return err
+}
+
+// GetOrg retrieves an organization, or nil if it does not exist
+func (db *DB) GetOrg(id string) (*models.Org, error) {
+	org, err := scanOrg(db.queryRow(`SELECT `+orgColumns+` FROM orgs WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return org, err
+}
+
+// UpdateOrg saves the settings of an existing organization
+func (db *DB) UpdateOrg(org *models.Org) error {
+	result, err := db.exec(`
+		UPDATE orgs SET name = ?, rate_limit = ?, token_quota = ?, allowed_models = ?
+		WHERE id = ?`,
+		org.Name,
+		org.RateLimit,
+		org.TokenQuota,
+		strings.Join(org.AllowedModels, ","),
+		org.ID,
+	)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
+}
+
+// ListOrgs retrieves all organizations
+func (db *DB) ListOrgs() ([]models.Org, error) {
+	rows, err := db.query(`SELECT ` + orgColumns + ` FROM orgs ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgs []models.Org
+	for rows.Next() {
+		org, err := scanOrg(rows)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, *org)
+	}
+	return orgs, rows.Err()
+}
+
+// DeleteOrg removes an organization. Organizations that still own keys
+// cannot be removed and give ErrInUse, as does the default organization.
+func (db *DB) DeleteOrg(id string) error {
+	if id == models.DefaultOrgID {
+		return ErrInUse
+	}
+	result, err := db.exec(`
+		DELETE FROM orgs
+		WHERE id = ? AND NOT EXISTS (SELECT 1 FROM apiKeys WHERE org_id = orgs.id)`, id)
+	if err != nil {
+		return err
+	}
+	if err := requireRowsAffected(result); err != nil {
+		if org, getErr := db.GetOrg(id); getErr == nil && org != nil {
+			return ErrInUse
+		}
+		return err
+	}
+	return nil
+}
+
+// CountOrgKeys returns the number of keys an organization owns
+func (db *DB) CountOrgKeys(id string) (int, error) {
+	var count int
+	err := db.queryRow(`SELECT COUNT(*) FROM apiKeys WHERE org_id = ?`, id).Scan(&count)
+	return count, err
+}
+
+// tokensDay formats the UTC day of t as stored in orgTokens and keyTokens
+func tokensDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// GetOrgTokens returns the tokens an organization has used on the UTC day
+// of day
+func (db *DB) GetOrgTokens(orgID string, day time.Time) (int64, error) {
+	var tokens int64
+	err := db.queryRow(`SELECT tokens FROM orgTokens WHERE org_id = ? AND day = ?`, orgID, tokensDay(day)).Scan(&tokens)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return tokens, err
+}
+
+// AddOrgTokens adds to the tokens an organization has used on the UTC day
+// of day
+func (db *DB) AddOrgTokens(orgID string, day time.Time, tokens int64) error {
+	_, err := db.exec(`
+		INSERT INTO orgTokens (org_id, day, tokens) VALUES (?, ?, ?)
+		ON CONFLICT (org_id, day) DO UPDATE SET tokens = orgTokens.tokens + excluded.tokens`,
+		orgID, tokensDay(day), tokens)
+	return err
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// planColumns lists the plans columns in the order scanPlan reads them
+const planColumns = `name, created_at, rate_limit, rate_limit_algorithm, rate_limit_burst, token_quota,
+	max_concurrent, priority, queue_weight, allowed_models`
+
+// scanPlan reads a row selected with planColumns
+func scanPlan(row rowScanner) (*models.Plan, error) {
+	var plan models.Plan
+	var allowedModels string
+	err := row.Scan(
+		&plan.Name,
+		&plan.CreatedAt,
+		&plan.RateLimit,
+		&plan.RateLimitAlgorithm,
+		&plan.RateLimitBurst,
+		&plan.TokenQuota,
+		&plan.MaxConcurrent,
+		&plan.Priority,
+		&plan.QueueWeight,
+		&allowedModels,
+	)
+	if err != nil {
+		return nil, err
+	}
+	plan.AllowedModels = splitList(allowedModels)
+	return &plan, nil
+}
+
+// CreatePlan stores a new plan
+func (db *DB) CreatePlan(plan *models.Plan) error {
+	_, err := db.exec(`
+		INSERT INTO plans (name, rate_limit, rate_limit_algorithm, rate_limit_burst, token_quota,
+			max_concurrent, priority, queue_weight, allowed_models)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		plan.Name,
+		plan.RateLimit,
+		plan.RateLimitAlgorithm,
+		plan.RateLimitBurst,
+		plan.TokenQuota,
+		plan.MaxConcurrent,
+		plan.Priority,
+		plan.QueueWeight,
+		strings.Join(plan.AllowedModels, ","),
+	)
+	return err
+}
+
+// GetPlan retrieves a plan, or nil if it does not exist
+func (db *DB) GetPlan(name string) (*models.Plan, error) {
+	plan, err := scanPlan(db.queryRow(`SELECT `+planColumns+` FROM plans WHERE name = ?`, name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return plan, err
+}
+
+// UpdatePlan saves the limits of an existing plan. Its keys pick them up
+// the next time they are read.
+func (db *DB) UpdatePlan(plan *models.Plan) error {
+	result, err := db.exec(`
+		UPDATE plans
+		SET rate_limit = ?, rate_limit_algorithm = ?, rate_limit_burst = ?, token_quota = ?,
+			max_concurrent = ?, priority = ?, queue_weight = ?, allowed_models = ?
+		WHERE name = ?`,
+		plan.RateLimit,
+		plan.RateLimitAlgorithm,
+		plan.RateLimitBurst,
+		plan.TokenQuota,
+		plan.MaxConcurrent,
+		plan.Priority,
+		plan.QueueWeight,
+		strings.Join(plan.AllowedModels, ","),
+		plan.Name,
+	)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
+}
+
+// ListPlans retrieves all plans
+func (db *DB) ListPlans() ([]models.Plan, error) {
+	rows, err := db.query(`SELECT ` + planColumns + ` FROM plans ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans []models.Plan
+	for rows.Next() {
+		plan, err := scanPlan(rows)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, *plan)
+	}
+	return plans, rows.Err()
+}
+
+// DeletePlan removes a plan. Plans that keys still reference cannot be
+// removed and give ErrInUse.
+func (db *DB) DeletePlan(name string) error {
+	result, err := db.exec(`
+		DELETE FROM plans
+		WHERE name = ? AND NOT EXISTS (SELECT 1 FROM apiKeys WHERE plan = plans.name)`, name)
+	if err != nil {
+		return err
+	}
+	if err := requireRowsAffected(result); err != nil {
+		if plan, getErr := db.GetPlan(name); getErr == nil && plan != nil {
+			return ErrInUse
+		}
+		return err
+	}
+	return nil
+}
+
+// GetKeyTokens returns the tokens an API key has used on the UTC day of day
+func (db *DB) GetKeyTokens(key string, day time.Time) (int64, error) {
+	var tokens int64
+	err := db.queryRow(`SELECT tokens FROM keyTokens WHERE key = ? AND day = ?`, key, tokensDay(day)).Scan(&tokens)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return tokens, err
+}
+
+// AddKeyTokens adds to the tokens an API key has used on the UTC day of day
+func (db *DB) AddKeyTokens(key string, day time.Time, tokens int64) error {
+	_, err := db.exec(`
+		INSERT INTO keyTokens (key, day, tokens) VALUES (?, ?, ?)
+		ON CONFLICT (key, day) DO UPDATE SET tokens = keyTokens.tokens + excluded.tokens`,
+		key, tokensDay(day), tokens)
+	return err
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// maxStateAttempts bounds optimistic-concurrency retries in UpdateRateState
+const maxStateAttempts = 10
+
+// errStateContention is returned when UpdateRateState keeps losing races
+var errStateContention = errors.New("rate limit state is under heavy contention")
+
+// IncrementRateCounter atomically records a hit for key in the fixed window
+// starting at windowStart and returns the window's hit count. The upsert runs
+// as a single statement, so concurrent replicas never lose increments. A hit
+// from an older window (clock skew between replicas) is counted against the
+// newer window rather than resetting it.
+func (db *DB) IncrementRateCounter(ctx context.Context, key string, windowStart time.Time, period time.Duration) (int64, error) {
+	var hits int64
+	err := db.QueryRowContext(ctx, db.dialect.rebind(`
+		INSERT INTO rateLimitCounters (key, window_start, hits)
+		VALUES (?, ?, 1)
+		ON CONFLICT (key) DO UPDATE SET
+			hits = CASE
+				WHEN rateLimitCounters.window_start >= excluded.window_start THEN rateLimitCounters.hits + 1
+				ELSE 1
+			END,
+			window_start = CASE
+				WHEN rateLimitCounters.window_start >= excluded.window_start THEN rateLimitCounters.window_start
+				ELSE excluded.window_start
+			END
+		RETURNING hits`),
+		key,
+		windowStart.UnixMilli(),
+	).Scan(&hits)
+	return hits, err
+}
+
+// UpdateRateState atomically replaces the rate limit state of key with the
+// result of update. Rows carry a version number; a write only succeeds if
+// the version is unchanged since the read, otherwise update is retried with
+// the fresh state. The algorithms treat stale state like no state, so ttl
+// is not needed here.
+func (db *DB) UpdateRateState(ctx context.Context, key string, ttl time.Duration, update func(state []byte) ([]byte, error)) error {
+	for attempt := 0; attempt < maxStateAttempts; attempt++ {
+		var state []byte
+		var version int64
+		err := db.QueryRowContext(ctx, db.dialect.rebind(
+			`SELECT state, version FROM rateLimitState WHERE key = ?`), key).Scan(&state, &version)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		next, err := update(state)
+		if err != nil {
+			return err
+		}
+
+		var result sql.Result
+		if version == 0 {
+			result, err = db.ExecContext(ctx, db.dialect.rebind(`
+				INSERT INTO rateLimitState (key, state, version) VALUES (?, ?, 1)
+				ON CONFLICT (key) DO NOTHING`), key, string(next))
+		} else {
+			result, err = db.ExecContext(ctx, db.dialect.rebind(`
+				UPDATE rateLimitState SET state = ?, version = version + 1
+				WHERE key = ? AND version = ?`), string(next), key, version)
+		}
+		if err != nil {
+			return err
+		}
+		if rows, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rows == 1 {
+			return nil
+		}
+		if err := backoff(ctx, attempt); err != nil {
+			return err
+		}
+	}
+	return errStateContention
+}
+
+// backoff sleeps for a random, exponentially growing time before retry
+// attempt+1 so that writers which collided do not collide again
+func backoff(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(time.Millisecond) << attempt)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
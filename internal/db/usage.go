@@ -0,0 +1,261 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// sqliteTimeFormat matches the format SQLite uses for CURRENT_TIMESTAMP
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// usageRollups maps a report granularity to its rollup table and period column
+var usageRollups = map[models.UsageGranularity]struct{ table, column string }{
+	models.UsageHourly: {"apiUsageHourly", "hour"},
+	models.UsageDaily:  {"apiUsageDaily", "day"},
+}
+
+// bucketExpr returns the SQL expression that truncates a raw usage timestamp
+// to the start of its bucket
+func (db *DB) bucketExpr(granularity models.UsageGranularity) string {
+	if db.dialect == postgresDialect {
+		if granularity == models.UsageHourly {
+			return `date_trunc('hour', timestamp AT TIME ZONE 'UTC')`
+		}
+		return `(timestamp AT TIME ZONE 'UTC')::date`
+	}
+
+	if granularity == models.UsageHourly {
+		return `strftime('%Y-%m-%d %H:00:00', timestamp)`
+	}
+	return `strftime('%Y-%m-%d', timestamp)`
+}
+
+// timeArg converts t into a query argument comparable with raw usage timestamps
+func (db *DB) timeArg(t time.Time) interface{} {
+	if db.dialect == postgresDialect {
+		return t.UTC()
+	}
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+// periodArg converts t into a query argument comparable with rollup periods
+func (db *DB) periodArg(t time.Time, granularity models.UsageGranularity) interface{} {
+	if db.dialect == postgresDialect {
+		return t.UTC()
+	}
+	return t.UTC().Format(periodLayout(granularity))
+}
+
+// CompactUsage rolls raw usage events older than rawBefore into the hourly
+// and daily aggregate tables and deletes them. Hourly rollups older than
+// hourlyBefore are pruned; the daily rollups are kept. A zero rawBefore keeps
+// every raw event and a zero hourlyBefore every hourly rollup. It returns the
+// number of raw events that were compacted.
+func (db *DB) CompactUsage(rawBefore, hourlyBefore time.Time) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	compacted, err := db.compactRawUsage(tx, rawBefore)
+	if err != nil {
+		return 0, err
+	}
+
+	if !hourlyBefore.IsZero() {
+		_, err = tx.Exec(db.dialect.rebind(`DELETE FROM apiUsageHourly WHERE hour < ?`),
+			db.periodArg(hourlyBefore, models.UsageHourly))
+		if err != nil {
+			return 0, fmt.Errorf("pruning hourly usage: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return compacted, nil
+}
+
+// compactRawUsage rolls raw usage events older than rawBefore up and deletes
+// them, unless rawBefore is zero
+func (db *DB) compactRawUsage(tx *sql.Tx, rawBefore time.Time) (int64, error) {
+	if rawBefore.IsZero() {
+		return 0, nil
+	}
+	for _, granularity := range []models.UsageGranularity{models.UsageHourly, models.UsageDaily} {
+		rollup := usageRollups[granularity]
+		_, err := tx.Exec(db.dialect.rebind(fmt.Sprintf(`
+			INSERT INTO %[1]s (key, %[2]s, requests, org_id)
+			SELECT key, %[3]s, COUNT(*), MAX(org_id)
+			FROM apiUsage WHERE timestamp < ?
+			GROUP BY 1, 2
+			ON CONFLICT (key, %[2]s) DO UPDATE SET requests = %[1]s.requests + excluded.requests, org_id = excluded.org_id`,
+			rollup.table, rollup.column, db.bucketExpr(granularity))),
+			db.timeArg(rawBefore),
+		)
+		if err != nil {
+			return 0, fmt.Errorf("rolling up %s usage: %w", granularity, err)
+		}
+	}
+
+	result, err := tx.Exec(db.dialect.rebind(`DELETE FROM apiUsage WHERE timestamp < ?`), db.timeArg(rawBefore))
+	if err != nil {
+		return 0, fmt.Errorf("deleting raw usage: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// IncrementalVacuum returns free pages to the filesystem. The first call on a
+// database that was not created in incremental auto-vacuum mode switches the
+// mode, which requires a one-time full VACUUM. PostgreSQL relies on
+// autovacuum, so this is a no-op there.
+func (db *DB) IncrementalVacuum() error {
+	if db.dialect == postgresDialect {
+		return nil
+	}
+
+	// A new auto_vacuum mode only takes effect through a VACUUM on the
+	// connection that set it, so all of it runs on one
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// The pragma answers from the connection's cached copy of the database
+	// header, which a read brings up to date
+	var mode, tables int
+	if err := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master`).Scan(&tables); err != nil {
+		return err
+	}
+	if err := conn.QueryRowContext(ctx, `PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		return err
+	}
+
+	// 2 is INCREMENTAL
+	if mode != 2 {
+		log.Printf("Converting the database to incremental auto-vacuum; this runs a full VACUUM, which locks the database until it is done")
+		if _, err := conn.ExecContext(ctx, `PRAGMA auto_vacuum = INCREMENTAL`); err != nil {
+			return err
+		}
+		_, err := conn.ExecContext(ctx, `VACUUM`)
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, `PRAGMA incremental_vacuum`)
+	return err
+}
+
+// GetUsageReport returns usage since the given time grouped by key and
+// period. Rolled-up aggregates and raw events that have not been compacted
+// yet are combined, so the result does not depend on when compaction ran.
+// An empty key reports on all keys.
+func (db *DB) GetUsageReport(key string, since time.Time, granularity models.UsageGranularity) ([]models.UsageBucket, error) {
+	return db.usageReport(key, nil, since, granularity)
+}
+
+// GetOrgUsageReport returns usage since the given time rolled up by the
+// organization that owns each key. Keys that are not stored, such as the
+// virtual keys of bearer tokens and deleted keys, count toward the
+// organization their usage was logged under. An empty orgID reports on all
+// organizations.
+func (db *DB) GetOrgUsageReport(orgID string, since time.Time, granularity models.UsageGranularity) ([]models.UsageBucket, error) {
+	buckets, err := db.usageReport("", &orgID, since, granularity)
+	for i := range buckets {
+		buckets[i].Org, buckets[i].Key = buckets[i].Key, ""
+	}
+	return buckets, err
+}
+
+// usageReport sums usage by period and key, or by the owning organization
+// if orgID is set. Empty filters report on everything.
+func (db *DB) usageReport(key string, orgID *string, since time.Time, granularity models.UsageGranularity) ([]models.UsageBucket, error) {
+	rollup, ok := usageRollups[granularity]
+	if !ok {
+		return nil, fmt.Errorf("unknown usage granularity %q", granularity)
+	}
+
+	// Truncate since to the start of its bucket so partially covered
+	// buckets are reported in full from both sources.
+	sinceBucket := since.UTC().Truncate(time.Hour)
+	if granularity == models.UsageDaily {
+		sinceBucket = time.Date(sinceBucket.Year(), sinceBucket.Month(), sinceBucket.Day(), 0, 0, 0, 0, time.UTC)
+	}
+
+	group, join := "usage.key", ""
+	args := []interface{}{
+		db.periodArg(sinceBucket, granularity), key, key,
+		db.timeArg(sinceBucket), key, key,
+	}
+	if orgID != nil {
+		// Usage logged before organizations were recorded with it has an
+		// empty org_id, and is left out if its key is gone
+		group = "COALESCE(apiKeys.org_id, usage.org_id)"
+		join = "LEFT JOIN apiKeys ON apiKeys.key = usage.key WHERE " + group + " <> '' AND (? = '' OR " + group + " = ?)"
+		args = append(args, *orgID, *orgID)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %[4]s, usage.period, SUM(usage.requests) FROM (
+			SELECT key, %[2]s AS period, requests, org_id FROM %[1]s
+			WHERE %[2]s >= ? AND (? = '' OR key = ?)
+			UNION ALL
+			SELECT key, %[3]s AS period, COUNT(*), org_id FROM apiUsage
+			WHERE timestamp >= ? AND (? = '' OR key = ?)
+			GROUP BY 1, 2, 4
+		) usage
+		%[5]s
+		GROUP BY %[4]s, usage.period
+		ORDER BY usage.period, %[4]s`,
+		rollup.table, rollup.column, db.bucketExpr(granularity), group, join,
+	)
+
+	rows, err := db.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []models.UsageBucket
+	for rows.Next() {
+		var bucket models.UsageBucket
+		var period interface{}
+		if err := rows.Scan(&bucket.Key, &period, &bucket.Requests); err != nil {
+			return nil, err
+		}
+		if bucket.Period, err = parsePeriod(period, granularity); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, rows.Err()
+}
+
+// parsePeriod converts a scanned period value into a UTC time
+func parsePeriod(value interface{}, granularity models.UsageGranularity) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return time.Date(v.Year(), v.Month(), v.Day(), v.Hour(), 0, 0, 0, time.UTC), nil
+	case []byte:
+		return time.Parse(periodLayout(granularity), string(v))
+	case string:
+		return time.Parse(periodLayout(granularity), v)
+	default:
+		return time.Time{}, fmt.Errorf("unexpected period type %T", value)
+	}
+}
+
+// periodLayout returns the Go time layout of a granularity's SQLite period format
+func periodLayout(granularity models.UsageGranularity) string {
+	if granularity == models.UsageHourly {
+		return sqliteTimeFormat
+	}
+	return "2006-01-02"
+}
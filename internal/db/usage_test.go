@@ -0,0 +1,240 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	database, err := OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+func insertUsage(t *testing.T, database *DB, key string, at time.Time) {
+	t.Helper()
+	_, err := database.Exec(`INSERT INTO apiUsage (key, timestamp) VALUES (?, ?)`,
+		key, at.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		t.Fatalf("Failed to insert usage: %v", err)
+	}
+}
+
+func TestCompactUsage(t *testing.T) {
+	database := openTestDB(t)
+
+	now := time.Now().UTC().Truncate(time.Hour)
+	old := now.Add(-48 * time.Hour)
+
+	insertUsage(t, database, "key-a", old.Add(5*time.Minute))
+	insertUsage(t, database, "key-a", old.Add(10*time.Minute))
+	insertUsage(t, database, "key-b", old.Add(15*time.Minute))
+	insertUsage(t, database, "key-a", now.Add(5*time.Minute))
+
+	reportBefore, err := database.GetUsageReport("", now.Add(-72*time.Hour), models.UsageHourly)
+	if err != nil {
+		t.Fatalf("GetUsageReport failed: %v", err)
+	}
+
+	compacted, err := database.CompactUsage(now.Add(-24*time.Hour), time.Time{})
+	if err != nil {
+		t.Fatalf("CompactUsage failed: %v", err)
+	}
+	if compacted != 3 {
+		t.Errorf("compacted %d events, want 3", compacted)
+	}
+
+	var raw int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM apiUsage`).Scan(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw != 1 {
+		t.Errorf("raw events left = %d, want 1", raw)
+	}
+
+	reportAfter, err := database.GetUsageReport("", now.Add(-72*time.Hour), models.UsageHourly)
+	if err != nil {
+		t.Fatalf("GetUsageReport failed: %v", err)
+	}
+	if len(reportAfter) != len(reportBefore) {
+		t.Fatalf("report has %d buckets after compaction, want %d", len(reportAfter), len(reportBefore))
+	}
+	for i := range reportBefore {
+		if reportAfter[i] != reportBefore[i] {
+			t.Errorf("bucket %d = %+v, want %+v", i, reportAfter[i], reportBefore[i])
+		}
+	}
+
+	daily, err := database.GetUsageReport("key-a", now.Add(-72*time.Hour), models.UsageDaily)
+	if err != nil {
+		t.Fatalf("GetUsageReport failed: %v", err)
+	}
+	var total int64
+	for _, bucket := range daily {
+		total += bucket.Requests
+	}
+	if total != 3 {
+		t.Errorf("daily total for key-a = %d, want 3", total)
+	}
+
+	// Compacting again must not double count
+	if _, err := database.CompactUsage(now.Add(-24*time.Hour), time.Time{}); err != nil {
+		t.Fatalf("CompactUsage failed: %v", err)
+	}
+	again, err := database.GetUsageReport("", now.Add(-72*time.Hour), models.UsageHourly)
+	if err != nil {
+		t.Fatalf("GetUsageReport failed: %v", err)
+	}
+	if len(again) != len(reportBefore) || again[0] != reportBefore[0] {
+		t.Errorf("report changed after second compaction: %+v", again)
+	}
+}
+
+func TestCompactUsagePrunesHourly(t *testing.T) {
+	database := openTestDB(t)
+
+	now := time.Now().UTC()
+	insertUsage(t, database, "key-a", now.Add(-10*24*time.Hour))
+
+	if _, err := database.CompactUsage(now.Add(-24*time.Hour), now.Add(-7*24*time.Hour)); err != nil {
+		t.Fatalf("CompactUsage failed: %v", err)
+	}
+
+	hourly, err := database.GetUsageReport("key-a", now.Add(-30*24*time.Hour), models.UsageHourly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hourly) != 0 {
+		t.Errorf("expected hourly rollups to be pruned, got %+v", hourly)
+	}
+
+	daily, err := database.GetUsageReport("key-a", now.Add(-30*24*time.Hour), models.UsageDaily)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(daily) != 1 || daily[0].Requests != 1 {
+		t.Errorf("expected daily rollup to be kept, got %+v", daily)
+	}
+}
+
+func TestCompactUsageBoundaries(t *testing.T) {
+	database := openTestDB(t)
+
+	now := time.Now().UTC().Truncate(time.Hour)
+	rawBefore := now.Add(-24 * time.Hour)
+	hourlyBefore := now.Add(-7 * 24 * time.Hour)
+
+	// Events older than the cutoff are rolled up; one exactly at it is not
+	insertUsage(t, database, "key-a", rawBefore.Add(-time.Second))
+	insertUsage(t, database, "key-a", rawBefore)
+	// Rollups of hours before the hourly cutoff are pruned; the hour that
+	// starts at it is kept
+	insertUsage(t, database, "key-b", hourlyBefore.Add(-time.Minute))
+	insertUsage(t, database, "key-b", hourlyBefore)
+
+	compacted, err := database.CompactUsage(rawBefore, hourlyBefore)
+	if err != nil {
+		t.Fatalf("CompactUsage failed: %v", err)
+	}
+	if compacted != 3 {
+		t.Errorf("compacted %d events, want 3", compacted)
+	}
+
+	var raw int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM apiUsage WHERE key = 'key-a'`).Scan(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw != 1 {
+		t.Errorf("raw events left = %d, want the one at the cutoff", raw)
+	}
+
+	hourly, err := database.GetUsageReport("key-b", now.Add(-30*24*time.Hour), models.UsageHourly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hourly) != 1 || hourly[0].Requests != 1 {
+		t.Errorf("hourly rollups of key-b = %+v, want only the hour at the cutoff", hourly)
+	}
+	daily, err := database.GetUsageReport("key-b", now.Add(-30*24*time.Hour), models.UsageDaily)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, bucket := range daily {
+		total += bucket.Requests
+	}
+	if total != 2 {
+		t.Errorf("daily total for key-b = %d, want 2", total)
+	}
+}
+
+func TestCompactUsageKeepsRaw(t *testing.T) {
+	database := openTestDB(t)
+
+	now := time.Now().UTC()
+	insertUsage(t, database, "key-a", now.Add(-10*24*time.Hour))
+	if _, err := database.CompactUsage(now.Add(-24*time.Hour), time.Time{}); err != nil {
+		t.Fatalf("CompactUsage failed: %v", err)
+	}
+	insertUsage(t, database, "key-a", now.Add(-9*24*time.Hour))
+
+	// A zero raw cutoff leaves raw events alone but still prunes rollups
+	compacted, err := database.CompactUsage(time.Time{}, now.Add(-7*24*time.Hour))
+	if err != nil {
+		t.Fatalf("CompactUsage failed: %v", err)
+	}
+	if compacted != 0 {
+		t.Errorf("compacted %d events, want 0", compacted)
+	}
+
+	hourly, err := database.GetUsageReport("key-a", now.Add(-30*24*time.Hour), models.UsageHourly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hourly) != 1 || hourly[0].Requests != 1 {
+		t.Errorf("hourly report = %+v, want only the raw event", hourly)
+	}
+}
+
+func TestIncrementalVacuum(t *testing.T) {
+	database := openTestDB(t)
+
+	// Hold a second connection open so the pool has more than one
+	other, err := database.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := database.IncrementalVacuum(); err != nil {
+			t.Fatalf("IncrementalVacuum failed: %v", err)
+		}
+	}
+
+	var mode int
+	if err := database.QueryRow(`PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != 2 {
+		t.Errorf("auto_vacuum = %d, want 2 (incremental)", mode)
+	}
+
+	// The other connection sees the new mode once it reads the database,
+	// so the next pass there does not convert it again
+	var tables int
+	if err := other.QueryRowContext(context.Background(), `SELECT COUNT(*) FROM sqlite_master`).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.QueryRowContext(context.Background(), `PRAGMA auto_vacuum`).Scan(&mode); err != nil || mode != 2 {
+		t.Errorf("auto_vacuum on another connection = %d, %v; want 2 (incremental)", mode, err)
+	}
+}
@@ -0,0 +1,148 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// List is a set of IP ranges
+type List []netip.Prefix
+
+// ParseList reads CIDRs such as 10.0.0.0/8, or single addresses. Entries
+// that cannot be parsed are reported in the error and left out of the list.
+func ParseList(entries []string) (List, error) {
+	var list List
+	var invalid []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			list = append(list, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(entry); err == nil {
+			addr = addr.Unmap()
+			list = append(list, netip.PrefixFrom(addr, addr.BitLen()))
+		} else {
+			invalid = append(invalid, entry)
+		}
+	}
+	if len(invalid) > 0 {
+		return list, fmt.Errorf("invalid CIDR %s", strings.Join(invalid, ", "))
+	}
+	return list, nil
+}
+
+// Contains reports whether addr is in any range of the list
+func (l List) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range l {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolver finds the address of the client that sent a request. The
+// Forwarded and X-Forwarded-For headers are only believed when they were
+// added by a trusted proxy.
+type Resolver struct {
+	trusted List
+}
+
+// NewResolver creates a resolver that trusts the proxies in trusted
+func NewResolver(trusted List) *Resolver {
+	return &Resolver{trusted: trusted}
+}
+
+// ClientIP returns the address of the client that sent r. Starting from the
+// peer the request came from, the forwarding chain is followed back through
+// trusted proxies, and the first address that is not a trusted proxy is the
+// client. The Forwarded header is used if present, X-Forwarded-For
+// otherwise. An invalid address in the chain ends it at the proxy that
+// added it.
+func (res *Resolver) ClientIP(r *http.Request) netip.Addr {
+	client := parseAddr(r.RemoteAddr)
+	if !client.IsValid() || !res.trusted.Contains(client) {
+		return client
+	}
+
+	chain := forwardedFor(r.Header)
+	if chain == nil {
+		chain = xForwardedFor(r.Header)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := parseAddr(chain[i])
+		if !hop.IsValid() {
+			break
+		}
+		client = hop
+		if !res.trusted.Contains(client) {
+			break
+		}
+	}
+	return client
+}
+
+// parseAddr reads an address that may carry a port, such as the
+// RemoteAddr of a request
+func parseAddr(hostport string) netip.Addr {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
+// forwardedFor returns the for= addresses of the Forwarded headers (RFC
+// 7239), from the client to the last proxy, or nil if there are none
+func forwardedFor(header http.Header) []string {
+	var chain []string
+	for _, value := range header.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			found := false
+			for _, pair := range strings.Split(element, ";") {
+				name, node, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(name, "for") {
+					continue
+				}
+				chain = append(chain, forwardedNode(node))
+				found = true
+			}
+			// An element without for= still counts as a hop, an
+			// unknown one that ends the chain
+			if !found {
+				chain = append(chain, "")
+			}
+		}
+	}
+	return chain
+}
+
+// forwardedNode reads the address of a Forwarded node such as
+// "[2001:db8::1]:4711" or 192.0.2.60. Obfuscated identifiers and "unknown"
+// are returned as they are and do not parse as addresses.
+func forwardedNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if strings.HasPrefix(node, "[") && !strings.Contains(node, "]:") {
+		return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	}
+	return node
+}
+
+// xForwardedFor returns the addresses of the X-Forwarded-For headers, from
+// the client to the last proxy
+func xForwardedFor(header http.Header) []string {
+	var chain []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			chain = append(chain, strings.TrimSpace(hop))
+		}
+	}
+	return chain
+}
@@ -0,0 +1,69 @@
+package ipfilter
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestParseList(t *testing.T) {
+	list, err := ParseList([]string{"10.0.0.0/8", " 192.0.2.7 ", "", "2001:db8::/32", "10.1.2.3/33", "example.com"})
+	if err == nil || err.Error() != "invalid CIDR 10.1.2.3/33, example.com" {
+		t.Errorf("ParseList error = %v", err)
+	}
+	if len(list) != 3 || list[1].String() != "192.0.2.7/32" {
+		t.Errorf("ParseList = %v", list)
+	}
+
+	for addr, want := range map[string]bool{
+		"10.20.30.40":        true,
+		"::ffff:10.20.30.40": true,
+		"192.0.2.7":          true,
+		"192.0.2.8":          false,
+		"2001:db8:1::1":      true,
+		"2001:db9::1":        false,
+		"172.16.0.1":         false,
+	} {
+		if got := list.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseList([]string{"10.0.0.0/8", "2001:db8:ffff::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := NewResolver(trusted)
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"direct", "192.0.2.1:5000", nil, "192.0.2.1"},
+		{"untrusted peer", "192.0.2.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"proxy without header", "10.0.0.1:5000", nil, "10.0.0.1"},
+		{"invalid hop", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1, garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"forwarded", "10.0.0.1:5000", map[string]string{"Forwarded": `for=198.51.100.1;proto=https, for="10.0.0.2:80"`}, "198.51.100.1"},
+		{"forwarded ipv6", "[2001:db8:ffff::1]:5000", map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{"forwarded over x-forwarded-for", "10.0.0.1:5000", map[string]string{"Forwarded": "for=198.51.100.1", "X-Forwarded-For": "203.0.113.9"}, "198.51.100.1"},
+		{"forwarded unknown", "10.0.0.1:5000", map[string]string{"Forwarded": "for=unknown"}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			if got := resolver.ClientIP(req); got.String() != tt.want {
+				t.Errorf("ClientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
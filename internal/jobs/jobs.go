@@ -0,0 +1,504 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/concurrency"
+	"github.com/erock530/go-ollama-api/internal/ipfilter"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+	"github.com/erock530/go-ollama-api/internal/quota"
+	"github.com/erock530/go-ollama-api/internal/scheduler"
+)
+
+// Job kinds and the Ollama endpoint each one calls. Kinds are named after
+// the scope a key needs to run them.
+var kindPaths = map[string]string{
+	"generate": ollama.GeneratePath,
+	"chat":     ollama.ChatPath,
+}
+
+// errJobCancelled is the cancellation cause of a job cancelled by its owner
+var errJobCancelled = errors.New("job cancelled")
+
+// Store is the persistence the pool needs
+type Store interface {
+	GetAPIKey(key string) (*models.APIKey, error)
+	LogAPIUsage(key, orgID string) error
+	quota.Store
+
+	CreateJob(job *models.Job) error
+	GetJob(id string) (*models.Job, error)
+	ClaimJob(leaseUntil time.Time) (*models.Job, error)
+	RenewJobLease(id string, leaseUntil time.Time) (models.JobStatus, error)
+	FinishJob(id string, status models.JobStatus, result []byte, message string) error
+	RequeueJob(id string) error
+	CancelJob(id string) error
+	RecoverJobs(now time.Time, maxAttempts int) (requeued, failed int64, err error)
+}
+
+// Config holds the worker pool settings
+type Config struct {
+	// Workers is the number of jobs executed at once
+	Workers int
+	// Lease is how long a running job stays claimed without a heartbeat.
+	// After that it is considered lost and is retried or failed.
+	Lease time.Duration
+	// MaxAttempts is how many times a lost job is started before it fails
+	MaxAttempts int
+	// PollInterval is how often idle workers look for jobs submitted by
+	// other replicas
+	PollInterval time.Duration
+	// CallbackTimeout bounds each callback delivery attempt
+	CallbackTimeout time.Duration
+	// CallbackAllowlist lists loopback, private and link-local addresses
+	// callbacks may still be sent to. Other such addresses are refused, so
+	// key holders cannot reach the gateway's internal network.
+	CallbackAllowlist ipfilter.List
+}
+
+// Pool executes jobs against Ollama. Jobs live in the Store, so several
+// gateway replicas can share one queue and a restarted gateway picks up
+// where it left off.
+type Pool struct {
+	store    Store
+	client   *ollama.Client
+	inFlight *concurrency.Limiter
+	queue    *scheduler.Scheduler
+	cfg      Config
+
+	wake      chan struct{}
+	callbacks sync.WaitGroup
+	http      *http.Client
+
+	mu      sync.Mutex
+	running map[string]context.CancelCauseFunc
+}
+
+// NewPool creates a worker pool. Jobs hold a slot of inFlight while they run,
+// like the generations of their key. Call Run to start it.
+func NewPool(store Store, client *ollama.Client, inFlight *concurrency.Limiter, queue *scheduler.Scheduler, cfg Config) *Pool {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.Lease <= 0 {
+		cfg.Lease = time.Minute
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 3
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.CallbackTimeout <= 0 {
+		cfg.CallbackTimeout = 10 * time.Second
+	}
+	p := &Pool{
+		store:    store,
+		client:   client,
+		inFlight: inFlight,
+		queue:    queue,
+		cfg:      cfg,
+		wake:     make(chan struct{}, 1),
+		running:  make(map[string]context.CancelCauseFunc),
+	}
+	// Addresses are checked again as callbacks connect, since a host name
+	// can resolve differently than it did when the job was submitted
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout: cfg.CallbackTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !p.callbackAllowed(addr.Addr()) {
+				return fmt.Errorf("callback address %s is not allowed", addr.Addr())
+			}
+			return nil
+		},
+	}).DialContext
+	p.http = &http.Client{Timeout: cfg.CallbackTimeout, Transport: transport}
+	return p
+}
+
+// Submit validates and queues a job
+func (p *Pool) Submit(key, kind string, request json.RawMessage, callbackURL string) (*models.Job, error) {
+	if _, ok := kindPaths[kind]; !ok {
+		return nil, fmt.Errorf("unknown job type %q", kind)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(request, &fields); err != nil || fields == nil {
+		return nil, errors.New("request must be a JSON object")
+	}
+	if _, ok := fields["model"]; !ok {
+		return nil, errors.New("request must name a model")
+	}
+	if callbackURL != "" {
+		if err := p.checkCallbackURL(callbackURL); err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	job := &models.Job{
+		ID:          id,
+		Key:         key,
+		Kind:        kind,
+		Request:     request,
+		CallbackURL: callbackURL,
+	}
+	if err := p.store.CreateJob(job); err != nil {
+		return nil, err
+	}
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// checkCallbackURL refuses callback URLs that are not http or https, or whose
+// host is, or resolves to, an address callbacks may not be sent to
+func (p *Pool) checkCallbackURL(callbackURL string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("callback_url must be an http or https URL")
+	}
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+		addrs = append(addrs, addr)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), p.cfg.CallbackTimeout)
+		defer cancel()
+		if addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname()); err != nil {
+			return fmt.Errorf("callback_url host %q cannot be resolved", u.Hostname())
+		}
+	}
+	for _, addr := range addrs {
+		if !p.callbackAllowed(addr) {
+			return errors.New("callback_url must not point to a loopback, private or link-local address")
+		}
+	}
+	return nil
+}
+
+// callbackAllowed reports whether callbacks may be sent to addr. Loopback,
+// private and link-local addresses, which include cloud metadata services,
+// are only allowed if the allowlist has them.
+func (p *Pool) callbackAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if p.cfg.CallbackAllowlist.Contains(addr) {
+		return true
+	}
+	return !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsUnspecified() &&
+		!addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() &&
+		!addr.IsInterfaceLocalMulticast() && !addr.IsMulticast()
+}
+
+// Get returns a job, or nil if it does not exist
+func (p *Pool) Get(id string) (*models.Job, error) {
+	return p.store.GetJob(id)
+}
+
+// Cancel cancels a queued or running job. A job running on this replica is
+// stopped at once; one running elsewhere stops at its next heartbeat.
+func (p *Pool) Cancel(id string) error {
+	if err := p.store.CancelJob(id); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	if cancel, ok := p.running[id]; ok {
+		cancel(errJobCancelled)
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// Run recovers jobs lost by a previous process, then executes jobs until ctx
+// is done. Jobs still running at that point are put back in the queue.
+func (p *Pool) Run(ctx context.Context) {
+	p.recover()
+
+	var workers sync.WaitGroup
+	for i := 0; i < p.cfg.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			p.work(ctx)
+		}()
+	}
+
+	// Look for lost jobs as often as a lease can run out
+	ticker := time.NewTicker(p.cfg.Lease)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.recover()
+		case <-ctx.Done():
+			workers.Wait()
+			p.callbacks.Wait()
+			return
+		}
+	}
+}
+
+// recover requeues or fails jobs whose worker died
+func (p *Pool) recover() {
+	requeued, failed, err := p.store.RecoverJobs(time.Now(), p.cfg.MaxAttempts)
+	if err != nil {
+		log.Printf("Error recovering jobs: %v", err)
+		return
+	}
+	if requeued > 0 || failed > 0 {
+		log.Printf("Recovered lost jobs: %d requeued, %d failed", requeued, failed)
+	}
+}
+
+// work claims and executes jobs until ctx is done
+func (p *Pool) work(ctx context.Context) {
+	for {
+		job, err := p.store.ClaimJob(time.Now().Add(p.cfg.Lease))
+		if err != nil {
+			log.Printf("Error claiming job: %v", err)
+		}
+		if job != nil {
+			p.execute(ctx, job)
+			continue
+		}
+
+		select {
+		case <-p.wake:
+		case <-time.After(p.cfg.PollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// execute runs one claimed job and records its outcome
+func (p *Pool) execute(ctx context.Context, job *models.Job) {
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	p.mu.Lock()
+	p.running[job.ID] = cancel
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.running, job.ID)
+		p.mu.Unlock()
+	}()
+
+	stopHeartbeat := p.heartbeat(jobCtx, job.ID, cancel)
+	result, runErr := p.run(jobCtx, job)
+	stopHeartbeat()
+
+	switch {
+	case context.Cause(jobCtx) == errJobCancelled:
+		// Already recorded by Cancel
+		return
+	case ctx.Err() != nil:
+		// The gateway is shutting down: let another worker start over
+		if err := p.store.RequeueJob(job.ID); err != nil {
+			log.Printf("Error requeueing job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	status, message := models.JobSucceeded, ""
+	if runErr != nil {
+		status, message = models.JobFailed, runErr.Error()
+	}
+	err := p.store.FinishJob(job.ID, status, result, message)
+	if err != nil {
+		// Most likely cancelled by another replica
+		log.Printf("Error finishing job %s: %v", job.ID, err)
+		return
+	}
+
+	if job.CallbackURL != "" {
+		p.callbacks.Add(1)
+		go func() {
+			defer p.callbacks.Done()
+			p.notify(job.ID, job.CallbackURL)
+		}()
+	}
+}
+
+// heartbeat renews the job's lease until stopped, cancelling the job if it
+// was cancelled on another replica
+func (p *Pool) heartbeat(ctx context.Context, id string, cancel context.CancelCauseFunc) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(p.cfg.Lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				status, err := p.store.RenewJobLease(id, time.Now().Add(p.cfg.Lease))
+				if err != nil {
+					log.Printf("Error renewing lease of job %s: %v", id, err)
+				} else if status != models.JobRunning {
+					cancel(errJobCancelled)
+					return
+				}
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// run sends the job's request to Ollama and returns the response body
+func (p *Pool) run(ctx context.Context, job *models.Job) ([]byte, error) {
+	// Jobs are always answered as one JSON document
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(job.Request, &fields); err != nil {
+		return nil, fmt.Errorf("invalid request: %v", err)
+	}
+	fields["stream"] = json.RawMessage("false")
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// The key is checked again when the job runs, since it may have been
+	// changed, deactivated or deleted while the job was queued
+	apiKey, err := p.store.GetAPIKey(job.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error loading API key: %v", err)
+	}
+	if apiKey == nil || !apiKey.Active {
+		return nil, errors.New("API key does not exist or is inactive")
+	}
+	apiKey = apiKey.Effective()
+	if body, _, err = ollama.LimitsFor(apiKey).Apply(kindPaths[job.Kind], body); err != nil {
+		return nil, fmt.Errorf("invalid request: %v", err)
+	}
+	if !apiKey.HasScope(job.Kind) {
+		return nil, fmt.Errorf("API key lacks the %s scope", job.Kind)
+	}
+	if model := requestModel(fields); !apiKey.AllowsModel(model) {
+		return nil, fmt.Errorf("API key may not use the model %q", model)
+	}
+	if err := quota.Check(p.store, apiKey, time.Now()); err != nil {
+		return nil, err
+	}
+	// Wait for a slot under the key's concurrency limit, which synchronous
+	// generations share
+	release, err := p.inFlight.Acquire(ctx, job.Key, apiKey.MaxConcurrent, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	ticket, err := p.queue.Acquire(ctx, scheduler.Request{
+		Key:      job.Key,
+		Priority: scheduler.Priority(apiKey.Priority),
+		Weight:   apiKey.QueueWeight,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer ticket.Release()
+
+	resp, err := p.client.Post(ctx, kindPaths[job.Kind], body)
+	if err != nil {
+		return nil, fmt.Errorf("error making request to Ollama API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if err := p.store.LogAPIUsage(job.Key, apiKey.OrgID); err != nil {
+		log.Printf("Error logging API usage: %v", err)
+	}
+
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Ollama response: %v", err)
+	}
+	quota.Charge(p.store, apiKey, ollama.UsedTokens(result))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Ollama returned %s: %s", resp.Status, bytes.TrimSpace(result))
+	}
+	return result, nil
+}
+
+// notify posts the finished job to its callback URL, retrying a few times
+// with backoff if the receiver is unavailable
+func (p *Pool) notify(id, callbackURL string) {
+	job, err := p.store.GetJob(id)
+	if err != nil || job == nil {
+		log.Printf("Error loading job %s for callback: %v", id, err)
+		return
+	}
+	payload, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("Error encoding job %s for callback: %v", id, err)
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		resp, err := p.http.Post(callbackURL, "application/json", bytes.NewReader(payload))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("callback returned %s", resp.Status)
+		}
+		if attempt == 3 {
+			log.Printf("Error delivering callback for job %s: %v", id, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// newID generates a random job ID
+func newID() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// requestModel returns the model a request body asks for
+func requestModel(fields map[string]json.RawMessage) string {
+	var model string
+	json.Unmarshal(fields["model"], &model)
+	return model
+}
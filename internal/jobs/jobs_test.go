@@ -0,0 +1,337 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/concurrency"
+	"github.com/erock530/go-ollama-api/internal/db"
+	"github.com/erock530/go-ollama-api/internal/ipfilter"
+	"github.com/erock530/go-ollama-api/internal/models"
+	"github.com/erock530/go-ollama-api/internal/ollama"
+	"github.com/erock530/go-ollama-api/internal/scheduler"
+)
+
+// testConfig keeps leases and polling short so tests run quickly, and lets
+// callbacks reach test servers on the loopback interface
+var testConfig = Config{
+	Workers:           2,
+	Lease:             300 * time.Millisecond,
+	MaxAttempts:       2,
+	PollInterval:      10 * time.Millisecond,
+	CallbackAllowlist: ipfilter.List{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")},
+}
+
+func openTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	database, err := db.OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	for _, key := range []*models.APIKey{
+		{Key: "key-a", Active: true, RateLimit: 10},
+		{Key: "key-inactive", Active: false, RateLimit: 10},
+		{Key: "key-single", Active: true, RateLimit: 10, MaxConcurrent: 1},
+	} {
+		if err := database.CreateAPIKey(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return database
+}
+
+// startPool runs a pool until the test ends
+func startPool(t *testing.T, store Store, ollamaURL string) *Pool {
+	t.Helper()
+	pool := NewPool(store, ollama.NewClient(ollamaURL, ollama.Config{}, nil), concurrency.NewLimiter(0), scheduler.New(scheduler.Config{}, nil), testConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return pool
+}
+
+// waitForStatus polls until the job reaches a finished status
+func waitForStatus(t *testing.T, pool *Pool, id string) *models.Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := pool.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status.Finished() {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return nil
+}
+
+func TestJobSucceedsAndCallsBack(t *testing.T) {
+	var upstreamBody map[string]interface{}
+	ollamaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != ollama.ChatPath {
+			t.Errorf("job called %s, want %s", r.URL.Path, ollama.ChatPath)
+		}
+		json.NewDecoder(r.Body).Decode(&upstreamBody)
+		w.Write([]byte(`{"message":{"role":"assistant","content":"hello"},"done":true}`))
+	}))
+	defer ollamaServer.Close()
+
+	callbacks := make(chan models.Job, 1)
+	callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var job models.Job
+		json.NewDecoder(r.Body).Decode(&job)
+		callbacks <- job
+	}))
+	defer callbackServer.Close()
+
+	database := openTestDB(t)
+	pool := startPool(t, database, ollamaServer.URL)
+
+	job, err := pool.Submit("key-a", "chat", json.RawMessage(`{"model":"llama3","messages":[],"stream":true}`), callbackServer.URL)
+	if err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	if job.Status != models.JobQueued || job.ID == "" {
+		t.Errorf("unexpected submitted job: %+v", job)
+	}
+
+	job = waitForStatus(t, pool, job.ID)
+	if job.Status != models.JobSucceeded || !strings.Contains(string(job.Result), `"content":"hello"`) {
+		t.Errorf("unexpected finished job: %+v", job)
+	}
+	if upstreamBody["stream"] != false {
+		t.Errorf("job was sent with stream = %v, want false", upstreamBody["stream"])
+	}
+
+	select {
+	case notified := <-callbacks:
+		if notified.ID != job.ID || notified.Status != models.JobSucceeded {
+			t.Errorf("unexpected callback: %+v", notified)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("callback was not delivered")
+	}
+}
+
+func TestJobFailsOnUpstreamError(t *testing.T) {
+	ollamaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"model 'missing' not found"}`, http.StatusNotFound)
+	}))
+	defer ollamaServer.Close()
+
+	pool := startPool(t, openTestDB(t), ollamaServer.URL)
+	job, err := pool.Submit("key-a", "generate", json.RawMessage(`{"model":"missing","prompt":"hi"}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job = waitForStatus(t, pool, job.ID)
+	if job.Status != models.JobFailed || !strings.Contains(job.Error, "not found") {
+		t.Errorf("unexpected job: %+v", job)
+	}
+}
+
+func TestJobFailsWithoutActiveKey(t *testing.T) {
+	var called atomic.Bool
+	ollamaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called.Store(true)
+		w.Write([]byte(`{"response":"done"}`))
+	}))
+	defer ollamaServer.Close()
+
+	pool := startPool(t, openTestDB(t), ollamaServer.URL)
+	for _, key := range []string{"key-inactive", "key-deleted"} {
+		job, err := pool.Submit(key, "generate", json.RawMessage(`{"model":"llama3","prompt":"hi"}`), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		job = waitForStatus(t, pool, job.ID)
+		if job.Status != models.JobFailed || !strings.Contains(job.Error, "inactive") {
+			t.Errorf("job of %s: %+v, want failed for the key", key, job)
+		}
+	}
+	if called.Load() {
+		t.Error("a job of a missing or inactive key was sent to Ollama")
+	}
+}
+
+func TestJobWaitsForKeyConcurrency(t *testing.T) {
+	var calls atomic.Int32
+	ollamaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"response":"done"}`))
+	}))
+	defer ollamaServer.Close()
+
+	// A synchronous generation holds the key's only slot
+	inFlight := concurrency.NewLimiter(0)
+	release, err := inFlight.Acquire(context.Background(), "key-single", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := NewPool(openTestDB(t), ollama.NewClient(ollamaServer.URL, ollama.Config{}, nil), inFlight, scheduler.New(scheduler.Config{}, nil), testConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	job, err := pool.Submit("key-single", "generate", json.RawMessage(`{"model":"llama3","prompt":"hi"}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if calls.Load() != 0 {
+		t.Fatal("job ran while its key was at its concurrency limit")
+	}
+
+	release()
+	if job = waitForStatus(t, pool, job.ID); job.Status != models.JobSucceeded {
+		t.Errorf("status = %s, want succeeded", job.Status)
+	}
+}
+
+func TestCancelRunningJob(t *testing.T) {
+	started := make(chan struct{}, 1)
+	ollamaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client going away once the body is read
+		io.Copy(io.Discard, r.Body)
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer ollamaServer.Close()
+
+	pool := startPool(t, openTestDB(t), ollamaServer.URL)
+	job, err := pool.Submit("key-a", "generate", json.RawMessage(`{"model":"llama3","prompt":"hi"}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	if err := pool.Cancel(job.ID); err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+	job = waitForStatus(t, pool, job.ID)
+	if job.Status != models.JobCancelled {
+		t.Errorf("status = %s, want cancelled", job.Status)
+	}
+	if err := pool.Cancel(job.ID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("second Cancel = %v, want ErrNotFound", err)
+	}
+}
+
+func TestJobsSurviveRestart(t *testing.T) {
+	ollamaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte(`{"response":"done"}`))
+	}))
+	defer ollamaServer.Close()
+
+	database := openTestDB(t)
+
+	// A previous gateway accepted two jobs and died while running one of them
+	for _, id := range []string{"interrupted", "pending"} {
+		err := database.CreateJob(&models.Job{ID: id, Key: "key-a", Kind: "generate", Request: []byte(`{"model":"llama3"}`)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := database.ClaimJob(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := startPool(t, database, ollamaServer.URL)
+	for _, id := range []string{"interrupted", "pending"} {
+		job := waitForStatus(t, pool, id)
+		if job.Status != models.JobSucceeded {
+			t.Errorf("job %s status = %s, want succeeded", id, job.Status)
+		}
+	}
+	if job, _ := pool.Get("interrupted"); job.Attempts != 2 {
+		t.Errorf("interrupted job attempts = %d, want 2", job.Attempts)
+	}
+}
+
+func TestSubmitValidation(t *testing.T) {
+	cfg := testConfig
+	cfg.CallbackAllowlist = ipfilter.List{netip.MustParsePrefix("10.1.0.0/16")}
+	pool := NewPool(openTestDB(t), ollama.NewClient("http://127.0.0.1:0", ollama.Config{}, nil), concurrency.NewLimiter(0), scheduler.New(scheduler.Config{}, nil), cfg)
+
+	tests := []struct {
+		name     string
+		kind     string
+		request  string
+		callback string
+	}{
+		{name: "Unknown Type", kind: "translate", request: `{"model":"llama3"}`},
+		{name: "Not An Object", kind: "generate", request: `["llama3"]`},
+		{name: "Missing Model", kind: "generate", request: `{"prompt":"hi"}`},
+		{name: "Bad Callback", kind: "generate", request: `{"model":"llama3"}`, callback: "file:///etc/passwd"},
+		{name: "Loopback Callback", kind: "generate", request: `{"model":"llama3"}`, callback: "http://127.0.0.1:8080/done"},
+		{name: "Localhost Callback", kind: "generate", request: `{"model":"llama3"}`, callback: "http://localhost/done"},
+		{name: "Metadata Callback", kind: "generate", request: `{"model":"llama3"}`, callback: "http://169.254.169.254/latest/meta-data/"},
+		{name: "Private Callback", kind: "generate", request: `{"model":"llama3"}`, callback: "https://10.2.0.5/done"},
+		{name: "Mapped Callback", kind: "generate", request: `{"model":"llama3"}`, callback: "http://[::ffff:127.0.0.1]/done"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := pool.Submit("key-a", tt.kind, json.RawMessage(tt.request), tt.callback); err == nil {
+				t.Error("expected Submit to fail")
+			}
+		})
+	}
+
+	// Addresses in the allowlist may be called back
+	if _, err := pool.Submit("key-a", "generate", json.RawMessage(`{"model":"llama3"}`), "https://10.1.2.3/done"); err != nil {
+		t.Errorf("Submit with an allowed callback failed: %v", err)
+	}
+}
+
+func TestCallbackAddressCheckedOnConnect(t *testing.T) {
+	received := make(chan struct{}, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer receiver.Close()
+
+	// A host name that resolved to a public address when the job was
+	// submitted may point elsewhere by the time the callback is sent
+	cfg := testConfig
+	cfg.CallbackAllowlist = nil
+	pool := NewPool(openTestDB(t), ollama.NewClient("http://127.0.0.1:0", ollama.Config{}, nil), concurrency.NewLimiter(0), scheduler.New(scheduler.Config{}, nil), cfg)
+	if _, err := pool.http.Post(receiver.URL, "application/json", strings.NewReader("{}")); err == nil {
+		t.Error("callback to a loopback address was sent")
+	}
+	select {
+	case <-received:
+		t.Error("receiver got the callback")
+	default:
+	}
+}
@@ -0,0 +1,422 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidToken is wrapped by the errors of tokens that fail verification
+var ErrInvalidToken = errors.New("invalid token")
+
+// Config holds the settings of JWT bearer authentication. Exactly one of
+// JWKSURL and KeyFile gives the keys tokens are signed with.
+type Config struct {
+	// JWKSURL is where the identity provider publishes its signing keys
+	JWKSURL string
+	// KeyFile is a JWKS document, or PEM public keys or certificates, for
+	// use without a JWKS URL
+	KeyFile string
+	// Issuer must match the iss claim of every token
+	Issuer string
+	// Audience must be in the aud claim of every token
+	Audience string
+
+	// SubjectClaim names the claim identifying the caller; empty means sub
+	SubjectClaim string
+	// ScopesClaim names the claim holding the caller's scopes, as a space
+	// separated string or a list; empty means scope
+	ScopesClaim string
+	// PlanClaim names the claim holding the caller's plan; empty means plan
+	PlanClaim string
+	// OrgClaim names the claim holding the caller's organization; empty
+	// means org
+	OrgClaim string
+	// DefaultPlan is the plan of tokens without a plan claim
+	DefaultPlan string
+	// AllowPresets lets the scopes claim name scope presets, such as
+	// inference; otherwise only single scopes are taken from it
+	AllowPresets bool
+	// AllowAdmin lets the scopes claim grant the admin scope, directly or
+	// through a preset
+	AllowAdmin bool
+
+	// Leeway is the clock skew allowed when checking exp and nbf
+	Leeway time.Duration
+	// RefreshInterval is how often the JWKS is fetched again; zero means
+	// every 15 minutes. A token signed with an unknown key fetches it
+	// sooner, at most once a minute.
+	RefreshInterval time.Duration
+}
+
+// Enabled reports whether the config names a source of keys
+func (c Config) Enabled() bool {
+	return c.JWKSURL != "" || c.KeyFile != ""
+}
+
+// Identity is the caller a verified token speaks for
+type Identity struct {
+	Subject string
+	// Scopes lists the scope claim as given, including names this server
+	// does not know
+	Scopes []string
+	// Plan is the plan claim, or the default plan if there is none
+	Plan string
+	// Org is the organization claim, empty if there is none
+	Org       string
+	ExpiresAt time.Time
+}
+
+// minRefetchInterval is the shortest time between two fetches of the JWKS
+var minRefetchInterval = time.Minute
+
+// Authenticator verifies bearer tokens against the keys of an identity
+// provider
+type Authenticator struct {
+	cfg    Config
+	client *http.Client
+	now    func() time.Time
+
+	// mu guards keys, the times they were last fetched and last tried, and
+	// the fetch in progress. It is not held while fetching.
+	mu        sync.Mutex
+	keys      []key
+	fetchedAt time.Time
+	triedAt   time.Time
+	fetching  *fetchCall
+}
+
+// fetchCall is a fetch of the JWKS that other callers can wait for
+type fetchCall struct {
+	done chan struct{}
+	err  error
+}
+
+// New checks cfg and loads its key file. Keys at a JWKS URL are fetched by
+// Refresh, or on the first token.
+func New(cfg Config) (*Authenticator, error) {
+	if cfg.JWKSURL != "" && cfg.KeyFile != "" {
+		return nil, errors.New("set either a JWKS URL or a key file, not both")
+	}
+	if !cfg.Enabled() {
+		return nil, errors.New("a JWKS URL or a key file is required")
+	}
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return nil, errors.New("both an issuer and an audience are required")
+	}
+	if cfg.SubjectClaim == "" {
+		cfg.SubjectClaim = "sub"
+	}
+	if cfg.ScopesClaim == "" {
+		cfg.ScopesClaim = "scope"
+	}
+	if cfg.PlanClaim == "" {
+		cfg.PlanClaim = "plan"
+	}
+	if cfg.OrgClaim == "" {
+		cfg.OrgClaim = "org"
+	}
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = 15 * time.Minute
+	}
+	a := &Authenticator{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}, now: time.Now}
+	if cfg.KeyFile != "" {
+		keys, err := loadKeyFile(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = keys
+	}
+	return a, nil
+}
+
+// Config returns the settings of the authenticator, with defaults filled in
+func (a *Authenticator) Config() Config {
+	return a.cfg
+}
+
+// Refresh fetches the JWKS. The keys fetched last are kept if it fails.
+func (a *Authenticator) Refresh() error {
+	if a.cfg.JWKSURL == "" {
+		return nil
+	}
+	return a.fetch()
+}
+
+// fetch fetches the JWKS, or waits for the fetch already in progress. mu is
+// only held to swap in the keys, so a slow identity provider does not hold
+// up tokens signed with keys we already have.
+func (a *Authenticator) fetch() error {
+	a.mu.Lock()
+	if call := a.fetching; call != nil {
+		a.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &fetchCall{done: make(chan struct{})}
+	a.fetching = call
+	a.triedAt = a.now()
+	a.mu.Unlock()
+
+	keys, err := fetchJWKS(a.client, a.cfg.JWKSURL)
+
+	a.mu.Lock()
+	if err == nil {
+		a.keys, a.fetchedAt = keys, a.now()
+	}
+	a.fetching = nil
+	a.mu.Unlock()
+	call.err = err
+	close(call.done)
+	return err
+}
+
+// signingKeys returns the keys that may have signed a token with kid,
+// fetching the JWKS first if it is stale or has no such key. While another
+// caller fetches it, a stale JWKS is used as it is; only tokens with a key
+// we do not have wait for the fetch.
+func (a *Authenticator) signingKeys(kid string) []key {
+	a.mu.Lock()
+	matching := matchingKeys(a.keys, kid)
+	if a.cfg.JWKSURL == "" {
+		a.mu.Unlock()
+		return matching
+	}
+	now := a.now()
+	stale := now.Sub(a.fetchedAt) >= a.cfg.RefreshInterval
+	due := now.Sub(a.triedAt) >= minRefetchInterval
+	inProgress := a.fetching != nil
+	a.mu.Unlock()
+
+	if len(matching) > 0 && (!stale || !due || inProgress) {
+		return matching
+	}
+	if len(matching) == 0 && !due && !inProgress {
+		return nil
+	}
+	if err := a.fetch(); err != nil {
+		log.Printf("Error fetching JWKS from %s: %v", a.cfg.JWKSURL, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return matchingKeys(a.keys, kid)
+}
+
+// matchingKeys returns the keys with kid, and those without a kid, which
+// may have signed any token
+func matchingKeys(keys []key, kid string) []key {
+	var matching []key
+	for _, k := range keys {
+		if kid == "" || k.kid == "" || k.kid == kid {
+			matching = append(matching, k)
+		}
+	}
+	return matching
+}
+
+// header is the JOSE header of a token
+type header struct {
+	Alg  string   `json:"alg"`
+	Kid  string   `json:"kid"`
+	Crit []string `json:"crit"`
+}
+
+// Verify checks the signature, issuer, audience and lifetime of a compact
+// serialized JWT and returns the identity it carries. Errors of tokens that
+// fail verification wrap ErrInvalidToken.
+func (a *Authenticator) Verify(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalid("token is not a JWT")
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, invalid("malformed token header")
+	}
+	if len(h.Crit) > 0 {
+		return nil, invalid("token has unsupported critical headers %v", h.Crit)
+	}
+	alg, ok := algorithms[h.Alg]
+	if !ok {
+		return nil, invalid("unsupported signing algorithm %q", h.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalid("malformed token signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range a.signingKeys(h.Kid) {
+		if (k.alg == "" || k.alg == h.Alg) && alg.verify(k.public, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, invalid("token signature does not match any key")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, invalid("malformed token claims")
+	}
+	return a.identity(claims)
+}
+
+// identity checks the registered claims and maps the rest to an identity
+func (a *Authenticator) identity(claims map[string]interface{}) (*Identity, error) {
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, invalid("token has no expiry")
+	}
+	expiresAt := time.Unix(int64(exp), 0)
+	if now.After(expiresAt.Add(a.cfg.Leeway)) {
+		return nil, invalid("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.cfg.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, invalid("token is not valid yet")
+	}
+	if iss, _ := claims["iss"].(string); iss != a.cfg.Issuer {
+		return nil, invalid("token issuer %q is not trusted", iss)
+	}
+	if !contains(stringList(claims["aud"]), a.cfg.Audience) {
+		return nil, invalid("token is not meant for this audience")
+	}
+	subject, _ := claims[a.cfg.SubjectClaim].(string)
+	if subject == "" {
+		return nil, invalid("token has no %s claim", a.cfg.SubjectClaim)
+	}
+
+	identity := &Identity{
+		Subject:   subject,
+		Scopes:    stringList(claims[a.cfg.ScopesClaim]),
+		Plan:      a.cfg.DefaultPlan,
+		ExpiresAt: expiresAt,
+	}
+	if plan, ok := claims[a.cfg.PlanClaim].(string); ok && plan != "" {
+		identity.Plan = plan
+	}
+	identity.Org, _ = claims[a.cfg.OrgClaim].(string)
+	return identity, nil
+}
+
+// invalid returns an error wrapping ErrInvalidToken
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidToken, fmt.Sprintf(format, args...))
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stringList reads a claim that is a string or a list of strings. Strings
+// are split on spaces, as the scope claim is.
+func stringList(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	default:
+		return nil
+	}
+}
+
+// contains reports whether list contains s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// algorithm verifies the signatures of one JWS algorithm
+type algorithm struct {
+	verify func(public crypto.PublicKey, signed, signature []byte) bool
+}
+
+// algorithms are the supported signing algorithms. Only asymmetric ones
+// are, so that the gateway never holds a key able to sign tokens.
+var algorithms = map[string]algorithm{
+	"RS256": rsaPKCS1(crypto.SHA256),
+	"RS384": rsaPKCS1(crypto.SHA384),
+	"RS512": rsaPKCS1(crypto.SHA512),
+	"PS256": rsaPSS(crypto.SHA256),
+	"PS384": rsaPSS(crypto.SHA384),
+	"PS512": rsaPSS(crypto.SHA512),
+	"ES256": ecdsaCurve(elliptic.P256(), crypto.SHA256),
+	"ES384": ecdsaCurve(elliptic.P384(), crypto.SHA384),
+	"ES512": ecdsaCurve(elliptic.P521(), crypto.SHA512),
+	"EdDSA": {verify: func(public crypto.PublicKey, signed, signature []byte) bool {
+		pub, ok := public.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, signed, signature)
+	}},
+}
+
+// digest hashes the signed part of a token
+func digest(hash crypto.Hash, signed []byte) []byte {
+	h := hash.New()
+	h.Write(signed)
+	return h.Sum(nil)
+}
+
+// rsaPKCS1 verifies RSASSA-PKCS1-v1_5 signatures
+func rsaPKCS1(hash crypto.Hash) algorithm {
+	return algorithm{verify: func(public crypto.PublicKey, signed, signature []byte) bool {
+		pub, ok := public.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, hash, digest(hash, signed), signature) == nil
+	}}
+}
+
+// rsaPSS verifies RSASSA-PSS signatures
+func rsaPSS(hash crypto.Hash) algorithm {
+	return algorithm{verify: func(public crypto.PublicKey, signed, signature []byte) bool {
+		pub, ok := public.(*rsa.PublicKey)
+		opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}
+		return ok && rsa.VerifyPSS(pub, hash, digest(hash, signed), signature, opts) == nil
+	}}
+}
+
+// ecdsaCurve verifies ECDSA signatures, which JWS encodes as r and s side
+// by side, over one curve
+func ecdsaCurve(curve elliptic.Curve, hash crypto.Hash) algorithm {
+	size := (curve.Params().BitSize + 7) / 8
+	return algorithm{verify: func(public crypto.PublicKey, signed, signature []byte) bool {
+		pub, ok := public.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != curve || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(pub, digest(hash, signed), r, s)
+	}}
+}
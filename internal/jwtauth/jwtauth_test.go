@@ -0,0 +1,353 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sign makes a token signed with private by alg
+func sign(t *testing.T, alg string, private crypto.Signer, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	h := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		h["kid"] = kid
+	}
+	signed := encode(t, h) + "." + encode(t, claims)
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "EdDSA":
+		signature, err = private.Sign(rand.Reader, []byte(signed), crypto.Hash(0))
+	case "PS256":
+		signature, err = private.Sign(rand.Reader, digest(crypto.SHA256, []byte(signed)),
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+	case "RS256":
+		signature, err = private.Sign(rand.Reader, digest(crypto.SHA256, []byte(signed)), crypto.SHA256)
+	case "ES256":
+		// JWS wants r and s side by side rather than ASN.1
+		r, s, e := ecdsa.Sign(rand.Reader, private.(*ecdsa.PrivateKey), digest(crypto.SHA256, []byte(signed)))
+		signature, err = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), e
+	default:
+		t.Fatalf("cannot sign with %s", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// encode base64url encodes v as JSON
+func encode(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// jwkOf returns the JWK of a public key
+func jwkOf(kid string, public crypto.PublicKey) map[string]string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(pub.X.FillBytes(make([]byte, 32))), "y": b64(pub.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64(pub)}
+	}
+	return nil
+}
+
+// claims returns valid claims for the test issuer and audience
+func claims(extra map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{
+		"iss": "https://sso.example.org",
+		"aud": "ollama-gateway",
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range extra {
+		c[k] = v
+	}
+	return c
+}
+
+func testConfig(cfg Config) Config {
+	cfg.Issuer = "https://sso.example.org"
+	cfg.Audience = "ollama-gateway"
+	return cfg
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []interface{}{
+		jwkOf("rsa", rsaKey.Public()),
+		jwkOf("ec", ecKey.Public()),
+		jwkOf("ed", edKey.Public()),
+		map[string]string{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	auth, err := New(testConfig(Config{JWKSURL: server.URL, DefaultPlan: "free", Leeway: time.Minute}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		alg    string
+		kid    string
+		signer crypto.Signer
+	}{
+		{"RS256", "rsa", rsaKey},
+		{"PS256", "rsa", rsaKey},
+		{"ES256", "ec", ecKey},
+		{"EdDSA", "ed", edKey},
+	} {
+		identity, err := auth.Verify(sign(t, tt.alg, tt.signer, tt.kid, claims(nil)))
+		if err != nil || identity.Subject != "alice" {
+			t.Errorf("%s: Verify = %+v, %v", tt.alg, identity, err)
+		}
+	}
+
+	// Claims map to the identity
+	identity, err := auth.Verify(sign(t, "ES256", ecKey, "ec", claims(map[string]interface{}{
+		"aud":   []string{"other", "ollama-gateway"},
+		"scope": "openid generate models:read",
+		"plan":  "premium",
+		"org":   "research",
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"openid", "generate", "models:read"}
+	if !reflect.DeepEqual(identity.Scopes, want) || identity.Plan != "premium" || identity.Org != "research" {
+		t.Errorf("identity = %+v", identity)
+	}
+	identity, err = auth.Verify(sign(t, "ES256", ecKey, "ec", claims(map[string]interface{}{"scope": []string{"chat"}})))
+	if err != nil || !reflect.DeepEqual(identity.Scopes, []string{"chat"}) || identity.Plan != "free" || identity.Org != "" {
+		t.Errorf("identity = %+v, %v", identity, err)
+	}
+
+	// Tokens within the leeway of their lifetime are accepted
+	if _, err := auth.Verify(sign(t, "ES256", ecKey, "ec", claims(map[string]interface{}{
+		"exp": time.Now().Add(-30 * time.Second).Unix(),
+		"nbf": time.Now().Add(30 * time.Second).Unix(),
+	}))); err != nil {
+		t.Errorf("token within the leeway: %v", err)
+	}
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	valid := sign(t, "ES256", ecKey, "ec", claims(nil))
+	parts := strings.Split(valid, ".")
+	for name, token := range map[string]string{
+		"expired":          sign(t, "ES256", ecKey, "ec", claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})),
+		"no expiry":        sign(t, "ES256", ecKey, "ec", claims(map[string]interface{}{"exp": nil})),
+		"not yet valid":    sign(t, "ES256", ecKey, "ec", claims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})),
+		"wrong issuer":     sign(t, "ES256", ecKey, "ec", claims(map[string]interface{}{"iss": "https://evil.example.org"})),
+		"wrong audience":   sign(t, "ES256", ecKey, "ec", claims(map[string]interface{}{"aud": "other"})),
+		"no subject":       sign(t, "ES256", ecKey, "ec", claims(map[string]interface{}{"sub": ""})),
+		"unknown key":      sign(t, "ES256", otherKey, "ec", claims(nil)),
+		"key of other alg": sign(t, "ES256", ecKey, "rsa", claims(nil)),
+		"tampered":         parts[0] + "." + encode(t, claims(map[string]interface{}{"sub": "mallory"})) + "." + parts[2],
+		"alg none":         encode(t, map[string]string{"alg": "none"}) + "." + parts[1] + ".",
+		"HMAC":             encode(t, map[string]string{"alg": "HS256", "kid": "rsa"}) + "." + parts[1] + "." + parts[2],
+		"critical header":  encode(t, map[string]interface{}{"alg": "ES256", "crit": []string{"b64"}}) + "." + parts[1] + "." + parts[2],
+		"not a JWT":        "opaque-access-token",
+	} {
+		if _, err := auth.Verify(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: Verify error = %v, want ErrInvalidToken", name, err)
+		}
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(edKey.Public())
+	pemFile := filepath.Join(dir, "keys.pem")
+	os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []interface{}{jwkOf("rsa", rsaKey.Public())}})
+	jwksFile := filepath.Join(dir, "jwks.json")
+	os.WriteFile(jwksFile, jwks, 0o600)
+
+	for file, token := range map[string]string{
+		pemFile:  sign(t, "EdDSA", edKey, "any", claims(nil)),
+		jwksFile: sign(t, "RS256", rsaKey, "rsa", claims(nil)),
+	} {
+		auth, err := New(testConfig(Config{KeyFile: file}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := auth.Verify(token); err != nil {
+			t.Errorf("%s: %v", filepath.Base(file), err)
+		}
+	}
+
+	for _, cfg := range []Config{
+		{},
+		{JWKSURL: "https://sso.example.org/jwks", KeyFile: pemFile},
+		{KeyFile: filepath.Join(dir, "missing.pem")},
+	} {
+		if _, err := New(testConfig(cfg)); err == nil {
+			t.Errorf("New(%+v) succeeded", cfg)
+		}
+	}
+	if _, err := New(Config{KeyFile: pemFile}); err == nil {
+		t.Error("New succeeded without an issuer and audience")
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var current atomic.Value
+	current.Store(jwkOf("old", oldKey.Public()))
+	var fetches, failing atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if failing.Load() == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{current.Load()}})
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	auth, err := New(testConfig(Config{JWKSURL: server.URL, RefreshInterval: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.now = func() time.Time { return now }
+
+	// The keys are fetched on the first token
+	if _, err := auth.Verify(sign(t, "ES256", oldKey, "old", claims(nil))); err != nil || fetches.Load() != 1 {
+		t.Fatalf("first token: %v, %d fetches", err, fetches.Load())
+	}
+
+	// A token signed with a new key fetches the keys again, but at most
+	// once a minute
+	current.Store(jwkOf("new", newKey.Public()))
+	if _, err := auth.Verify(sign(t, "ES256", newKey, "new", claims(nil))); !errors.Is(err, ErrInvalidToken) || fetches.Load() != 1 {
+		t.Fatalf("new key within a minute: %v, %d fetches", err, fetches.Load())
+	}
+	now = now.Add(time.Minute)
+	if _, err := auth.Verify(sign(t, "ES256", newKey, "new", claims(nil))); err != nil || fetches.Load() != 2 {
+		t.Fatalf("new key: %v, %d fetches", err, fetches.Load())
+	}
+
+	// The keys fetched last are kept when the JWKS cannot be fetched
+	failing.Store(1)
+	token := sign(t, "ES256", newKey, "new", claims(map[string]interface{}{"exp": now.Add(3 * time.Hour).Unix()}))
+	now = now.Add(2 * time.Hour)
+	if _, err := auth.Verify(token); err != nil || fetches.Load() != 3 {
+		t.Fatalf("JWKS down: %v, %d fetches", err, fetches.Load())
+	}
+	if err := auth.Refresh(); err == nil {
+		t.Error("Refresh succeeded while the JWKS was down")
+	}
+}
+
+func TestSlowJWKS(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := []interface{}{jwkOf("old", oldKey.Public())}
+		if fetches.Add(1) > 1 {
+			// Later fetches hang until released, then return the new key too
+			<-release
+			keys = append(keys, jwkOf("new", newKey.Public()))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	now := time.Now()
+	auth, err := New(testConfig(Config{JWKSURL: server.URL, RefreshInterval: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.now = func() time.Time { return now }
+	if err := auth.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+
+	// Tokens with the new key wait for one fetch between them
+	newToken := sign(t, "ES256", newKey, "new", claims(nil))
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := auth.Verify(newToken)
+			results <- err
+		}()
+	}
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Meanwhile tokens with a key we have are verified without waiting
+	verified := make(chan error, 1)
+	go func() {
+		_, err := auth.Verify(sign(t, "ES256", oldKey, "old", claims(nil)))
+		verified <- err
+	}()
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Errorf("token with a known key: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("token with a known key waited for the JWKS fetch")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("token with the new key: %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("%d fetches, want 2", n)
+	}
+}
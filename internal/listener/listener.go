@@ -0,0 +1,290 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Networks a listener can use
+const (
+	NetworkTCP     = "tcp"
+	NetworkUnix    = "unix"
+	NetworkSystemd = "systemd"
+)
+
+// Spec describes a listener, parsed from a -listen value such as
+// tcp://:8080, unix:///run/app.sock?mode=0660 or systemd://api
+type Spec struct {
+	Network string
+	// Address is host:port for TCP, the socket path for Unix sockets and
+	// the LISTEN_FDNAMES name of systemd sockets; empty takes every socket
+	// systemd passed that no other listener names
+	Address string
+	// Mode, Owner and Group are applied to a Unix socket file. A zero
+	// mode leaves it as the umask made it; empty owners are unchanged.
+	Mode  os.FileMode
+	Owner string
+	Group string
+	// Routes names the routes served, such as "all" or "admin"
+	Routes string
+	// TLS serves HTTPS on the listener when the server has a certificate.
+	// It defaults to on, except for Unix sockets.
+	TLS bool
+}
+
+// String returns the network and address of the spec
+func (s Spec) String() string {
+	return s.Network + "://" + s.Address
+}
+
+// Parse reads a -listen value. Options are given as query parameters: mode,
+// owner and group for Unix sockets, and routes and tls for any listener.
+// Routes are not checked here.
+func Parse(value string) (Spec, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return Spec{}, fmt.Errorf("invalid listener %q: %v", value, err)
+	}
+	spec := Spec{Network: u.Scheme, Routes: "all", TLS: u.Scheme != NetworkUnix}
+	switch u.Scheme {
+	case NetworkTCP:
+		spec.Address = u.Host
+		if _, _, err := net.SplitHostPort(spec.Address); err != nil {
+			return Spec{}, fmt.Errorf("invalid TCP listener %q: %v", value, err)
+		}
+	case NetworkUnix:
+		// Relative paths are written unix://run/app.sock
+		spec.Address = u.Host + u.Path
+		if spec.Address == "" {
+			return Spec{}, fmt.Errorf("Unix listener %q has no path", value)
+		}
+	case NetworkSystemd:
+		spec.Address = u.Host
+	default:
+		return Spec{}, fmt.Errorf("invalid listener %q, expected tcp://, unix:// or systemd://", value)
+	}
+
+	query := u.Query()
+	for name, values := range query {
+		v := values[0]
+		switch name {
+		case "routes":
+			spec.Routes = v
+		case "tls":
+			if spec.TLS, err = strconv.ParseBool(v); err != nil {
+				return Spec{}, fmt.Errorf("invalid tls %q of listener %q", v, value)
+			}
+		case "mode", "owner", "group":
+			if spec.Network != NetworkUnix {
+				return Spec{}, fmt.Errorf("%s is only supported by Unix listeners, not %q", name, value)
+			}
+			if name == "owner" {
+				spec.Owner = v
+			} else if name == "group" {
+				spec.Group = v
+			} else {
+				mode, err := strconv.ParseUint(v, 8, 32)
+				if err != nil || mode > 0o777 {
+					return Spec{}, fmt.Errorf("invalid mode %q of listener %q, expected octal permissions such as 0660", v, value)
+				}
+				spec.Mode = os.FileMode(mode)
+			}
+		default:
+			return Spec{}, fmt.Errorf("unknown option %q of listener %q", name, value)
+		}
+	}
+	return spec, nil
+}
+
+// Listener is an open listener and the spec it was opened for
+type Listener struct {
+	net.Listener
+	Spec Spec
+}
+
+// Open opens a listener for each spec, or for a systemd spec one for each
+// socket it takes. If any cannot be opened, those opened are closed again.
+func Open(specs []Spec) ([]Listener, error) {
+	var listeners []Listener
+	fail := func(err error) ([]Listener, error) {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+
+	var activated []activatedSocket
+	for _, spec := range specs {
+		if spec.Network == NetworkSystemd {
+			sockets, err := systemdSockets()
+			if err != nil {
+				return fail(err)
+			}
+			activated = sockets
+			break
+		}
+	}
+	claimed := make([]bool, len(activated))
+	// Named sockets go to the specs that name them before the rest are
+	// handed out
+	for _, named := range []bool{true, false} {
+		for _, spec := range specs {
+			if spec.Network != NetworkSystemd || (spec.Address != "") != named {
+				continue
+			}
+			found := false
+			for i, socket := range activated {
+				if claimed[i] || (named && socket.name != spec.Address) {
+					continue
+				}
+				claimed[i] = true
+				found = true
+				listeners = append(listeners, Listener{Listener: socket.listener, Spec: spec})
+			}
+			if !found {
+				return fail(fmt.Errorf("systemd passed no sockets for %s", spec))
+			}
+		}
+	}
+	for i, socket := range activated {
+		if !claimed[i] {
+			socket.listener.Close()
+		}
+	}
+
+	for _, spec := range specs {
+		var l net.Listener
+		var err error
+		switch spec.Network {
+		case NetworkTCP:
+			l, err = net.Listen("tcp", spec.Address)
+		case NetworkUnix:
+			l, err = listenUnix(spec)
+		default:
+			continue
+		}
+		if err != nil {
+			return fail(err)
+		}
+		listeners = append(listeners, Listener{Listener: l, Spec: spec})
+	}
+	return listeners, nil
+}
+
+// listenUnix creates the socket of spec, replacing a stale socket file left
+// by a process that did not stop cleanly
+func listenUnix(spec Spec) (net.Listener, error) {
+	if info, err := os.Lstat(spec.Address); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", spec.Address)
+		}
+		if conn, err := net.Dial("unix", spec.Address); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", spec.Address)
+		}
+		if err := os.Remove(spec.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", spec.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err := setOwnership(spec); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("setting permissions of %s: %v", spec.Address, err)
+	}
+	return l, nil
+}
+
+// setOwnership applies the mode, owner and group of spec to its socket
+func setOwnership(spec Spec) error {
+	if spec.Mode != 0 {
+		if err := os.Chmod(spec.Address, spec.Mode); err != nil {
+			return err
+		}
+	}
+	if spec.Owner == "" && spec.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if spec.Owner != "" {
+		u, err := user.Lookup(spec.Owner)
+		if err != nil {
+			if u, err = user.LookupId(spec.Owner); err != nil {
+				return err
+			}
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+	}
+	if spec.Group != "" {
+		g, err := user.LookupGroup(spec.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(spec.Group); err != nil {
+				return err
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+	return os.Chown(spec.Address, uid, gid)
+}
+
+// activatedSocket is a socket passed by systemd
+type activatedSocket struct {
+	name     string
+	listener net.Listener
+}
+
+// listenFDsStart is the first file descriptor systemd passes
+var listenFDsStart = 3
+
+// systemdSockets returns the sockets systemd passed to this process with
+// LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES. The variables are cleared so
+// that the sockets are only taken once.
+func systemdSockets() ([]activatedSocket, error) {
+	pid, count, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	if pid == "" || count == "" {
+		return nil, errors.New("no sockets were passed by systemd (LISTEN_FDS is not set)")
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, fmt.Errorf("sockets were passed by systemd to process %s, not this one", pid)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", count)
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	nameList := strings.Split(names, ":")
+	var sockets []activatedSocket
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(nameList) {
+			name = nameList[i]
+		}
+		file := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, socket := range sockets {
+				socket.listener.Close()
+			}
+			return nil, fmt.Errorf("socket %d passed by systemd: %v", i, err)
+		}
+		sockets = append(sockets, activatedSocket{name: name, listener: l})
+	}
+	return sockets, nil
+}
@@ -0,0 +1,153 @@
+package listener
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Spec
+	}{
+		{"tcp://:8080", Spec{Network: "tcp", Address: ":8080", Routes: "all", TLS: true}},
+		{"tcp://[::1]:8080?routes=api&tls=false", Spec{Network: "tcp", Address: "[::1]:8080", Routes: "api"}},
+		{"unix:///run/app.sock?mode=0660&owner=app&group=www&routes=admin",
+			Spec{Network: "unix", Address: "/run/app.sock", Mode: 0o660, Owner: "app", Group: "www", Routes: "admin"}},
+		{"unix://app.sock", Spec{Network: "unix", Address: "app.sock", Routes: "all"}},
+		{"systemd://", Spec{Network: "systemd", Routes: "all", TLS: true}},
+		{"systemd://admin?routes=admin", Spec{Network: "systemd", Address: "admin", Routes: "admin", TLS: true}},
+	}
+	for _, tt := range tests {
+		spec, err := Parse(tt.value)
+		if err != nil || spec != tt.want {
+			t.Errorf("Parse(%q) = %+v, %v; want %+v", tt.value, spec, err, tt.want)
+		}
+	}
+
+	for _, value := range []string{
+		":8080",
+		"http://:8080",
+		"tcp://localhost",
+		"unix://",
+		"unix:///run/app.sock?mode=999",
+		"tcp://:8080?mode=0600",
+		"tcp://:8080?tls=maybe",
+		"tcp://:8080?color=blue",
+	} {
+		if spec, err := Parse(value); err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", value, spec)
+		}
+	}
+}
+
+func TestOpenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+	spec := Spec{Network: NetworkUnix, Address: path, Mode: 0o600, Owner: strconv.Itoa(os.Getuid())}
+	listeners, err := Open([]Spec{spec, {Network: NetworkTCP, Address: "127.0.0.1:0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 || listeners[0].Spec != spec {
+		t.Fatalf("Open = %+v", listeners)
+	}
+	defer listeners[1].Close()
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o600 {
+		t.Fatalf("socket file: %v, %v", info, err)
+	}
+
+	// A socket that is in use is not taken over
+	if _, err := Open([]Spec{spec}); err == nil {
+		t.Error("opened a socket another listener serves")
+	}
+
+	// A socket left behind by a process that did not stop cleanly is
+	// replaced
+	unix := listeners[0].Listener.(*net.UnixListener)
+	unix.SetUnlinkOnClose(false)
+	unix.Close()
+	listeners, err = Open([]Spec{spec})
+	if err != nil {
+		t.Fatalf("replacing a stale socket: %v", err)
+	}
+	listeners[0].Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file remains after Close: %v", err)
+	}
+
+	// Other files are never removed
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open([]Spec{spec}); err == nil {
+		t.Error("replaced a regular file with a socket")
+	}
+}
+
+// handedOver keeps the files whose descriptors TestOpenSystemd hands to
+// Open, which closes them. Being referenced, they are never finalized, which
+// would close the descriptors a second time.
+var handedOver []*os.File
+
+func TestOpenSystemd(t *testing.T) {
+	// Pretend systemd passed two sockets, named api and admin
+	var files []*os.File
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		files = append(files, file)
+	}
+	handedOver = append(handedOver, files...)
+	if files[1].Fd() != files[0].Fd()+1 {
+		t.Skip("could not get consecutive file descriptors")
+	}
+	defer func(start int) { listenFDsStart = start }(listenFDsStart)
+	listenFDsStart = int(files[0].Fd())
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "2")
+	t.Setenv("LISTEN_FDNAMES", "api:admin")
+
+	specs := []Spec{
+		{Network: NetworkSystemd, Routes: "api"},
+		{Network: NetworkSystemd, Address: "admin", Routes: "admin"},
+	}
+	listeners, err := Open(specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	// The named socket goes to the spec naming it, the rest to the other
+	if len(listeners) != 2 || listeners[0].Spec.Routes != "admin" || listeners[1].Spec.Routes != "api" {
+		t.Fatalf("Open = %+v", listeners)
+	}
+	for _, l := range listeners {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("dialing %s: %v", l.Addr(), err)
+		}
+		conn.Close()
+	}
+
+	// The sockets are only taken once
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS was not cleared")
+	}
+	if _, err := Open(specs[:1]); err == nil {
+		t.Error("opened systemd sockets twice")
+	}
+}
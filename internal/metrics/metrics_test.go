@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	registry := NewRegistry()
+
+	requests := registry.NewCounter("test_requests_total", "Requests served.", "code")
+	requests.Inc("200")
+	requests.Inc("200")
+	requests.Add(3, "429")
+
+	registry.NewGaugeFunc("test_queue_depth", "Requests waiting.", func() float64 { return 4 })
+
+	wait := registry.NewHistogram("test_wait_seconds", "Time spent waiting.", []float64{1, 0.1}, "class")
+	wait.Observe(0.05, "high")
+	wait.Observe(0.5, "high")
+	wait.Observe(2, "high")
+
+	rr := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `# HELP test_queue_depth Requests waiting.
+# TYPE test_queue_depth gauge
+test_queue_depth 4
+# HELP test_requests_total Requests served.
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 2
+test_requests_total{code="429"} 3
+# HELP test_wait_seconds Time spent waiting.
+# TYPE test_wait_seconds histogram
+test_wait_seconds_bucket{class="high",le="0.1"} 1
+test_wait_seconds_bucket{class="high",le="1"} 2
+test_wait_seconds_bucket{class="high",le="+Inf"} 3
+test_wait_seconds_sum{class="high"} 2.55
+test_wait_seconds_count{class="high"} 3
+`
+	if got := rr.Body.String(); got != want {
+		t.Errorf("unexpected exposition:\n%s\nwant:\n%s", got, want)
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
+
+func TestDuplicateMetricPanics(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("dup", "First.")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic registering a duplicate metric")
+		}
+	}()
+	registry.NewCounter("dup", "Second.")
+}
@@ -2,6 +2,11 @@ package models
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -14,6 +19,287 @@ type APIKey struct {
 	RateLimit   int
 	Active      bool
 	Description sql.NullString
+	// RateLimitAlgorithm names the ratelimit algorithm; empty uses the server default
+	RateLimitAlgorithm string
+	// RateLimitBurst is the burst size for bucket algorithms; zero means RateLimit
+	RateLimitBurst int
+	// MaxConcurrent is the most generations the key may have in flight; zero is unlimited
+	MaxConcurrent int
+	// Priority is the scheduler class ("high", "normal" or "low"); empty means normal
+	Priority string
+	// QueueWeight is the key's share of the backend within its priority; zero means one
+	QueueWeight int
+	// ResponseCache is "on" or "off" to opt the key in or out of the
+	// response cache; empty follows the server default
+	ResponseCache string
+	// MaxNumCtx caps the context window the key may request; zero is unlimited
+	MaxNumCtx int
+	// MaxNumPredict caps the tokens the key may generate; zero is unlimited
+	MaxNumPredict int
+	// MaxKeepAlive caps how long the key may keep a model loaded, which
+	// also forbids keeping it loaded forever; zero is unlimited
+	MaxKeepAlive time.Duration
+	// AllowedModels lists the models the key may use, such as llama3 or
+	// qwen2.5:*; empty allows all
+	AllowedModels []string
+	// Scopes lists what the key may do, such as generate or models:read;
+	// empty means DefaultScopes
+	Scopes []string
+	// OrgID is the organization that owns the key
+	OrgID string
+	// Org is the owning organization. It is filled in when a single key is
+	// read and is not saved with the key.
+	Org *Org
+	// TokenQuota is the prompt and generated tokens the key may use per UTC
+	// day; zero is unlimited
+	TokenQuota int64
+	// PlanName is the plan the key takes its limits from; empty is none
+	PlanName string
+	// Plan is the key's plan. Like Org it is filled in when a single key is
+	// read and is not saved with the key.
+	Plan *Plan
+	// AllowedCIDRs lists the addresses the key may be used from, such as
+	// 10.0.0.0/8 or 192.0.2.7; empty allows all
+	AllowedCIDRs []string
+	// TokenSubject is set on the virtual keys of bearer tokens, which are
+	// never saved, to the subject of the token
+	TokenSubject string
+}
+
+// Effective returns the key with the limits it takes from its plan filled
+// in. The key's own rate limit, token quota, concurrency, priority and
+// allowed models override the plan's where they are set. The key itself is
+// not changed, so it can still be saved with only its own limits.
+func (k *APIKey) Effective() *APIKey {
+	effective := *k
+	p := k.Plan
+	if p == nil {
+		return &effective
+	}
+	if effective.RateLimit <= 0 {
+		effective.RateLimit = p.RateLimit
+	}
+	if effective.RateLimitAlgorithm == "" {
+		effective.RateLimitAlgorithm = p.RateLimitAlgorithm
+	}
+	if effective.RateLimitBurst <= 0 {
+		effective.RateLimitBurst = p.RateLimitBurst
+	}
+	if effective.TokenQuota <= 0 {
+		effective.TokenQuota = p.TokenQuota
+	}
+	if effective.MaxConcurrent <= 0 {
+		effective.MaxConcurrent = p.MaxConcurrent
+	}
+	if effective.Priority == "" {
+		effective.Priority = p.Priority
+	}
+	if effective.QueueWeight <= 0 {
+		effective.QueueWeight = p.QueueWeight
+	}
+	if len(effective.AllowedModels) == 0 {
+		effective.AllowedModels = p.AllowedModels
+	}
+	return &effective
+}
+
+// ClearOverrides removes the key's own plan limits, so that it takes all
+// of them from its plan
+func (k *APIKey) ClearOverrides() {
+	k.RateLimit, k.RateLimitAlgorithm, k.RateLimitBurst = 0, "", 0
+	k.TokenQuota = 0
+	k.MaxConcurrent = 0
+	k.Priority, k.QueueWeight = "", 0
+	k.AllowedModels = nil
+}
+
+// AllowsModel reports whether the key may use a model. Both the key and its
+// organization must allow it.
+func (k *APIKey) AllowsModel(name string) bool {
+	if k.Org != nil && !modelAllowed(k.Org.AllowedModels, name) {
+		return false
+	}
+	return modelAllowed(k.AllowedModels, name)
+}
+
+// modelAllowed reports whether a model is in an allow list; an empty list
+// allows all. A name without a tag means its latest tag, as in Ollama, and
+// entries may use * wildcards.
+func modelAllowed(allowedModels []string, name string) bool {
+	if len(allowedModels) == 0 {
+		return true
+	}
+	name = fullModelName(name)
+	for _, allowed := range allowedModels {
+		if matched, _ := path.Match(fullModelName(allowed), name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// OrgStatus is an organization with its keys and the tokens it has used
+// today, as served by the admin API
+type OrgStatus struct {
+	Org
+	Keys        int   `json:"keys"`
+	TokensToday int64 `json:"tokens_today"`
+}
+
+// DefaultOrgID is the organization that owns keys created without one,
+// including every key created before organizations existed
+const DefaultOrgID = "default"
+
+// orgIDPattern is the form of organization IDs
+var orgIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// ValidOrgID reports whether id is 1 to 64 lowercase letters, digits, - or
+// _, starting with a letter or digit
+func ValidOrgID(id string) bool {
+	return orgIDPattern.MatchString(id)
+}
+
+// ValidPlanName reports whether name has the same form as organization IDs
+func ValidPlanName(name string) bool {
+	return orgIDPattern.MatchString(name)
+}
+
+// Org is an organization, such as a team, that owns API keys. Its quotas
+// are shared by all of its keys, on top of each key's own limits.
+type Org struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// RateLimit is the requests per minute of all the org's keys together;
+	// zero is unlimited
+	RateLimit int `json:"rate_limit"`
+	// TokenQuota is the prompt and generated tokens all the org's keys may
+	// use per UTC day; zero is unlimited
+	TokenQuota int64 `json:"token_quota"`
+	// AllowedModels lists the models the org's keys may use; empty allows all
+	AllowedModels []string `json:"allowed_models"`
+}
+
+// LimitKey is the rate limiter key all of the org's keys count against
+func (o *Org) LimitKey() string {
+	return "org:" + o.ID
+}
+
+// Plan is a named set of limits, such as free or premium, that keys
+// reference. Changing a plan changes the limits of all of its keys.
+type Plan struct {
+	Name      string
+	CreatedAt time.Time
+	// RateLimit is the requests per minute of each key
+	RateLimit int
+	// RateLimitAlgorithm names the ratelimit algorithm; empty uses the server default
+	RateLimitAlgorithm string
+	// RateLimitBurst is the burst size for bucket algorithms; zero means RateLimit
+	RateLimitBurst int
+	// TokenQuota is the prompt and generated tokens each key may use per
+	// UTC day; zero is unlimited
+	TokenQuota int64
+	// MaxConcurrent is the most generations each key may have in flight; zero is unlimited
+	MaxConcurrent int
+	// Priority is the scheduler class of the keys; empty means normal
+	Priority string
+	// QueueWeight is each key's share of the backend within its priority; zero means one
+	QueueWeight int
+	// AllowedModels lists the models the keys may use; empty allows all
+	AllowedModels []string
+}
+
+// Scopes of API keys
+const (
+	// ScopeGenerate allows /generate and generate jobs and batches
+	ScopeGenerate = "generate"
+	// ScopeChat allows /chat and chat jobs and batches
+	ScopeChat = "chat"
+	// ScopeEmbed allows embedding batches
+	ScopeEmbed = "embed"
+	// ScopeModelsRead allows listing and showing models
+	ScopeModelsRead = "models:read"
+	// ScopeModelsWrite allows pulling, creating, copying and deleting models
+	ScopeModelsWrite = "models:write"
+	// ScopeUsageRead allows reading the key's own usage
+	ScopeUsageRead = "usage:read"
+	// ScopeAdmin allows everything, including reading the usage of other keys
+	ScopeAdmin = "admin"
+)
+
+// AllScopes lists every scope in the order they are documented
+var AllScopes = []string{ScopeGenerate, ScopeChat, ScopeEmbed, ScopeModelsRead, ScopeModelsWrite, ScopeUsageRead, ScopeAdmin}
+
+// DefaultScopes are the scopes of keys without any, which includes every key
+// created before scopes existed
+var DefaultScopes = []string{ScopeGenerate, ScopeChat, ScopeEmbed, ScopeModelsRead, ScopeUsageRead}
+
+// ScopePresets are bundles of scopes for common roles
+var ScopePresets = map[string][]string{
+	"inference": {ScopeGenerate, ScopeChat, ScopeEmbed, ScopeModelsRead},
+	"readonly":  {ScopeModelsRead, ScopeUsageRead},
+	"operator":  {ScopeModelsRead, ScopeModelsWrite, ScopeUsageRead},
+	"default":   DefaultScopes,
+	"full":      {ScopeAdmin},
+}
+
+// ExpandScopes resolves scope and preset names into a list of scopes without
+// duplicates
+func ExpandScopes(names []string) ([]string, error) {
+	var scopes []string
+	seen := make(map[string]bool)
+	add := func(scope string) {
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	for _, name := range names {
+		if preset, ok := ScopePresets[name]; ok {
+			for _, scope := range preset {
+				add(scope)
+			}
+			continue
+		}
+		if !isScope(name) {
+			return nil, fmt.Errorf("unknown scope or preset %q", name)
+		}
+		add(name)
+	}
+	return scopes, nil
+}
+
+// isScope reports whether name is a scope
+func isScope(name string) bool {
+	for _, scope := range AllScopes {
+		if scope == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the key has a scope. The admin scope includes
+// all others.
+func (k *APIKey) HasScope(scope string) bool {
+	scopes := k.Scopes
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	for _, s := range scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// fullModelName adds the latest tag to a model name without one
+func fullModelName(name string) string {
+	if strings.Contains(name, ":") || strings.HasSuffix(name, "*") {
+		return name
+	}
+	return name + ":latest"
 }
 
 // Webhook represents a webhook configuration
@@ -22,20 +308,299 @@ type Webhook struct {
 	URL string
 }
 
+// CertIdentity maps an identity of a client certificate, such as
+// cn:gateway-client or uri:spiffe://example.org/app, to the API key that
+// requests with the certificate are made with
+type CertIdentity struct {
+	Identity  string
+	Key       string
+	CreatedAt time.Time
+}
+
 // GenerateRequest represents a request to the Ollama API
 type GenerateRequest struct {
-	Model  string   `json:"model"`
-	Prompt string   `json:"prompt"`
-	Stream bool     `json:"stream"`
-	Images []string `json:"images,omitempty"`
-	Raw    bool     `json:"raw"`
-	APIKey string   `json:"apikey"`
+	Model    string   `json:"model"`
+	Prompt   string   `json:"prompt"`
+	Suffix   string   `json:"suffix,omitempty"`
+	System   string   `json:"system,omitempty"`
+	Template string   `json:"template,omitempty"`
+	Context  []int    `json:"context,omitempty"`
+	Stream   bool     `json:"stream"`
+	Images   []string `json:"images,omitempty"`
+	Raw      bool     `json:"raw"`
+	// Format is "json" or a JSON schema the response must follow
+	Format json.RawMessage `json:"format,omitempty"`
+	// KeepAlive is a duration such as "5m" or a number of seconds; negative
+	// values keep the model loaded forever
+	KeepAlive json.RawMessage `json:"keep_alive,omitempty"`
+	// Think is true or false, or a level such as "high" for some models
+	Think   json.RawMessage        `json:"think,omitempty"`
+	Options map[string]interface{} `json:"options,omitempty"`
+	APIKey  string                 `json:"apikey,omitempty"`
+	// SchemaRetries is how many times the gateway asks the model to repair
+	// a response that does not match the Format schema
+	SchemaRetries int `json:"schema_retries,omitempty"`
+}
+
+// ChatMessage is a message of a chat conversation
+type ChatMessage struct {
+	Role      string          `json:"role"`
+	Content   string          `json:"content"`
+	Thinking  string          `json:"thinking,omitempty"`
+	Images    []string        `json:"images,omitempty"`
+	ToolCalls json.RawMessage `json:"tool_calls,omitempty"`
+	ToolName  string          `json:"tool_name,omitempty"`
+}
+
+// ChatRequest represents a chat request to the Ollama API
+type ChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ChatMessage   `json:"messages"`
+	Tools    json.RawMessage `json:"tools,omitempty"`
+	Stream   bool            `json:"stream"`
+	// Format is "json" or a JSON schema the response must follow
+	Format    json.RawMessage        `json:"format,omitempty"`
+	KeepAlive json.RawMessage        `json:"keep_alive,omitempty"`
+	Think     json.RawMessage        `json:"think,omitempty"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	APIKey    string                 `json:"apikey,omitempty"`
+	// SchemaRetries is how many times the gateway asks the model to repair
+	// a response that does not match the Format schema
+	SchemaRetries int `json:"schema_retries,omitempty"`
 }
 
 // APIResponse represents a generic API response
 type APIResponse struct {
-	Error     string      `json:"error,omitempty"`
 	Status    string      `json:"status,omitempty"`
 	Timestamp time.Time   `json:"timestamp,omitempty"`
 	Data      interface{} `json:"data,omitempty"`
 }
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	// Error is a message for people
+	Error string `json:"error"`
+	// Code identifies the error for programs, such as rate_limited
+	Code string `json:"code"`
+	// RequestID matches the X-Request-ID header and the gateway's logs
+	RequestID string `json:"request_id,omitempty"`
+	// RetryAfter is how many seconds to wait before retrying; it is only
+	// set for errors that are expected to pass
+	RetryAfter int `json:"retry_after,omitempty"`
+	// Field is the request field at fault
+	Field string `json:"field,omitempty"`
+	// Limit is the limit that was exceeded
+	Limit int64 `json:"limit,omitempty"`
+	// RequiredScope is the scope the API key lacks
+	RequiredScope string `json:"required_scope,omitempty"`
+	// Details holds more information specific to the code
+	Details interface{} `json:"details,omitempty"`
+}
+
+// BackendResult is the outcome of a model management request on one
+// Ollama backend
+type BackendResult struct {
+	Backend string `json:"backend"`
+	// Status is the HTTP status of the backend's response, zero if it
+	// could not be reached
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// InFlightStatus reports the generations currently in flight
+type InFlightStatus struct {
+	InFlight      int `json:"in_flight"`
+	MaxConcurrent int `json:"max_concurrent"`
+	TotalInFlight int `json:"total_in_flight"`
+	MaxTotal      int `json:"max_total"`
+}
+
+// HealthStatus is the data of the health check response
+type HealthStatus struct {
+	InFlightStatus
+	Upstream UpstreamStatus `json:"upstream"`
+}
+
+// ReadinessReport is the response of the readiness check
+type ReadinessReport struct {
+	// Status is ready or not ready
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// CheckResult is the outcome of checking one dependency
+type CheckResult struct {
+	// Status is ok or fail
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// BuildInfo identifies the running build
+type BuildInfo struct {
+	Version    string `json:"version"`
+	CommitHash string `json:"commit_hash"`
+	BuildTime  string `json:"build_time"`
+	GoVersion  string `json:"go_version"`
+}
+
+// LoadedModel is a model Ollama has in memory
+type LoadedModel struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	SizeVRAM  int64     `json:"size_vram"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ServerStatus is the detailed status of the gateway and its backend
+type ServerStatus struct {
+	Status    string                 `json:"status"`
+	Timestamp time.Time              `json:"timestamp"`
+	Build     BuildInfo              `json:"build"`
+	Uptime    string                 `json:"uptime"`
+	Checks    map[string]CheckResult `json:"checks"`
+	Ollama    OllamaStatus           `json:"ollama"`
+	Queue     QueueStatus            `json:"queue"`
+	// TotalInFlight and MaxTotal count generations across all keys
+	TotalInFlight int `json:"total_in_flight"`
+	MaxTotal      int `json:"max_total"`
+}
+
+// OllamaStatus describes the Ollama backend
+type OllamaStatus struct {
+	Version      string         `json:"version,omitempty"`
+	LoadedModels []LoadedModel  `json:"loaded_models"`
+	Upstream     UpstreamStatus `json:"upstream"`
+}
+
+// QueueStatus reports the scheduler queue
+type QueueStatus struct {
+	Depth   int `json:"depth"`
+	Running int `json:"running"`
+}
+
+// UpstreamStatus reports the circuit breaker in front of Ollama
+type UpstreamStatus struct {
+	// Breaker is closed, half-open or open
+	Breaker string `json:"breaker"`
+	// ConsecutiveFailures is the number of failed requests in a row
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// RetryAt is when an open breaker lets a probe request through
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+}
+
+// JobStatus is the state of an asynchronous job
+type JobStatus string
+
+const (
+	// JobQueued jobs wait for a worker
+	JobQueued JobStatus = "queued"
+	// JobRunning jobs are being executed by a worker
+	JobRunning JobStatus = "running"
+	// JobSucceeded jobs hold Ollama's response in Result
+	JobSucceeded JobStatus = "succeeded"
+	// JobFailed jobs hold the reason in Error
+	JobFailed JobStatus = "failed"
+	// JobCancelled jobs were cancelled by their owner
+	JobCancelled JobStatus = "cancelled"
+)
+
+// Finished reports whether the job will not change any more
+func (s JobStatus) Finished() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobCancelled
+}
+
+// Job is a generation request executed in the background
+type Job struct {
+	ID          string          `json:"id"`
+	Key         string          `json:"-"`
+	Kind        string          `json:"type"`
+	Request     json.RawMessage `json:"request"`
+	CallbackURL string          `json:"callback_url,omitempty"`
+	Status      JobStatus       `json:"status"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Attempts    int             `json:"attempts"`
+	CreatedAt   time.Time       `json:"created_at"`
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+}
+
+// BatchStatus is the state of a batch
+type BatchStatus string
+
+const (
+	// BatchQueued batches wait for a worker
+	BatchQueued BatchStatus = "queued"
+	// BatchRunning batches are being executed by a worker
+	BatchRunning BatchStatus = "running"
+	// BatchCompleted batches have a result for every request
+	BatchCompleted BatchStatus = "completed"
+	// BatchFailed batches were stopped early, with the reason in Error
+	BatchFailed BatchStatus = "failed"
+	// BatchCancelled batches were cancelled by their owner
+	BatchCancelled BatchStatus = "cancelled"
+)
+
+// Finished reports whether the batch will not change any more
+func (s BatchStatus) Finished() bool {
+	return s == BatchCompleted || s == BatchFailed || s == BatchCancelled
+}
+
+// Batch is a file of requests executed in the background
+type Batch struct {
+	ID          string      `json:"id"`
+	Key         string      `json:"-"`
+	Status      BatchStatus `json:"status"`
+	Total       int         `json:"total"`
+	Succeeded   int         `json:"succeeded"`
+	Failed      int         `json:"failed"`
+	Concurrency int         `json:"concurrency"`
+	Error       string      `json:"error,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+	StartedAt   *time.Time  `json:"started_at,omitempty"`
+	FinishedAt  *time.Time  `json:"finished_at,omitempty"`
+}
+
+// BatchResult is the outcome of one request of a batch. Status is
+// "succeeded" or "failed".
+type BatchResult struct {
+	CustomID   string          `json:"custom_id"`
+	Status     string          `json:"status"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Response   json.RawMessage `json:"response,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	// Code is the error code of requests the gateway failed itself, such as
+	// prompt_too_long
+	Code string `json:"code,omitempty"`
+}
+
+// UsageBucket represents the aggregated API usage of a key over one period.
+// Reports rolled up by organization set Org instead of Key.
+type UsageBucket struct {
+	Key      string    `json:"key,omitempty"`
+	Org      string    `json:"org,omitempty"`
+	Period   time.Time `json:"period"`
+	Requests int64     `json:"requests"`
+}
+
+// UsageReport is the usage of a key served by the /usage endpoint, or of an
+// organization served by the admin API
+type UsageReport struct {
+	Key         string           `json:"key,omitempty"`
+	Org         string           `json:"org,omitempty"`
+	Granularity UsageGranularity `json:"granularity"`
+	Since       time.Time        `json:"since"`
+	Buckets     []UsageBucket    `json:"buckets"`
+	Total       int64            `json:"total"`
+}
+
+// UsageGranularity selects the bucket size of a usage report
+type UsageGranularity string
+
+const (
+	// UsageHourly groups usage by hour
+	UsageHourly UsageGranularity = "hourly"
+	// UsageDaily groups usage by day
+	UsageDaily UsageGranularity = "daily"
+)
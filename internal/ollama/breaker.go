@@ -0,0 +1,123 @@
+package ollama
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting Ollama while the circuit
+// breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets all requests through
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen lets one request through to probe the backend
+	BreakerHalfOpen
+	// BreakerOpen rejects all requests until the cooldown has passed
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// BreakerStatus reports the circuit breaker of a backend
+type BreakerStatus struct {
+	State BreakerState
+	// Failures is the number of failures in a row
+	Failures int
+	// RetryAt is when an open breaker lets a probe through
+	RetryAt time.Time
+}
+
+// breaker is a circuit breaker. It opens after threshold failures in a
+// row, and after cooldown lets a single probe through, which closes it on
+// success and opens it again on failure. A zero threshold disables it.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether a request may be sent
+func (b *breaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+	default:
+		return nil
+	}
+	b.probing = true
+	return nil
+}
+
+// success records a request that reached the backend
+func (b *breaker) success() {
+	b.mu.Lock()
+	b.state, b.failures, b.probing = BreakerClosed, 0, false
+	b.mu.Unlock()
+}
+
+// failure records a request that failed to reach the backend
+func (b *breaker) failure() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state, b.openedAt, b.probing = BreakerOpen, b.now(), false
+	}
+	b.mu.Unlock()
+}
+
+// abandon records a request given up by its caller, which says nothing
+// about the backend. A probe is let through again.
+func (b *breaker) abandon() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *breaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BreakerStatus{State: b.state, Failures: b.failures}
+	if b.state == BreakerOpen {
+		status.RetryAt = b.openedAt.Add(b.cooldown)
+	}
+	return status
+}
@@ -0,0 +1,138 @@
+package ollama
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// Limits bounds the options a request may ask Ollama for. Zero values are
+// unlimited.
+type Limits struct {
+	// MaxNumCtx caps options.num_ctx, the context window
+	MaxNumCtx int
+	// MaxNumPredict caps options.num_predict, the tokens generated
+	MaxNumPredict int
+	// MaxKeepAlive caps keep_alive, how long the model stays loaded after
+	// the request. Requests to keep it loaded forever get MaxKeepAlive.
+	MaxKeepAlive time.Duration
+}
+
+// LimitsFor returns the limits set on an API key
+func LimitsFor(apiKey *models.APIKey) Limits {
+	return Limits{
+		MaxNumCtx:     apiKey.MaxNumCtx,
+		MaxNumPredict: apiKey.MaxNumPredict,
+		MaxKeepAlive:  apiKey.MaxKeepAlive,
+	}
+}
+
+// Apply clamps the options of a request body for path to the limits. It
+// returns the body to send and the names of the fields it changed. The body
+// is returned unchanged if no limit applies.
+func (l Limits) Apply(path string, body []byte) ([]byte, []string, error) {
+	if l == (Limits{}) {
+		return body, nil, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, nil, err
+	}
+	var options map[string]json.RawMessage
+	if raw, ok := fields["options"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &options); err != nil {
+			return nil, nil, errors.New("options must be an object")
+		}
+	}
+	if options == nil {
+		options = make(map[string]json.RawMessage)
+	}
+
+	var clamped []string
+	if l.MaxNumCtx > 0 {
+		numCtx, ok, err := intOption(options, "num_ctx")
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok && numCtx > l.MaxNumCtx {
+			options["num_ctx"] = json.RawMessage(strconv.Itoa(l.MaxNumCtx))
+			clamped = append(clamped, "num_ctx")
+		}
+	}
+	// Only generations produce tokens. A missing or negative num_predict
+	// means no limit, so it is set too.
+	if l.MaxNumPredict > 0 && (path == GeneratePath || path == ChatPath) {
+		numPredict, ok, err := intOption(options, "num_predict")
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok || numPredict < 0 || numPredict > l.MaxNumPredict {
+			options["num_predict"] = json.RawMessage(strconv.Itoa(l.MaxNumPredict))
+			clamped = append(clamped, "num_predict")
+		}
+	}
+	if l.MaxKeepAlive > 0 {
+		if raw, ok := fields["keep_alive"]; ok {
+			keepAlive, err := parseKeepAlive(raw)
+			if err != nil {
+				return nil, nil, err
+			}
+			if keepAlive < 0 || keepAlive > l.MaxKeepAlive {
+				fields["keep_alive"], _ = json.Marshal(l.MaxKeepAlive.String())
+				clamped = append(clamped, "keep_alive")
+			}
+		}
+	}
+
+	if clamped == nil {
+		return body, nil, nil
+	}
+	if len(options) > 0 {
+		raw, err := json.Marshal(options)
+		if err != nil {
+			return nil, nil, err
+		}
+		fields["options"] = raw
+	}
+	body, err := json.Marshal(fields)
+	return body, clamped, err
+}
+
+// intOption reads a whole number option. ok is false if it is not set.
+func intOption(options map[string]json.RawMessage, name string) (value int, ok bool, err error) {
+	raw, ok := options[name]
+	if !ok || string(raw) == "null" {
+		return 0, false, nil
+	}
+	var f float64
+	if err := json.Unmarshal(raw, &f); err != nil || f != float64(int(f)) {
+		return 0, false, fmt.Errorf("options.%s must be a whole number", name)
+	}
+	return int(f), true, nil
+}
+
+// parseKeepAlive reads a keep_alive value the way Ollama does: a number of
+// seconds or a duration string such as "10m". Negative values mean forever.
+func parseKeepAlive(raw json.RawMessage) (time.Duration, error) {
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return 0, errors.New("keep_alive must be a duration or a number of seconds")
+	}
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid keep_alive %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,72 @@
+package ollama
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	limits := Limits{MaxNumCtx: 4096, MaxNumPredict: 256, MaxKeepAlive: 10 * time.Minute}
+
+	tests := []struct {
+		name    string
+		path    string
+		body    string
+		want    string
+		clamped []string
+	}{
+		{"within limits", GeneratePath,
+			`{"model":"m","options":{"num_ctx":2048,"num_predict":100},"keep_alive":"5m"}`,
+			`{"model":"m","options":{"num_ctx":2048,"num_predict":100},"keep_alive":"5m"}`, nil},
+		{"too large", GeneratePath,
+			`{"model":"m","options":{"num_ctx":32768,"num_predict":1000,"temperature":0.5},"keep_alive":3600}`,
+			`{"model":"m","options":{"num_ctx":4096,"num_predict":256,"temperature":0.5},"keep_alive":"10m0s"}`,
+			[]string{"num_ctx", "num_predict", "keep_alive"}},
+		{"unbounded generation", ChatPath,
+			`{"model":"m","options":{"num_predict":-1},"keep_alive":"-1"}`,
+			`{"model":"m","options":{"num_predict":256},"keep_alive":"10m0s"}`,
+			[]string{"num_predict", "keep_alive"}},
+		{"missing num_predict", GeneratePath,
+			`{"model":"m","keep_alive":-1}`,
+			`{"model":"m","options":{"num_predict":256},"keep_alive":"10m0s"}`,
+			[]string{"num_predict", "keep_alive"}},
+		{"embeddings generate no tokens", EmbedPath,
+			`{"model":"m","input":"hi"}`,
+			`{"model":"m","input":"hi"}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, clamped, err := limits.Apply(tt.path, []byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want interface{}
+			json.Unmarshal(body, &got)
+			json.Unmarshal([]byte(tt.want), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("body = %s, want %s", body, tt.want)
+			}
+			if !reflect.DeepEqual(clamped, tt.clamped) {
+				t.Errorf("clamped = %v, want %v", clamped, tt.clamped)
+			}
+		})
+	}
+
+	for _, body := range []string{
+		`{"model":"m","options":{"num_ctx":"big"}}`,
+		`{"model":"m","options":"fast"}`,
+		`{"model":"m","keep_alive":"forever"}`,
+	} {
+		if _, _, err := limits.Apply(GeneratePath, []byte(body)); err == nil {
+			t.Errorf("Apply(%s) accepted an invalid body", body)
+		}
+	}
+
+	// Without limits the body is passed on untouched
+	body := `{"model":"m","options":"anything"}`
+	if got, _, err := (Limits{}).Apply(GeneratePath, []byte(body)); err != nil || string(got) != body {
+		t.Errorf("Apply without limits = %s, %v", got, err)
+	}
+}
@@ -0,0 +1,316 @@
+package ollama
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/metrics"
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// Ollama API paths
+const (
+	GeneratePath   = "/api/generate"
+	ChatPath       = "/api/chat"
+	EmbedPath      = "/api/embed"
+	EmbeddingsPath = "/api/embeddings"
+	VersionPath    = "/api/version"
+	TagsPath       = "/api/tags"
+	ShowPath       = "/api/show"
+	PsPath         = "/api/ps"
+	PullPath       = "/api/pull"
+	DeletePath     = "/api/delete"
+	CopyPath       = "/api/copy"
+	CreatePath     = "/api/create"
+)
+
+var (
+	// ErrUnavailable is returned when Ollama cannot be reached
+	ErrUnavailable = errors.New("Ollama is unavailable")
+	// ErrTimeout is returned when Ollama takes longer than a timeout
+	ErrTimeout = errors.New("timed out waiting for Ollama")
+)
+
+// Config holds the timeouts and failure handling of a Client. Zero values
+// disable each setting.
+type Config struct {
+	// ConnectTimeout bounds opening a connection to Ollama
+	ConnectTimeout time.Duration
+	// HeaderTimeout bounds the wait for the response headers. Ollama only
+	// sends them once a non-streaming generation has finished.
+	HeaderTimeout time.Duration
+	// IdleTimeout bounds the wait for each part of the response body
+	IdleTimeout time.Duration
+	// Timeout bounds the whole request, including reading the response
+	Timeout time.Duration
+
+	// Retries is how many times a request that could not connect is sent
+	// again. Requests that reached Ollama are never retried.
+	Retries int
+	// RetryBackoff is the wait before the first retry, doubled for each
+	// one after it
+	RetryBackoff time.Duration
+
+	// BreakerThreshold is how many failures in a row open the circuit
+	// breaker, which then fails requests at once
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open before a probe
+	// request is let through
+	BreakerCooldown time.Duration
+
+	// TLS configures HTTPS connections to Ollama, such as the CAs that sign
+	// its certificate; nil uses the system defaults
+	TLS *tls.Config
+}
+
+// WithoutTimeouts returns the settings without the header, idle and total
+// timeouts, for requests such as model pulls that may rightly take hours.
+// Those requests end only when their context does.
+func (c Config) WithoutTimeouts() Config {
+	c.HeaderTimeout, c.IdleTimeout, c.Timeout = 0, 0, 0
+	return c
+}
+
+// Client sends requests to an Ollama server
+type Client struct {
+	baseURL string
+	cfg     Config
+	http    *http.Client
+	breaker *breaker
+
+	retries  *metrics.Counter
+	failures *metrics.Counter
+}
+
+// NewClient creates a client for the Ollama server at baseURL. Its metrics
+// are registered with registry if it is not nil.
+func NewClient(baseURL string, cfg Config, registry *metrics.Registry) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.ResponseHeaderTimeout = cfg.HeaderTimeout
+	if cfg.TLS != nil {
+		transport.TLSClientConfig = cfg.TLS
+	}
+
+	c := &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		cfg:     cfg,
+		http:    &http.Client{Transport: transport},
+		breaker: newBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+	}
+	if registry != nil {
+		c.retries = registry.NewCounter("ollama_api_upstream_retries_total",
+			"Requests sent to Ollama again after failing to connect.")
+		c.failures = registry.NewCounter("ollama_api_upstream_failures_total",
+			"Requests that failed to reach Ollama or timed out.", "reason")
+		registry.NewGaugeFunc("ollama_api_upstream_breaker_state",
+			"State of the Ollama circuit breaker: 0 closed, 1 half-open, 2 open.",
+			func() float64 { return float64(c.breaker.status().State) })
+	}
+	return c
+}
+
+// URL returns the address of the Ollama server
+func (c *Client) URL() string {
+	return c.baseURL
+}
+
+// Status reports the circuit breaker of the client's backend
+func (c *Client) Status() BreakerStatus {
+	return c.breaker.status()
+}
+
+// Version asks Ollama for its version. It is meant for health checks, so it
+// bypasses the circuit breaker and retries.
+func (c *Client) Version(ctx context.Context) (string, error) {
+	var response struct {
+		Version string `json:"version"`
+	}
+	err := c.get(ctx, VersionPath, &response)
+	return response.Version, err
+}
+
+// LoadedModels lists the models Ollama has in memory
+func (c *Client) LoadedModels(ctx context.Context) ([]models.LoadedModel, error) {
+	var response struct {
+		Models []models.LoadedModel `json:"models"`
+	}
+	err := c.get(ctx, PsPath, &response)
+	return response.Models, err
+}
+
+// get reads a JSON response from path into v
+func (c *Client) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return classify(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Ollama returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Post sends a JSON body to path. The request is abandoned when ctx is done.
+// Failures wrap ErrUnavailable or ErrTimeout, and ErrCircuitOpen is returned
+// while the circuit breaker is open.
+func (c *Client) Post(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	return c.Do(ctx, http.MethodPost, path, body)
+}
+
+// Do sends a request with an optional JSON body to path, like Post
+func (c *Client) Do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := c.breaker.allow(); err != nil {
+			return nil, err
+		}
+		resp, err := c.send(ctx, method, path, body)
+		if err == nil {
+			c.breaker.success()
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			c.breaker.abandon()
+			return nil, ctx.Err()
+		}
+		c.breaker.failure()
+		c.countFailure(err)
+		if !isConnectError(err) || attempt >= c.cfg.Retries {
+			return nil, err
+		}
+
+		if c.retries != nil {
+			c.retries.Inc()
+		}
+		select {
+		case <-time.After(c.cfg.RetryBackoff << attempt):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// send makes one attempt at a request
+func (c *Client) send(parent context.Context, method, path string, body []byte) (*http.Response, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if c.cfg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, c.cfg.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		cancel()
+		return nil, classify(err)
+	}
+	resp.Body = c.watch(resp.Body, cancel)
+	return resp, nil
+}
+
+// classify wraps a transport error in ErrTimeout or ErrUnavailable.
+// Connection timeouts mean Ollama is unreachable rather than slow.
+func classify(err error) error {
+	var netErr net.Error
+	if !isConnectError(err) && (errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return fmt.Errorf("%w: %w", ErrUnavailable, err)
+}
+
+// isConnectError reports whether err happened before the request was sent,
+// so it is safe to send again
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func (c *Client) countFailure(err error) {
+	if c.failures == nil {
+		return
+	}
+	if errors.Is(err, ErrTimeout) {
+		c.failures.Inc("timeout")
+	} else {
+		c.failures.Inc("unavailable")
+	}
+}
+
+// watch wraps a response body so that it is abandoned once no data has
+// arrived for the idle timeout. cancel ends the request.
+func (c *Client) watch(body io.ReadCloser, cancel context.CancelFunc) io.ReadCloser {
+	w := &watchedBody{ReadCloser: body, idle: c.cfg.IdleTimeout, cancel: cancel}
+	if w.idle > 0 {
+		w.timer = time.AfterFunc(w.idle, func() {
+			if w.timedOut.CompareAndSwap(false, true) {
+				c.breaker.failure()
+				if c.failures != nil {
+					c.failures.Inc("timeout")
+				}
+				cancel()
+			}
+		})
+	}
+	return w
+}
+
+// watchedBody is a response body with an idle timeout
+type watchedBody struct {
+	io.ReadCloser
+	idle     time.Duration
+	timer    *time.Timer
+	timedOut atomic.Bool
+	cancel   context.CancelFunc
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.timedOut.Load() {
+		return n, fmt.Errorf("%w: no data for %s", ErrTimeout, b.idle)
+	}
+	if b.timer != nil {
+		if err == nil {
+			b.timer.Reset(b.idle)
+		} else {
+			b.timer.Stop()
+		}
+	}
+	return n, err
+}
+
+func (b *watchedBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
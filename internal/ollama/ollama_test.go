@@ -0,0 +1,155 @@
+package ollama
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/metrics"
+)
+
+// closedURL returns the URL of a port nothing listens on
+func closedURL(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + listener.Addr().String()
+	listener.Close()
+	return url
+}
+
+func TestRetries(t *testing.T) {
+	registry := metrics.NewRegistry()
+	client := NewClient(closedURL(t), Config{Retries: 2, RetryBackoff: time.Millisecond}, registry)
+
+	_, err := client.Post(context.Background(), GeneratePath, []byte(`{}`))
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("err = %v, want ErrUnavailable", err)
+	}
+	var out strings.Builder
+	registry.Write(&out)
+	if !strings.Contains(out.String(), "ollama_api_upstream_retries_total 2") ||
+		!strings.Contains(out.String(), `ollama_api_upstream_failures_total{reason="unavailable"} 3`) {
+		t.Errorf("metrics:\n%s", out.String())
+	}
+}
+
+func TestTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version":"0.5.0"}`))
+	}))
+	defer server.Close()
+
+	// The test server's certificate is not signed by a CA the system trusts
+	if _, err := NewClient(server.URL, Config{}, nil).Version(context.Background()); err == nil {
+		t.Error("untrusted certificate was accepted")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	client := NewClient(server.URL, Config{TLS: &tls.Config{RootCAs: roots}}, nil)
+	if version, err := client.Version(context.Background()); err != nil || version != "0.5.0" {
+		t.Errorf("Version = %q, %v", version, err)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == ChatPath {
+			// Start streaming, then stall
+			w.Write([]byte(`{"done":false}` + "\n"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := NewClient(server.URL, Config{HeaderTimeout: 50 * time.Millisecond, IdleTimeout: 50 * time.Millisecond}, nil)
+
+	// No headers in time
+	if _, err := client.Post(context.Background(), GeneratePath, []byte(`{}`)); !errors.Is(err, ErrTimeout) {
+		t.Errorf("header timeout: err = %v, want ErrTimeout", err)
+	}
+
+	// Headers and the first chunk, then nothing
+	resp, err := client.Post(context.Background(), ChatPath, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if !errors.Is(err, ErrTimeout) || string(body) != `{"done":false}`+"\n" {
+		t.Errorf("idle timeout: body %q, err = %v", body, err)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	b.failure()
+	if err := b.allow(); err != nil {
+		t.Fatalf("opened after one failure: %v", err)
+	}
+	b.failure()
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allowed after two failures")
+	}
+	if status := b.status(); status.State != BreakerOpen || !status.RetryAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("status = %+v", status)
+	}
+
+	// After the cooldown a single probe goes through
+	now = now.Add(time.Minute)
+	if err := b.allow(); err != nil {
+		t.Fatalf("probe rejected: %v", err)
+	}
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) || b.status().State != BreakerHalfOpen {
+		t.Fatalf("second probe allowed")
+	}
+
+	// A failed probe opens it again, an abandoned one lets another through
+	b.failure()
+	if b.status().State != BreakerOpen {
+		t.Fatalf("state = %s after failed probe", b.status().State)
+	}
+	now = now.Add(time.Minute)
+	b.allow()
+	b.abandon()
+	if err := b.allow(); err != nil {
+		t.Fatalf("probe after abandoned probe rejected: %v", err)
+	}
+
+	// A successful probe closes it
+	b.success()
+	if status := b.status(); status.State != BreakerClosed || status.Failures != 0 {
+		t.Errorf("status = %+v after successful probe", status)
+	}
+}
+
+func TestBreakerFailsFast(t *testing.T) {
+	client := NewClient(closedURL(t), Config{BreakerThreshold: 1, BreakerCooldown: time.Hour}, nil)
+	if _, err := client.Post(context.Background(), GeneratePath, []byte(`{}`)); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("err = %v, want ErrUnavailable", err)
+	}
+	if _, err := client.Post(context.Background(), GeneratePath, []byte(`{}`)); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("err = %v, want ErrCircuitOpen", err)
+	}
+	if client.Status().State != BreakerOpen {
+		t.Errorf("state = %s", client.Status().State)
+	}
+}
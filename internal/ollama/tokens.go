@@ -0,0 +1,47 @@
+package ollama
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// TokenTailSize is how much of the end of a response UsedTokens needs.
+// Ollama reports the token counts in the last fields of its final object.
+const TokenTailSize = 1024
+
+// tokenCount matches the token counts of an Ollama response
+var tokenCount = regexp.MustCompile(`"(prompt_eval_count|eval_count)"\s*:\s*(\d+)`)
+
+// UsedTokens returns the prompt and generated tokens an Ollama response
+// reports, or zero if it reports none. Streamed responses report them in
+// their last line, and only the last TokenTailSize bytes are looked at.
+func UsedTokens(response []byte) int64 {
+	if len(response) > TokenTailSize {
+		response = response[len(response)-TokenTailSize:]
+	}
+	counts := make(map[string]int64)
+	for _, match := range tokenCount.FindAllSubmatch(response, -1) {
+		n, _ := strconv.ParseInt(string(match[2]), 10, 64)
+		counts[string(match[1])] = n
+	}
+	return counts["prompt_eval_count"] + counts["eval_count"]
+}
+
+// TokenTail keeps the end of a response for UsedTokens while it is copied
+type TokenTail struct {
+	buf []byte
+}
+
+// Write keeps the last TokenTailSize bytes written
+func (t *TokenTail) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > TokenTailSize {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-TokenTailSize:]...)
+	}
+	return len(p), nil
+}
+
+// UsedTokens returns the tokens reported by the response written so far
+func (t *TokenTail) UsedTokens() int64 {
+	return UsedTokens(t.buf)
+}
@@ -0,0 +1,30 @@
+package ollama
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUsedTokens(t *testing.T) {
+	final := `{"model":"m","done":true,"prompt_eval_count":12,"eval_count":30}`
+	if n := UsedTokens([]byte(final)); n != 42 {
+		t.Errorf("UsedTokens = %d, want 42", n)
+	}
+	if n := UsedTokens([]byte(`{"error":"model not found"}`)); n != 0 {
+		t.Errorf("UsedTokens without counts = %d, want 0", n)
+	}
+
+	// A long stream is copied in pieces; only its last line has the counts
+	var tail TokenTail
+	stream := strings.Repeat(`{"response":"token","done":false}`+"\n", 200) + final + "\n"
+	for i := 0; i < len(stream); i += 100 {
+		end := i + 100
+		if end > len(stream) {
+			end = len(stream)
+		}
+		tail.Write([]byte(stream[i:end]))
+	}
+	if n := tail.UsedTokens(); n != 42 {
+		t.Errorf("TokenTail.UsedTokens = %d, want 42", n)
+	}
+}
@@ -0,0 +1,77 @@
+package quota
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// Store reads and records the tokens keys and organizations use per UTC day
+type Store interface {
+	GetKeyTokens(key string, day time.Time) (int64, error)
+	AddKeyTokens(key string, day time.Time, tokens int64) error
+	GetOrgTokens(orgID string, day time.Time) (int64, error)
+	AddOrgTokens(orgID string, day time.Time, tokens int64) error
+}
+
+// ExceededError reports a daily token quota that has been used up
+type ExceededError struct {
+	// Org is set if the quota is the organization's rather than the key's
+	Org string
+	// Quota is the tokens allowed per day
+	Quota int64
+	// ResetAt is the next UTC midnight, when the quota starts over
+	ResetAt time.Time
+}
+
+func (e *ExceededError) Error() string {
+	if e.Org != "" {
+		return fmt.Sprintf("organization %s has used its %d tokens for today", e.Org, e.Quota)
+	}
+	return fmt.Sprintf("API key has used its %d tokens for today", e.Quota)
+}
+
+// Check returns an *ExceededError if the key, or its organization, has used
+// up today's tokens. apiKey should have its plan applied.
+func Check(store Store, apiKey *models.APIKey, now time.Time) error {
+	now = now.UTC()
+	resetAt := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	if apiKey.TokenQuota > 0 {
+		used, err := store.GetKeyTokens(apiKey.Key, now)
+		if err != nil {
+			return err
+		}
+		if used >= apiKey.TokenQuota {
+			return &ExceededError{Quota: apiKey.TokenQuota, ResetAt: resetAt}
+		}
+	}
+	if org := apiKey.Org; org != nil && org.TokenQuota > 0 {
+		used, err := store.GetOrgTokens(org.ID, now)
+		if err != nil {
+			return err
+		}
+		if used >= org.TokenQuota {
+			return &ExceededError{Org: org.ID, Quota: org.TokenQuota, ResetAt: resetAt}
+		}
+	}
+	return nil
+}
+
+// Charge adds the tokens a response used to the key and its organization.
+// Failures are logged, as the response has already been paid for.
+func Charge(store Store, apiKey *models.APIKey, tokens int64) {
+	if tokens <= 0 {
+		return
+	}
+	now := time.Now()
+	if err := store.AddKeyTokens(apiKey.Key, now, tokens); err != nil {
+		log.Printf("Error recording API key tokens: %v", err)
+	}
+	if apiKey.Org != nil {
+		if err := store.AddOrgTokens(apiKey.Org.ID, now, tokens); err != nil {
+			log.Printf("Error recording organization tokens: %v", err)
+		}
+	}
+}
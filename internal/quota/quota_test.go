@@ -0,0 +1,137 @@
+package quota
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// memStore keeps token counts in memory. Days are not told apart, as each
+// test runs within one.
+type memStore struct {
+	keys map[string]int64
+	orgs map[string]int64
+}
+
+func newMemStore() *memStore {
+	return &memStore{keys: make(map[string]int64), orgs: make(map[string]int64)}
+}
+
+func (s *memStore) GetKeyTokens(key string, day time.Time) (int64, error) {
+	return s.keys[key], nil
+}
+
+func (s *memStore) AddKeyTokens(key string, day time.Time, tokens int64) error {
+	s.keys[key] += tokens
+	return nil
+}
+
+func (s *memStore) GetOrgTokens(orgID string, day time.Time) (int64, error) {
+	return s.orgs[orgID], nil
+}
+
+func (s *memStore) AddOrgTokens(orgID string, day time.Time, tokens int64) error {
+	s.orgs[orgID] += tokens
+	return nil
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	store := newMemStore()
+	apiKey := &models.APIKey{Key: "key-a", TokenQuota: 100}
+	now := time.Date(2024, 3, 9, 22, 30, 0, 0, time.UTC)
+
+	Charge(store, apiKey, 99)
+	if err := Check(store, apiKey, now); err != nil {
+		t.Fatalf("with 1 token left: %v", err)
+	}
+
+	Charge(store, apiKey, 1)
+	var exceeded *ExceededError
+	if err := Check(store, apiKey, now); !errors.As(err, &exceeded) {
+		t.Fatalf("with the quota used up: err = %v, want *ExceededError", err)
+	}
+	if want := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC); exceeded.Quota != 100 || exceeded.Org != "" || !exceeded.ResetAt.Equal(want) {
+		t.Errorf("exceeded = %+v, want the key's quota of 100 resetting at %v", exceeded, want)
+	}
+
+	// Responses without usage cost nothing
+	Charge(store, apiKey, 0)
+	if store.keys["key-a"] != 100 {
+		t.Errorf("charged %d tokens, want 100", store.keys["key-a"])
+	}
+
+	// A key without a quota is never turned away
+	unlimited := &models.APIKey{Key: "key-b"}
+	Charge(store, unlimited, 1000000)
+	if err := Check(store, unlimited, now); err != nil {
+		t.Errorf("unlimited key: %v", err)
+	}
+}
+
+func TestPlanQuota(t *testing.T) {
+	plan := &models.Plan{Name: "free", TokenQuota: 50}
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		quota     int64
+		used      int64
+		wantQuota int64
+	}{
+		{"plan quota applies", 0, 50, 50},
+		{"within the plan quota", 0, 49, 0},
+		{"key override above the plan", 200, 50, 0},
+		{"key override reached", 200, 200, 200},
+		{"key override below the plan", 10, 10, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore()
+			apiKey := (&models.APIKey{Key: "key-a", TokenQuota: tt.quota, Plan: plan}).Effective()
+			Charge(store, apiKey, tt.used)
+
+			err := Check(store, apiKey, now)
+			var exceeded *ExceededError
+			switch {
+			case tt.wantQuota == 0 && err != nil:
+				t.Errorf("err = %v, want none", err)
+			case tt.wantQuota != 0 && (!errors.As(err, &exceeded) || exceeded.Quota != tt.wantQuota):
+				t.Errorf("err = %v, want a quota of %d exceeded", err, tt.wantQuota)
+			}
+		})
+	}
+}
+
+func TestOrgQuota(t *testing.T) {
+	store := newMemStore()
+	org := &models.Org{ID: "acme", TokenQuota: 100}
+	first := &models.APIKey{Key: "key-a", Org: org}
+	second := &models.APIKey{Key: "key-b", Org: org, TokenQuota: 1000}
+	now := time.Now()
+
+	// The org's keys draw on one pool
+	Charge(store, first, 60)
+	Charge(store, second, 30)
+	if store.orgs["acme"] != 90 || store.keys["key-a"] != 60 || store.keys["key-b"] != 30 {
+		t.Fatalf("org %d, keys %d and %d; want 90, 60 and 30", store.orgs["acme"], store.keys["key-a"], store.keys["key-b"])
+	}
+	if err := Check(store, first, now); err != nil {
+		t.Fatalf("with 10 org tokens left: %v", err)
+	}
+
+	// Once it is used up, every key is turned away, even one within its own quota
+	Charge(store, first, 10)
+	for _, apiKey := range []*models.APIKey{first, second} {
+		var exceeded *ExceededError
+		if err := Check(store, apiKey, now); !errors.As(err, &exceeded) || exceeded.Org != "acme" || exceeded.Quota != 100 {
+			t.Errorf("%s: err = %v, want the org's quota exceeded", apiKey.Key, err)
+		}
+	}
+
+	// Keys outside the org are not affected
+	if err := Check(store, &models.APIKey{Key: "key-c", TokenQuota: 100}, now); err != nil {
+		t.Errorf("key outside the org: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Algorithm selects how a Limit is enforced
+type Algorithm string
+
+const (
+	// FixedWindow counts requests in windows aligned to the clock. Cheap, but
+	// allows up to twice the limit across a window boundary.
+	FixedWindow Algorithm = "fixed_window"
+	// TokenBucket refills Requests tokens per Period continuously into a
+	// bucket holding up to Burst tokens
+	TokenBucket Algorithm = "token_bucket"
+	// SlidingWindow keeps a log of request times and allows at most Requests
+	// in any Period
+	SlidingWindow Algorithm = "sliding_window"
+	// GCRA is the generic cell rate algorithm: the same shape as TokenBucket
+	// but with a single timestamp of state
+	GCRA Algorithm = "gcra"
+)
+
+// DefaultAlgorithm is used when a limit does not name an algorithm
+const DefaultAlgorithm = TokenBucket
+
+// ParseAlgorithm validates an algorithm name. An empty name is allowed and
+// means the default.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch a := Algorithm(name); a {
+	case "", FixedWindow, TokenBucket, SlidingWindow, GCRA:
+		return a, nil
+	default:
+		return "", fmt.Errorf("unknown rate limit algorithm %q", name)
+	}
+}
+
+// State is the per-key state of the stateful algorithms. It is serialized to
+// JSON by shared stores, so field names are kept short.
+type State struct {
+	// TokenBucket
+	Tokens  float64   `json:"t,omitempty"`
+	Updated time.Time `json:"u,omitempty"`
+	// SlidingWindow, as Unix nanoseconds
+	Log []int64 `json:"l,omitempty"`
+	// GCRA theoretical arrival time
+	TAT time.Time `json:"a,omitempty"`
+}
+
+// algorithm returns the limit's algorithm, applying the default
+func (l Limit) algorithm() Algorithm {
+	if l.Algorithm == "" {
+		return DefaultAlgorithm
+	}
+	return l.Algorithm
+}
+
+// burst returns the bucket capacity, defaulting to Requests
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Requests
+}
+
+// interval is the time it takes to earn back one request
+func (l Limit) interval() time.Duration {
+	return l.Period / time.Duration(l.Requests)
+}
+
+// apply runs one request through a stateful algorithm, updating state if the
+// request is allowed
+func apply(limit Limit, state *State, now time.Time) Result {
+	if limit.Requests <= 0 || limit.Period <= 0 {
+		return Result{Allowed: false, Limit: limit.Requests, ResetAt: now}
+	}
+
+	switch limit.algorithm() {
+	case SlidingWindow:
+		return applySlidingWindow(limit, state, now)
+	case GCRA:
+		return applyGCRA(limit, state, now)
+	default:
+		return applyTokenBucket(limit, state, now)
+	}
+}
+
+// applyTokenBucket implements TokenBucket
+func applyTokenBucket(limit Limit, state *State, now time.Time) Result {
+	capacity := float64(limit.burst())
+	rate := float64(limit.Requests) / limit.Period.Seconds()
+
+	tokens := capacity
+	if !state.Updated.IsZero() {
+		elapsed := now.Sub(state.Updated).Seconds()
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		tokens = math.Min(capacity, state.Tokens+elapsed*rate)
+	}
+
+	result := Result{Limit: limit.burst()}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - tokens) / rate)
+	}
+
+	state.Tokens = tokens
+	state.Updated = now
+
+	result.Remaining = int(tokens)
+	result.ResetAt = now.Add(secondsToDuration((capacity - tokens) / rate))
+	return result
+}
+
+// applySlidingWindow implements SlidingWindow
+func applySlidingWindow(limit Limit, state *State, now time.Time) Result {
+	cutoff := now.Add(-limit.Period).UnixNano()
+
+	// Drop requests that have left the window
+	kept := state.Log[:0]
+	for _, at := range state.Log {
+		if at > cutoff {
+			kept = append(kept, at)
+		}
+	}
+	state.Log = kept
+
+	result := Result{Limit: limit.Requests}
+	if len(state.Log) < limit.Requests {
+		state.Log = append(state.Log, now.UnixNano())
+		result.Allowed = true
+	}
+
+	result.Remaining = limit.Requests - len(state.Log)
+	oldestExpiry := time.Unix(0, state.Log[0]).Add(limit.Period)
+	result.ResetAt = oldestExpiry
+	if !result.Allowed {
+		result.RetryAfter = oldestExpiry.Sub(now)
+	}
+	return result
+}
+
+// applyGCRA implements GCRA
+func applyGCRA(limit Limit, state *State, now time.Time) Result {
+	interval := limit.interval()
+	tolerance := interval * time.Duration(limit.burst())
+
+	tat := state.TAT
+	if tat.Before(now) {
+		tat = now
+	}
+	newTAT := tat.Add(interval)
+	allowAt := newTAT.Add(-tolerance)
+
+	result := Result{Limit: limit.burst()}
+	if now.Before(allowAt) {
+		result.RetryAfter = allowAt.Sub(now)
+		result.ResetAt = tat
+		result.Remaining = 0
+		return result
+	}
+
+	state.TAT = newTAT
+	result.Allowed = true
+	result.ResetAt = newTAT
+	result.Remaining = int(now.Sub(newTAT.Add(-tolerance)) / interval)
+	return result
+}
+
+// secondsToDuration converts fractional seconds into a Duration
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,224 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Limit describes how many requests a key may make per period
+type Limit struct {
+	Algorithm Algorithm
+	Requests  int
+	Period    time.Duration
+	// Burst is the most requests that may be made at once by TokenBucket
+	// and GCRA. Zero means Requests.
+	Burst int
+}
+
+// Result is the outcome of a rate limit check
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// ResetAt is when the full allowance is available again
+	ResetAt time.Time
+	// RetryAfter is how long a rejected client should wait
+	RetryAfter time.Duration
+}
+
+// Limiter decides whether a request for a key may proceed. Implementations
+// must be safe for concurrent use.
+type Limiter interface {
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// CounterStore is a shared store of fixed-window hit counters. Increment
+// atomically records one hit for key in the window starting at windowStart
+// and returns the number of hits in that window. A hit in a newer window
+// resets the counter.
+type CounterStore interface {
+	IncrementRateCounter(ctx context.Context, key string, windowStart time.Time, period time.Duration) (int64, error)
+}
+
+// StateStore is a shared store of per-key algorithm state. UpdateRateState
+// atomically replaces the state stored for key with the result of update,
+// calling update again if another replica changed the state concurrently.
+// update receives nil when no state is stored. Stored state may be dropped
+// once it has not been updated for ttl.
+type StateStore interface {
+	UpdateRateState(ctx context.Context, key string, ttl time.Duration, update func(state []byte) ([]byte, error)) error
+}
+
+// SharedStore is a store that supports every algorithm
+type SharedStore interface {
+	CounterStore
+	StateStore
+}
+
+// Option configures a limiter
+type Option func(*settings)
+
+// settings holds the options common to all limiters
+type settings struct {
+	now func() time.Time
+}
+
+// WithClock replaces the limiter's clock, for tests
+func WithClock(now func() time.Time) Option {
+	return func(s *settings) {
+		s.now = now
+	}
+}
+
+// newSettings applies opts over the defaults
+func newSettings(opts []Option) settings {
+	s := settings{now: time.Now}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return s
+}
+
+// windowStart returns the start of the fixed window containing now. Windows
+// are aligned to the Unix epoch so every replica agrees on their boundaries.
+func windowStart(now time.Time, period time.Duration) time.Time {
+	return now.Truncate(period)
+}
+
+// fixedWindowResult builds the Result for a window that has seen hits requests
+func fixedWindowResult(limit Limit, start, now time.Time, hits int64) Result {
+	remaining := int64(limit.Requests) - hits
+	if remaining < 0 {
+		remaining = 0
+	}
+	result := Result{
+		Allowed:   hits <= int64(limit.Requests),
+		Limit:     limit.Requests,
+		Remaining: int(remaining),
+		ResetAt:   start.Add(limit.Period),
+	}
+	if !result.Allowed {
+		result.RetryAfter = result.ResetAt.Sub(now)
+	}
+	return result
+}
+
+// stateTTL is how long state must be kept before it is equivalent to no state
+func stateTTL(limit Limit) time.Duration {
+	refill := limit.Period
+	if limit.Requests > 0 {
+		refill = limit.interval() * time.Duration(limit.burst())
+	}
+	if refill < limit.Period {
+		return limit.Period
+	}
+	return refill
+}
+
+// MemoryLimiter keeps rate limit state in process memory. It is only
+// accurate when a single gateway replica serves all traffic.
+type MemoryLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*memoryWindow
+	states  map[string]*State
+	now     func() time.Time
+}
+
+type memoryWindow struct {
+	start time.Time
+	hits  int64
+}
+
+// Ensure MemoryLimiter implements Limiter
+var _ Limiter = (*MemoryLimiter)(nil)
+
+// NewMemoryLimiter creates a new in-memory limiter
+func NewMemoryLimiter(opts ...Option) *MemoryLimiter {
+	return &MemoryLimiter{
+		windows: make(map[string]*memoryWindow),
+		states:  make(map[string]*State),
+		now:     newSettings(opts).now,
+	}
+}
+
+// Allow records a request for key and reports whether it is within limit
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit.algorithm() != FixedWindow {
+		state, exists := l.states[key]
+		if !exists {
+			state = &State{}
+			l.states[key] = state
+		}
+		return apply(limit, state, now), nil
+	}
+
+	start := windowStart(now, limit.Period)
+	window, exists := l.windows[key]
+	if !exists || window.start.Before(start) {
+		window = &memoryWindow{start: start}
+		l.windows[key] = window
+	}
+	window.hits++
+
+	return fixedWindowResult(limit, window.start, now, window.hits), nil
+}
+
+// Reset forgets all state
+func (l *MemoryLimiter) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.windows = make(map[string]*memoryWindow)
+	l.states = make(map[string]*State)
+}
+
+// SharedLimiter keeps rate limit state in a store shared by all gateway
+// replicas, so a key's limit holds across the whole deployment
+type SharedLimiter struct {
+	store SharedStore
+	now   func() time.Time
+}
+
+// Ensure SharedLimiter implements Limiter
+var _ Limiter = (*SharedLimiter)(nil)
+
+// NewSharedLimiter creates a limiter backed by store
+func NewSharedLimiter(store SharedStore, opts ...Option) *SharedLimiter {
+	return &SharedLimiter{
+		store: store,
+		now:   newSettings(opts).now,
+	}
+}
+
+// Allow records a request for key and reports whether it is within limit
+func (l *SharedLimiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := l.now()
+
+	if limit.algorithm() == FixedWindow {
+		start := windowStart(now, limit.Period)
+		hits, err := l.store.IncrementRateCounter(ctx, key, start, limit.Period)
+		if err != nil {
+			return Result{}, err
+		}
+		return fixedWindowResult(limit, start, now, hits), nil
+	}
+
+	var result Result
+	err := l.store.UpdateRateState(ctx, key, stateTTL(limit), func(raw []byte) ([]byte, error) {
+		var state State
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &state); err != nil {
+				return nil, err
+			}
+		}
+		result = apply(limit, &state, now)
+		return json.Marshal(state)
+	})
+	return result, err
+}
@@ -0,0 +1,434 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/db"
+)
+
+// fakeRedis is an in-process stand-in for a Redis server that understands the
+// handful of commands the limiter uses, including optimistic transactions
+type fakeRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	values   map[string]string
+	versions map[string]int64
+}
+
+// fakeRedisConn is the per-connection transaction state
+type fakeRedisConn struct {
+	watched map[string]int64
+	queued  [][]string
+	inMulti bool
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		listener: listener,
+		values:   make(map[string]string),
+		versions: make(map[string]int64),
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) URL() string {
+	return "redis://" + f.listener.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	state := &fakeRedisConn{}
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		io.WriteString(conn, f.handle(state, args))
+	}
+}
+
+func (f *fakeRedis) handle(c *fakeRedisConn, args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(args) == 0 {
+		return "-ERR empty command\r\n"
+	}
+	command := strings.ToUpper(args[0])
+
+	if c.inMulti && command != "EXEC" {
+		c.queued = append(c.queued, args)
+		return "+QUEUED\r\n"
+	}
+
+	switch command {
+	case "WATCH":
+		if c.watched == nil {
+			c.watched = make(map[string]int64)
+		}
+		for _, key := range args[1:] {
+			c.watched[key] = f.versions[key]
+		}
+		return "+OK\r\n"
+	case "UNWATCH":
+		c.watched = nil
+		return "+OK\r\n"
+	case "MULTI":
+		c.inMulti = true
+		return "+OK\r\n"
+	case "EXEC":
+		queued, watched := c.queued, c.watched
+		c.inMulti, c.queued, c.watched = false, nil, nil
+		for key, version := range watched {
+			if f.versions[key] != version {
+				return "*-1\r\n"
+			}
+		}
+		replies := fmt.Sprintf("*%d\r\n", len(queued))
+		for _, queuedArgs := range queued {
+			replies += f.apply(queuedArgs)
+		}
+		return replies
+	default:
+		return f.apply(args)
+	}
+}
+
+// apply executes a data command; the caller holds f.mu
+func (f *fakeRedis) apply(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		value, ok := f.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		f.values[args[1]] = args[2]
+		f.versions[args[1]]++
+		return "+OK\r\n"
+	case "INCR":
+		var n int64
+		fmt.Sscan(f.values[args[1]], &n)
+		n++
+		f.values[args[1]] = fmt.Sprint(n)
+		f.versions[args[1]]++
+		return fmt.Sprintf(":%d\r\n", n)
+	case "PEXPIRE":
+		return ":1\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+// fakeClock is a manually advanced clock
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// limiterFactories builds every limiter implementation around a clock
+func limiterFactories(t *testing.T) map[string]func(clock *fakeClock) Limiter {
+	return map[string]func(clock *fakeClock) Limiter{
+		"Memory": func(clock *fakeClock) Limiter {
+			return NewMemoryLimiter(WithClock(clock.Now))
+		},
+		"SQL": func(clock *fakeClock) Limiter {
+			database, err := db.OpenDB(filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { database.Close() })
+			return NewSharedLimiter(database, WithClock(clock.Now))
+		},
+		"Redis": func(clock *fakeClock) Limiter {
+			store, err := NewRedisStore(newFakeRedis(t).URL())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Close() })
+			return NewSharedLimiter(store, WithClock(clock.Now))
+		},
+	}
+}
+
+// step is one request in an algorithm scenario
+type step struct {
+	advance    time.Duration
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration
+}
+
+// repeat returns n copies of s
+func repeat(n int, s step) []step {
+	steps := make([]step, n)
+	for i := range steps {
+		steps[i] = s
+	}
+	return steps
+}
+
+func TestAlgorithms(t *testing.T) {
+	// 10 seconds into a minute, so fixed windows are not aligned with the start
+	start := time.Date(2024, 1, 1, 12, 0, 10, 0, time.UTC)
+	perMinute := func(algorithm Algorithm, requests, burst int) Limit {
+		return Limit{Algorithm: algorithm, Requests: requests, Period: time.Minute, Burst: burst}
+	}
+
+	tests := []struct {
+		name  string
+		limit Limit
+		steps []step
+	}{
+		{
+			name:  "FixedWindowResetsAtBoundary",
+			limit: perMinute(FixedWindow, 3, 0),
+			steps: []step{
+				{allowed: true, remaining: 2},
+				{allowed: true, remaining: 1},
+				{allowed: true, remaining: 0},
+				{allowed: false, remaining: 0, retryAfter: 50 * time.Second},
+				{advance: 50 * time.Second, allowed: true, remaining: 2},
+			},
+		},
+		{
+			name:  "FixedWindowAllowsDoubleBurstAtEdge",
+			limit: perMinute(FixedWindow, 3, 0),
+			steps: []step{
+				{advance: 49 * time.Second, allowed: true, remaining: 2},
+				{allowed: true, remaining: 1},
+				{allowed: true, remaining: 0},
+				{advance: time.Second, allowed: true, remaining: 2},
+				{allowed: true, remaining: 1},
+				{allowed: true, remaining: 0},
+			},
+		},
+		{
+			name:  "TokenBucketBurstThenRefill",
+			limit: perMinute(TokenBucket, 3, 0),
+			steps: []step{
+				{allowed: true, remaining: 2},
+				{allowed: true, remaining: 1},
+				{allowed: true, remaining: 0},
+				{allowed: false, remaining: 0, retryAfter: 20 * time.Second},
+				{advance: 10 * time.Second, allowed: false, remaining: 0, retryAfter: 10 * time.Second},
+				{advance: 10 * time.Second, allowed: true, remaining: 0},
+				{advance: 40 * time.Second, allowed: true, remaining: 1},
+			},
+		},
+		{
+			name:  "TokenBucketLargerBurst",
+			limit: perMinute(TokenBucket, 6, 2),
+			steps: []step{
+				{allowed: true, remaining: 1},
+				{allowed: true, remaining: 0},
+				{allowed: false, remaining: 0, retryAfter: 10 * time.Second},
+				{advance: 10 * time.Second, allowed: true, remaining: 0},
+			},
+		},
+		{
+			// The old counter only refilled after a full idle minute, so a
+			// client pacing itself at one request per 59s was starved
+			name:  "TokenBucketSteadyClientNeverStarves",
+			limit: perMinute(TokenBucket, 10, 0),
+			steps: repeat(20, step{advance: 59 * time.Second, allowed: true, remaining: 9}),
+		},
+		{
+			name:  "SlidingWindowLog",
+			limit: perMinute(SlidingWindow, 3, 0),
+			steps: []step{
+				{allowed: true, remaining: 2},
+				{advance: 10 * time.Second, allowed: true, remaining: 1},
+				{advance: 10 * time.Second, allowed: true, remaining: 0},
+				{advance: 10 * time.Second, allowed: false, remaining: 0, retryAfter: 30 * time.Second},
+				{advance: 30 * time.Second, allowed: true, remaining: 0},
+				{advance: 10 * time.Second, allowed: true, remaining: 0},
+				{allowed: false, remaining: 0, retryAfter: 10 * time.Second},
+			},
+		},
+		{
+			name:  "SlidingWindowNoDoubleBurstAtEdge",
+			limit: perMinute(SlidingWindow, 3, 0),
+			steps: []step{
+				{advance: 49 * time.Second, allowed: true, remaining: 2},
+				{allowed: true, remaining: 1},
+				{allowed: true, remaining: 0},
+				{advance: time.Second, allowed: false, remaining: 0, retryAfter: 59 * time.Second},
+			},
+		},
+		{
+			name:  "GCRA",
+			limit: perMinute(GCRA, 3, 0),
+			steps: []step{
+				{allowed: true, remaining: 2},
+				{allowed: true, remaining: 1},
+				{allowed: true, remaining: 0},
+				{allowed: false, remaining: 0, retryAfter: 20 * time.Second},
+				{advance: 20 * time.Second, allowed: true, remaining: 0},
+				{advance: 60 * time.Second, allowed: true, remaining: 2},
+			},
+		},
+		{
+			name:  "GCRASteadyClientNeverStarves",
+			limit: perMinute(GCRA, 10, 0),
+			steps: repeat(20, step{advance: 59 * time.Second, allowed: true, remaining: 9}),
+		},
+	}
+
+	for backend, newLimiter := range limiterFactories(t) {
+		for _, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				clock := &fakeClock{now: start}
+				limiter := newLimiter(clock)
+
+				for i, s := range tt.steps {
+					clock.Advance(s.advance)
+					result, err := limiter.Allow(context.Background(), "key", tt.limit)
+					if err != nil {
+						t.Fatalf("step %d: Allow failed: %v", i, err)
+					}
+					if result.Allowed != s.allowed {
+						t.Errorf("step %d: allowed = %v, want %v", i, result.Allowed, s.allowed)
+					}
+					if result.Remaining != s.remaining {
+						t.Errorf("step %d: remaining = %d, want %d", i, result.Remaining, s.remaining)
+					}
+					if result.RetryAfter.Round(time.Second) != s.retryAfter {
+						t.Errorf("step %d: retry after = %v, want %v", i, result.RetryAfter, s.retryAfter)
+					}
+					if result.ResetAt.Before(clock.Now()) {
+						t.Errorf("step %d: reset at %v is in the past", i, result.ResetAt)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestSharedLimiterAcrossReplicas checks that two gateway replicas sharing a
+// store enforce one combined limit instead of one limit each
+func TestSharedLimiterAcrossReplicas(t *testing.T) {
+	database, err := db.OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	redisStore, err := NewRedisStore(newFakeRedis(t).URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redisStore.Close()
+
+	stores := map[string]SharedStore{"SQL": database, "Redis": redisStore}
+	for name, store := range stores {
+		for _, algorithm := range []Algorithm{FixedWindow, TokenBucket, SlidingWindow, GCRA} {
+			t.Run(name+"/"+string(algorithm), func(t *testing.T) {
+				// Freeze time so no tokens are earned back during the test
+				clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 10, 0, time.UTC)}
+				replicas := []*SharedLimiter{
+					NewSharedLimiter(store, WithClock(clock.Now)),
+					NewSharedLimiter(store, WithClock(clock.Now)),
+				}
+				limit := Limit{Algorithm: algorithm, Requests: 10, Period: time.Hour}
+				key := "shared-" + string(algorithm)
+
+				var wg sync.WaitGroup
+				var mu sync.Mutex
+				allowed := 0
+				for i := 0; i < 30; i++ {
+					wg.Add(1)
+					go func(replica *SharedLimiter) {
+						defer wg.Done()
+						result, err := replica.Allow(context.Background(), key, limit)
+						if err != nil {
+							t.Errorf("Allow failed: %v", err)
+							return
+						}
+						if result.Allowed {
+							mu.Lock()
+							allowed++
+							mu.Unlock()
+						}
+					}(replicas[i%2])
+				}
+				wg.Wait()
+
+				if allowed != limit.Requests {
+					t.Errorf("allowed %d requests across replicas, want %d", allowed, limit.Requests)
+				}
+			})
+		}
+	}
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	for _, name := range []string{"", "fixed_window", "token_bucket", "sliding_window", "gcra"} {
+		if _, err := ParseAlgorithm(name); err != nil {
+			t.Errorf("ParseAlgorithm(%q) failed: %v", name, err)
+		}
+	}
+	if _, err := ParseAlgorithm("leaky"); err == nil {
+		t.Error("expected error for unknown algorithm")
+	}
+}
+
+func TestNewRedisStore(t *testing.T) {
+	store, err := NewRedisStore("redis://:secret@cache.internal/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.addr != "cache.internal:6379" || store.password != "secret" || store.database != 2 {
+		t.Errorf("unexpected store settings: addr=%q password=%q database=%d", store.addr, store.password, store.database)
+	}
+
+	if _, err := NewRedisStore("http://cache.internal"); err == nil {
+		t.Error("expected error for non-redis scheme")
+	}
+}
@@ -0,0 +1,319 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisStore is a SharedStore backed by any server speaking the Redis
+// protocol (Redis, Valkey, KeyDB, ...)
+type RedisStore struct {
+	addr     string
+	password string
+	database int
+	timeout  time.Duration
+	pool     chan *redisConn
+}
+
+// Ensure RedisStore implements SharedStore
+var _ SharedStore = (*RedisStore)(nil)
+
+// maxStateAttempts bounds optimistic-concurrency retries in UpdateRateState
+const maxStateAttempts = 10
+
+// errStateContention is returned when UpdateRateState keeps losing races
+var errStateContention = errors.New("redis: rate limit state is under heavy contention")
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisConn is a single connection speaking RESP
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewRedisStore creates a store from a redis://[:password@]host[:port][/db] URL
+func NewRedisStore(rawURL string) (*RedisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported redis URL scheme %q", u.Scheme)
+	}
+
+	store := &RedisStore{
+		addr:    u.Host,
+		timeout: 5 * time.Second,
+		pool:    make(chan *redisConn, 16),
+	}
+	if u.Port() == "" {
+		store.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		store.password, _ = u.User.Password()
+	}
+	if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+		if store.database, err = strconv.Atoi(path); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", path)
+		}
+	}
+	return store, nil
+}
+
+// IncrementRateCounter implements CounterStore. Each window has its own key
+// that expires once the window is over.
+func (s *RedisStore) IncrementRateCounter(ctx context.Context, key string, windowStart time.Time, period time.Duration) (int64, error) {
+	counterKey := fmt.Sprintf("ratelimit:%s:%d", key, windowStart.UnixMilli())
+	ttl := strconv.FormatInt(period.Milliseconds(), 10)
+
+	replies, err := s.do(ctx, []string{"INCR", counterKey}, []string{"PEXPIRE", counterKey, ttl})
+	if err != nil {
+		return 0, err
+	}
+
+	hits, ok := replies[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected INCR reply %v", replies[0])
+	}
+	return hits, nil
+}
+
+// UpdateRateState implements StateStore with WATCH/MULTI/EXEC: the
+// transaction is discarded if another client changed the key after it was
+// read, and the update is retried with the fresh state.
+func (s *RedisStore) UpdateRateState(ctx context.Context, key string, ttl time.Duration, update func(state []byte) ([]byte, error)) error {
+	stateKey := "ratelimit:state:" + key
+	ttlMillis := strconv.FormatInt(ttl.Milliseconds(), 10)
+
+	return s.withConn(ctx, func(c *redisConn) error {
+		for attempt := 0; attempt < maxStateAttempts; attempt++ {
+			replies, err := c.pipeline([]string{"WATCH", stateKey}, []string{"GET", stateKey})
+			if err != nil {
+				return err
+			}
+
+			var state []byte
+			if current, ok := replies[1].(string); ok {
+				state = []byte(current)
+			}
+
+			next, err := update(state)
+			if err != nil {
+				if _, unwatchErr := c.pipeline([]string{"UNWATCH"}); unwatchErr != nil {
+					return unwatchErr
+				}
+				return err
+			}
+
+			replies, err = c.pipeline(
+				[]string{"MULTI"},
+				[]string{"SET", stateKey, string(next), "PX", ttlMillis},
+				[]string{"EXEC"},
+			)
+			if err != nil {
+				return err
+			}
+			// EXEC replies nil when a watched key changed
+			if replies[2] != nil {
+				return nil
+			}
+			if err := backoff(ctx, attempt); err != nil {
+				return err
+			}
+		}
+		return errStateContention
+	})
+}
+
+// backoff sleeps for a random, exponentially growing time before retry
+// attempt+1 so that clients which collided do not collide again
+func backoff(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(time.Millisecond) << attempt)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes all pooled connections
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-s.pool:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends the commands as one pipeline and returns their replies in order
+func (s *RedisStore) do(ctx context.Context, commands ...[]string) ([]interface{}, error) {
+	var replies []interface{}
+	err := s.withConn(ctx, func(c *redisConn) error {
+		var err error
+		replies, err = c.pipeline(commands...)
+		return err
+	})
+	return replies, err
+}
+
+// withConn runs fn on a pooled connection. The connection is discarded
+// instead of pooled if fn fails with anything but an error reply.
+func (s *RedisStore) withConn(ctx context.Context, fn func(c *redisConn) error) error {
+	c, err := s.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+
+	err = fn(c)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) && err != errStateContention {
+		// The connection state is unknown after an I/O error
+		c.conn.Close()
+		return err
+	}
+	s.put(c)
+	return err
+}
+
+// get takes a pooled connection or dials a new one
+func (s *RedisStore) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-s.pool:
+		return c, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: s.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	var setup [][]string
+	if s.password != "" {
+		setup = append(setup, []string{"AUTH", s.password})
+	}
+	if s.database != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.database)})
+	}
+	if len(setup) > 0 {
+		if _, err := c.pipeline(setup...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// put returns a healthy connection to the pool
+func (s *RedisStore) put(c *redisConn) {
+	select {
+	case s.pool <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// pipeline writes all commands, then reads one reply per command. The first
+// error reply is returned after all replies have been consumed.
+func (c *redisConn) pipeline(commands ...[]string) ([]interface{}, error) {
+	var buf strings.Builder
+	for _, args := range commands {
+		fmt.Fprintf(&buf, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := io.WriteString(c.conn, buf.String()); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(commands))
+	var firstErr error
+	for i := range commands {
+		reply, err := readReply(c.r)
+		if err != nil {
+			var replyErr redisError
+			if !errors.As(err, &replyErr) {
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		replies[i] = reply
+	}
+	return replies, firstErr
+}
+
+// readReply parses one RESP reply. Bulk strings are returned as strings, nil
+// bulk strings and arrays as nil.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,95 @@
+package retention
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// UsageStore defines the storage operations needed to compact usage data
+type UsageStore interface {
+	CompactUsage(rawBefore, hourlyBefore time.Time) (int64, error)
+	IncrementalVacuum() error
+}
+
+// Config controls how long usage data is kept at each resolution
+type Config struct {
+	// RawRetention is how long raw usage events are kept before they are
+	// rolled up. Zero keeps them forever.
+	RawRetention time.Duration
+	// HourlyRetention is how long hourly rollups are kept. Zero keeps them forever.
+	HourlyRetention time.Duration
+	// Interval is how often compaction runs
+	Interval time.Duration
+	// VacuumInterval is how often free pages are released. Zero disables vacuuming.
+	VacuumInterval time.Duration
+}
+
+// Compactor periodically rolls up and prunes usage data
+type Compactor struct {
+	store      UsageStore
+	cfg        Config
+	now        func() time.Time
+	lastVacuum time.Time
+}
+
+// NewCompactor creates a new Compactor
+func NewCompactor(store UsageStore, cfg Config) *Compactor {
+	return &Compactor{
+		store: store,
+		cfg:   cfg,
+		now:   time.Now,
+	}
+}
+
+// Run compacts usage data every Interval until ctx is cancelled
+func (c *Compactor) Run(ctx context.Context) {
+	if c.cfg.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		c.RunOnce()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce performs a single compaction pass
+func (c *Compactor) RunOnce() {
+	now := c.now()
+
+	// Zero times keep the data, so the rollups are still pruned and the
+	// database vacuumed when raw events are kept
+	var rawBefore, hourlyBefore time.Time
+	if c.cfg.RawRetention > 0 {
+		rawBefore = now.Add(-c.cfg.RawRetention)
+	}
+	if c.cfg.HourlyRetention > 0 {
+		hourlyBefore = now.Add(-c.cfg.HourlyRetention)
+	}
+
+	compacted, err := c.store.CompactUsage(rawBefore, hourlyBefore)
+	if err != nil {
+		log.Printf("Error compacting API usage: %v", err)
+		return
+	}
+	if compacted > 0 {
+		log.Printf("Compacted %d API usage events", compacted)
+	}
+
+	if c.cfg.VacuumInterval > 0 && now.Sub(c.lastVacuum) >= c.cfg.VacuumInterval {
+		if err := c.store.IncrementalVacuum(); err != nil {
+			log.Printf("Error vacuuming database: %v", err)
+			return
+		}
+		c.lastVacuum = now
+	}
+}
@@ -0,0 +1,99 @@
+package retention
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeStore records the compactions and vacuums asked of it
+type fakeStore struct {
+	rawBefore    []time.Time
+	hourlyBefore []time.Time
+	vacuums      int
+}
+
+func (s *fakeStore) CompactUsage(rawBefore, hourlyBefore time.Time) (int64, error) {
+	s.rawBefore = append(s.rawBefore, rawBefore)
+	s.hourlyBefore = append(s.hourlyBefore, hourlyBefore)
+	return 0, nil
+}
+
+func (s *fakeStore) IncrementalVacuum() error {
+	s.vacuums++
+	return nil
+}
+
+func TestRunOnce(t *testing.T) {
+	now := time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name             string
+		cfg              Config
+		wantRawBefore    time.Time
+		wantHourlyBefore time.Time
+	}{
+		{
+			name:             "raw and hourly retention",
+			cfg:              Config{RawRetention: 24 * time.Hour, HourlyRetention: 7 * 24 * time.Hour},
+			wantRawBefore:    now.Add(-24 * time.Hour),
+			wantHourlyBefore: now.Add(-7 * 24 * time.Hour),
+		},
+		{
+			name:          "hourly rollups kept forever",
+			cfg:           Config{RawRetention: 24 * time.Hour},
+			wantRawBefore: now.Add(-24 * time.Hour),
+		},
+		{
+			name:             "raw events kept forever",
+			cfg:              Config{HourlyRetention: 7 * 24 * time.Hour},
+			wantHourlyBefore: now.Add(-7 * 24 * time.Hour),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeStore{}
+			c := NewCompactor(store, tt.cfg)
+			c.now = func() time.Time { return now }
+
+			c.RunOnce()
+			if len(store.rawBefore) != 1 || !store.rawBefore[0].Equal(tt.wantRawBefore) || !store.hourlyBefore[0].Equal(tt.wantHourlyBefore) {
+				t.Errorf("compacted before %v and %v; want %v and %v", store.rawBefore, store.hourlyBefore, tt.wantRawBefore, tt.wantHourlyBefore)
+			}
+		})
+	}
+}
+
+func TestVacuumInterval(t *testing.T) {
+	now := time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC)
+	store := &fakeStore{}
+	// Raw events are kept, which must not stop the vacuum
+	c := NewCompactor(store, Config{VacuumInterval: time.Hour})
+	c.now = func() time.Time { return now }
+
+	steps := []struct {
+		after time.Duration
+		want  int
+	}{
+		{0, 1},
+		{30 * time.Minute, 1},
+		{59 * time.Minute, 1},
+		{time.Hour, 2},
+		{90 * time.Minute, 2},
+	}
+	start := now
+	for _, step := range steps {
+		now = start.Add(step.after)
+		c.RunOnce()
+		if store.vacuums != step.want {
+			t.Errorf("after %v: %d vacuums, want %d", step.after, store.vacuums, step.want)
+		}
+	}
+
+	// Without an interval the database is never vacuumed
+	store = &fakeStore{}
+	c = NewCompactor(store, Config{RawRetention: time.Hour})
+	c.RunOnce()
+	if store.vacuums != 0 {
+		t.Errorf("%d vacuums without an interval, want 0", store.vacuums)
+	}
+}
@@ -0,0 +1,349 @@
+package scheduler
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/metrics"
+)
+
+var (
+	// ErrQueueFull is returned when the queue already holds MaxDepth requests
+	ErrQueueFull = errors.New("request queue is full")
+	// ErrQueueTimeout is returned when a request waited longer than Timeout
+	ErrQueueTimeout = errors.New("timed out waiting in the request queue")
+)
+
+// Priority is a scheduling class. Every queued request of a higher class is
+// dispatched before any request of a lower class.
+type Priority string
+
+// The priority classes, from highest to lowest
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
+)
+
+// priorities lists the classes from highest to lowest
+var priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// ParsePriority validates a priority name. An empty name means PriorityNormal.
+func ParsePriority(name string) (Priority, error) {
+	if name == "" {
+		return PriorityNormal, nil
+	}
+	for _, p := range priorities {
+		if Priority(name) == p {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown priority %q", name)
+}
+
+// class returns the index of p in priorities. Unknown priorities, including
+// the empty one, are treated as PriorityNormal.
+func (p Priority) class() int {
+	for i, candidate := range priorities {
+		if p == candidate {
+			return i
+		}
+	}
+	return 1
+}
+
+// Config holds the scheduler settings
+type Config struct {
+	// Parallel is how many requests are dispatched to the backend at once.
+	// Zero disables queuing.
+	Parallel int
+	// MaxDepth is the most requests that may wait, zero for unlimited
+	MaxDepth int
+	// Timeout is the longest a request may wait, zero for no limit
+	Timeout time.Duration
+}
+
+// Request describes who is asking for a slot
+type Request struct {
+	Key      string
+	Priority Priority
+	// Weight is the key's share of the backend relative to other keys of
+	// the same priority. Values below one count as one.
+	Weight int
+	// Queued, if set, is called with the request's place in line when it
+	// has to wait, before Acquire blocks
+	Queued func(position int)
+}
+
+// Ticket is a dispatched request
+type Ticket struct {
+	// Position is the request's place in line when it was queued, starting
+	// at one, or zero if it was dispatched immediately
+	Position int
+	// Waited is how long the request spent in the queue
+	Waited  time.Duration
+	release func()
+}
+
+// Release gives the slot back. It must be called exactly once.
+func (t *Ticket) Release() {
+	t.release()
+}
+
+// Scheduler holds requests until the backend has capacity for them. Between
+// keys of the same priority it uses weighted fair queuing: each request gets
+// a virtual finish time of max(virtual time, the key's previous finish) +
+// 1/weight and the earliest finish is dispatched first, so a key flooding
+// the queue only delays its own requests.
+type Scheduler struct {
+	cfg Config
+
+	mu      sync.Mutex
+	running int
+	depth   int
+	seq     uint64
+	classes []*class
+
+	waitTime *metrics.Histogram
+	rejected *metrics.Counter
+}
+
+// class is the queue of one priority
+type class struct {
+	queue waiterHeap
+	// virtual is the finish time of the last request dispatched
+	virtual float64
+	// finish holds the finish time of each key's last queued request
+	finish map[string]float64
+}
+
+// waiter is a queued request
+type waiter struct {
+	key    string
+	finish float64
+	seq    uint64
+	index  int
+	ready  chan struct{}
+}
+
+// New creates a scheduler. Its metrics are registered with registry if it
+// is not nil.
+func New(cfg Config, registry *metrics.Registry) *Scheduler {
+	s := &Scheduler{cfg: cfg}
+	for range priorities {
+		s.classes = append(s.classes, &class{finish: make(map[string]float64)})
+	}
+
+	if registry != nil {
+		s.waitTime = registry.NewHistogram("ollama_api_queue_wait_seconds",
+			"Time requests spent waiting in the scheduler queue.", metrics.DefaultBuckets, "priority")
+		s.rejected = registry.NewCounter("ollama_api_queue_rejected_total",
+			"Requests rejected by the scheduler.", "reason")
+		registry.NewGaugeFunc("ollama_api_queue_depth", "Requests waiting in the scheduler queue.",
+			func() float64 { return float64(s.Depth()) })
+		registry.NewGaugeFunc("ollama_api_queue_running", "Requests dispatched to the backend.",
+			func() float64 { return float64(s.Running()) })
+	}
+	return s
+}
+
+// Acquire waits until req may be dispatched to the backend
+func (s *Scheduler) Acquire(ctx context.Context, req Request) (*Ticket, error) {
+	start := time.Now()
+	class := req.Priority.class()
+	req.Priority = priorities[class]
+
+	s.mu.Lock()
+	if s.cfg.Parallel <= 0 || (s.running < s.cfg.Parallel && s.depth == 0) {
+		s.running++
+		s.mu.Unlock()
+		s.observe(req.Priority, 0)
+		return &Ticket{release: s.releaseFunc()}, nil
+	}
+	if s.cfg.MaxDepth > 0 && s.depth >= s.cfg.MaxDepth {
+		s.mu.Unlock()
+		s.reject("full")
+		return nil, ErrQueueFull
+	}
+	w := s.enqueue(class, req)
+	position := s.position(class, w)
+	s.mu.Unlock()
+	if req.Queued != nil {
+		req.Queued(position)
+	}
+
+	var timeout <-chan time.Time
+	if s.cfg.Timeout > 0 {
+		timer := time.NewTimer(s.cfg.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		waited := time.Since(start)
+		s.observe(req.Priority, waited)
+		return &Ticket{Position: position, Waited: waited, release: s.releaseFunc()}, nil
+	case <-timeout:
+		err = ErrQueueTimeout
+		s.reject("timeout")
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.reject("cancelled")
+	}
+
+	s.mu.Lock()
+	if w.index >= 0 {
+		heap.Remove(&s.classes[class].queue, w.index)
+		s.depth--
+		s.mu.Unlock()
+	} else {
+		// Dispatched just as we gave up: hand the slot to the next waiter
+		s.mu.Unlock()
+		s.releaseFunc()()
+	}
+	return nil, err
+}
+
+// enqueue adds req to its class. The caller holds s.mu.
+func (s *Scheduler) enqueue(class int, req Request) *waiter {
+	c := s.classes[class]
+	weight := req.Weight
+	if weight < 1 {
+		weight = 1
+	}
+
+	start := c.virtual
+	if last, ok := c.finish[req.Key]; ok && last > start {
+		start = last
+	}
+	s.seq++
+	w := &waiter{
+		key:    req.Key,
+		finish: start + 1/float64(weight),
+		seq:    s.seq,
+		ready:  make(chan struct{}),
+	}
+	c.finish[req.Key] = w.finish
+	heap.Push(&c.queue, w)
+	s.depth++
+	return w
+}
+
+// position returns w's place in line, counting the requests that would be
+// dispatched before it. The caller holds s.mu.
+func (s *Scheduler) position(class int, w *waiter) int {
+	position := 0
+	for i, c := range s.classes {
+		if i < class {
+			position += len(c.queue)
+		} else if i == class {
+			for _, other := range c.queue {
+				if other != w && other.less(w) {
+					position++
+				}
+			}
+		}
+	}
+	return position + 1
+}
+
+// releaseFunc returns a function that frees one running slot once
+func (s *Scheduler) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.running--
+			s.dispatch()
+		})
+	}
+}
+
+// dispatch wakes waiters while there is capacity. The caller holds s.mu.
+func (s *Scheduler) dispatch() {
+	for s.depth > 0 && (s.cfg.Parallel <= 0 || s.running < s.cfg.Parallel) {
+		for _, c := range s.classes {
+			if len(c.queue) == 0 {
+				continue
+			}
+			w := heap.Pop(&c.queue).(*waiter)
+			c.virtual = w.finish
+			if len(c.queue) == 0 {
+				// Nobody is waiting, so past finish times no longer matter
+				c.finish = make(map[string]float64)
+			}
+			s.depth--
+			s.running++
+			close(w.ready)
+			break
+		}
+	}
+}
+
+// Depth returns the number of waiting requests
+func (s *Scheduler) Depth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.depth
+}
+
+// Running returns the number of dispatched requests
+func (s *Scheduler) Running() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+func (s *Scheduler) observe(priority Priority, waited time.Duration) {
+	if s.waitTime != nil {
+		s.waitTime.Observe(waited.Seconds(), string(priority))
+	}
+}
+
+func (s *Scheduler) reject(reason string) {
+	if s.rejected != nil {
+		s.rejected.Inc(reason)
+	}
+}
+
+// less orders waiters by finish time, then arrival
+func (w *waiter) less(other *waiter) bool {
+	if w.finish != other.finish {
+		return w.finish < other.finish
+	}
+	return w.seq < other.seq
+}
+
+// waiterHeap is a min-heap of waiters implementing heap.Interface
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int           { return len(h) }
+func (h waiterHeap) Less(i, j int) bool { return h[i].less(h[j]) }
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*h = old[:len(old)-1]
+	return w
+}
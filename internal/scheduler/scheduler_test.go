@@ -0,0 +1,194 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/metrics"
+)
+
+// queueInOrder queues reqs one at a time behind a held slot, then releases
+// slots one by one and returns the order in which they were dispatched
+func queueInOrder(t *testing.T, s *Scheduler, reqs []Request) []string {
+	t.Helper()
+
+	held, err := s.Acquire(context.Background(), Request{Key: "holder"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var order []string
+	tickets := make(chan *Ticket, len(reqs))
+	for i, req := range reqs {
+		go func(req Request) {
+			ticket, err := s.Acquire(context.Background(), req)
+			if err != nil {
+				t.Errorf("Acquire failed: %v", err)
+				return
+			}
+			mu.Lock()
+			order = append(order, req.Key)
+			mu.Unlock()
+			tickets <- ticket
+		}(req)
+		for s.Depth() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	held.Release()
+	for range reqs {
+		(<-tickets).Release()
+	}
+	return order
+}
+
+func TestFairQueuingBetweenKeys(t *testing.T) {
+	s := New(Config{Parallel: 1}, nil)
+
+	// A floods the queue before B arrives, but B does not wait behind all of A
+	order := queueInOrder(t, s, []Request{
+		{Key: "a"}, {Key: "a"}, {Key: "a"}, {Key: "b"},
+	})
+	if got := strings.Join(order, ","); got != "a,b,a,a" {
+		t.Errorf("dispatch order = %s, want a,b,a,a", got)
+	}
+}
+
+func TestWeightedFairQueuing(t *testing.T) {
+	s := New(Config{Parallel: 1}, nil)
+
+	order := queueInOrder(t, s, []Request{
+		{Key: "b", Weight: 1}, {Key: "b", Weight: 1}, {Key: "b", Weight: 1},
+		{Key: "a", Weight: 2}, {Key: "a", Weight: 2}, {Key: "a", Weight: 2}, {Key: "a", Weight: 2},
+	})
+	if got := strings.Join(order, ","); got != "a,b,a,a,b,a,b" {
+		t.Errorf("dispatch order = %s, want a,b,a,a,b,a,b", got)
+	}
+}
+
+func TestPriorities(t *testing.T) {
+	s := New(Config{Parallel: 1}, nil)
+
+	order := queueInOrder(t, s, []Request{
+		{Key: "low", Priority: PriorityLow},
+		{Key: "normal", Priority: PriorityNormal},
+		{Key: "high", Priority: PriorityHigh},
+	})
+	if got := strings.Join(order, ","); got != "high,normal,low" {
+		t.Errorf("dispatch order = %s, want high,normal,low", got)
+	}
+}
+
+func TestQueuePosition(t *testing.T) {
+	s := New(Config{Parallel: 1}, nil)
+	ctx := context.Background()
+
+	held, err := s.Acquire(ctx, Request{Key: "holder"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held.Position != 0 {
+		t.Errorf("immediate dispatch position = %d, want 0", held.Position)
+	}
+
+	positions := make(chan int, 2)
+	queued := make(chan int, 2)
+	for i, priority := range []Priority{PriorityNormal, PriorityHigh} {
+		go func(priority Priority) {
+			notify := func(position int) { queued <- position }
+			ticket, err := s.Acquire(ctx, Request{Key: string(priority), Priority: priority, Queued: notify})
+			if err != nil {
+				t.Errorf("Acquire failed: %v", err)
+				return
+			}
+			positions <- ticket.Position
+			ticket.Release()
+		}(priority)
+		for s.Depth() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Both were told their place in line while waiting
+	if normal, high := <-queued, <-queued; normal != 1 || high != 1 {
+		t.Errorf("queued positions = %d, %d; want 1, 1", normal, high)
+	}
+
+	held.Release()
+	// The high priority request jumped the normal one, which was first in line
+	if first, second := <-positions, <-positions; first != 1 || second != 1 {
+		t.Errorf("positions = %d, %d; want 1, 1", first, second)
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	registry := metrics.NewRegistry()
+	s := New(Config{Parallel: 1, MaxDepth: 1, Timeout: 30 * time.Millisecond}, registry)
+	ctx := context.Background()
+
+	held, err := s.Acquire(ctx, Request{Key: "holder"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timedOut := make(chan error)
+	go func() {
+		_, err := s.Acquire(ctx, Request{Key: "waiter"})
+		timedOut <- err
+	}()
+	for s.Depth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := s.Acquire(ctx, Request{Key: "overflow"}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Acquire on a full queue = %v, want ErrQueueFull", err)
+	}
+	if err := <-timedOut; !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("Acquire = %v, want ErrQueueTimeout", err)
+	}
+	if s.Depth() != 0 || s.Running() != 1 {
+		t.Errorf("depth = %d, running = %d; want 0, 1", s.Depth(), s.Running())
+	}
+
+	// A cancelled request leaves the queue too
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := s.Acquire(cancelled, Request{Key: "waiter"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Acquire = %v, want context.Canceled", err)
+	}
+
+	held.Release()
+	if s.Running() != 0 {
+		t.Errorf("running after release = %d, want 0", s.Running())
+	}
+
+	var out strings.Builder
+	registry.Write(&out)
+	for _, want := range []string{
+		`ollama_api_queue_rejected_total{reason="full"} 1`,
+		`ollama_api_queue_rejected_total{reason="timeout"} 1`,
+		`ollama_api_queue_wait_seconds_count{priority="normal"} 1`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestUnlimitedParallel(t *testing.T) {
+	s := New(Config{}, nil)
+	for i := 0; i < 100; i++ {
+		if _, err := s.Acquire(context.Background(), Request{Key: "key"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Running() != 100 || s.Depth() != 0 {
+		t.Errorf("running = %d, depth = %d; want 100, 0", s.Running(), s.Depth())
+	}
+}
@@ -0,0 +1,397 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error is a place where a document does not match a schema
+type Error struct {
+	// Path locates the value, such as $.items[0].name
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e Error) String() string {
+	return e.Path + ": " + e.Message
+}
+
+// Schema is a JSON Schema. It supports the keywords used to describe
+// structured output: type, enum, const, properties, required,
+// additionalProperties, items, the string, number, array and object size
+// keywords, pattern, allOf, anyOf, oneOf, not and local $ref.
+type Schema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// Compile parses a schema. It fails if the schema is not an object or a
+// boolean, or uses an invalid pattern.
+func Compile(raw []byte) (*Schema, error) {
+	// Numbers are compared with those of documents, decoded the same way
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var root interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	switch root.(type) {
+	case map[string]interface{}, bool:
+	default:
+		return nil, errors.New("invalid schema: must be an object")
+	}
+
+	s := &Schema{root: root, patterns: make(map[string]*regexp.Regexp)}
+	if err := s.compilePatterns(root); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// compilePatterns compiles every pattern in the schema ahead of validation
+func (s *Schema) compilePatterns(node interface{}) error {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if pattern, ok := n["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid schema: pattern %q: %v", pattern, err)
+			}
+			s.patterns[pattern] = re
+		}
+		for _, child := range n {
+			if err := s.compilePatterns(child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range n {
+			if err := s.compilePatterns(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks a JSON document against the schema and returns the
+// problems found, nil if it matches
+func (s *Schema) Validate(doc []byte) []Error {
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return []Error{{Path: "$", Message: "not valid JSON: " + err.Error()}}
+	}
+	if decoder.More() {
+		return []Error{{Path: "$", Message: "not valid JSON: unexpected data after the document"}}
+	}
+	return s.validate(s.root, value, "$", 0)
+}
+
+// maxDepth bounds $ref recursion in self-referencing schemas
+const maxDepth = 64
+
+func (s *Schema) validate(node, value interface{}, path string, depth int) []Error {
+	if depth > maxDepth {
+		return []Error{{Path: path, Message: "schema nests too deeply"}}
+	}
+	switch n := node.(type) {
+	case bool:
+		if !n {
+			return []Error{{Path: path, Message: "no value is allowed here"}}
+		}
+		return nil
+	case map[string]interface{}:
+		return s.validateObject(n, value, path, depth)
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(node map[string]interface{}, value interface{}, path string, depth int) []Error {
+	if ref, ok := node["$ref"].(string); ok {
+		target, err := s.resolve(ref)
+		if err != nil {
+			return []Error{{Path: path, Message: err.Error()}}
+		}
+		if errs := s.validate(target, value, path, depth+1); errs != nil {
+			return errs
+		}
+	}
+
+	var errs []Error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, Error{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if types, ok := node["type"]; ok && !matchesType(types, value) {
+		fail("expected %s, got %s", describeTypes(types), typeName(value))
+		return errs
+	}
+	if enum, ok := node["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if equal(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %s", compact(enum))
+		}
+	}
+	if constant, ok := node["const"]; ok && !equal(constant, value) {
+		fail("must be %s", compact(constant))
+	}
+
+	switch v := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(v)
+		if min, ok := number(node["minLength"]); ok && float64(length) < min {
+			fail("must be at least %v characters long", min)
+		}
+		if max, ok := number(node["maxLength"]); ok && float64(length) > max {
+			fail("must be at most %v characters long", max)
+		}
+		if pattern, ok := node["pattern"].(string); ok && !s.patterns[pattern].MatchString(v) {
+			fail("must match the pattern %q", pattern)
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if min, ok := number(node["minimum"]); ok && f < min {
+			fail("must be at least %v", min)
+		}
+		if max, ok := number(node["maximum"]); ok && f > max {
+			fail("must be at most %v", max)
+		}
+		if min, ok := number(node["exclusiveMinimum"]); ok && f <= min {
+			fail("must be greater than %v", min)
+		}
+		if max, ok := number(node["exclusiveMaximum"]); ok && f >= max {
+			fail("must be less than %v", max)
+		}
+		if step, ok := number(node["multipleOf"]); ok && step > 0 {
+			if q := f / step; math.Abs(q-math.Round(q)) > 1e-9 {
+				fail("must be a multiple of %v", step)
+			}
+		}
+	case []interface{}:
+		if min, ok := number(node["minItems"]); ok && float64(len(v)) < min {
+			fail("must have at least %v items", min)
+		}
+		if max, ok := number(node["maxItems"]); ok && float64(len(v)) > max {
+			fail("must have at most %v items", max)
+		}
+		if unique, _ := node["uniqueItems"].(bool); unique {
+			for i := range v {
+				for j := i + 1; j < len(v); j++ {
+					if equal(v[i], v[j]) {
+						fail("items %d and %d are equal", i, j)
+					}
+				}
+			}
+		}
+		if items, ok := node["items"]; ok {
+			for i, item := range v {
+				errs = append(errs, s.validate(items, item, path+"["+strconv.Itoa(i)+"]", depth+1)...)
+			}
+		}
+	case map[string]interface{}:
+		if min, ok := number(node["minProperties"]); ok && float64(len(v)) < min {
+			fail("must have at least %v properties", min)
+		}
+		if max, ok := number(node["maxProperties"]); ok && float64(len(v)) > max {
+			fail("must have at most %v properties", max)
+		}
+		if required, ok := node["required"].([]interface{}); ok {
+			for _, name := range required {
+				if name, ok := name.(string); ok {
+					if _, present := v[name]; !present {
+						fail("missing required property %q", name)
+					}
+				}
+			}
+		}
+		properties, _ := node["properties"].(map[string]interface{})
+		additional, hasAdditional := node["additionalProperties"]
+		for _, name := range sortedKeys(v) {
+			childPath := propertyPath(path, name)
+			if property, ok := properties[name]; ok {
+				errs = append(errs, s.validate(property, v[name], childPath, depth+1)...)
+			} else if hasAdditional {
+				if allowed, ok := additional.(bool); ok && !allowed {
+					errs = append(errs, Error{Path: childPath, Message: "property is not allowed"})
+				} else {
+					errs = append(errs, s.validate(additional, v[name], childPath, depth+1)...)
+				}
+			}
+		}
+	}
+
+	if allOf, ok := node["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			errs = append(errs, s.validate(sub, value, path, depth+1)...)
+		}
+	}
+	if anyOf, ok := node["anyOf"].([]interface{}); ok && s.matching(anyOf, value, path, depth) == 0 {
+		fail("must match at least one of the anyOf schemas")
+	}
+	if oneOf, ok := node["oneOf"].([]interface{}); ok {
+		if matched := s.matching(oneOf, value, path, depth); matched != 1 {
+			fail("must match exactly one of the oneOf schemas, matched %d", matched)
+		}
+	}
+	if not, ok := node["not"]; ok && s.validate(not, value, path, depth+1) == nil {
+		fail("must not match the not schema")
+	}
+	return errs
+}
+
+// matching counts the schemas value matches
+func (s *Schema) matching(schemas []interface{}, value interface{}, path string, depth int) int {
+	matched := 0
+	for _, sub := range schemas {
+		if s.validate(sub, value, path, depth+1) == nil {
+			matched++
+		}
+	}
+	return matched
+}
+
+// resolve follows a reference within the schema, such as #/$defs/item
+func (s *Schema) resolve(ref string) (interface{}, error) {
+	if ref == "#" {
+		return s.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported $ref %q, only references within the schema are allowed", ref)
+	}
+	node := s.root
+	for _, token := range strings.Split(ref[2:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		if node, ok = object[token]; !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+	return node, nil
+}
+
+// matchesType checks value against a type keyword, a name or a list of names
+func matchesType(types, value interface{}) bool {
+	switch t := types.(type) {
+	case string:
+		return isType(t, value)
+	case []interface{}:
+		for _, name := range t {
+			if name, ok := name.(string); ok && isType(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func isType(name string, value interface{}) bool {
+	switch name {
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := n.Float64()
+		return err == nil && f == math.Trunc(f)
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	}
+	return typeName(value) == name
+}
+
+// typeName returns the JSON type of a decoded value
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+func describeTypes(types interface{}) string {
+	if list, ok := types.([]interface{}); ok {
+		names := make([]string, len(list))
+		for i, name := range list {
+			names[i] = fmt.Sprint(name)
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(types)
+}
+
+// equal compares decoded JSON values, treating numbers by value
+func equal(a, b interface{}) bool {
+	if x, ok := a.(json.Number); ok {
+		if y, ok := b.(json.Number); ok {
+			fx, _ := x.Float64()
+			fy, _ := y.Float64()
+			return fx == fy
+		}
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// number reads a numeric keyword
+func number(value interface{}) (float64, bool) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+func compact(value interface{}) string {
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// propertyPath appends a property name to a path
+func propertyPath(path, name string) string {
+	if identifier.MatchString(name) {
+		return path + "." + name
+	}
+	return path + "[" + strconv.Quote(name) + "]"
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
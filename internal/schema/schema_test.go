@@ -0,0 +1,76 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	s, err := Compile([]byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "pattern": "^[A-Z]"},
+			"age": {"type": "integer", "minimum": 0, "maximum": 150},
+			"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2, "uniqueItems": true},
+			"kind": {"enum": ["person", "robot"]},
+			"pet": {"$ref": "#/$defs/pet"},
+			"contact": {"oneOf": [{"type": "string"}, {"type": "integer"}]}
+		},
+		"required": ["name", "age"],
+		"additionalProperties": false,
+		"$defs": {"pet": {"type": ["object", "null"], "required": ["species"]}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		doc  string
+		want []Error
+	}{
+		{`{"name":"Ada","age":36,"tags":["x","y"],"kind":"person","pet":null,"contact":5}`, nil},
+		{`{"name":"Ada","age":36.0}`, nil},
+		{`{"name":"Ada"}`, []Error{{"$", `missing required property "age"`}}},
+		{`{"name":"ada","age":-1}`, []Error{
+			{"$.age", "must be at least 0"},
+			{"$.name", `must match the pattern "^[A-Z]"`},
+		}},
+		{`{"name":"Ada","age":1.5}`, []Error{{"$.age", "expected integer, got number"}}},
+		{`{"name":"Ada","age":1,"tags":["x","x",3]}`, []Error{
+			{"$.tags", "must have at most 2 items"},
+			{"$.tags", "items 0 and 1 are equal"},
+			{"$.tags[2]", "expected string, got number"},
+		}},
+		{`{"name":"Ada","age":1,"kind":"cat","extra lives":9}`, []Error{
+			{`$["extra lives"]`, "property is not allowed"},
+			{"$.kind", `must be one of ["person","robot"]`},
+		}},
+		{`{"name":"Ada","age":1,"pet":{}}`, []Error{{"$.pet", `missing required property "species"`}}},
+		{`{"name":"Ada","age":1,"contact":true}`, []Error{{"$.contact", "must match exactly one of the oneOf schemas, matched 0"}}},
+		{`["Ada"]`, []Error{{"$", "expected object, got array"}}},
+		{`{"name":"Ada",`, []Error{{"$", "not valid JSON: unexpected EOF"}}},
+		{`{"name":"Ada","age":1} trailing`, []Error{{"$", "not valid JSON: unexpected data after the document"}}},
+	}
+	for _, tt := range tests {
+		if got := s.Validate([]byte(tt.doc)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Validate(%s) = %v, want %v", tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	for _, schema := range []string{`"json"`, `{"pattern":"("}`, `{`} {
+		if _, err := Compile([]byte(schema)); err == nil {
+			t.Errorf("Compile(%s) accepted an invalid schema", schema)
+		}
+	}
+
+	// Recursive schemas are followed to a fixed depth
+	s, err := Compile([]byte(`{"type":"object","properties":{"child":{"$ref":"#"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := s.Validate([]byte(`{"child":{"child":{"child":1}}}`)); len(errs) != 1 || errs[0].Path != "$.child.child.child" {
+		t.Errorf("Validate of a recursive document = %v", errs)
+	}
+}
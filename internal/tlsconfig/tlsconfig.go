@@ -0,0 +1,258 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the TLS settings of the server
+type Config struct {
+	// CertFile and KeyFile are the PEM certificate chain and private key
+	CertFile string
+	KeyFile  string
+	// MinVersion is the oldest TLS version accepted, "1.2" or "1.3";
+	// empty means 1.2
+	MinVersion string
+	// ClientCAFile is a PEM bundle of the CAs that sign client
+	// certificates. Setting it enables mutual TLS.
+	ClientCAFile string
+	// RequireClientCert refuses connections without a valid client
+	// certificate; otherwise clients may still authenticate with API keys
+	RequireClientCert bool
+}
+
+// ParseVersion reads a TLS version such as "1.2"
+func ParseVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q, expected 1.2 or 1.3", version)
+	}
+}
+
+// Server holds the certificate and client CAs of a TLS listener and
+// reloads them from disk without dropping connections. Handshakes use
+// whatever was loaded last.
+type Server struct {
+	cfg        Config
+	minVersion uint16
+	current    atomic.Pointer[tls.Config]
+
+	// mu serializes reloads and guards modTimes, the modification times
+	// of the files when they were last read
+	mu       sync.Mutex
+	modTimes map[string]time.Time
+}
+
+// NewServer loads the files of cfg
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("both a certificate and a key file are required")
+	}
+	if cfg.RequireClientCert && cfg.ClientCAFile == "" {
+		return nil, errors.New("requiring client certificates needs a client CA file")
+	}
+	minVersion, err := ParseVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{cfg: cfg, minVersion: minVersion}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// TLSConfig returns the configuration for an http.Server or tls.Listen.
+// Each handshake picks up the files loaded last.
+func (s *Server) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: s.minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.current.Load(), nil
+		},
+		// http.Server checks that a certificate is configured
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &s.current.Load().Certificates[0], nil
+		},
+	}
+}
+
+// Reload reads the certificate, key and client CAs again. If any of them
+// cannot be read, the ones loaded before stay in use.
+func (s *Server) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Files that fail to load are not tried again until they change
+	s.modTimes = s.readModTimes()
+
+	cert, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:   s.minVersion,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if s.cfg.ClientCAFile != "" {
+		if config.ClientCAs, err = LoadCAs(s.cfg.ClientCAFile); err != nil {
+			return fmt.Errorf("loading client CAs: %w", err)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.cfg.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	s.current.Store(config)
+	return nil
+}
+
+// Watch reloads the files whenever one of them changes, checking every
+// interval until ctx is done. Failed reloads are logged.
+func (s *Server) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+			if err := s.Reload(); err != nil {
+				log.Printf("Error reloading TLS certificate: %v", err)
+				continue
+			}
+			log.Println("Reloaded TLS certificate")
+		}
+	}
+}
+
+// files lists the files the server reads
+func (s *Server) files() []string {
+	files := []string{s.cfg.CertFile, s.cfg.KeyFile}
+	if s.cfg.ClientCAFile != "" {
+		files = append(files, s.cfg.ClientCAFile)
+	}
+	return files
+}
+
+// readModTimes returns the modification time of each file, zero for files
+// that cannot be read
+func (s *Server) readModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, file := range s.files() {
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// changed reports whether a file was modified since it was last loaded
+func (s *Server) changed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	modTimes := s.readModTimes()
+	for _, file := range s.files() {
+		if !modTimes[file].Equal(s.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadCAs reads a PEM bundle of CA certificates
+func LoadCAs(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// ClientConfig returns the configuration for connecting to servers whose
+// certificates are signed by the CAs in caFile, as well as by the CAs the
+// system trusts
+func ClientConfig(caFile string) (*tls.Config, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}, nil
+}
+
+// Identity prefixes of client certificates, in the order Identities lists
+// them
+const (
+	PrefixSubject = "subject:"
+	PrefixCN      = "cn:"
+	PrefixDNS     = "dns:"
+	PrefixEmail   = "email:"
+	PrefixURI     = "uri:"
+	PrefixIP      = "ip:"
+)
+
+var prefixes = []string{PrefixSubject, PrefixCN, PrefixDNS, PrefixEmail, PrefixURI, PrefixIP}
+
+// Identities lists the names a client certificate can be mapped to an API
+// key by: its subject, such as subject:CN=app,O=Example, its common name
+// as cn:app, and each subject alternative name as dns:, email:, uri: or ip:
+func Identities(cert *x509.Certificate) []string {
+	var identities []string
+	if subject := cert.Subject.String(); subject != "" {
+		identities = append(identities, PrefixSubject+subject)
+	}
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, PrefixCN+cert.Subject.CommonName)
+	}
+	for _, name := range cert.DNSNames {
+		identities = append(identities, PrefixDNS+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		identities = append(identities, PrefixEmail+email)
+	}
+	for _, uri := range cert.URIs {
+		identities = append(identities, PrefixURI+uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		identities = append(identities, PrefixIP+ip.String())
+	}
+	return identities
+}
+
+// ValidIdentity reports whether identity has one of the prefixes of
+// Identities followed by a name
+func ValidIdentity(identity string) bool {
+	for _, prefix := range prefixes {
+		if name, ok := strings.CutPrefix(identity, prefix); ok {
+			return name != ""
+		}
+	}
+	return false
+}
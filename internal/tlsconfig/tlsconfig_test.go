@@ -0,0 +1,294 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testCA signs certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue creates a certificate from template, returning it and its key in PEM
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// serverCert issues a certificate for 127.0.0.1 named name
+func (ca *testCA) serverCert(t *testing.T, name string) (certPEM, keyPEM []byte) {
+	return ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+// clientCert issues a client certificate named name
+func (ca *testCA) clientCert(t *testing.T, name string) tls.Certificate {
+	certPEM, keyPEM := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve runs an HTTPS server with config that answers with the common name
+// of the client certificate, if any
+func serve(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	})}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + ln.Addr().String()
+}
+
+func TestServer(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cfg := Config{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server-key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	certPEM, keyPEM := ca.serverCert(t, "server-1")
+	writeFile(t, cfg.CertFile, certPEM)
+	writeFile(t, cfg.KeyFile, keyPEM)
+	writeFile(t, cfg.ClientCAFile, ca.pem)
+
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, server.TLSConfig())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	// get returns the name of the server certificate and the response
+	get := func(certs ...tls.Certificate) (string, string, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+		resp, err := client.Get(addr)
+		if err != nil {
+			return "", "", err
+		}
+		defer resp.Body.Close()
+		body := make([]byte, 64)
+		n, _ := resp.Body.Read(body)
+		return resp.TLS.PeerCertificates[0].Subject.CommonName, string(body[:n]), nil
+	}
+
+	if name, body, err := get(ca.clientCert(t, "app")); err != nil || name != "server-1" || body != "app" {
+		t.Fatalf("with a client certificate: %q, %q, %v", name, body, err)
+	}
+	// Client certificates are optional unless required
+	if _, body, err := get(); err != nil || body != "" {
+		t.Fatalf("without a client certificate: %q, %v", body, err)
+	}
+	// Certificates from other CAs are refused
+	if _, _, err := get(newTestCA(t).clientCert(t, "intruder")); err == nil {
+		t.Error("a client certificate from another CA was accepted")
+	}
+
+	// A broken certificate file keeps the old certificate in use
+	writeFile(t, cfg.CertFile, []byte("not a certificate"))
+	if err := server.Reload(); err == nil {
+		t.Error("Reload of a broken certificate succeeded")
+	}
+	if name, _, err := get(); err != nil || name != "server-1" {
+		t.Fatalf("after a failed reload: %q, %v", name, err)
+	}
+
+	// Replaced files are picked up by Watch
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Watch(ctx, 10*time.Millisecond)
+	certPEM, keyPEM = ca.serverCert(t, "server-2")
+	writeFile(t, cfg.KeyFile, keyPEM)
+	writeFile(t, cfg.CertFile, certPEM)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(cfg.CertFile, later, later)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		name, _, err := get()
+		if err == nil && name == "server-2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate was not reloaded: %q, %v", name, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerRequireClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cfg := Config{
+		CertFile:          filepath.Join(dir, "server.pem"),
+		KeyFile:           filepath.Join(dir, "server-key.pem"),
+		ClientCAFile:      filepath.Join(dir, "ca.pem"),
+		MinVersion:        "1.3",
+		RequireClientCert: true,
+	}
+	certPEM, keyPEM := ca.serverCert(t, "server")
+	writeFile(t, cfg.CertFile, certPEM)
+	writeFile(t, cfg.KeyFile, keyPEM)
+	writeFile(t, cfg.ClientCAFile, ca.pem)
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, server.TLSConfig())
+
+	// The upstream client configuration trusts the CA file as well
+	caFile := filepath.Join(dir, "ca.pem")
+	clientConfig, err := ClientConfig(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+	if _, err := client.Get(addr); err == nil {
+		t.Error("connection without a client certificate was accepted")
+	}
+
+	clientConfig.Certificates = []tls.Certificate{ca.clientCert(t, "app")}
+	resp, err := client.Get(addr)
+	if err != nil {
+		t.Fatalf("with a client certificate: %v", err)
+	}
+	resp.Body.Close()
+	if resp.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("TLS version %x, want 1.3", resp.TLS.Version)
+	}
+
+	clientConfig.MaxVersion = tls.VersionTLS12
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+	if _, err := client.Get(addr); err == nil {
+		t.Error("TLS 1.2 connection was accepted with a minimum of 1.3")
+	}
+
+	if _, err := NewServer(Config{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile, RequireClientCert: true}); err == nil {
+		t.Error("requiring client certificates without a CA succeeded")
+	}
+	if _, err := NewServer(Config{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile, MinVersion: "1.1"}); err == nil {
+		t.Error("TLS 1.1 was accepted as a minimum version")
+	}
+}
+
+func TestIdentities(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.org/app")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "app", Organization: []string{"Example"}},
+		DNSNames:       []string{"app.example.org"},
+		EmailAddresses: []string{"ops@example.org"},
+		URIs:           []*url.URL{uri},
+		IPAddresses:    []net.IP{net.ParseIP("192.0.2.7")},
+	}
+	want := []string{
+		"subject:CN=app,O=Example",
+		"cn:app",
+		"dns:app.example.org",
+		"email:ops@example.org",
+		"uri:spiffe://example.org/app",
+		"ip:192.0.2.7",
+	}
+	identities := Identities(cert)
+	if !reflect.DeepEqual(identities, want) {
+		t.Errorf("Identities = %q, want %q", identities, want)
+	}
+	for _, identity := range identities {
+		if !ValidIdentity(identity) {
+			t.Errorf("ValidIdentity(%q) = false", identity)
+		}
+	}
+	for _, identity := range []string{"", "app", "cn:", "serial:1234"} {
+		if ValidIdentity(identity) {
+			t.Errorf("ValidIdentity(%q) = true", identity)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// Store lists the registered webhooks
+type Store interface {
+	GetWebhooks() ([]models.Webhook, error)
+}
+
+// Event is the body posted to every webhook
+type Event struct {
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+	// APIKey is the key the request was made with, if it got that far
+	APIKey string `json:"apikey,omitempty"`
+	IP     string `json:"ip,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Config holds the settings of a Notifier
+type Config struct {
+	// Timeout bounds each delivery; zero means 10 seconds
+	Timeout time.Duration
+	// Throttle is how long repeats of an event are dropped after it is
+	// sent; zero means a minute
+	Throttle time.Duration
+	// QueueSize is how many events may wait for delivery; more are dropped.
+	// Zero means 100.
+	QueueSize int
+	// MaxRecent is how many distinct events are remembered for throttling;
+	// new events are dropped while it is reached. Zero means 10000.
+	MaxRecent int
+}
+
+// Notifier posts events to the registered webhooks from Run. Repeats of an
+// event, such as many rejected requests from one address, are only sent
+// once per Throttle, and events are dropped rather than queued without
+// bound when delivery falls behind. It is safe for concurrent use.
+type Notifier struct {
+	store Store
+	http  *http.Client
+	cfg   Config
+	queue chan Event
+
+	mu      sync.Mutex
+	recent  map[Event]time.Time
+	dropped int
+}
+
+// NewNotifier creates a notifier for the webhooks in store
+func NewNotifier(store Store, cfg Config) *Notifier {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.Throttle <= 0 {
+		cfg.Throttle = time.Minute
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 100
+	}
+	if cfg.MaxRecent <= 0 {
+		cfg.MaxRecent = 10000
+	}
+	return &Notifier{
+		store:  store,
+		http:   &http.Client{Timeout: cfg.Timeout},
+		cfg:    cfg,
+		queue:  make(chan Event, cfg.QueueSize),
+		recent: make(map[Event]time.Time),
+	}
+}
+
+// Notify queues event for every webhook unless the same event was sent
+// within the throttle period. It does not wait for delivery.
+func (n *Notifier) Notify(event Event) {
+	now := time.Now()
+	if !n.claim(event, now) {
+		return
+	}
+	queued := event
+	queued.Timestamp = now.UTC()
+	select {
+	case n.queue <- queued:
+	default:
+		// Forget the event, so that it is sent if it happens again once
+		// delivery has caught up
+		n.mu.Lock()
+		delete(n.recent, event)
+		n.dropped++
+		n.mu.Unlock()
+	}
+}
+
+// claim records that event is being sent, or reports false if it was sent
+// recently or too many events are remembered already
+func (n *Notifier) claim(event Event, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	sent, ok := n.recent[event]
+	if ok && now.Sub(sent) < n.cfg.Throttle {
+		return false
+	}
+	if !ok && len(n.recent) >= n.cfg.MaxRecent {
+		n.dropped++
+		return false
+	}
+	n.recent[event] = now
+	return true
+}
+
+// Run delivers queued events, and forgets those sent longer ago than the
+// throttle period, until ctx is done
+func (n *Notifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(n.cfg.Throttle)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-n.queue:
+			n.deliver(event)
+		case now := <-ticker.C:
+			n.prune(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// prune drops the events sent at least a throttle period before now, and
+// logs how many were dropped since the last prune
+func (n *Notifier) prune(now time.Time) {
+	n.mu.Lock()
+	for e, sent := range n.recent {
+		if now.Sub(sent) >= n.cfg.Throttle {
+			delete(n.recent, e)
+		}
+	}
+	dropped := n.dropped
+	n.dropped = 0
+	n.mu.Unlock()
+	if dropped > 0 {
+		log.Printf("Dropped %d webhook events during a burst", dropped)
+	}
+}
+
+// deliver posts event to each webhook once, logging failures
+func (n *Notifier) deliver(event Event) {
+	webhooks, err := n.store.GetWebhooks()
+	if err != nil {
+		log.Printf("Error loading webhooks: %v", err)
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding webhook event: %v", err)
+		return
+	}
+	for _, webhook := range webhooks {
+		resp, err := n.http.Post(webhook.URL, "application/json", bytes.NewReader(payload))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("webhook returned %s", resp.Status)
+			}
+		}
+		if err != nil {
+			log.Printf("Error delivering %s event to webhook %d: %v", event.Event, webhook.ID, err)
+		}
+	}
+}
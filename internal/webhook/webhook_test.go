@@ -0,0 +1,131 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/erock530/go-ollama-api/internal/models"
+)
+
+// fixedStore serves one webhook
+type fixedStore string
+
+func (s fixedStore) GetWebhooks() ([]models.Webhook, error) {
+	return []models.Webhook{{ID: 1, URL: string(s)}}, nil
+}
+
+func TestNotifierThrottle(t *testing.T) {
+	received := make(chan Event, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("decoding event: %v", err)
+		}
+		received <- event
+	}))
+	defer receiver.Close()
+
+	const throttle = 200 * time.Millisecond
+	n := NewNotifier(fixedStore(receiver.URL), Config{Throttle: throttle})
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go n.Run(ctx)
+	event := Event{Event: "ip_blocked", IP: "203.0.113.7", Reason: "denylist"}
+
+	expect := func(what string) {
+		t.Helper()
+		select {
+		case got := <-received:
+			if got.Event != event.Event || got.IP != event.IP || got.Reason != event.Reason || got.Timestamp.IsZero() {
+				t.Errorf("%s: got %+v", what, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: not delivered", what)
+		}
+	}
+
+	// The first event is delivered
+	n.Notify(event)
+	expect("first event")
+
+	// Repeats within the throttle period are dropped, other events are not
+	n.Notify(event)
+	n.Notify(event)
+	other := Event{Event: "ip_blocked", IP: "198.51.100.1", Reason: "denylist"}
+	n.Notify(other)
+	select {
+	case got := <-received:
+		if got.IP != other.IP {
+			t.Errorf("repeat delivered within the throttle period: %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("other event: not delivered")
+	}
+	select {
+	case got := <-received:
+		t.Errorf("repeat delivered within the throttle period: %+v", got)
+	case <-time.After(throttle / 2):
+	}
+
+	// Once the throttle period is over it is sent again
+	time.Sleep(throttle)
+	n.Notify(event)
+	expect("event after the throttle period")
+}
+
+func TestNotifierBounds(t *testing.T) {
+	received := make(chan Event, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer receiver.Close()
+
+	n := NewNotifier(fixedStore(receiver.URL), Config{QueueSize: 1, MaxRecent: 2})
+	blocked := func(ip string) Event { return Event{Event: "ip_blocked", IP: ip} }
+
+	// Before Run drains the queue, only one event fits
+	n.Notify(blocked("203.0.113.1"))
+	n.Notify(blocked("203.0.113.2"))
+	if len(n.queue) != 1 || len(n.recent) != 1 || n.dropped != 1 {
+		t.Fatalf("queued %d, remembered %d, dropped %d; want 1, 1 and 1", len(n.queue), len(n.recent), n.dropped)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go n.Run(ctx)
+	if got := <-received; got.IP != "203.0.113.1" {
+		t.Errorf("delivered %+v, want the first event", got)
+	}
+
+	// A dropped event is sent when it happens again
+	n.Notify(blocked("203.0.113.2"))
+	select {
+	case got := <-received:
+		if got.IP != "203.0.113.2" {
+			t.Errorf("delivered %+v, want the dropped event", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dropped event not sent when it happened again")
+	}
+
+	// No more than MaxRecent events are remembered until they expire
+	n.Notify(blocked("203.0.113.3"))
+	select {
+	case got := <-received:
+		t.Errorf("delivered %+v beyond MaxRecent", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	n.prune(time.Now().Add(time.Minute))
+	n.mu.Lock()
+	remembered := len(n.recent)
+	n.mu.Unlock()
+	if remembered != 0 {
+		t.Errorf("%d events remembered after they expired, want 0", remembered)
+	}
+}